@@ -0,0 +1,165 @@
+package accesslog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/internal"
+)
+
+// entryKey is the context key of the entry of a request.
+type entryKey struct{}
+
+// Entry is what is logged about a request.
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Host      string    `json:"host"`
+	Method    string    `json:"method"`
+	URI       string    `json:"uri"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Latency   float64   `json:"latency"`
+	User      string    `json:"user,omitempty"`
+	ClientIP  string    `json:"client-ip"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user-agent,omitempty"`
+}
+
+// Logger writes an entry for each request to a log.
+type Logger struct {
+	format string
+
+	lck sync.Mutex
+	w   io.Writer
+}
+
+// New creates a Logger that writes to w in the given format, either combined or json.
+// The combined log format is prefixed with the host and followed by the latency in
+// seconds.
+func New(w io.Writer, format string) (*Logger, error) {
+	switch format {
+	case config.AccessLogCombined, config.AccessLogJSON:
+	default:
+		return nil, fmt.Errorf("invalid access log format: %s", format)
+	}
+
+	return &Logger{
+		format: format,
+		w:      w,
+	}, nil
+}
+
+// Open creates the Logger configured by the access-log, which appends to its path or
+// writes to stdout if it has none.
+func Open(cfg *config.AccessLogInfo) (*Logger, error) {
+	if cfg.Path == "" {
+		return New(os.Stdout, cfg.Format)
+	}
+
+	f, err := os.OpenFile(cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(f, cfg.Format)
+}
+
+// Log writes the entry to the log.
+func (l *Logger) Log(e *Entry) error {
+	var b []byte
+	if l.format == config.AccessLogJSON {
+		var err error
+		if b, err = json.Marshal(e); err != nil {
+			return err
+		}
+		b = append(b, '\n')
+	} else {
+		b = []byte(combined(e))
+	}
+
+	l.lck.Lock()
+	defer l.lck.Unlock()
+	_, err := l.w.Write(b)
+	return err
+}
+
+// combined formats the entry in the combined log format.
+func combined(e *Entry) string {
+	return fmt.Sprintf("%s %s - %s [%s] \"%s %s %s\" %d %d %s %s %.3f\n",
+		e.Host,
+		e.ClientIP,
+		orDash(e.User),
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method,
+		e.URI,
+		e.Proto,
+		e.Status,
+		e.Bytes,
+		strconv.Quote(orDash(e.Referer)),
+		strconv.Quote(orDash(e.UserAgent)),
+		e.Latency)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// SetUser records the email of the user a request was made by. It does nothing if the
+// request is not being logged.
+func SetUser(r *http.Request, email string) {
+	if e, ok := r.Context().Value(entryKey{}).(*Entry); ok {
+		e.User = email
+	}
+}
+
+// Handler logs every request served by next.
+func Handler(l *Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := &Entry{
+			Time:      time.Now(),
+			Host:      r.Host,
+			Method:    r.Method,
+			URI:       r.RequestURI,
+			Proto:     r.Proto,
+			ClientIP:  clientIP(r),
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+		}
+
+		rw := &internal.ResponseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), entryKey{}, e)))
+
+		e.Status = rw.Status
+		if e.Status == 0 {
+			e.Status = http.StatusOK
+		}
+		e.Bytes = rw.Bytes
+		e.Latency = time.Since(e.Time).Seconds()
+
+		if err := l.Log(e); err != nil {
+			// there is nowhere left to log this, the response is already sent.
+			fmt.Fprintf(os.Stderr, "unable to write access log: %s\n", err)
+		}
+	})
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,68 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/kellegous/underpants/config"
+)
+
+func serve(t *testing.T, format string) []byte {
+	var buf bytes.Buffer
+	l, err := New(&buf, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := Handler(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetUser(r, "a@a.com")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	}))
+
+	r := httptest.NewRequest("POST", "/x?y=z", nil)
+	r.Host = "a.com"
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("User-Agent", "test")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	return buf.Bytes()
+}
+
+func TestCombined(t *testing.T) {
+	line := serve(t, config.AccessLogCombined)
+
+	pat := regexp.MustCompile(`^a\.com 10\.0\.0\.1 - a@a\.com \[[^\]]+\] ` +
+		`"POST /x\?y=z HTTP/1\.1" 201 5 "-" "test" \d+\.\d{3}\n$`)
+	if !pat.Match(line) {
+		t.Fatalf("unexpected log line: %q", line)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var e Entry
+	if err := json.Unmarshal(serve(t, config.AccessLogJSON), &e); err != nil {
+		t.Fatal(err)
+	}
+
+	if e.Host != "a.com" ||
+		e.Method != "POST" ||
+		e.URI != "/x?y=z" ||
+		e.Status != http.StatusCreated ||
+		e.Bytes != 5 ||
+		e.User != "a@a.com" ||
+		e.ClientIP != "10.0.0.1" ||
+		e.UserAgent != "test" {
+		t.Fatalf("unexpected entry: %+v", e)
+	}
+}
+
+func TestInvalidFormat(t *testing.T) {
+	if _, err := New(&bytes.Buffer{}, "apache"); err == nil {
+		t.Fatal("expected an error for an invalid format")
+	}
+}
@@ -0,0 +1,493 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kellegous/underpants/audit"
+	"github.com/kellegous/underpants/auth"
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/internal"
+	"github.com/kellegous/underpants/mux"
+	"github.com/kellegous/underpants/proxy"
+	"github.com/kellegous/underpants/session"
+	"github.com/kellegous/underpants/user"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// BaseURI is the base path used for administrative endpoints. These are only
+	// available on the hub.
+	BaseURI = "/__underpants__/"
+
+	// checkTimeout is the maximum amount of time allowed for an on demand backend
+	// check.
+	checkTimeout = 10 * time.Second
+
+	// defaultTokenTTL is how long API tokens last if no ttl is given.
+	defaultTokenTTL = 90 * 24 * time.Hour
+)
+
+// handler is an admin handler that has been given the authenticated admin user.
+type handler func(w http.ResponseWriter, r *http.Request, u *user.Info)
+
+// tokenUser is the user that requests presenting the admin token are made as.
+var tokenUser = &user.Info{Email: "admin-token", Name: "Admin API token"}
+
+// requireAdmin wraps a handler so that it is only reachable by authenticated users
+// who are members of one of the admin groups, or by requests presenting the admin
+// token.
+func requireAdmin(ctx *config.Context, h handler) http.Handler {
+	return internal.AddSecurityHeadersFunc(ctx.Info,
+		func(w http.ResponseWriter, r *http.Request) {
+			if tok := ctx.Admin.Token(); tok != "" {
+				if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+					if subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(tok)) != 1 {
+						zap.L().Info("access denied (invalid admin token)",
+							zap.String("uri", r.RequestURI))
+						http.Error(w,
+							http.StatusText(http.StatusUnauthorized),
+							http.StatusUnauthorized)
+						return
+					}
+
+					h(w, r, tokenUser)
+					return
+				}
+			}
+
+			u, err := ctx.Sessions.FromRequest(w, r)
+			if err != nil {
+				http.Error(w,
+					http.StatusText(http.StatusUnauthorized),
+					http.StatusUnauthorized)
+				return
+			}
+
+			if !ctx.IsAdmin(u.Email) {
+				zap.L().Info("access denied (not an admin)",
+					zap.String("uri", r.RequestURI),
+					zap.String("user", u.Email))
+				http.Error(w,
+					http.StatusText(http.StatusForbidden),
+					http.StatusForbidden)
+				return
+			}
+
+			// browsers send the session cookie with requests made by other sites, so
+			// changes made with it need the CSRF token, which is given with every
+			// response made to the admin.
+			if !isSafeMethod(r.Method) {
+				if err := ctx.Sessions.CheckCSRF(r, u); err != nil {
+					zap.L().Info("access denied (csrf)",
+						zap.String("uri", r.RequestURI),
+						zap.String("user", u.Email),
+						zap.Error(err))
+					http.Error(w,
+						http.StatusText(http.StatusForbidden),
+						http.StatusForbidden)
+					return
+				}
+			}
+			w.Header().Set(session.CSRFHeader, ctx.Sessions.CSRFToken(u))
+
+			h(w, r, u)
+		})
+}
+
+// writeJSON writes v as the JSON body of the response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		zap.L().Error("unable to encode admin response",
+			zap.Error(err))
+	}
+}
+
+// isSafeMethod determines if requests with the method only read.
+func isSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	return false
+}
+
+// writeError writes an error as a JSON body.
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
+
+// Setup adds the admin handlers to the mux.Builder, which is the hub's unless the
+// admin API has a listener of its own.
+func Setup(ctx *config.Context, backends []*proxy.Backend, mb *mux.Builder) {
+	idx := map[string]*proxy.Backend{}
+	for _, b := range backends {
+		idx[b.Route.From] = b
+	}
+
+	mb.ForAnyHost().Handle(fmt.Sprintf("%scapture", BaseURI),
+		requireAdmin(ctx, func(w http.ResponseWriter, r *http.Request, u *user.Info) {
+			serveCapture(w, r, u, idx)
+		}))
+
+	mb.ForAnyHost().Handle(fmt.Sprintf("%smaintenance", BaseURI),
+		requireAdmin(ctx, func(w http.ResponseWriter, r *http.Request, u *user.Info) {
+			serveMaintenance(w, r, u, idx)
+		}))
+
+	mb.ForAnyHost().Handle(fmt.Sprintf("%srevoke", BaseURI),
+		requireAdmin(ctx, func(w http.ResponseWriter, r *http.Request, u *user.Info) {
+			serveRevoke(w, r, u, ctx)
+		}))
+
+	mb.ForAnyHost().Handle(fmt.Sprintf("%stokens", BaseURI),
+		requireAdmin(ctx, func(w http.ResponseWriter, r *http.Request, u *user.Info) {
+			serveTokens(w, r, u, ctx, idx)
+		}))
+
+	mb.ForAnyHost().Handle(fmt.Sprintf("%simpersonate", BaseURI),
+		requireAdmin(ctx, func(w http.ResponseWriter, r *http.Request, u *user.Info) {
+			serveImpersonate(w, r, u, ctx, idx)
+		}))
+
+	mb.ForAnyHost().Handle(fmt.Sprintf("%scheck", BaseURI),
+		requireAdmin(ctx, func(w http.ResponseWriter, r *http.Request, u *user.Info) {
+			serveCheck(w, r, idx)
+		}))
+
+	mb.ForAnyHost().Handle(fmt.Sprintf("%shealth", BaseURI),
+		requireAdmin(ctx, func(w http.ResponseWriter, r *http.Request, u *user.Info) {
+			serveHealth(w, r, backends)
+		}))
+
+	mb.ForAnyHost().Handle(fmt.Sprintf("%sroutes", BaseURI),
+		requireAdmin(ctx, func(w http.ResponseWriter, r *http.Request, u *user.Info) {
+			serveRoutes(w, r, backends)
+		}))
+
+	mb.ForAnyHost().Handle(fmt.Sprintf("%ssessions", BaseURI),
+		requireAdmin(ctx, func(w http.ResponseWriter, r *http.Request, u *user.Info) {
+			serveSessions(w, r, ctx)
+		}))
+
+	mb.ForAnyHost().Handle(fmt.Sprintf("%sstatus", BaseURI),
+		requireAdmin(ctx, func(w http.ResponseWriter, r *http.Request, u *user.Info) {
+			serveStatus(w, r, ctx)
+		}))
+}
+
+// routeHealth is the health of a route's backends as reported by the health endpoint.
+type routeHealth struct {
+	Route    string               `json:"route"`
+	Backends []*proxy.HealthState `json:"backends"`
+}
+
+// serveHealth reports the health of the backends of the routes that have active
+// health checks, or of just one route if the route parameter is given.
+func serveHealth(w http.ResponseWriter, r *http.Request, backends []*proxy.Backend) {
+	route := r.FormValue("route")
+
+	res := []*routeHealth{}
+	for _, b := range backends {
+		if route != "" && b.Route.From != route {
+			continue
+		}
+
+		if states := b.Health(); states != nil {
+			res = append(res, &routeHealth{
+				Route:    b.Route.From,
+				Backends: states,
+			})
+		}
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// serveCheck performs the health check for a route's backend on demand and reports
+// the result.
+func serveCheck(w http.ResponseWriter, r *http.Request, idx map[string]*proxy.Backend) {
+	b := idx[r.FormValue("route")]
+	if b == nil {
+		writeError(w, http.StatusNotFound,
+			fmt.Errorf("unknown route: %s", r.FormValue("route")))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+	defer cancel()
+
+	writeJSON(w, http.StatusOK, b.Check(ctx))
+}
+
+// serveCapture reports (GET) or arms (POST) body capture for a route. When arming, the
+// count parameter gives the number of requests to capture, 0 disables capture.
+func serveCapture(w http.ResponseWriter, r *http.Request, u *user.Info, idx map[string]*proxy.Backend) {
+	b := idx[r.FormValue("route")]
+	if b == nil {
+		writeError(w, http.StatusNotFound,
+			fmt.Errorf("unknown route: %s", r.FormValue("route")))
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "POST":
+		n, err := strconv.Atoi(r.FormValue("count"))
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest,
+				fmt.Errorf("invalid count: %s", r.FormValue("count")))
+			return
+		}
+
+		if err := b.ArmCapture(n); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+
+		zap.L().Info("admin armed body capture",
+			zap.String("from", b.Route.From),
+			zap.String("user", u.Email),
+			zap.Int("count", n))
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, http.StatusMethodNotAllowed,
+			fmt.Errorf("method not allowed: %s", r.Method))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Route     string `json:"route"`
+		Remaining int    `json:"remaining"`
+	}{b.Route.From, b.CaptureRemaining()})
+}
+
+// serveMaintenance reports (GET) or sets (POST) whether a route is in maintenance. When
+// setting, the enabled parameter is true to serve the maintenance page and false to
+// resume proxying.
+func serveMaintenance(w http.ResponseWriter, r *http.Request, u *user.Info, idx map[string]*proxy.Backend) {
+	b := idx[r.FormValue("route")]
+	if b == nil {
+		writeError(w, http.StatusNotFound,
+			fmt.Errorf("unknown route: %s", r.FormValue("route")))
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+	case "POST":
+		enabled, err := strconv.ParseBool(r.FormValue("enabled"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest,
+				fmt.Errorf("invalid enabled: %s", r.FormValue("enabled")))
+			return
+		}
+
+		b.SetMaintenance(enabled)
+
+		zap.L().Info("admin set maintenance",
+			zap.String("from", b.Route.From),
+			zap.String("user", u.Email),
+			zap.Bool("enabled", enabled))
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, http.StatusMethodNotAllowed,
+			fmt.Errorf("method not allowed: %s", r.Method))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Route       string `json:"route"`
+		Maintenance bool   `json:"maintenance"`
+	}{b.Route.From, b.InMaintenance()})
+}
+
+// serveTokens issues an API token for the user given by the email parameter, which is
+// valid for each of the routes given by route parameters for ttl seconds.
+func serveTokens(
+	w http.ResponseWriter,
+	r *http.Request,
+	u *user.Info,
+	ctx *config.Context,
+	idx map[string]*proxy.Backend) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed,
+			fmt.Errorf("method not allowed: %s", r.Method))
+		return
+	}
+
+	email := r.FormValue("email")
+	if email == "" {
+		writeError(w, http.StatusBadRequest, errors.New("email is required"))
+		return
+	}
+
+	routes := r.Form["route"]
+	if len(routes) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("route is required"))
+		return
+	}
+
+	for _, route := range routes {
+		if idx[route] == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("unknown route: %s", route))
+			return
+		}
+	}
+
+	ttl := defaultTokenTTL
+	if v := r.FormValue("ttl"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest,
+				fmt.Errorf("invalid ttl: %s", v))
+			return
+		}
+		ttl = time.Duration(n) * time.Second
+	}
+
+	tok, err := ctx.Sessions.NewAPIToken(email, routes, ttl)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	zap.L().Info("admin issued api token",
+		zap.String("user", u.Email),
+		zap.String("email", email),
+		zap.Strings("routes", routes),
+		zap.Duration("ttl", ttl))
+
+	writeJSON(w, http.StatusOK, struct {
+		Token   string    `json:"token"`
+		Email   string    `json:"email"`
+		Routes  []string  `json:"routes"`
+		Expires time.Time `json:"expires"`
+	}{tok, email, routes, time.Now().Add(ttl)})
+}
+
+// serveImpersonate signs the admin in to the route given by the route parameter as
+// the user given by the email parameter. Without an email, the admin is signed in to
+// the route as themselves again.
+func serveImpersonate(
+	w http.ResponseWriter,
+	r *http.Request,
+	u *user.Info,
+	ctx *config.Context,
+	idx map[string]*proxy.Backend) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed,
+			fmt.Errorf("method not allowed: %s", r.Method))
+		return
+	}
+
+	// the admin token has no session to return to and nobody to hold accountable.
+	if u == tokenUser || !ctx.CanImpersonate(u.Email) {
+		writeError(w, http.StatusForbidden,
+			errors.New("impersonation is not allowed"))
+		return
+	}
+
+	b := idx[r.FormValue("route")]
+	if b == nil || b.Route.IsWildcard() {
+		writeError(w, http.StatusNotFound,
+			fmt.Errorf("unknown route: %s", r.FormValue("route")))
+		return
+	}
+
+	as := u
+	if email := r.FormValue("email"); email != "" {
+		as = &user.Info{
+			Email:             email,
+			EmailVerified:     true,
+			Name:              email,
+			LastAuthenticated: time.Now(),
+			Impersonator:      u.Email,
+		}
+	}
+
+	v, err := ctx.Sessions.Encode(as)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	code, err := ctx.Sessions.NewHandoff(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if as == u {
+		zap.L().Info("admin stopped impersonating",
+			zap.String("user", u.Email),
+			zap.String("route", b.Route.From))
+		ctx.Audit.Record(r, audit.Impersonate, u.Email, "stopped on "+b.Route.From)
+	} else {
+		zap.L().Info("admin impersonating",
+			zap.String("user", u.Email),
+			zap.String("as", as.Email),
+			zap.String("route", b.Route.From))
+		ctx.Audit.RecordImpersonated(r, audit.Impersonate, as.Email, u.Email,
+			"started on "+b.Route.From)
+	}
+
+	host := b.Route.Host()
+	switch ctx.Port {
+	case 80, 443:
+	default:
+		host = fmt.Sprintf("%s:%d", host, ctx.Port)
+	}
+
+	http.Redirect(w, r,
+		fmt.Sprintf("%s://%s%s?%s", ctx.Scheme(), host, auth.BaseURI,
+			url.Values{
+				"p": {b.Route.PathPrefix() + "/"},
+				"c": {code},
+			}.Encode()),
+		http.StatusSeeOther)
+}
+
+// serveRevoke revokes all of the sessions of the user given by the email parameter.
+func serveRevoke(w http.ResponseWriter, r *http.Request, u *user.Info, ctx *config.Context) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed,
+			fmt.Errorf("method not allowed: %s", r.Method))
+		return
+	}
+
+	email := r.FormValue("email")
+	if email == "" {
+		writeError(w, http.StatusBadRequest, errors.New("email is required"))
+		return
+	}
+
+	if err := ctx.Sessions.RevokeUser(email); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	zap.L().Info("admin revoked sessions",
+		zap.String("user", u.Email),
+		zap.String("revoked", email))
+
+	writeJSON(w, http.StatusOK, struct {
+		Email string `json:"email"`
+	}{email})
+}
@@ -0,0 +1,288 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/mux"
+	"github.com/kellegous/underpants/proxy"
+	"github.com/kellegous/underpants/user"
+)
+
+func adminFor(t *testing.T, conf string) (*config.Context, http.Handler) {
+	var cfg config.Info
+	if err := cfg.Read(strings.NewReader(conf)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := config.BuildContext(&cfg, 80, []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mb := mux.Create()
+	Setup(ctx, proxy.Setup(ctx, nil, mb), mb)
+	return ctx, mb.Build()
+}
+
+func get(h http.Handler, path, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "http://hub.com"+BaseURI+path, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestToken(t *testing.T) {
+	os.Setenv("UNDERPANTS_TEST_ADMIN_TOKEN", "t0ken")
+	defer os.Unsetenv("UNDERPANTS_TEST_ADMIN_TOKEN")
+
+	ctx, h := adminFor(t, `{
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"session": {"store": "memory"},
+		"admin": {"token-env": "UNDERPANTS_TEST_ADMIN_TOKEN"},
+		"routes": [{"from": "a.com", "to": "http://localhost:8080"}]
+	}`)
+
+	if w := get(h, "routes", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a token, got %d", w.Code)
+	}
+
+	if w := get(h, "routes", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 with the wrong token, got %d", w.Code)
+	}
+
+	w := get(h, "routes", "t0ken")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	var routes []*routeStatus
+	if err := json.NewDecoder(w.Body).Decode(&routes); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(routes) != 1 || routes[0].From != "a.com" || routes[0].To[0] != "http://localhost:8080" {
+		t.Fatalf("unexpected routes %+v", routes)
+	}
+
+	for i, email := range []string{"b@a.com", "a@a.com", "a@a.com"} {
+		if err := ctx.Sessions.Store.Put(fmt.Sprintf("s%d", i), &user.Info{Email: email}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w = get(h, "sessions", "t0ken")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	var sessions struct {
+		Sessions int             `json:"sessions"`
+		Users    []*userSessions `json:"users"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&sessions); err != nil {
+		t.Fatal(err)
+	}
+
+	if sessions.Sessions != 3 || len(sessions.Users) != 2 ||
+		sessions.Users[0].Email != "a@a.com" || sessions.Users[0].Sessions != 2 {
+		t.Fatalf("unexpected sessions %+v", sessions)
+	}
+
+	w = get(h, "status", "t0ken")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	var st status
+	if err := json.NewDecoder(w.Body).Decode(&st); err != nil {
+		t.Fatal(err)
+	}
+
+	if st.Routes != 1 || len(st.ConfigFingerprint) != 64 || st.GoVersion == "" {
+		t.Fatalf("unexpected status %+v", st)
+	}
+}
+
+func TestIssueToken(t *testing.T) {
+	os.Setenv("UNDERPANTS_TEST_ADMIN_TOKEN", "t0ken")
+	defer os.Unsetenv("UNDERPANTS_TEST_ADMIN_TOKEN")
+
+	ctx, h := adminFor(t, `{
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"admin": {"token-env": "UNDERPANTS_TEST_ADMIN_TOKEN"},
+		"routes": [{"from": "a.com", "to": "http://localhost:8080"}]
+	}`)
+
+	post := func(form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "http://hub.com"+BaseURI+"tokens",
+			strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Authorization", "Bearer t0ken")
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := post(url.Values{"email": {"ci@a.com"}}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without a route, got %d", w.Code)
+	}
+
+	if w := post(url.Values{"email": {"ci@a.com"}, "route": {"b.com"}}); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown route, got %d", w.Code)
+	}
+
+	w := post(url.Values{"email": {"ci@a.com"}, "route": {"a.com"}, "ttl": {"60"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	var res struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	if u, err := ctx.Sessions.DecodeAPIToken(res.Token, "a.com"); err != nil || u.Email != "ci@a.com" {
+		t.Fatalf("expected a token for ci@a.com, got %v, %v", u, err)
+	}
+}
+
+func TestSessionsUnsupported(t *testing.T) {
+	os.Setenv("UNDERPANTS_TEST_ADMIN_TOKEN", "t0ken")
+	defer os.Unsetenv("UNDERPANTS_TEST_ADMIN_TOKEN")
+
+	_, h := adminFor(t, `{
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"admin": {"token-env": "UNDERPANTS_TEST_ADMIN_TOKEN"}
+	}`)
+
+	if w := get(h, "sessions", "t0ken"); w.Code != http.StatusNotImplemented {
+		t.Fatalf("expected 501 with cookie sessions, got %d", w.Code)
+	}
+}
+
+func TestImpersonate(t *testing.T) {
+	ctx, h := adminFor(t, `{
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"groups": {"admins": ["root@a.com", "ops@a.com"], "support": ["root@a.com"]},
+		"admin-groups": ["admins"],
+		"admin": {"impersonate-groups": ["support"]},
+		"routes": [{"from": "a.com/app", "to": "http://localhost:8080", "allowed-groups": ["admins"]}]
+	}`)
+
+	post := func(admin *user.Info, form url.Values) *httptest.ResponseRecorder {
+		v, err := ctx.Sessions.Encode(admin)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		form.Set("csrf", ctx.Sessions.CSRFToken(admin))
+		r := httptest.NewRequest("POST", "http://hub.com"+BaseURI+"impersonate",
+			strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(ctx.Sessions.NewCookie(v))
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// follow redeems the session handed to the route by the redirect.
+	follow := func(w *httptest.ResponseRecorder) *user.Info {
+		loc, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if loc.Host != "a.com" || loc.Query().Get("p") != "/app/" {
+			t.Fatalf("unexpected redirect to %s", loc)
+		}
+
+		_, u, err := ctx.Sessions.RedeemHandoff(loc.Query().Get("c"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+
+	ops := &user.Info{Email: "ops@a.com", LastAuthenticated: time.Now()}
+	if w := post(ops, url.Values{"route": {"a.com/app"}, "email": {"b@a.com"}}); w.Code != http.StatusForbidden {
+		t.Fatalf("expected admins outside of impersonate-groups to be forbidden, got %d", w.Code)
+	}
+
+	root := &user.Info{Email: "root@a.com", LastAuthenticated: time.Now()}
+	w := post(root, url.Values{"route": {"a.com/app"}, "email": {"b@a.com"}})
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("expected 303, got %d", w.Code)
+	}
+
+	if u := follow(w); u.Email != "b@a.com" || u.Impersonator != "root@a.com" {
+		t.Fatalf("expected b@a.com impersonated by root@a.com, got %+v", u)
+	}
+
+	w = post(root, url.Values{"route": {"a.com/app"}})
+	if u := follow(w); u.Email != "root@a.com" || u.Impersonator != "" {
+		t.Fatalf("expected root@a.com as themselves, got %+v", u)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	os.Setenv("UNDERPANTS_TEST_ADMIN_TOKEN", "t0ken")
+	defer os.Unsetenv("UNDERPANTS_TEST_ADMIN_TOKEN")
+
+	_, h := adminFor(t, `{
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"admin": {"token-env": "UNDERPANTS_TEST_ADMIN_TOKEN"},
+		"routes": [{"from": "a.com", "to": "http://localhost:8080"}]
+	}`)
+
+	post := func(form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "http://hub.com"+BaseURI+"maintenance",
+			strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Authorization", "Bearer t0ken")
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := post(url.Values{"route": {"a.com"}, "enabled": {"maybe"}}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid enabled, got %d", w.Code)
+	}
+
+	if w := post(url.Values{"route": {"a.com"}, "enabled": {"true"}}); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	r := httptest.NewRequest("GET", "http://a.com/", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected the route to be in maintenance, got %d", w.Code)
+	}
+
+	var routes []*routeStatus
+	if err := json.NewDecoder(get(h, "routes", "t0ken").Body).Decode(&routes); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(routes) != 1 || !routes[0].Maintenance {
+		t.Fatalf("expected routes to report maintenance, got %+v", routes[0])
+	}
+}
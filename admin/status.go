@@ -0,0 +1,149 @@
+package admin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"time"
+
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/proxy"
+	"github.com/kellegous/underpants/session"
+)
+
+// started is when underpants started, for reporting uptime.
+var started = time.Now()
+
+// routeStatus describes a route as reported by the routes endpoint.
+type routeStatus struct {
+	From     string               `json:"from"`
+	To       []string             `json:"to"`
+	Failover []string             `json:"failover,omitempty"`
+	Provider string               `json:"provider,omitempty"`
+	Health   []*proxy.HealthState `json:"health,omitempty"`
+
+	Maintenance bool `json:"maintenance,omitempty"`
+}
+
+// serveRoutes lists the routes along with the health of their backends, if they have
+// active health checks.
+func serveRoutes(w http.ResponseWriter, r *http.Request, backends []*proxy.Backend) {
+	res := []*routeStatus{}
+	for _, b := range backends {
+		res = append(res, &routeStatus{
+			From:     b.Route.From,
+			To:       b.Route.To,
+			Failover: b.Route.Failover,
+			Provider: b.Route.Provider,
+			Health:   b.Health(),
+
+			Maintenance: b.InMaintenance(),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// userSessions are the sessions of one user as reported by the sessions endpoint.
+type userSessions struct {
+	Email    string    `json:"email"`
+	Sessions int       `json:"sessions"`
+	Expires  time.Time `json:"expires"`
+}
+
+// serveSessions lists the users who have active sessions, which is only possible
+// when the session store can list its sessions.
+func serveSessions(w http.ResponseWriter, r *http.Request, ctx *config.Context) {
+	l, ok := ctx.Sessions.Store.(session.Lister)
+	if !ok {
+		writeError(w, http.StatusNotImplemented,
+			errors.New("the session store cannot list sessions"))
+		return
+	}
+
+	idx := map[string]*userSessions{}
+	ls := l.List()
+	for _, s := range ls {
+		u := idx[s.User.Email]
+		if u == nil {
+			u = &userSessions{Email: s.User.Email}
+			idx[s.User.Email] = u
+		}
+
+		u.Sessions++
+		if s.Expires.After(u.Expires) {
+			u.Expires = s.Expires
+		}
+	}
+
+	users := make([]*userSessions, 0, len(idx))
+	for _, u := range idx {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Email < users[j].Email
+	})
+
+	writeJSON(w, http.StatusOK, struct {
+		Sessions int             `json:"sessions"`
+		Users    []*userSessions `json:"users"`
+	}{len(ls), users})
+}
+
+// status is the response of the status endpoint.
+type status struct {
+	Version           string    `json:"version"`
+	Revision          string    `json:"revision,omitempty"`
+	GoVersion         string    `json:"go-version"`
+	Started           time.Time `json:"started"`
+	Uptime            float64   `json:"uptime-seconds"`
+	ConfigFingerprint string    `json:"config-fingerprint"`
+	Routes            int       `json:"routes"`
+}
+
+// serveStatus reports the build, uptime and a fingerprint of the config, which
+// differs whenever the running config does.
+func serveStatus(w http.ResponseWriter, r *http.Request, ctx *config.Context) {
+	res := &status{
+		Version:   "unknown",
+		GoVersion: runtime.Version(),
+		Started:   started,
+		Uptime:    time.Since(started).Seconds(),
+		Routes:    len(ctx.Routes),
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		res.Version = bi.Main.Version
+		for _, s := range bi.Settings {
+			if s.Key == "vcs.revision" {
+				res.Revision = s.Value
+			}
+		}
+	}
+
+	fp, err := fingerprint(ctx.Info)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	res.ConfigFingerprint = fp
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// fingerprint is a hash of the config. Secrets are hashed along with everything else,
+// which is why the fingerprint is only shown to admins.
+func fingerprint(cfg *config.Info) (string, error) {
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:]), nil
+}
@@ -0,0 +1,259 @@
+package assertion
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"time"
+
+	"github.com/kellegous/underpants/user"
+)
+
+// Claims are the claims of an identity assertion.
+type Claims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	Audience  string `json:"aud"`
+	IssuedAt  int64  `json:"iat"`
+	NotBefore int64  `json:"nbf"`
+	Expires   int64  `json:"exp"`
+	Email     string `json:"email"`
+	Name      string `json:"name,omitempty"`
+	Provider  string `json:"provider,omitempty"`
+
+	// Groups are the groups the user belongs to, they are only included for routes
+	// that forward groups.
+	Groups []string `json:"groups,omitempty"`
+
+	// Actor is the admin acting as the subject, it is only set when the user is
+	// being impersonated.
+	Actor *Actor `json:"act,omitempty"`
+}
+
+// Actor identifies the party acting on behalf of the subject of an assertion, as in
+// the act claim of RFC 8693.
+type Actor struct {
+	Subject string `json:"sub"`
+}
+
+// Signer issues short-lived JWTs asserting the identity of users to backends. It signs
+// with RS256 for RSA keys and ES256 for P-256 keys.
+type Signer struct {
+	key crypto.Signer
+	alg string
+	kid string
+
+	issuer string
+	ttl    time.Duration
+
+	jwks []byte
+}
+
+// LoadSigner creates a Signer with the PEM encoded private key in keyFile. Assertions
+// are issued by issuer and are valid for ttl.
+func LoadSigner(keyFile, issuer string, ttl time.Duration) (*Signer, error) {
+	b, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := parseKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", keyFile, err)
+	}
+
+	return NewSigner(key, issuer, ttl)
+}
+
+// NewSigner creates a Signer with the given key.
+func NewSigner(key crypto.Signer, issuer string, ttl time.Duration) (*Signer, error) {
+	var alg string
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		alg = "RS256"
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, errors.New("only P-256 ecdsa keys are supported")
+		}
+		alg = "ES256"
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+
+	s := &Signer{
+		key:    key,
+		alg:    alg,
+		kid:    base64.RawURLEncoding.EncodeToString(sum[:12]),
+		issuer: issuer,
+		ttl:    ttl,
+	}
+
+	// the key set never changes, so it is encoded once here where a failure can be
+	// reported rather than on every request.
+	s.jwks, err = s.encodeJWKS()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// parseKey parses a PKCS#1, SEC 1 or PKCS#8 private key.
+func parseKey(b []byte) (crypto.Signer, error) {
+	blk, _ := pem.Decode(b)
+	if blk == nil {
+		return nil, errors.New("no PEM encoded key")
+	}
+
+	if k, err := x509.ParsePKCS1PrivateKey(blk.Bytes); err == nil {
+		return k, nil
+	}
+
+	if k, err := x509.ParseECPrivateKey(blk.Bytes); err == nil {
+		return k, nil
+	}
+
+	k, err := x509.ParsePKCS8PrivateKey(blk.Bytes)
+	if err != nil {
+		return nil, errors.New("unable to parse private key")
+	}
+
+	s, ok := k.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", k)
+	}
+	return s, nil
+}
+
+// Sign creates an assertion of the user's identity for the given audience.
+func (s *Signer) Sign(u *user.Info, audience string) (string, error) {
+	return s.SignWithGroups(u, audience, nil)
+}
+
+// SignWithGroups creates an assertion of the user's identity for the given audience
+// that also asserts the groups the user belongs to.
+func (s *Signer) SignWithGroups(u *user.Info, audience string, groups []string) (string, error) {
+	var act *Actor
+	if u.Impersonator != "" {
+		act = &Actor{Subject: u.Impersonator}
+	}
+
+	now := time.Now()
+	return s.sign(&Claims{
+		Issuer:    s.issuer,
+		Subject:   u.Email,
+		Audience:  audience,
+		IssuedAt:  now.Unix(),
+		NotBefore: now.Unix(),
+		Expires:   now.Add(s.ttl).Unix(),
+		Email:     u.Email,
+		Name:      u.Name,
+		Provider:  u.Provider,
+		Groups:    groups,
+		Actor:     act,
+	})
+}
+
+func (s *Signer) sign(c *Claims) (string, error) {
+	hdr, err := json.Marshal(map[string]string{
+		"alg": s.alg,
+		"typ": "JWT",
+		"kid": s.kid,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	body, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	msg := base64.RawURLEncoding.EncodeToString(hdr) + "." +
+		base64.RawURLEncoding.EncodeToString(body)
+	sum := sha256.Sum256([]byte(msg))
+
+	var sig []byte
+	switch k := s.key.(type) {
+	case *rsa.PrivateKey:
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:])
+	case *ecdsa.PrivateKey:
+		var r, ss *big.Int
+		r, ss, err = ecdsa.Sign(rand.Reader, k, sum[:])
+		if err == nil {
+			// JWS uses the fixed width concatenation of r and s.
+			sig = make([]byte, 64)
+			r.FillBytes(sig[:32])
+			ss.FillBytes(sig[32:])
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return msg + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// jwk is the JSON Web Key representation of a public key.
+type jwk struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS is the JSON Web Key Set that backends use to verify assertions.
+func (s *Signer) JWKS() []byte {
+	return s.jwks
+}
+
+// encodeJWKS encodes the public half of the signer's key as a JSON Web Key Set.
+func (s *Signer) encodeJWKS() ([]byte, error) {
+	k := jwk{
+		Use: "sig",
+		Alg: s.alg,
+		Kid: s.kid,
+	}
+
+	enc := base64.RawURLEncoding.EncodeToString
+	switch p := s.key.Public().(type) {
+	case *rsa.PublicKey:
+		k.Kty = "RSA"
+		k.N = enc(p.N.Bytes())
+		k.E = enc(big.NewInt(int64(p.E)).Bytes())
+	case *ecdsa.PublicKey:
+		x, y := make([]byte, 32), make([]byte, 32)
+		p.X.FillBytes(x)
+		p.Y.FillBytes(y)
+		k.Kty = "EC"
+		k.Crv = "P-256"
+		k.X = enc(x)
+		k.Y = enc(y)
+	}
+
+	return json.Marshal(struct {
+		Keys []jwk `json:"keys"`
+	}{[]jwk{k}})
+}
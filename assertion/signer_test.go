@@ -0,0 +1,195 @@
+package assertion
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kellegous/underpants/user"
+)
+
+// verify checks the token's signature against the signer's published JWKS and returns
+// its claims.
+func verify(t *testing.T, s *Signer, token string) *Claims {
+	b := s.JWKS()
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(set.Keys) != 1 {
+		t.Fatalf("expected 1 key, got %d", len(set.Keys))
+	}
+	k := set.Keys[0]
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("expected 3 parts, got %d", len(parts))
+	}
+
+	dec := func(s string) []byte {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	var hdr map[string]string
+	if err := json.Unmarshal(dec(parts[0]), &hdr); err != nil {
+		t.Fatal(err)
+	}
+
+	if hdr["alg"] != k.Alg || hdr["kid"] != k.Kid {
+		t.Fatalf("header %v does not match key %v", hdr, k)
+	}
+
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	sig := dec(parts[2])
+
+	switch k.Kty {
+	case "RSA":
+		pub := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(dec(k.N)),
+			E: int(new(big.Int).SetBytes(dec(k.E)).Int64()),
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig); err != nil {
+			t.Fatalf("invalid signature: %s", err)
+		}
+	case "EC":
+		pub := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(dec(k.X)),
+			Y:     new(big.Int).SetBytes(dec(k.Y)),
+		}
+		if len(sig) != 64 || !ecdsa.Verify(pub, sum[:],
+			new(big.Int).SetBytes(sig[:32]),
+			new(big.Int).SetBytes(sig[32:])) {
+			t.Fatal("invalid signature")
+		}
+	default:
+		t.Fatalf("unexpected key type %s", k.Kty)
+	}
+
+	var c Claims
+	if err := json.Unmarshal(dec(parts[1]), &c); err != nil {
+		t.Fatal(err)
+	}
+	return &c
+}
+
+func TestSign(t *testing.T) {
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []crypto.Signer{rk, ek} {
+		s, err := NewSigner(key, "https://hub.com", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		token, err := s.Sign(&user.Info{
+			Email:    "a@a.com",
+			Name:     "A",
+			Provider: "google",
+		}, "a.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c := verify(t, s, token)
+		if c.Issuer != "https://hub.com" || c.Audience != "a.com" ||
+			c.Subject != "a@a.com" || c.Email != "a@a.com" || c.Name != "A" {
+			t.Fatalf("%s: unexpected claims %v", s.alg, c)
+		}
+
+		if c.Expires-c.IssuedAt != 60 {
+			t.Fatalf("%s: expected assertion to last 60s, got %ds",
+				s.alg, c.Expires-c.IssuedAt)
+		}
+
+		if c.Actor != nil {
+			t.Fatalf("%s: expected no actor, got %v", s.alg, c.Actor)
+		}
+
+		token, err = s.Sign(&user.Info{
+			Email:        "a@a.com",
+			Impersonator: "root@a.com",
+		}, "a.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if c := verify(t, s, token); c.Actor == nil || c.Actor.Subject != "root@a.com" {
+			t.Fatalf("%s: expected root@a.com to be the actor, got %v", s.alg, c.Actor)
+		}
+	}
+}
+
+func TestLoadSigner(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(ek)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(tmp, "key.pem")
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: der,
+	}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := LoadSigner(file, "https://hub.com", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.alg != "ES256" {
+		t.Fatalf("expected ES256, got %s", s.alg)
+	}
+
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewSigner(p384, "https://hub.com", time.Minute); err == nil {
+		t.Fatal("P-384 keys should have been rejected")
+	}
+}
@@ -0,0 +1,125 @@
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// Login is recorded when a user signs in.
+	Login = "login"
+
+	// LoginRejected is recorded when the identity provider authenticates a user who
+	// may not sign in, such as one outside of the allowed domain.
+	LoginRejected = "login-rejected"
+
+	// InvalidSignature is recorded when a session handed to a route was not signed
+	// with the session key.
+	InvalidSignature = "invalid-signature"
+
+	// Logout is recorded when a user signs out.
+	Logout = "logout"
+
+	// AccessDenied is recorded when a request to a route is refused.
+	AccessDenied = "access-denied"
+
+	// Impersonate is recorded when an admin starts, or stops, impersonating a user.
+	Impersonate = "impersonate"
+
+	// ImpersonatedAccess is recorded for each request an admin makes as a user they
+	// are impersonating.
+	ImpersonatedAccess = "impersonated-access"
+)
+
+// Event is a security relevant event.
+type Event struct {
+	Time         time.Time `json:"time"`
+	Type         string    `json:"event"`
+	User         string    `json:"user,omitempty"`
+	Impersonator string    `json:"impersonator,omitempty"`
+	ClientIP     string    `json:"client-ip"`
+	Host         string    `json:"host"`
+	URI          string    `json:"uri"`
+	Reason       string    `json:"reason,omitempty"`
+}
+
+// Log writes events as a JSON object per line.
+type Log struct {
+	lck sync.Mutex
+	w   io.Writer
+}
+
+// New creates a Log that writes to w.
+func New(w io.Writer) *Log {
+	return &Log{w: w}
+}
+
+// Open creates a Log that appends to the file at path, or writes to stdout if the
+// path is empty.
+func Open(path string) (*Log, error) {
+	if path == "" {
+		return New(os.Stdout), nil
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(f), nil
+}
+
+// Record writes an event of the given type about the request, which was made by the
+// user with the given email, if it is known. It does nothing if the log is nil.
+func (l *Log) Record(r *http.Request, typ, email, reason string) {
+	l.RecordImpersonated(r, typ, email, "", reason)
+}
+
+// RecordImpersonated writes an event of the given type about the request, which was
+// made by the admin with the impersonator email as the user with the given email. It
+// does nothing if the log is nil.
+func (l *Log) RecordImpersonated(r *http.Request, typ, email, impersonator, reason string) {
+	if l == nil {
+		return
+	}
+
+	b, err := json.Marshal(&Event{
+		Time:         time.Now(),
+		Type:         typ,
+		User:         email,
+		Impersonator: impersonator,
+		ClientIP:     clientIP(r),
+		Host:         r.Host,
+		URI:          r.RequestURI,
+		Reason:       reason,
+	})
+	if err != nil {
+		zap.L().Error("unable to encode audit event",
+			zap.Error(err))
+		return
+	}
+
+	l.lck.Lock()
+	defer l.lck.Unlock()
+	if _, err := l.w.Write(append(b, '\n')); err != nil {
+		zap.L().Error("unable to write audit event",
+			zap.String("event", typ),
+			zap.String("user", email),
+			zap.Error(err))
+	}
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
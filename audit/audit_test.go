@@ -0,0 +1,46 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRecord(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf)
+
+	r := httptest.NewRequest("GET", "/__auth__/logout", nil)
+	r.Host = "hub.com"
+	r.RemoteAddr = "10.0.0.1:1234"
+	l.Record(r, Logout, "a@a.com", "")
+	l.Record(r, LoginRejected, "", "user b@b.com is not in domain a.com")
+
+	dec := json.NewDecoder(&buf)
+
+	var e Event
+	if err := dec.Decode(&e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != Logout ||
+		e.User != "a@a.com" ||
+		e.ClientIP != "10.0.0.1" ||
+		e.Host != "hub.com" ||
+		e.URI != "/__auth__/logout" ||
+		e.Time.IsZero() {
+		t.Fatalf("unexpected event %+v", e)
+	}
+
+	if err := dec.Decode(&e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != LoginRejected || e.Reason != "user b@b.com is not in domain a.com" {
+		t.Fatalf("unexpected event %+v", e)
+	}
+}
+
+func TestNilLog(t *testing.T) {
+	var l *Log
+	l.Record(httptest.NewRequest("GET", "/", nil), Login, "a@a.com", "")
+}
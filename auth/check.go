@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/kellegous/underpants/config"
+)
+
+// Checker is implemented by providers that check that their identity providers can be
+// reached themselves, rather than by where GetAuthURL sends users.
+type Checker interface {
+	Check(ctx *config.Context, timeout time.Duration) error
+}
+
+// CheckReachable determines if the identity provider that users are sent to in order
+// to sign in can be reached. Any response from its host will do.
+func CheckReachable(ctx *config.Context, p Provider, timeout time.Duration) error {
+	if c, ok := p.(Checker); ok {
+		return c.Check(ctx, timeout)
+	}
+
+	r := &http.Request{
+		Method: "GET",
+		URL:    &url.URL{Path: "/"},
+		Host:   ctx.Host(),
+		Header: http.Header{},
+	}
+
+	u, err := url.Parse(p.GetAuthURL(ctx, r))
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("invalid auth url: %s", u)
+	}
+
+	c, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(c,
+		"HEAD",
+		(&url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/"}).String(),
+		nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	return nil
+}
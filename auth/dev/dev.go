@@ -0,0 +1,57 @@
+package dev
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/kellegous/underpants/auth"
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/user"
+)
+
+// Name is the name for this provider as it is reported in logs.
+const Name = "dev"
+
+// Provider is the auth.Provider that signs everyone in as the config's dev user
+// without sending them to an identity provider. It is only for developing locally.
+var Provider = &provider{}
+
+type provider struct{}
+
+func (p *provider) Validate(cfg *config.Info) error {
+	if cfg.DevUser == "" {
+		return errors.New("dev provider requires a dev-user")
+	}
+	return nil
+}
+
+// GetAuthURL sends the user straight back to the hub's callback, as though they had
+// signed in.
+func (p *provider) GetAuthURL(ctx *config.Context, r *http.Request) string {
+	return fmt.Sprintf("%s://%s%s?%s",
+		ctx.Scheme(),
+		ctx.Host(),
+		auth.BaseURI,
+		url.Values{"state": {auth.EncodeState(ctx, r)}}.Encode())
+}
+
+func (p *provider) Authenticate(ctx *config.Context, r *http.Request) (*user.Info, *url.URL, error) {
+	state := r.FormValue("state")
+	if state == "" {
+		return nil, nil, errors.New("state parameter is missing")
+	}
+
+	ret, err := auth.DecodeState(ctx, state)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &user.Info{
+		Email:         ctx.DevUser,
+		EmailVerified: true,
+		Name:          ctx.DevUser[:strings.Index(ctx.DevUser, "@")],
+	}, ret, nil
+}
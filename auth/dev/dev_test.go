@@ -0,0 +1,49 @@
+package dev
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/kellegous/underpants/config"
+)
+
+func TestSignIn(t *testing.T) {
+	cfg := config.Info{DevUser: "alice@example.com"}
+	if err := cfg.Read(strings.NewReader(`{
+		"host": "localhost",
+		"routes": [{"from": "app.localhost", "to": "http://localhost:3000"}]
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := config.BuildContext(&cfg, 8080, []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authURL, err := url.Parse(Provider.GetAuthURL(ctx,
+		httptest.NewRequest("GET", "http://app.localhost:8080/a?b=c", nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if authURL.Host != "localhost:8080" || authURL.Path != "/__auth__/" {
+		t.Fatalf("expected the hub's callback, got %s", authURL)
+	}
+
+	u, ret, err := Provider.Authenticate(ctx,
+		httptest.NewRequest("GET", authURL.String(), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Email != "alice@example.com" || u.Name != "alice" || !u.EmailVerified {
+		t.Fatalf("expected alice@example.com, got %+v", u)
+	}
+
+	if ret.String() != "http://app.localhost:8080/a?b=c" {
+		t.Fatalf("expected to return to app.localhost, got %s", ret)
+	}
+}
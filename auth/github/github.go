@@ -0,0 +1,245 @@
+package github
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/kellegous/underpants/auth"
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/user"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
+)
+
+// Name is the name for this provider as used in config.Info.
+const Name = "github"
+
+// apiURL is the base URL of the GitHub API.
+var apiURL = "https://api.github.com"
+
+// Provider is the auth.Provider for GitHub oauth
+var Provider = &provider{}
+
+type provider struct{}
+
+func configFor(ctx *config.Context) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     ctx.Oauth.ClientID,
+		ClientSecret: ctx.Oauth.ClientSecret,
+		Endpoint:     github.Endpoint,
+		Scopes: []string{
+			"read:user",
+			"user:email",
+			"read:org",
+		},
+		RedirectURL: fmt.Sprintf("%s://%s%s",
+			ctx.Scheme(),
+			ctx.Host(),
+			auth.BaseURI),
+	}
+}
+
+// get fetches a GitHub API resource into v.
+func get(c *http.Client, path string, v interface{}) (int, error) {
+	status, _, err := getPage(c, apiURL+path, v)
+	return status, err
+}
+
+// getPage fetches the page of a GitHub API list at rawURL into v. It also returns the
+// URL of the next page, which is empty on the last page.
+func getPage(c *http.Client, rawURL string, v interface{}) (int, string, error) {
+	res, err := c.Get(rawURL)
+	if err != nil {
+		return 0, "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return res.StatusCode, "", nil
+	}
+
+	return res.StatusCode, nextPage(res.Header), json.NewDecoder(res.Body).Decode(v)
+}
+
+// nextPage is the URL of the next page in the Link header of a list response, which
+// looks like <https://api.github.com/user/teams?page=2>; rel="next", <...>; rel="last".
+func nextPage(h http.Header) string {
+	for _, link := range strings.Split(h.Get("Link"), ",") {
+		parts := strings.Split(link, ";")
+		if len(parts) < 2 {
+			continue
+		}
+
+		for _, p := range parts[1:] {
+			if strings.TrimSpace(p) == `rel="next"` {
+				return strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			}
+		}
+	}
+	return ""
+}
+
+func fetchUser(c *http.Client) (*user.Info, error) {
+	var u struct {
+		Login     string `json:"login"`
+		Name      string `json:"name"`
+		AvatarURL string `json:"avatar_url"`
+	}
+
+	if status, err := get(c, "/user", &u); err != nil {
+		return nil, err
+	} else if status != http.StatusOK {
+		return nil, fmt.Errorf("fetching user returned status %d", status)
+	}
+
+	// the profile email is optional and unverified, so use the primary email.
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+
+	if status, err := get(c, "/user/emails", &emails); err != nil {
+		return nil, err
+	} else if status != http.StatusOK {
+		return nil, fmt.Errorf("fetching emails returned status %d", status)
+	}
+
+	info := &user.Info{
+		Name:    u.Name,
+		Picture: u.AvatarURL,
+	}
+
+	if info.Name == "" {
+		info.Name = u.Login
+	}
+
+	for _, e := range emails {
+		if e.Primary {
+			info.Email = e.Email
+			info.EmailVerified = e.Verified
+		}
+	}
+
+	if info.Email == "" {
+		return nil, fmt.Errorf("user %s has no primary email", u.Login)
+	}
+
+	return info, nil
+}
+
+// isMember determines if the authenticated user is an active member of the org, and
+// if teams are given, a member of one of those teams in the org.
+func isMember(c *http.Client, org string, teams []string) (bool, error) {
+	var m struct {
+		State string `json:"state"`
+	}
+
+	status, err := get(c, fmt.Sprintf("/user/memberships/orgs/%s", url.PathEscape(org)), &m)
+	if err != nil {
+		return false, err
+	}
+
+	if status != http.StatusOK || m.State != "active" {
+		return false, nil
+	}
+
+	if len(teams) == 0 {
+		return true, nil
+	}
+
+	// users in many teams have their teams spread over several pages.
+	for next := apiURL + "/user/teams?per_page=100"; next != ""; {
+		var ts []struct {
+			Slug         string `json:"slug"`
+			Organization struct {
+				Login string `json:"login"`
+			} `json:"organization"`
+		}
+
+		status, n, err := getPage(c, next, &ts)
+		if err != nil {
+			return false, err
+		} else if status != http.StatusOK {
+			return false, fmt.Errorf("fetching teams returned status %d", status)
+		}
+
+		for _, t := range ts {
+			if !strings.EqualFold(t.Organization.Login, org) {
+				continue
+			}
+
+			for _, team := range teams {
+				if strings.EqualFold(t.Slug, team) {
+					return true, nil
+				}
+			}
+		}
+
+		next = n
+	}
+
+	return false, nil
+}
+
+func (p *provider) Validate(cfg *config.Info) error {
+	if cfg.Oauth.Organization == "" {
+		return errors.New("the github provider requires an organization")
+	}
+	return nil
+}
+
+func (p *provider) GetAuthURL(ctx *config.Context, r *http.Request) string {
+	return configFor(ctx).AuthCodeURL(
+		auth.EncodeState(ctx, r))
+}
+
+func (p *provider) Authenticate(ctx *config.Context, r *http.Request) (*user.Info, *url.URL, error) {
+	state := r.FormValue("state")
+	if state == "" {
+		return nil, nil, errors.New("state parameter is missing")
+	}
+
+	ret, err := auth.DecodeState(ctx, state)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg := configFor(ctx)
+
+	code := r.FormValue("code")
+	if code == "" {
+		return nil, nil, errors.New("code parameter is missing")
+	}
+
+	tok, err := cfg.Exchange(context.Background(), code)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := cfg.Client(context.Background(), tok)
+
+	u, err := fetchUser(c)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ok, err := isMember(c, ctx.Oauth.Organization, ctx.Oauth.Teams)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !ok {
+		return nil, nil, fmt.Errorf("user %s is not a member of %s",
+			u.Email,
+			ctx.Oauth.Organization)
+	}
+
+	return u, ret, nil
+}
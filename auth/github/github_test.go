@@ -0,0 +1,98 @@
+package github
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// fakeAPI serves a user whose org membership is in state, and whose teams are listed
+// over as many pages as are given.
+func fakeAPI(state string, teams ...string) *httptest.Server {
+	var s *httptest.Server
+	s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/user":
+			fmt.Fprint(w, `{"login": "a", "avatar_url": "http://a.com/a.png"}`)
+		case "/user/emails":
+			fmt.Fprint(w, `[
+				{"email": "a@b.com", "primary": false, "verified": true},
+				{"email": "a@a.com", "primary": true, "verified": true}
+			]`)
+		case "/user/memberships/orgs/acme":
+			fmt.Fprintf(w, `{"state": "%s"}`, state)
+		case "/user/teams":
+			page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+			if page < 1 {
+				page = 1
+			}
+
+			if page < len(teams) {
+				w.Header().Set("Link", fmt.Sprintf(
+					`<%[1]s/user/teams?per_page=100&page=%[2]d>; rel="next", <%[1]s/user/teams?per_page=100&page=%[3]d>; rel="last"`,
+					s.URL, page+1, len(teams)))
+			}
+			fmt.Fprint(w, teams[page-1])
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return s
+}
+
+func TestFetchUser(t *testing.T) {
+	s := fakeAPI("active", "[]")
+	defer s.Close()
+	apiURL = s.URL
+
+	u, err := fetchUser(http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Email != "a@a.com" || !u.EmailVerified || u.Name != "a" {
+		t.Fatalf("unexpected user %+v", u)
+	}
+}
+
+func TestIsMember(t *testing.T) {
+	teams := []string{
+		`[{"slug": "ops", "organization": {"login": "other"}}]`,
+		`[{"slug": "eng", "organization": {"login": "acme"}}]`,
+	}
+
+	tests := []struct {
+		State    string
+		Org      string
+		Teams    []string
+		Expected bool
+	}{
+		{"active", "acme", nil, true},
+		{"pending", "acme", nil, false},
+		{"active", "nope", nil, false},
+		{"active", "acme", []string{"eng"}, true},
+		{"active", "acme", []string{"ops"}, false},
+		{"active", "acme", []string{"web"}, false},
+	}
+
+	for _, test := range tests {
+		s := fakeAPI(test.State, teams...)
+		apiURL = s.URL
+
+		ok, err := isMember(http.DefaultClient, test.Org, test.Teams)
+		s.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ok != test.Expected {
+			t.Fatalf("membership of %s in %s/%v should have been %t",
+				test.State,
+				test.Org,
+				test.Teams,
+				test.Expected)
+		}
+	}
+}
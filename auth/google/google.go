@@ -2,6 +2,7 @@ package google
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -20,7 +21,11 @@ import (
 // Name ...
 const Name = "google"
 
-const profileURL = "https://www.googleapis.com/oauth2/v1/userinfo?alt=json"
+// profileURL and endpoint are variables so that tests can replace them.
+var (
+	profileURL = "https://www.googleapis.com/oauth2/v1/userinfo?alt=json"
+	endpoint   = google.Endpoint
+)
 
 type provider struct{}
 
@@ -31,7 +36,7 @@ func configFor(ctx *config.Context) *oauth2.Config {
 	return &oauth2.Config{
 		ClientID:     ctx.Oauth.ClientID,
 		ClientSecret: ctx.Oauth.ClientSecret,
-		Endpoint:     google.Endpoint,
+		Endpoint:     endpoint,
 		Scopes: []string{
 			"https://www.googleapis.com/auth/userinfo.profile",
 			"https://www.googleapis.com/auth/userinfo.email",
@@ -43,28 +48,84 @@ func configFor(ctx *config.Context) *oauth2.Config {
 	}
 }
 
-func fetchUser(cfg *oauth2.Config, tok *oauth2.Token) (*user.Info, error) {
+// fetchUser gets the profile of the user and the hosted domain they belong to, which
+// is empty for users outside of a Google Workspace.
+func fetchUser(cfg *oauth2.Config, tok *oauth2.Token) (*user.Info, string, error) {
 	res, err := cfg.Client(context.Background(), tok).Get(profileURL)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 	defer res.Body.Close()
 
 	var u struct {
-		Name    string `json:"name"`
-		Email   string `json:"email"`
-		Picture string `json:"picture"`
+		Name          string `json:"name"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"verified_email"`
+		Picture       string `json:"picture"`
+		HostedDomain  string `json:"hd"`
 	}
 
 	if err := json.NewDecoder(res.Body).Decode(&u); err != nil {
-		return nil, err
+		return nil, "", err
+	}
+
+	hd := u.HostedDomain
+	if d, ok := idTokenDomain(tok); ok {
+		hd = d
 	}
 
 	return &user.Info{
-		Name:    u.Name,
-		Email:   u.Email,
-		Picture: u.Picture,
-	}, nil
+		Name:          u.Name,
+		Email:         u.Email,
+		EmailVerified: u.EmailVerified,
+		Picture:       u.Picture,
+	}, hd, nil
+}
+
+// idTokenDomain is the hd claim of the ID token issued with tok, if there is one. The
+// token comes directly from Google's token endpoint, so its signature is not checked.
+func idTokenDomain(tok *oauth2.Token) (string, bool) {
+	raw, ok := tok.Extra("id_token").(string)
+	if !ok {
+		return "", false
+	}
+
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", false
+	}
+
+	var claims struct {
+		HostedDomain string `json:"hd"`
+	}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return "", false
+	}
+
+	return claims.HostedDomain, true
+}
+
+// checkDomain ensures a user in the hosted domain hd may sign in. Guests are matched
+// by email, so theirs must have been verified.
+func checkDomain(ctx *config.Context, u *user.Info, hd string) error {
+	if len(ctx.Oauth.AllowedDomains()) == 0 || ctx.Oauth.HasDomain(hd) {
+		return nil
+	}
+
+	if u.EmailVerified && ctx.Oauth.IsGuest(u.Email) {
+		return nil
+	}
+
+	if hd == "" {
+		return fmt.Errorf("user %s is not in a hosted domain", u.Email)
+	}
+
+	return fmt.Errorf("user %s is in domain %s, which is not allowed", u.Email, hd)
 }
 
 func (p *provider) Validate(cfg *config.Info) error {
@@ -72,12 +133,32 @@ func (p *provider) Validate(cfg *config.Info) error {
 }
 
 func (p *provider) GetAuthURL(ctx *config.Context, r *http.Request) string {
-	u := configFor(ctx).AuthCodeURL(
-		auth.GetCurrentURL(ctx, r).String())
+	ctx = ctx.ForHost(r.Host)
+
+	var opts []oauth2.AuthCodeOption
+	if ctx.Oauth.RefreshTokens {
+		// google only issues a refresh token when the user consents.
+		opts = append(opts,
+			oauth2.AccessTypeOffline,
+			oauth2.SetAuthURLParam("prompt", "consent"))
+	}
 
-	// If the config is restricting by domain, then add that to the auth url.
-	if d := ctx.Oauth.Domain; d != "" {
-		u += fmt.Sprintf("&hd=%s", url.QueryEscape(d))
+	if auth.RequiresLogin(r) {
+		// google has no prompt=login, but max_age=0 makes the user sign in again.
+		opts = append(opts, oauth2.SetAuthURLParam("max_age", "0"))
+	}
+
+	u := configFor(ctx).AuthCodeURL(
+		auth.EncodeState(ctx, r), opts...)
+
+	// If the config is restricting by domain, then add that to the auth url. Google
+	// only takes one domain, so "*" limits the choice to hosted accounts otherwise.
+	switch ds := ctx.Oauth.AllowedDomains(); len(ds) {
+	case 0:
+	case 1:
+		u += fmt.Sprintf("&hd=%s", url.QueryEscape(ds[0]))
+	default:
+		u += "&hd=*"
 	}
 
 	return u
@@ -89,11 +170,14 @@ func (p *provider) Authenticate(ctx *config.Context, r *http.Request) (*user.Inf
 		return nil, nil, errors.New("state parameter is missing")
 	}
 
-	ret, err := url.Parse(state)
+	st, err := auth.ParseState(ctx, state)
 	if err != nil {
-		return nil, nil, errors.New("invalid return URL")
+		return nil, nil, err
 	}
 
+	// users are signed in for the domain of the route they are returning to.
+	ctx = ctx.ForHost(st.Return.Host)
+
 	cfg := configFor(ctx)
 
 	code := r.FormValue("code")
@@ -106,16 +190,51 @@ func (p *provider) Authenticate(ctx *config.Context, r *http.Request) (*user.Inf
 		return nil, nil, err
 	}
 
-	u, err := fetchUser(cfg, tok)
+	u, hd, err := fetchUser(cfg, tok)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	if !strings.HasSuffix(u.Email, "@"+ctx.Oauth.Domain) {
-		return nil, nil, fmt.Errorf("user %s is not in domain %s",
-			u.Email,
-			ctx.Oauth.Domain)
+	if err := checkDomain(ctx, u, hd); err != nil {
+		return nil, nil, err
+	}
+
+	if ctx.Oauth.RefreshTokens {
+		u.RefreshToken = tok.RefreshToken
+	}
+
+	// the identity provider reports when the user last entered their credentials,
+	// which must be after they were sent to it if they were asked to sign in again.
+	u.LastSignIn = auth.IDTokenAuthTime(tok)
+	if err := st.CheckSignIn(u.LastSignIn); err != nil {
+		return nil, nil, err
+	}
+
+	return u, st.Return, nil
+}
+
+func (p *provider) Refresh(ctx *config.Context, token string) (*user.Info, error) {
+	cfg := configFor(ctx)
+
+	tok, err := cfg.TokenSource(context.Background(), &oauth2.Token{
+		RefreshToken: token,
+	}).Token()
+	if err != nil {
+		return nil, err
+	}
+
+	u, hd, err := fetchUser(cfg, tok)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkDomain(ctx, u, hd); err != nil {
+		return nil, err
+	}
+
+	if tok.RefreshToken != token {
+		u.RefreshToken = tok.RefreshToken
 	}
 
-	return u, ret, nil
+	return u, nil
 }
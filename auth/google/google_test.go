@@ -1,13 +1,20 @@
 package google
 
 import (
+	"encoding/base64"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"reflect"
 	"strings"
 	"testing"
 
+	"github.com/kellegous/underpants/auth"
 	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/user"
+
+	"golang.org/x/oauth2"
 )
 
 func TestAuthURLWithoutDomain(t *testing.T) {
@@ -17,7 +24,8 @@ func TestAuthURLWithoutDomain(t *testing.T) {
 				ClientID:     "client_id",
 				ClientSecret: "client_secret",
 			},
-			Host: "foo.com",
+			Host:   "foo.com",
+			Routes: []*config.RouteInfo{{From: "boo.com"}},
 		},
 		Port: 9090,
 	}
@@ -45,7 +53,6 @@ func TestAuthURLWithoutDomain(t *testing.T) {
 				"https://www.googleapis.com/auth/userinfo.email",
 			}, " "),
 		},
-		"state": {"http://boo.com:9090/"},
 	}
 
 	for param, exp := range toVerify {
@@ -58,6 +65,11 @@ func TestAuthURLWithoutDomain(t *testing.T) {
 			exp,
 			vals[param])
 	}
+
+	if ret, err := auth.DecodeState(ctx, vals.Get("state")); err != nil ||
+		ret.String() != "http://boo.com:9090/" {
+		t.Fatalf("expected state for http://boo.com:9090/, got %s", vals.Get("state"))
+	}
 }
 
 func TestAuthURLWith(t *testing.T) {
@@ -102,3 +114,180 @@ func TestAuthURLWith(t *testing.T) {
 			vals[param])
 	}
 }
+
+func TestAuthURLWithLogin(t *testing.T) {
+	ctx := &config.Context{
+		Info: &config.Info{
+			Oauth: config.OAuthInfo{
+				ClientID:     "client_id",
+				ClientSecret: "client_secret",
+			},
+			Host: "foo.com",
+		},
+		Port: 9090,
+	}
+
+	r := httptest.NewRequest("GET", "http://boo.com:9090/admin/", nil)
+
+	authURL, err := url.Parse(Provider.GetAuthURL(ctx, r))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := authURL.Query().Get("max_age"); v != "" {
+		t.Fatalf("expected no max_age, got %s", v)
+	}
+
+	authURL, err = url.Parse(Provider.GetAuthURL(ctx, auth.WithLogin(r)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := authURL.Query().Get("max_age"); v != "0" {
+		t.Fatalf("expected max_age of 0, got %q", v)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			if r.FormValue("grant_type") != "refresh_token" || r.FormValue("refresh_token") != "old" {
+				http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"access_token": "access", "token_type": "Bearer", "refresh_token": "new", "id_token": %q}`,
+				idToken(`{"email": "a@k.com", "hd": "k.com"}`))
+		case "/userinfo":
+			if r.Header.Get("Authorization") != "Bearer access" {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"email": "a@k.com", "verified_email": true, "name": "A"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+
+	defer func(p string, e oauth2.Endpoint) {
+		profileURL, endpoint = p, e
+	}(profileURL, endpoint)
+	profileURL = s.URL + "/userinfo"
+	endpoint = oauth2.Endpoint{
+		AuthURL:  s.URL + "/auth",
+		TokenURL: s.URL + "/token",
+	}
+
+	ctx := &config.Context{
+		Info: &config.Info{
+			Oauth: config.OAuthInfo{
+				ClientID:      "client_id",
+				ClientSecret:  "client_secret",
+				Domain:        "k.com",
+				RefreshTokens: true,
+			},
+			Host: "foo.com",
+		},
+		Port: 9090,
+	}
+
+	u, err := Provider.(auth.Refresher).Refresh(ctx, "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Email != "a@k.com" || !u.EmailVerified || u.RefreshToken != "new" {
+		t.Fatalf("unexpected user %+v", u)
+	}
+
+	if _, err := Provider.(auth.Refresher).Refresh(ctx, "revoked"); err == nil {
+		t.Fatal("expected an invalid refresh token to fail")
+	}
+
+	ctx.Oauth.Domain = "j.com"
+	if _, err := Provider.(auth.Refresher).Refresh(ctx, "old"); err == nil {
+		t.Fatal("expected a user outside of the domain to be refused")
+	}
+
+	ctx.Oauth.Domain = ""
+	ctx.Oauth.Domains = []string{"j.com", "K.com"}
+	if _, err := Provider.(auth.Refresher).Refresh(ctx, "old"); err != nil {
+		t.Fatalf("expected a user in one of the domains to be admitted, got %s", err)
+	}
+}
+
+func TestCheckDomain(t *testing.T) {
+	ctx := &config.Context{
+		Info: &config.Info{
+			Oauth: config.OAuthInfo{
+				Domain:  "example.com",
+				Domains: []string{"example.org"},
+				Guests:  []string{"vendor@gmail.com"},
+			},
+		},
+	}
+
+	tests := []struct {
+		Email    string
+		Verified bool
+		Domain   string
+		Allowed  bool
+	}{
+		{"a@example.com", true, "example.com", true},
+		{"a@example.org", true, "EXAMPLE.ORG", true},
+		{"a@evilexample.com", true, "evilexample.com", false},
+		{"a@sub.example.com", true, "sub.example.com", false},
+		{"a@example.com", true, "", false},
+		{"Vendor@gmail.com", true, "", true},
+		{"vendor@gmail.com", false, "", false},
+	}
+
+	for _, test := range tests {
+		err := checkDomain(ctx, &user.Info{
+			Email:         test.Email,
+			EmailVerified: test.Verified,
+		}, test.Domain)
+		if (err == nil) != test.Allowed {
+			t.Fatalf("expected %s in %q allowed to be %t, got %v",
+				test.Email, test.Domain, test.Allowed, err)
+		}
+	}
+}
+
+func TestAuthURLWithDomains(t *testing.T) {
+	ctx := &config.Context{
+		Info: &config.Info{
+			Oauth: config.OAuthInfo{
+				ClientID:     "client_id",
+				ClientSecret: "client_secret",
+				Domains:      []string{"j.com", "k.com"},
+			},
+			Host: "foo.com",
+		},
+		Port: 9090,
+	}
+
+	r := &http.Request{
+		Host: "boo.com:9090",
+		URL: &url.URL{
+			Path: "/",
+		},
+	}
+
+	authURL, err := url.Parse(
+		Provider.GetAuthURL(ctx, r))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hd := authURL.Query().Get("hd"); hd != "*" {
+		t.Fatalf("expected hd of * but got %s", hd)
+	}
+}
+
+// idToken is an unsigned ID token with the given claims.
+func idToken(claims string) string {
+	return "e30." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".sig"
+}
@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// IDTokenAuthTime is the auth_time claim of the ID token issued with tok, which is when
+// the user last entered their credentials with the identity provider, or the zero time
+// if there is none. The token comes directly from the provider's token endpoint, so its
+// signature is not checked.
+func IDTokenAuthTime(tok *oauth2.Token) time.Time {
+	raw, ok := tok.Extra("id_token").(string)
+	if !ok {
+		return time.Time{}
+	}
+
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}
+	}
+
+	var claims struct {
+		AuthTime int64 `json:"auth_time"`
+	}
+	if err := json.Unmarshal(b, &claims); err != nil || claims.AuthTime <= 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(claims.AuthTime, 0)
+}
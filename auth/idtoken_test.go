@@ -0,0 +1,31 @@
+package auth
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestIDTokenAuthTime(t *testing.T) {
+	withIDToken := func(claims string) *oauth2.Token {
+		return (&oauth2.Token{}).WithExtra(map[string]interface{}{
+			"id_token": "e30." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".sig",
+		})
+	}
+
+	if at := IDTokenAuthTime(withIDToken(`{"auth_time": 1700000000}`)); !at.Equal(time.Unix(1700000000, 0)) {
+		t.Fatalf("expected auth_time of 1700000000, got %s", at)
+	}
+
+	for name, tok := range map[string]*oauth2.Token{
+		"no id token":  {},
+		"no auth_time": withIDToken(`{"email": "a@a.com"}`),
+		"malformed":    withIDToken(`{`),
+	} {
+		if at := IDTokenAuthTime(tok); !at.IsZero() {
+			t.Fatalf("%s: expected no auth time, got %s", name, at)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package local
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kellegous/underpants/auth"
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/user"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Name is the name for this provider as used in config.Info.
+const Name = "local"
+
+// dummyHash is compared against the passwords of unknown users so that signing in as
+// one takes as long as signing in as a known user with the wrong password.
+var dummyHash = []byte("$2a$10$y6GNaxZY0g0eaww9hkaMOeuq/euq5zJRQahxRz4scIDnrBCMDT4/6")
+
+var loginTmpl = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+  <head>
+    <title>Sign in</title>
+  </head>
+  <body>
+    <h1>Sign in</h1>
+    <form method="post" action="{{.Action}}">
+      <input type="hidden" name="state" value="{{.State}}">
+      <p><label>Email <input type="email" name="email" autocomplete="username" required autofocus></label></p>
+      <p><label>Password <input type="password" name="password" autocomplete="current-password" required></label></p>
+      <p><button type="submit">Sign in</button></p>
+    </form>
+  </body>
+</html>
+`))
+
+// Provider is the auth.Provider for users listed, with their bcrypt hashed passwords,
+// in a local users file. It allows sign in when the other identity providers cannot be
+// reached.
+var Provider = &provider{
+	users:    map[string]map[string][]byte{},
+	throttle: newThrottle(),
+}
+
+type provider struct {
+	lck sync.Mutex
+
+	// users holds the password hashes by email, keyed by the filename they were
+	// loaded from.
+	users map[string]map[string][]byte
+
+	// throttle backs off sign ins for the emails and addresses with failed passwords.
+	throttle *throttle
+}
+
+func loginPath() string {
+	return fmt.Sprintf("%slocal", auth.BaseURI)
+}
+
+// loadUsers reads a users file of email:hash lines. Blank lines and lines starting
+// with # are ignored.
+func loadUsers(filename string) (map[string][]byte, error) {
+	r, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	users := map[string][]byte{}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		ix := strings.IndexByte(line, ':')
+		if ix <= 0 {
+			return nil, fmt.Errorf("%s:%d: expected email:hash", filename, n)
+		}
+
+		email, hash := strings.ToLower(line[:ix]), []byte(line[ix+1:])
+		if _, err := bcrypt.Cost(hash); err != nil {
+			return nil, fmt.Errorf("%s:%d: only bcrypt hashes are supported", filename, n)
+		}
+
+		users[email] = hash
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (p *provider) Validate(cfg *config.Info) error {
+	filename := cfg.Oauth.UsersFile
+	if filename == "" {
+		return errors.New("the local provider requires a users-file")
+	}
+
+	users, err := loadUsers(filename)
+	if err != nil {
+		return err
+	}
+
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	p.users[filename] = users
+	return nil
+}
+
+// Check always succeeds, local users do not depend on anything outside of underpants.
+func (p *provider) Check(ctx *config.Context, timeout time.Duration) error {
+	return nil
+}
+
+// GetAuthURL sends the user to the sign in form on the hub.
+func (p *provider) GetAuthURL(ctx *config.Context, r *http.Request) string {
+	return fmt.Sprintf("%s://%s%s?%s",
+		ctx.Scheme(),
+		ctx.Host(),
+		loginPath(),
+		url.Values{"state": {auth.EncodeState(ctx, r)}}.Encode())
+}
+
+// Authenticate checks the email and password posted by the sign in form.
+func (p *provider) Authenticate(ctx *config.Context, r *http.Request) (*user.Info, *url.URL, error) {
+	if r.Method != "POST" {
+		return nil, nil, errors.New("credentials must be posted")
+	}
+
+	ret, err := auth.DecodeState(ctx, r.PostFormValue("state"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	email := strings.ToLower(strings.TrimSpace(r.PostFormValue("email")))
+
+	now := time.Now()
+	keys := []string{"email:" + email, "ip:" + clientIP(r)}
+	if d := p.throttle.wait(now, keys...); d > 0 {
+		return nil, nil, fmt.Errorf("too many failed sign ins for %s, refused for another %s",
+			email, d.Round(time.Second))
+	}
+
+	p.lck.Lock()
+	hash, ok := p.users[ctx.Oauth.UsersFile][email]
+	p.lck.Unlock()
+
+	if !ok {
+		hash = dummyHash
+	}
+
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(r.PostFormValue("password"))); err != nil || !ok {
+		p.throttle.fail(now, keys...)
+		return nil, nil, fmt.Errorf("invalid password for %s", email)
+	}
+	p.throttle.succeed(keys[0])
+
+	return &user.Info{
+		Email:         email,
+		EmailVerified: true,
+		Name:          email,
+	}, ret, nil
+}
+
+// clientIP is the address the request came from.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Handlers serves the sign in form, which posts the credentials to the hub's shared
+// callback.
+func (p *provider) Handlers(ctx *config.Context) map[string]http.Handler {
+	return map[string]http.Handler{
+		loginPath(): http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html;charset=utf-8")
+			if err := loginTmpl.Execute(w, struct {
+				Action string
+				State  string
+			}{
+				Action: auth.BaseURI,
+				State:  r.FormValue("state"),
+			}); err != nil {
+				zap.L().Error("unable to render local sign in",
+					zap.Error(err))
+			}
+		}),
+	}
+}
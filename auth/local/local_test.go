@@ -0,0 +1,173 @@
+package local
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/kellegous/underpants/auth"
+	"github.com/kellegous/underpants/config"
+)
+
+// hunter2Hash is the bcrypt hash of "hunter2" at the minimum cost.
+const hunter2Hash = "$2a$04$Qv7LYpYNSMkyK79ZkgdX5OyW.0s8QpgehwWJKraHIulY6YnewMa6m"
+
+func writeUsers(t *testing.T, users string) string {
+	dir, err := ioutil.TempDir("", "underpants-local")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filename := filepath.Join(dir, "users")
+	if err := ioutil.WriteFile(filename, []byte(users), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestInvalidUsersFile(t *testing.T) {
+	for _, users := range []string{
+		"a@a.com\n",
+		"a@a.com:{SHA}8oykoxMvQQ0m6lOc4gUc0OJ0b1E=\n",
+	} {
+		filename := writeUsers(t, users)
+		defer os.RemoveAll(filepath.Dir(filename))
+
+		var cfg config.Info
+		cfg.Oauth.UsersFile = filename
+		if err := Provider.Validate(&cfg); err == nil {
+			t.Fatalf("expected %q to be invalid", users)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	filename := writeUsers(t, "# ops\n\nOps@a.com:"+hunter2Hash+"\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	var cfg config.Info
+	if err := cfg.Read(strings.NewReader(`{
+		"host": "hub.com",
+		"oauth": {"provider": "local", "users-file": "` + filename + `"},
+		"routes": [{"from": "a.com", "to": "http://localhost:8080"}]
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Provider.Validate(&cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := config.BuildContext(&cfg, 80, []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authURL, err := url.Parse(Provider.GetAuthURL(ctx,
+		httptest.NewRequest("GET", "http://a.com/runbooks", nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if authURL.Host != "hub.com" || authURL.Path != "/__auth__/local" {
+		t.Fatalf("expected the sign in form on the hub, got %s", authURL)
+	}
+
+	w := httptest.NewRecorder()
+	Provider.Handlers(ctx)[authURL.Path].ServeHTTP(w, httptest.NewRequest("GET", authURL.String(), nil))
+	if !strings.Contains(w.Body.String(), `action="/__auth__/"`) {
+		t.Fatalf("expected a form that posts to the callback, got:\n%s", w.Body.String())
+	}
+
+	post := func(email, password string) error {
+		r := httptest.NewRequest("POST", "http://hub.com/__auth__/",
+			strings.NewReader(url.Values{
+				"state":    {authURL.Query().Get("state")},
+				"email":    {email},
+				"password": {password},
+			}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		u, ret, err := Provider.Authenticate(ctx, r)
+		if err != nil {
+			return err
+		}
+
+		if u.Email != "ops@a.com" || ret.String() != "http://a.com/runbooks" {
+			t.Fatalf("unexpected user %+v returning to %s", u, ret)
+		}
+		return nil
+	}
+
+	if err := post("ops@a.com", "wrong"); err == nil {
+		t.Fatal("expected a wrong password to be rejected")
+	}
+
+	if err := post("b@a.com", "hunter2"); err == nil {
+		t.Fatal("expected an unknown user to be rejected")
+	}
+
+	if err := post(" OPS@a.com", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuthenticateThrottled(t *testing.T) {
+	filename := writeUsers(t, "ops@a.com:"+hunter2Hash+"\n")
+	defer os.RemoveAll(filepath.Dir(filename))
+
+	var cfg config.Info
+	if err := cfg.Read(strings.NewReader(`{
+		"host": "hub.com",
+		"oauth": {"provider": "local", "users-file": "` + filename + `"},
+		"routes": [{"from": "a.com", "to": "http://localhost:8080"}]
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &provider{
+		users:    map[string]map[string][]byte{},
+		throttle: newThrottle(),
+	}
+	if err := p.Validate(&cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := config.BuildContext(&cfg, 80, []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := auth.EncodeState(ctx, httptest.NewRequest("GET", "http://a.com/", nil))
+	post := func(email, password, addr string) error {
+		r := httptest.NewRequest("POST", "http://hub.com/__auth__/",
+			strings.NewReader(url.Values{
+				"state":    {state},
+				"email":    {email},
+				"password": {password},
+			}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = addr
+		_, _, err := p.Authenticate(ctx, r)
+		return err
+	}
+
+	for i := 0; i <= freeFailures; i++ {
+		if err := post("ops@a.com", "wrong", "10.0.0.1:1234"); err == nil {
+			t.Fatal("expected a wrong password to be rejected")
+		}
+	}
+
+	if err := post("ops@a.com", "hunter2", "10.0.0.2:1234"); err == nil {
+		t.Fatal("expected the right password to be refused while the email is throttled")
+	}
+
+	if err := post("b@a.com", "hunter2", "10.0.0.1:1234"); err == nil ||
+		!strings.Contains(err.Error(), "too many failed sign ins") {
+		t.Fatalf("expected the address to be throttled, got %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package local
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// freeFailures is the number of failed passwords that are allowed before sign ins
+	// are throttled.
+	freeFailures = 3
+
+	// minDelay is how long sign ins are refused after the first throttled failure.
+	// The delay doubles with each failure after that.
+	minDelay = time.Second
+
+	// maxDelay is the longest sign ins are ever refused for.
+	maxDelay = 15 * time.Minute
+)
+
+// failures are the consecutive failed passwords for an email or from an address.
+type failures struct {
+	count int
+	last  time.Time
+	until time.Time
+}
+
+// throttle refuses sign ins for an email or from an address that has recently failed
+// too many times, so that passwords cannot be guessed at the speed of bcrypt.
+type throttle struct {
+	lck       sync.Mutex
+	failures  map[string]*failures
+	lastSweep time.Time
+}
+
+func newThrottle() *throttle {
+	return &throttle{
+		failures: map[string]*failures{},
+	}
+}
+
+// wait is how much longer sign ins are refused for any of the keys.
+func (t *throttle) wait(now time.Time, keys ...string) time.Duration {
+	t.lck.Lock()
+	defer t.lck.Unlock()
+
+	var d time.Duration
+	for _, key := range keys {
+		if f := t.failures[key]; f != nil && f.until.Sub(now) > d {
+			d = f.until.Sub(now)
+		}
+	}
+	return d
+}
+
+// fail records a failed password for each of the keys.
+func (t *throttle) fail(now time.Time, keys ...string) {
+	t.lck.Lock()
+	defer t.lck.Unlock()
+
+	if now.Sub(t.lastSweep) >= maxDelay {
+		t.sweep(now)
+	}
+
+	for _, key := range keys {
+		f := t.failures[key]
+		if f == nil || now.Sub(f.last) >= maxDelay {
+			f = &failures{}
+			t.failures[key] = f
+		}
+
+		f.count++
+		f.last = now
+		if n := f.count - freeFailures; n > 0 {
+			d := maxDelay
+			if n <= 20 && minDelay<<uint(n-1) < maxDelay {
+				d = minDelay << uint(n-1)
+			}
+			f.until = now.Add(d)
+		}
+	}
+}
+
+// succeed forgets the failures of the key.
+func (t *throttle) succeed(key string) {
+	t.lck.Lock()
+	defer t.lck.Unlock()
+	delete(t.failures, key)
+}
+
+// sweep forgets the failures that are old enough to no longer count.
+func (t *throttle) sweep(now time.Time) {
+	for key, f := range t.failures {
+		if now.Sub(f.last) >= maxDelay && !now.Before(f.until) {
+			delete(t.failures, key)
+		}
+	}
+	t.lastSweep = now
+}
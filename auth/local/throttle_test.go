@@ -0,0 +1,53 @@
+package local
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	th := newThrottle()
+	now := time.Now()
+
+	for i := 0; i < freeFailures; i++ {
+		th.fail(now, "email:a@a.com", "ip:10.0.0.1")
+	}
+
+	if d := th.wait(now, "email:a@a.com", "ip:10.0.0.1"); d != 0 {
+		t.Fatalf("expected the first %d failures to be free, got a wait of %s", freeFailures, d)
+	}
+
+	th.fail(now, "email:a@a.com", "ip:10.0.0.1")
+	if d := th.wait(now, "email:a@a.com"); d != minDelay {
+		t.Fatalf("expected a wait of %s, got %s", minDelay, d)
+	}
+
+	th.fail(now, "email:a@a.com", "ip:10.0.0.1")
+	if d := th.wait(now, "email:b@a.com", "ip:10.0.0.1"); d != 2*minDelay {
+		t.Fatalf("expected the address to wait %s, got %s", 2*minDelay, d)
+	}
+
+	if d := th.wait(now, "email:b@a.com", "ip:10.0.0.2"); d != 0 {
+		t.Fatalf("expected other users and addresses not to wait, got %s", d)
+	}
+
+	for i := 0; i < 30; i++ {
+		th.fail(now, "email:a@a.com")
+	}
+
+	if d := th.wait(now, "email:a@a.com"); d != maxDelay {
+		t.Fatalf("expected the wait to be capped at %s, got %s", maxDelay, d)
+	}
+
+	th.succeed("email:a@a.com")
+	if d := th.wait(now, "email:a@a.com"); d != 0 {
+		t.Fatalf("expected a success to clear the failures, got %s", d)
+	}
+
+	// failures stop counting once they are old enough.
+	later := now.Add(maxDelay)
+	th.fail(later, "ip:10.0.0.1")
+	if d := th.wait(later, "ip:10.0.0.1"); d != 0 {
+		t.Fatalf("expected old failures to be forgotten, got %s", d)
+	}
+}
@@ -0,0 +1,267 @@
+package multi
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/kellegous/underpants/auth"
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/user"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// chooseCookieKey is the name of the cookie that remembers which provider the user
+	// chose while they are away signing in with it.
+	chooseCookieKey = "u_idp"
+
+	// chooseCookieMaxAge is the age (in seconds) of the choice cookie, which only needs
+	// to outlive a single sign in.
+	chooseCookieMaxAge = 600
+)
+
+var chooserTmpl = template.Must(template.New("chooser").Parse(`<!DOCTYPE html>
+<html>
+  <head>
+    <title>Sign in</title>
+  </head>
+  <body>
+    <h1>Sign in with</h1>
+    <ul>
+      {{range .}}
+      <li><a href="{{.URL}}">{{.Title}}</a></li>
+      {{end}}
+    </ul>
+  </body>
+</html>
+`))
+
+// idp is one of the configured identity providers.
+type idp struct {
+	info *config.IdPInfo
+	prv  auth.Provider
+}
+
+// Provider is an auth.Provider that lets users choose which of several identity
+// providers to sign in with. Routes may also be mapped to a specific provider, in which
+// case the choice is made for the user.
+type Provider struct {
+	idps   []*idp
+	byName map[string]*idp
+}
+
+// New creates a Provider for the providers in the config. The create function returns
+// the validated auth.Provider for a config whose Oauth is one of those providers.
+func New(cfg *config.Info, create func(cfg *config.Info) (auth.Provider, error)) (*Provider, error) {
+	p := &Provider{
+		byName: map[string]*idp{},
+	}
+
+	for _, info := range cfg.Providers {
+		c := *cfg
+		c.Oauth = info.OAuthInfo
+
+		prv, err := create(&c)
+		if err != nil {
+			return nil, fmt.Errorf("provider %s: %s", info.Name, err)
+		}
+
+		i := &idp{
+			info: info,
+			prv:  prv,
+		}
+		p.idps = append(p.idps, i)
+		p.byName[info.Name] = i
+	}
+
+	return p, nil
+}
+
+func choosePath() string {
+	return fmt.Sprintf("%schoose", auth.BaseURI)
+}
+
+// providerFor returns the name of the provider the route serving r requires, if any.
+func providerFor(ctx *config.Context, r *http.Request) string {
+	if route := ctx.RouteFor(r.Host, r.URL.Path); route != nil {
+		return route.Provider
+	}
+	return ""
+}
+
+// Validate ensures there is a provider to choose, each provider is validated by New.
+func (p *Provider) Validate(cfg *config.Info) error {
+	if len(p.idps) == 0 {
+		return errors.New("no providers are configured")
+	}
+	return nil
+}
+
+// Check determines if each of the identity providers can be reached.
+func (p *Provider) Check(ctx *config.Context, timeout time.Duration) error {
+	for _, i := range p.idps {
+		if err := auth.CheckReachable(
+			ctx.WithOAuth(&i.info.OAuthInfo),
+			i.prv,
+			timeout); err != nil {
+			return fmt.Errorf("provider %s: %s", i.info.Name, err)
+		}
+	}
+	return nil
+}
+
+// GetAuthURL sends the user to the chooser on the hub.
+func (p *Provider) GetAuthURL(ctx *config.Context, r *http.Request) string {
+	q := url.Values{
+		"u": {auth.GetCurrentURL(ctx, r).String()},
+	}
+
+	if name := providerFor(ctx, r); name != "" {
+		q.Set("p", name)
+	}
+
+	if auth.RequiresLogin(r) {
+		q.Set("login", "1")
+	}
+
+	return fmt.Sprintf("%s://%s%s?%s",
+		ctx.Scheme(),
+		ctx.Host(),
+		choosePath(),
+		q.Encode())
+}
+
+// Authenticate delegates to the provider the user chose.
+func (p *Provider) Authenticate(ctx *config.Context, r *http.Request) (*user.Info, *url.URL, error) {
+	c, err := r.Cookie(chooseCookieKey)
+	if err != nil {
+		return nil, nil, errors.New("no identity provider was chosen")
+	}
+
+	i := p.byName[c.Value]
+	if i == nil {
+		return nil, nil, fmt.Errorf("unknown identity provider: %s", c.Value)
+	}
+
+	u, ret, err := i.prv.Authenticate(ctx.WithOAuth(&i.info.OAuthInfo), r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if i.info.RequireVerifiedEmail && !u.EmailVerified {
+		return nil, nil, fmt.Errorf("email %s has not been verified", u.Email)
+	}
+
+	u.Provider = i.info.Name
+	return u, ret, nil
+}
+
+// Handlers serves the chooser along with the handlers of each of the providers.
+func (p *Provider) Handlers(ctx *config.Context) map[string]http.Handler {
+	hs := map[string]http.Handler{
+		choosePath(): http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p.serveChoose(ctx, w, r)
+		}),
+	}
+
+	for _, i := range p.idps {
+		if hp, ok := i.prv.(auth.HandlerProvider); ok {
+			for path, h := range hp.Handlers(ctx.WithOAuth(&i.info.OAuthInfo)) {
+				hs[path] = h
+			}
+		}
+	}
+
+	return hs
+}
+
+func (p *Provider) serveChoose(ctx *config.Context, w http.ResponseWriter, r *http.Request) {
+	back, err := url.Parse(r.FormValue("u"))
+	if err != nil || auth.CheckReturnURL(ctx, back) != nil {
+		http.Error(w,
+			http.StatusText(http.StatusBadRequest),
+			http.StatusBadRequest)
+		return
+	}
+
+	name := r.FormValue("p")
+	if name == "" && len(p.idps) == 1 {
+		name = p.idps[0].info.Name
+	}
+
+	if name == "" {
+		type choice struct {
+			Title string
+			URL   string
+		}
+
+		var choices []choice
+		for _, i := range p.idps {
+			q := url.Values{
+				"u": {back.String()},
+				"p": {i.info.Name},
+			}
+
+			if l := r.FormValue("login"); l != "" {
+				q.Set("login", l)
+			}
+
+			choices = append(choices, choice{
+				Title: i.info.Title,
+				URL:   fmt.Sprintf("%s?%s", choosePath(), q.Encode()),
+			})
+		}
+
+		w.Header().Set("Content-Type", "text/html;charset=utf-8")
+		if err := chooserTmpl.Execute(w, choices); err != nil {
+			zap.L().Error("unable to render provider chooser",
+				zap.Error(err))
+		}
+		return
+	}
+
+	i := p.byName[name]
+	if i == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	c := &http.Cookie{
+		Name:     chooseCookieKey,
+		Value:    i.info.Name,
+		Path:     auth.BaseURI,
+		MaxAge:   chooseCookieMaxAge,
+		HttpOnly: true,
+		Secure:   ctx.IsSecure(),
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	// identity providers that post back to the hub (SAML) are cross-site requests,
+	// which only carry the cookie if it is SameSite=None and so also Secure.
+	if ctx.IsSecure() {
+		c.SameSite = http.SameSiteNoneMode
+	}
+	http.SetCookie(w, c)
+
+	// the provider builds its auth URL as though the user were still on back.
+	br := &http.Request{
+		Host: back.Host,
+		URL: &url.URL{
+			Path:     back.Path,
+			RawQuery: back.RawQuery,
+		},
+	}
+
+	if r.FormValue("login") != "" {
+		br = auth.WithLogin(br)
+	}
+
+	http.Redirect(w, r,
+		i.prv.GetAuthURL(ctx.WithOAuth(&i.info.OAuthInfo), br),
+		http.StatusFound)
+}
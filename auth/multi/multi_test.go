@@ -0,0 +1,181 @@
+package multi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/kellegous/underpants/auth"
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/user"
+)
+
+// fakeProvider sends users to its base URL and authenticates them as an email on the
+// configured domain.
+type fakeProvider struct{}
+
+func (p *fakeProvider) Validate(cfg *config.Info) error {
+	return nil
+}
+
+func (p *fakeProvider) GetAuthURL(ctx *config.Context, r *http.Request) string {
+	return ctx.Oauth.BaseURL + "?state=" + url.QueryEscape(auth.GetCurrentURL(ctx, r).String())
+}
+
+func (p *fakeProvider) Authenticate(ctx *config.Context, r *http.Request) (*user.Info, *url.URL, error) {
+	ret, err := url.Parse(r.FormValue("state"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &user.Info{
+		Email:         "a@" + ctx.Oauth.Domain,
+		EmailVerified: true,
+	}, ret, nil
+}
+
+func newProvider(t *testing.T) (*config.Context, *Provider) {
+	var cfg config.Info
+	if err := cfg.Read(strings.NewReader(`{
+		"host": "hub.com",
+		"providers": [
+			{"name": "employees", "title": "Employees", "client-id": "id", "client-secret": "secret",
+				"base-url": "https://employees.com/auth", "domain": "employees.com"},
+			{"name": "contractors", "client-id": "id", "client-secret": "secret",
+				"base-url": "https://contractors.com/auth", "domain": "contractors.com"}
+		],
+		"routes": [
+			{"from": "a.com", "to": "http://localhost:8080"},
+			{"from": "b.com", "to": "http://localhost:8081", "provider": "contractors"},
+			{"from": "hub.com/wiki", "to": "http://localhost:8082", "provider": "contractors"},
+			{"from": "*.tools.com", "to": "http://localhost:8083", "provider": "employees"},
+			{"from": "x.tools.com/api", "to": "http://localhost:8084", "provider": "contractors"}
+		]
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := New(&cfg, func(cfg *config.Info) (auth.Provider, error) {
+		return &fakeProvider{}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := config.BuildContext(&cfg, 80, []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ctx, p
+}
+
+func TestGetAuthURL(t *testing.T) {
+	ctx, p := newProvider(t)
+
+	u, err := url.Parse(p.GetAuthURL(ctx, httptest.NewRequest("GET", "http://a.com/x", nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Host != "hub.com" || u.Path != "/__auth__/choose" {
+		t.Fatalf("expected to be sent to the chooser, got %s", u)
+	}
+
+	if q := u.Query(); q.Get("u") != "http://a.com/x" || q.Get("p") != "" {
+		t.Fatalf("unexpected query %s", u.RawQuery)
+	}
+
+	u, err = url.Parse(p.GetAuthURL(ctx, httptest.NewRequest("GET", "http://b.com/", nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if q := u.Query(); q.Get("p") != "contractors" {
+		t.Fatalf("expected route's provider to be chosen, got %s", u.RawQuery)
+	}
+
+	tests := []struct {
+		URL      string
+		Provider string
+	}{
+		{"http://hub.com/wiki/page", "contractors"},
+		{"http://hub.com/", ""},
+		{"http://z.tools.com/", "employees"},
+		{"http://y.tools.com:8080/", "employees"},
+		{"http://x.tools.com/api/v1", "contractors"},
+	}
+
+	for _, test := range tests {
+		u, err := url.Parse(p.GetAuthURL(ctx, httptest.NewRequest("GET", test.URL, nil)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if q := u.Query(); q.Get("p") != test.Provider {
+			t.Fatalf("expected provider %q for %s, got %s", test.Provider, test.URL, u.RawQuery)
+		}
+	}
+
+	u, err = url.Parse(p.GetAuthURL(ctx,
+		auth.WithLogin(httptest.NewRequest("GET", "http://a.com/x", nil))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if q := u.Query(); q.Get("login") != "1" {
+		t.Fatalf("expected login to be passed to the chooser, got %s", u.RawQuery)
+	}
+}
+
+func TestChoose(t *testing.T) {
+	ctx, p := newProvider(t)
+	h := p.Handlers(ctx)["/__auth__/choose"]
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET",
+		"http://hub.com/__auth__/choose?u=http%3A%2F%2Fa.com%2Fx", nil))
+	if w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), ">Employees<") ||
+		!strings.Contains(w.Body.String(), ">contractors<") {
+		t.Fatalf("expected chooser page, got %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET",
+		"http://hub.com/__auth__/choose?u=http%3A%2F%2Fa.com%2Fx&p=contractors", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected redirect, got %d", w.Code)
+	}
+
+	if loc := w.Header().Get("Location"); loc != "https://contractors.com/auth?state=http%3A%2F%2Fa.com%2Fx" {
+		t.Fatalf("unexpected redirect to %s", loc)
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != chooseCookieKey {
+		t.Fatal("expected choice to be remembered")
+	}
+
+	r := httptest.NewRequest("GET", "http://hub.com/__auth__/?state=http%3A%2F%2Fa.com%2Fx", nil)
+	r.AddCookie(cookies[0])
+	u, ret, err := p.Authenticate(ctx, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Email != "a@contractors.com" || u.Provider != "contractors" {
+		t.Fatalf("unexpected user %+v", u)
+	}
+
+	if ret.String() != "http://a.com/x" {
+		t.Fatalf("unexpected return url %s", ret)
+	}
+
+	r = httptest.NewRequest("GET", "http://hub.com/__auth__/?state=http%3A%2F%2Fa.com%2Fx", nil)
+	if _, _, err := p.Authenticate(ctx, r); err == nil {
+		t.Fatal("expected authentication without a choice to fail")
+	}
+}
@@ -0,0 +1,250 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/kellegous/underpants/auth"
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/user"
+
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+)
+
+// Name is the name for this provider as used in config.Info.
+const Name = "oidc"
+
+// Provider is the auth.Provider for any OpenID Connect compliant identity provider.
+var Provider = &provider{
+	docs: map[string]*discovery{},
+}
+
+// discovery is the subset of the OpenID Connect discovery document that is used.
+type discovery struct {
+	AuthURL     string `json:"authorization_endpoint"`
+	TokenURL    string `json:"token_endpoint"`
+	UserInfoURL string `json:"userinfo_endpoint"`
+}
+
+type provider struct {
+	lck  sync.Mutex
+	docs map[string]*discovery
+}
+
+// discover returns the endpoints for the configured provider. Endpoints that are
+// given explicitly in the config take precedence over the discovery document, which
+// is only fetched if needed and is cached once it has been fetched successfully.
+func (p *provider) discover(ctx *config.Context) (*discovery, error) {
+	o := &ctx.Oauth
+	if o.AuthURL != "" && o.TokenURL != "" && o.UserInfoURL != "" {
+		return &discovery{
+			AuthURL:     o.AuthURL,
+			TokenURL:    o.TokenURL,
+			UserInfoURL: o.UserInfoURL,
+		}, nil
+	}
+
+	p.lck.Lock()
+	defer p.lck.Unlock()
+
+	d := p.docs[o.Issuer]
+	if d == nil {
+		var err error
+		d, err = fetchDiscovery(o.Issuer)
+		if err != nil {
+			return nil, err
+		}
+		p.docs[o.Issuer] = d
+	}
+
+	res := *d
+	if o.AuthURL != "" {
+		res.AuthURL = o.AuthURL
+	}
+	if o.TokenURL != "" {
+		res.TokenURL = o.TokenURL
+	}
+	if o.UserInfoURL != "" {
+		res.UserInfoURL = o.UserInfoURL
+	}
+	return &res, nil
+}
+
+func fetchDiscovery(issuer string) (*discovery, error) {
+	res, err := http.Get(fmt.Sprintf("%s/.well-known/openid-configuration", issuer))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery document for %s returned status %d",
+			issuer,
+			res.StatusCode)
+	}
+
+	var d discovery
+	if err := json.NewDecoder(res.Body).Decode(&d); err != nil {
+		return nil, err
+	}
+
+	if d.AuthURL == "" || d.TokenURL == "" || d.UserInfoURL == "" {
+		return nil, fmt.Errorf("discovery document for %s is missing endpoints", issuer)
+	}
+
+	return &d, nil
+}
+
+func configFor(ctx *config.Context, d *discovery) *oauth2.Config {
+	scopes := ctx.Oauth.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "profile", "email"}
+	}
+
+	return &oauth2.Config{
+		ClientID:     ctx.Oauth.ClientID,
+		ClientSecret: ctx.Oauth.ClientSecret,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  d.AuthURL,
+			TokenURL: d.TokenURL,
+		},
+		Scopes: scopes,
+		RedirectURL: fmt.Sprintf("%s://%s%s",
+			ctx.Scheme(),
+			ctx.Host(),
+			auth.BaseURI),
+	}
+}
+
+// claim returns the named claim, or the standard claim if no name is configured.
+func claim(claims map[string]interface{}, name, std string) interface{} {
+	if name == "" {
+		name = std
+	}
+	return claims[name]
+}
+
+func stringClaim(claims map[string]interface{}, name, std string) string {
+	s, _ := claim(claims, name, std).(string)
+	return s
+}
+
+func boolClaim(claims map[string]interface{}, name, std string) bool {
+	switch v := claim(claims, name, std).(type) {
+	case bool:
+		return v
+	case string:
+		// some providers encode booleans as strings.
+		return v == "true"
+	}
+	return false
+}
+
+// userFromClaims maps the userinfo claims to a user according to the config.
+func userFromClaims(m *config.ClaimsInfo, claims map[string]interface{}) *user.Info {
+	return &user.Info{
+		Email:         stringClaim(claims, m.Email, "email"),
+		EmailVerified: boolClaim(claims, m.EmailVerified, "email_verified"),
+		Name:          stringClaim(claims, m.Name, "name"),
+		Picture:       stringClaim(claims, m.Picture, "picture"),
+	}
+}
+
+func fetchUser(ctx *config.Context, d *discovery, c *http.Client) (*user.Info, error) {
+	res, err := c.Get(d.UserInfoURL)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var claims map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&claims); err != nil {
+		return nil, err
+	}
+
+	u := userFromClaims(&ctx.Oauth.Claims, claims)
+	if u.Email == "" {
+		return nil, errors.New("userinfo did not include an email")
+	}
+
+	return u, nil
+}
+
+func (p *provider) Validate(cfg *config.Info) error {
+	o := &cfg.Oauth
+	if o.Issuer == "" && (o.AuthURL == "" || o.TokenURL == "" || o.UserInfoURL == "") {
+		return errors.New("the oidc provider requires an issuer or all of auth-url, token-url and userinfo-url")
+	}
+	return nil
+}
+
+func (p *provider) GetAuthURL(ctx *config.Context, r *http.Request) string {
+	d, err := p.discover(ctx)
+	if err != nil {
+		zap.L().Error("unable to discover oidc endpoints",
+			zap.String("issuer", ctx.Oauth.Issuer),
+			zap.Error(err))
+
+		// without endpoints there is nowhere to send the user, so send them to the
+		// hub's callback which will fail to authenticate them.
+		return fmt.Sprintf("%s://%s%s", ctx.Scheme(), ctx.Host(), auth.BaseURI)
+	}
+
+	var opts []oauth2.AuthCodeOption
+	if auth.RequiresLogin(r) {
+		opts = append(opts,
+			oauth2.SetAuthURLParam("prompt", "login"),
+			oauth2.SetAuthURLParam("max_age", "0"))
+	}
+
+	return configFor(ctx, d).AuthCodeURL(
+		auth.EncodeState(ctx, r), opts...)
+}
+
+func (p *provider) Authenticate(ctx *config.Context, r *http.Request) (*user.Info, *url.URL, error) {
+	state := r.FormValue("state")
+	if state == "" {
+		return nil, nil, errors.New("state parameter is missing")
+	}
+
+	st, err := auth.ParseState(ctx, state)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg := configFor(ctx, d)
+
+	code := r.FormValue("code")
+	if code == "" {
+		return nil, nil, errors.New("code parameter is missing")
+	}
+
+	tok, err := cfg.Exchange(context.Background(), code)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	u, err := fetchUser(ctx, d, cfg.Client(context.Background(), tok))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// a user asked to sign in again must have done so after being sent to the provider.
+	u.LastSignIn = auth.IDTokenAuthTime(tok)
+	if err := st.CheckSignIn(u.LastSignIn); err != nil {
+		return nil, nil, err
+	}
+
+	return u, st.Return, nil
+}
@@ -0,0 +1,93 @@
+package oidc
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/kellegous/underpants/config"
+)
+
+func TestAuthURLFromDiscovery(t *testing.T) {
+	var s *httptest.Server
+	s = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/openid-configuration" {
+			http.NotFound(w, r)
+			return
+		}
+
+		fmt.Fprintf(w, `{
+			"authorization_endpoint": "%[1]s/authorize",
+			"token_endpoint": "%[1]s/token",
+			"userinfo_endpoint": "%[1]s/userinfo"
+		}`, s.URL)
+	}))
+	defer s.Close()
+
+	ctx := &config.Context{
+		Info: &config.Info{
+			Oauth: config.OAuthInfo{
+				ClientID:     "client_id",
+				ClientSecret: "client_secret",
+				Issuer:       s.URL,
+				Scopes:       []string{"openid", "email"},
+			},
+			Host: "foo.com",
+		},
+		Port: 9090,
+	}
+
+	r := &http.Request{
+		Host: "boo.com:9090",
+		URL: &url.URL{
+			Path: "/",
+		},
+	}
+
+	authURL, err := url.Parse(
+		Provider.GetAuthURL(ctx, r))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := authURL.Scheme + "://" + authURL.Host + authURL.Path; got != s.URL+"/authorize" {
+		t.Fatalf("expected url to be %s/authorize got %s", s.URL, got)
+	}
+
+	vals := authURL.Query()
+	if vals.Get("scope") != "openid email" {
+		t.Fatalf("expected scope of openid email got %s", vals.Get("scope"))
+	}
+
+	if vals.Get("redirect_uri") != "http://foo.com:9090/__auth__/" {
+		t.Fatalf("unexpected redirect_uri %s", vals.Get("redirect_uri"))
+	}
+}
+
+func TestUserFromClaims(t *testing.T) {
+	claims := map[string]interface{}{
+		"email":          "a@a.com",
+		"email_verified": "true",
+		"preferred_name": "A",
+		"name":           "B",
+	}
+
+	u := userFromClaims(&config.ClaimsInfo{Name: "preferred_name"}, claims)
+	if u.Email != "a@a.com" || !u.EmailVerified || u.Name != "A" {
+		t.Fatalf("unexpected user %+v", u)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Provider.Validate(&config.Info{}); err == nil {
+		t.Fatal("expected error without issuer or endpoints")
+	}
+
+	if err := Provider.Validate(&config.Info{
+		Oauth: config.OAuthInfo{Issuer: "https://a.com"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
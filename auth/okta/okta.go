@@ -53,8 +53,9 @@ func fetchUser(ctx *config.Context, c *http.Client) (*user.Info, error) {
 	defer res.Body.Close()
 
 	var u struct {
-		Name  string `json:"name"`
-		Email string `json:"email"`
+		Name          string `json:"name"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
 	}
 
 	if err := json.NewDecoder(res.Body).Decode(&u); err != nil {
@@ -62,8 +63,9 @@ func fetchUser(ctx *config.Context, c *http.Client) (*user.Info, error) {
 	}
 
 	return &user.Info{
-		Email: u.Email,
-		Name:  u.Name,
+		Email:         u.Email,
+		EmailVerified: u.EmailVerified,
+		Name:          u.Name,
 	}, nil
 }
 
@@ -75,8 +77,15 @@ func (p *provider) Validate(cfg *config.Info) error {
 }
 
 func (p *provider) GetAuthURL(ctx *config.Context, r *http.Request) string {
+	var opts []oauth2.AuthCodeOption
+	if auth.RequiresLogin(r) {
+		opts = append(opts,
+			oauth2.SetAuthURLParam("prompt", "login"),
+			oauth2.SetAuthURLParam("max_age", "0"))
+	}
+
 	return configFor(ctx).AuthCodeURL(
-		auth.GetCurrentURL(ctx, r).String())
+		auth.EncodeState(ctx, r), opts...)
 }
 
 func (p *provider) Authenticate(ctx *config.Context, r *http.Request) (*user.Info, *url.URL, error) {
@@ -85,9 +94,9 @@ func (p *provider) Authenticate(ctx *config.Context, r *http.Request) (*user.Inf
 		return nil, nil, errors.New("state parameter is missing")
 	}
 
-	ret, err := url.Parse(state)
+	st, err := auth.ParseState(ctx, state)
 	if err != nil {
-		return nil, nil, errors.New("invalid return URL")
+		return nil, nil, err
 	}
 
 	cfg := configFor(ctx)
@@ -107,5 +116,11 @@ func (p *provider) Authenticate(ctx *config.Context, r *http.Request) (*user.Inf
 		return nil, nil, err
 	}
 
-	return u, ret, nil
+	// okta reports when the user last signed in through the ID token's auth_time.
+	u.LastSignIn = auth.IDTokenAuthTime(tok)
+	if err := st.CheckSignIn(u.LastSignIn); err != nil {
+		return nil, nil, err
+	}
+
+	return u, st.Return, nil
 }
@@ -7,6 +7,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/kellegous/underpants/auth"
 	"github.com/kellegous/underpants/config"
 )
 
@@ -18,7 +19,8 @@ func TestAuthURL(t *testing.T) {
 				ClientSecret: "client_secret",
 				BaseURL:      "https://oktapreview.com",
 			},
-			Host: "foo.com",
+			Host:   "foo.com",
+			Routes: []*config.RouteInfo{{From: "boo.com"}},
 		},
 		Port: 9090,
 	}
@@ -47,7 +49,6 @@ func TestAuthURL(t *testing.T) {
 				"email",
 			}, " "),
 		},
-		"state": {"http://boo.com:9090/"},
 	}
 
 	for param, exp := range toVerify {
@@ -61,6 +62,11 @@ func TestAuthURL(t *testing.T) {
 			vals[param])
 	}
 
+	if ret, err := auth.DecodeState(ctx, vals.Get("state")); err != nil ||
+		ret.String() != "http://boo.com:9090/" {
+		t.Fatalf("expected state for http://boo.com:9090/, got %s", vals.Get("state"))
+	}
+
 	if authURL.Host != "oktapreview.com" {
 		t.Fatalf("expected url to have host of oktapreview.com got %s",
 			authURL.Host)
@@ -1,10 +1,12 @@
 package auth
 
 import (
+	"context"
 	"net/http"
 	"net/url"
 
 	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/internal"
 	"github.com/kellegous/underpants/user"
 )
 
@@ -21,10 +23,46 @@ type Provider interface {
 	Authenticate(ctx *config.Context, r *http.Request) (*user.Info, *url.URL, error)
 }
 
+// HandlerProvider is implemented by providers that need to serve endpoints of their
+// own on the hub, in addition to the shared callback at BaseURI. The handlers are
+// keyed by path.
+type HandlerProvider interface {
+	Handlers(ctx *config.Context) map[string]http.Handler
+}
+
+// Refresher is implemented by providers that can re-validate a user without an
+// interactive sign in, using the refresh token they returned in user.Info when the
+// user last signed in. The refreshed user carries a new refresh token only if the
+// provider rotated it.
+type Refresher interface {
+	Refresh(ctx *config.Context, token string) (*user.Info, error)
+}
+
+// loginKey is the context key that marks requests whose user must enter their
+// credentials with the identity provider.
+type loginKey struct{}
+
+// WithLogin marks the request as one whose user must enter their credentials with the
+// identity provider, rather than be let through on a session they already have with
+// it. Providers that support it ask for a fresh login in the auth URL they build for
+// the request.
+func WithLogin(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), loginKey{}, true))
+}
+
+// RequiresLogin determines if the request was marked by WithLogin.
+func RequiresLogin(r *http.Request) bool {
+	v, _ := r.Context().Value(loginKey{}).(bool)
+	return v
+}
+
 // GetCurrentURL returns the URL for the current request.
 func GetCurrentURL(ctx *config.Context, r *http.Request) *url.URL {
 	u := *r.URL
 	u.Host = r.Host
 	u.Scheme = ctx.Scheme()
+	if s := internal.ForwardedScheme(r); s != "" {
+		u.Scheme = s
+	}
 	return &u
 }
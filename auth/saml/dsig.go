@@ -0,0 +1,157 @@
+package saml
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	algExcC14N      = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	algEnveloped    = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	algRSASHA1      = "http://www.w3.org/2000/09/xmldsig#rsa-sha1"
+	algRSASHA256    = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	algDigestSHA1   = "http://www.w3.org/2000/09/xmldsig#sha1"
+	algDigestSHA256 = "http://www.w3.org/2001/04/xmlenc#sha256"
+)
+
+// hashFor returns the hash for a signature or digest algorithm.
+func hashFor(alg string) (crypto.Hash, error) {
+	switch alg {
+	case algRSASHA256, algDigestSHA256:
+		return crypto.SHA256, nil
+	case algRSASHA1, algDigestSHA1:
+		return crypto.SHA1, nil
+	}
+	return 0, fmt.Errorf("unsupported algorithm: %s", alg)
+}
+
+func digest(h crypto.Hash, b []byte) []byte {
+	switch h {
+	case crypto.SHA1:
+		s := sha1.Sum(b)
+		return s[:]
+	default:
+		s := sha256.Sum256(b)
+		return s[:]
+	}
+}
+
+// inclusivePrefixes returns the InclusiveNamespaces PrefixList of a transform or
+// canonicalization method element.
+func inclusivePrefixes(e *element) []string {
+	if in := e.child(nsExcNS, "InclusiveNamespaces"); in != nil {
+		return strings.Fields(in.attr("PrefixList"))
+	}
+	return nil
+}
+
+func decodeBase64(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+}
+
+// verifySignature verifies the enveloped signature of an element against the given
+// certificate. Only a single reference to the element itself is accepted, so the
+// content that is verified is always the content that will be used.
+func verifySignature(e *element, cert *x509.Certificate) error {
+	sig := e.child(nsDSig, "Signature")
+	if sig == nil {
+		return errors.New("element is not signed")
+	}
+
+	si := sig.child(nsDSig, "SignedInfo")
+	if si == nil {
+		return errors.New("signature has no SignedInfo")
+	}
+
+	cm := si.child(nsDSig, "CanonicalizationMethod")
+	if cm == nil || cm.attr("Algorithm") != algExcC14N {
+		return errors.New("unsupported canonicalization method")
+	}
+
+	sm := si.child(nsDSig, "SignatureMethod")
+	if sm == nil {
+		return errors.New("signature has no SignatureMethod")
+	}
+
+	sigHash, err := hashFor(sm.attr("Algorithm"))
+	if err != nil {
+		return err
+	}
+
+	refs := si.childrenNamed(nsDSig, "Reference")
+	if len(refs) != 1 {
+		return errors.New("signature must have exactly one reference")
+	}
+	ref := refs[0]
+
+	id := e.attr("ID")
+	if id == "" || ref.attr("URI") != "#"+id {
+		return errors.New("signature does not reference the signed element")
+	}
+
+	var inclusive []string
+	if ts := ref.child(nsDSig, "Transforms"); ts != nil {
+		for _, t := range ts.childrenNamed(nsDSig, "Transform") {
+			switch t.attr("Algorithm") {
+			case algEnveloped:
+			case algExcC14N:
+				inclusive = inclusivePrefixes(t)
+			default:
+				return fmt.Errorf("unsupported transform: %s", t.attr("Algorithm"))
+			}
+		}
+	}
+
+	dm := ref.child(nsDSig, "DigestMethod")
+	if dm == nil {
+		return errors.New("reference has no DigestMethod")
+	}
+
+	digestHash, err := hashFor(dm.attr("Algorithm"))
+	if err != nil {
+		return err
+	}
+
+	dv := ref.child(nsDSig, "DigestValue")
+	if dv == nil {
+		return errors.New("reference has no DigestValue")
+	}
+
+	expected, err := decodeBase64(dv.text())
+	if err != nil {
+		return err
+	}
+
+	actual := digest(digestHash, canonicalize(e, sig, inclusive))
+	if subtle.ConstantTimeCompare(expected, actual) != 1 {
+		return errors.New("digest does not match")
+	}
+
+	sv := sig.child(nsDSig, "SignatureValue")
+	if sv == nil {
+		return errors.New("signature has no SignatureValue")
+	}
+
+	sigValue, err := decodeBase64(sv.text())
+	if err != nil {
+		return err
+	}
+
+	key, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("only RSA certificates are supported")
+	}
+
+	return rsa.VerifyPKCS1v15(key,
+		sigHash,
+		digest(sigHash, canonicalize(si, nil, inclusivePrefixes(cm))),
+		sigValue)
+}
@@ -0,0 +1,525 @@
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kellegous/underpants/auth"
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/user"
+
+	"go.uber.org/zap"
+)
+
+// Name is the name for this provider as used in config.Info.
+const Name = "saml"
+
+const (
+	nsProtocol  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	nsAssertion = "urn:oasis:names:tc:SAML:2.0:assertion"
+
+	bindingPOST       = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	statusSuccess     = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	methodBearer      = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+	nameIDEmailFormat = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+)
+
+// clockSkew is the allowance given to the identity provider's clock when checking the
+// validity period of an assertion.
+const clockSkew = 90 * time.Second
+
+// Provider is the auth.Provider for SAML 2.0 identity providers.
+var Provider = &provider{
+	certs: map[string]*x509.Certificate{},
+	seen:  map[string]time.Time{},
+}
+
+type provider struct {
+	lck sync.Mutex
+
+	// certs holds the identity provider certificates by the filename they were loaded
+	// from.
+	certs map[string]*x509.Certificate
+
+	// seen holds the ids of assertions that have been used along with their expiry so
+	// that a captured response cannot be replayed.
+	seen map[string]time.Time
+}
+
+// acsURL is the URL of the assertion consumer service. It lives under auth.BaseURI so
+// it is served by the hub's shared callback.
+func acsURL(ctx *config.Context) string {
+	return fmt.Sprintf("%s://%s%ssaml/acs", ctx.Scheme(), ctx.Host(), auth.BaseURI)
+}
+
+func metadataPath() string {
+	return fmt.Sprintf("%ssaml/metadata", auth.BaseURI)
+}
+
+// entityID is the entity id of underpants as a service provider.
+func entityID(ctx *config.Context) string {
+	if id := ctx.Oauth.SAML.EntityID; id != "" {
+		return id
+	}
+	return fmt.Sprintf("%s://%s%s", ctx.Scheme(), ctx.Host(), metadataPath())
+}
+
+func newID() (string, error) {
+	var b [20]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	// xml ids may not start with a digit.
+	return "_" + hex.EncodeToString(b[:]), nil
+}
+
+func loadCertificate(filename string) (*x509.Certificate, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	blk, _ := pem.Decode(b)
+	if blk == nil || blk.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%s does not contain a PEM certificate", filename)
+	}
+
+	return x509.ParseCertificate(blk.Bytes)
+}
+
+func (p *provider) Validate(cfg *config.Info) error {
+	s := &cfg.Oauth.SAML
+	if s.IdPSSOURL == "" {
+		return errors.New("the saml provider requires an idp-sso-url")
+	}
+
+	if u, err := url.Parse(s.IdPSSOURL); err != nil ||
+		(u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid idp-sso-url: %s, must be an absolute http(s) URL", s.IdPSSOURL)
+	}
+
+	if s.IdPCert == "" {
+		return errors.New("the saml provider requires an idp-cert")
+	}
+
+	cert, err := loadCertificate(s.IdPCert)
+	if err != nil {
+		return err
+	}
+
+	p.lck.Lock()
+	defer p.lck.Unlock()
+	p.certs[s.IdPCert] = cert
+	return nil
+}
+
+type authnRequest struct {
+	XMLName      xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
+	ID           string   `xml:",attr"`
+	Version      string   `xml:",attr"`
+	IssueInstant string   `xml:",attr"`
+	Destination  string   `xml:",attr"`
+	ACSURL       string   `xml:"AssertionConsumerServiceURL,attr"`
+	Binding      string   `xml:"ProtocolBinding,attr"`
+	ForceAuthn   bool     `xml:",attr,omitempty"`
+	Issuer       string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	NameIDPolicy struct {
+		Format      string `xml:",attr"`
+		AllowCreate bool   `xml:",attr"`
+	} `xml:"NameIDPolicy"`
+}
+
+// authURL builds the HTTP-Redirect binding URL of an AuthnRequest. With force, the
+// IdP is asked to have the user enter their credentials again.
+func authURL(ctx *config.Context, relayState string, force bool) (string, error) {
+	id, err := newID()
+	if err != nil {
+		return "", err
+	}
+
+	req := authnRequest{
+		ID:           id,
+		Version:      "2.0",
+		IssueInstant: time.Now().UTC().Format(time.RFC3339),
+		Destination:  ctx.Oauth.SAML.IdPSSOURL,
+		ACSURL:       acsURL(ctx),
+		Binding:      bindingPOST,
+		Issuer:       entityID(ctx),
+		ForceAuthn:   force,
+	}
+	req.NameIDPolicy.Format = nameIDEmailFormat
+	req.NameIDPolicy.AllowCreate = true
+
+	var b bytes.Buffer
+	w, err := flate.NewWriter(&b, flate.DefaultCompression)
+	if err != nil {
+		return "", err
+	}
+
+	if err := xml.NewEncoder(w).Encode(&req); err != nil {
+		return "", err
+	}
+
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(ctx.Oauth.SAML.IdPSSOURL)
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+	q.Set("SAMLRequest", base64.StdEncoding.EncodeToString(b.Bytes()))
+	q.Set("RelayState", relayState)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+func (p *provider) GetAuthURL(ctx *config.Context, r *http.Request) string {
+	u, err := authURL(ctx, auth.EncodeState(ctx, r), auth.RequiresLogin(r))
+	if err != nil {
+		zap.L().Error("unable to create saml authn request",
+			zap.String("idp-sso-url", ctx.Oauth.SAML.IdPSSOURL),
+			zap.Error(err))
+
+		// without a request there is nothing to send the user to the IdP with, so send
+		// them to the hub's callback which will fail to authenticate them.
+		return fmt.Sprintf("%s://%s%s", ctx.Scheme(), ctx.Host(), auth.BaseURI)
+	}
+	return u
+}
+
+func parseTime(s string) (time.Time, error) {
+	return time.Parse(time.RFC3339, strings.TrimSpace(s))
+}
+
+// authnInstant is when the IdP reports that the user signed in, or the zero time if
+// the assertion does not say.
+func authnInstant(a *element) time.Time {
+	s := a.child(nsAssertion, "AuthnStatement")
+	if s == nil {
+		return time.Time{}
+	}
+
+	t, err := parseTime(s.attr("AuthnInstant"))
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// checkWindow ensures that now falls within the optional NotBefore and NotOnOrAfter
+// attributes of e.
+func checkWindow(e *element, now time.Time) error {
+	if v := e.attr("NotBefore"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			return err
+		}
+		if now.Add(clockSkew).Before(t) {
+			return errors.New("assertion is not yet valid")
+		}
+	}
+
+	if v := e.attr("NotOnOrAfter"); v != "" {
+		t, err := parseTime(v)
+		if err != nil {
+			return err
+		}
+		if !now.Add(-clockSkew).Before(t) {
+			return errors.New("assertion has expired")
+		}
+	}
+
+	return nil
+}
+
+// attribute returns the first value of the named attribute of the assertion.
+func attribute(a *element, name string) string {
+	for _, st := range a.childrenNamed(nsAssertion, "AttributeStatement") {
+		for _, at := range st.childrenNamed(nsAssertion, "Attribute") {
+			if at.attr("Name") != name {
+				continue
+			}
+			if v := at.child(nsAssertion, "AttributeValue"); v != nil {
+				return strings.TrimSpace(v.text())
+			}
+		}
+	}
+	return ""
+}
+
+// assertionFrom returns the single assertion in the response once the response's
+// status and the signature covering the assertion have been verified.
+func assertionFrom(res *element, cert *x509.Certificate) (*element, error) {
+	if cert == nil {
+		return nil, errors.New("no identity provider certificate is configured")
+	}
+
+	if !res.is(nsProtocol, "Response") {
+		return nil, errors.New("document is not a SAML response")
+	}
+
+	var status string
+	if st := res.child(nsProtocol, "Status"); st != nil {
+		if sc := st.child(nsProtocol, "StatusCode"); sc != nil {
+			status = sc.attr("Value")
+		}
+	}
+	if status != statusSuccess {
+		return nil, fmt.Errorf("identity provider returned status %q", status)
+	}
+
+	as := res.childrenNamed(nsAssertion, "Assertion")
+	if len(as) != 1 {
+		return nil, errors.New("response must contain exactly one assertion")
+	}
+	a := as[0]
+
+	// either the assertion or the response that encloses it must be signed and any
+	// signature that is present must be valid.
+	signed := false
+	for _, e := range []*element{res, a} {
+		if e.child(nsDSig, "Signature") == nil {
+			continue
+		}
+		if err := verifySignature(e, cert); err != nil {
+			return nil, err
+		}
+		signed = true
+	}
+
+	if !signed {
+		return nil, errors.New("assertion is not signed")
+	}
+
+	return a, nil
+}
+
+// userFromAssertion validates the conditions and subject of the assertion and returns
+// the user it describes.
+func userFromAssertion(ctx *config.Context, a *element, now time.Time) (*user.Info, error) {
+	s := &ctx.Oauth.SAML
+
+	if s.IdPIssuer != "" {
+		iss := a.child(nsAssertion, "Issuer")
+		if iss == nil || strings.TrimSpace(iss.text()) != s.IdPIssuer {
+			return nil, errors.New("assertion has an unexpected issuer")
+		}
+	}
+
+	cnd := a.child(nsAssertion, "Conditions")
+	if cnd == nil {
+		return nil, errors.New("assertion has no conditions")
+	}
+
+	if err := checkWindow(cnd, now); err != nil {
+		return nil, err
+	}
+
+	// every audience restriction must include this service provider.
+	eid := entityID(ctx)
+	for _, ar := range cnd.childrenNamed(nsAssertion, "AudienceRestriction") {
+		ok := false
+		for _, au := range ar.childrenNamed(nsAssertion, "Audience") {
+			if strings.TrimSpace(au.text()) == eid {
+				ok = true
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("assertion is not intended for %s", eid)
+		}
+	}
+
+	sub := a.child(nsAssertion, "Subject")
+	if sub == nil {
+		return nil, errors.New("assertion has no subject")
+	}
+
+	confirmed := false
+	for _, sc := range sub.childrenNamed(nsAssertion, "SubjectConfirmation") {
+		if sc.attr("Method") != methodBearer {
+			continue
+		}
+
+		scd := sc.child(nsAssertion, "SubjectConfirmationData")
+		if scd == nil || scd.attr("Recipient") != acsURL(ctx) {
+			continue
+		}
+
+		if checkWindow(scd, now) == nil {
+			confirmed = true
+		}
+	}
+
+	if !confirmed {
+		return nil, errors.New("assertion has no valid bearer confirmation")
+	}
+
+	var email string
+	if s.EmailAttribute != "" {
+		email = attribute(a, s.EmailAttribute)
+	} else if n := sub.child(nsAssertion, "NameID"); n != nil {
+		email = strings.TrimSpace(n.text())
+	}
+
+	if email == "" {
+		return nil, errors.New("assertion did not include an email")
+	}
+
+	name := email
+	if s.NameAttribute != "" {
+		if n := attribute(a, s.NameAttribute); n != "" {
+			name = n
+		}
+	}
+
+	return &user.Info{
+		Email: email,
+		// the identity provider is the authority for its users' addresses.
+		EmailVerified: true,
+		Name:          name,
+	}, nil
+}
+
+// checkReplay records the assertion's id and fails if it has been seen before.
+func (p *provider) checkReplay(a *element, now time.Time) error {
+	id := a.attr("ID")
+	if id == "" {
+		return errors.New("assertion has no id")
+	}
+
+	// ids are remembered until the assertion would have expired anyway.
+	exp := now.Add(time.Hour)
+	if cnd := a.child(nsAssertion, "Conditions"); cnd != nil {
+		if t, err := parseTime(cnd.attr("NotOnOrAfter")); err == nil {
+			exp = t.Add(clockSkew)
+		}
+	}
+
+	p.lck.Lock()
+	defer p.lck.Unlock()
+
+	for k, t := range p.seen {
+		if now.After(t) {
+			delete(p.seen, k)
+		}
+	}
+
+	if _, ok := p.seen[id]; ok {
+		return errors.New("assertion has already been used")
+	}
+
+	p.seen[id] = exp
+	return nil
+}
+
+func (p *provider) Authenticate(ctx *config.Context, r *http.Request) (*user.Info, *url.URL, error) {
+	if r.Method != "POST" {
+		return nil, nil, errors.New("responses must use the HTTP-POST binding")
+	}
+
+	st, err := auth.ParseState(ctx, r.PostFormValue("RelayState"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b, err := base64.StdEncoding.DecodeString(r.PostFormValue("SAMLResponse"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res, err := parseXML(bytes.NewReader(b))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if d := res.attr("Destination"); d != "" && d != acsURL(ctx) {
+		return nil, nil, fmt.Errorf("response was sent to %s", d)
+	}
+
+	p.lck.Lock()
+	cert := p.certs[ctx.Oauth.SAML.IdPCert]
+	p.lck.Unlock()
+
+	a, err := assertionFrom(res, cert)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+
+	u, err := userFromAssertion(ctx, a, now)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := p.checkReplay(a, now); err != nil {
+		return nil, nil, err
+	}
+
+	// with ForceAuthn, the IdP must not have let the user through on an earlier sign in.
+	u.LastSignIn = authnInstant(a)
+	if err := st.CheckSignIn(u.LastSignIn); err != nil {
+		return nil, nil, err
+	}
+
+	return u, st.Return, nil
+}
+
+type entityDescriptor struct {
+	XMLName  xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+	EntityID string   `xml:"entityID,attr"`
+	SP       struct {
+		AuthnRequestsSigned  bool   `xml:",attr"`
+		WantAssertionsSigned bool   `xml:",attr"`
+		Protocols            string `xml:"protocolSupportEnumeration,attr"`
+		NameIDFormat         string
+		ACS                  struct {
+			Binding  string `xml:",attr"`
+			Location string `xml:",attr"`
+			Index    int    `xml:"index,attr"`
+		} `xml:"AssertionConsumerService"`
+	} `xml:"SPSSODescriptor"`
+}
+
+// Handlers serves the service provider metadata that is needed to register underpants
+// with the identity provider.
+func (p *provider) Handlers(ctx *config.Context) map[string]http.Handler {
+	return map[string]http.Handler{
+		metadataPath(): http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var md entityDescriptor
+			md.EntityID = entityID(ctx)
+			md.SP.WantAssertionsSigned = true
+			md.SP.Protocols = nsProtocol
+			md.SP.NameIDFormat = nameIDEmailFormat
+			md.SP.ACS.Binding = bindingPOST
+			md.SP.ACS.Location = acsURL(ctx)
+
+			w.Header().Set("Content-Type", "application/samlmetadata+xml")
+			if _, err := w.Write([]byte(xml.Header)); err != nil {
+				return
+			}
+
+			if err := xml.NewEncoder(w).Encode(&md); err != nil {
+				zap.L().Error("unable to write saml metadata",
+					zap.Error(err))
+			}
+		}),
+	}
+}
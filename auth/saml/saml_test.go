@@ -0,0 +1,372 @@
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kellegous/underpants/auth"
+	"github.com/kellegous/underpants/config"
+)
+
+func newCert(t *testing.T) (*rsa.PrivateKey, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "idp"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key, cert
+}
+
+func newContext() *config.Context {
+	return &config.Context{
+		Info: &config.Info{
+			Oauth: config.OAuthInfo{
+				Provider: Name,
+				SAML: config.SAMLInfo{
+					IdPSSOURL:     "https://idp.com/sso?tenant=a",
+					IdPIssuer:     "https://idp.com/",
+					NameAttribute: "displayName",
+				},
+			},
+			Host:   "foo.com",
+			Routes: []*config.RouteInfo{{From: "bar.com"}},
+		},
+		Port: 80,
+	}
+}
+
+// relayState is the RelayState that is sent to the identity provider for rawURL.
+func relayState(ctx *config.Context, rawURL string) string {
+	return auth.EncodeState(ctx, httptest.NewRequest("GET", rawURL, nil))
+}
+
+// newProvider creates a provider that trusts cert for the context's identity provider.
+func newProvider(ctx *config.Context, cert *x509.Certificate) *provider {
+	p := &provider{
+		certs: map[string]*x509.Certificate{},
+		seen:  map[string]time.Time{},
+	}
+	if cert != nil {
+		p.certs[ctx.Oauth.SAML.IdPCert] = cert
+	}
+	return p
+}
+
+const responseTmpl = `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_r1" Version="2.0" Destination="http://foo.com/__auth__/saml/acs">
+  <saml:Issuer xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion">https://idp.com/</saml:Issuer>
+  <samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></samlp:Status>
+  <saml:Assertion xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" xmlns:xs="http://www.w3.org/2001/XMLSchema" ID="%[1]s" Version="2.0">
+    <saml:Issuer>https://idp.com/</saml:Issuer>
+    <ds:Signature xmlns:ds="http://www.w3.org/2000/09/xmldsig#">
+      <ds:SignedInfo>
+        <ds:CanonicalizationMethod Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"/>
+        <ds:SignatureMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"/>
+        <ds:Reference URI="#%[1]s">
+          <ds:Transforms>
+            <ds:Transform Algorithm="http://www.w3.org/2000/09/xmldsig#enveloped-signature"/>
+            <ds:Transform Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"><ec:InclusiveNamespaces xmlns:ec="http://www.w3.org/2001/10/xml-exc-c14n#" PrefixList="xs"/></ds:Transform>
+          </ds:Transforms>
+          <ds:DigestMethod Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"/>
+          <ds:DigestValue>DIGEST</ds:DigestValue>
+        </ds:Reference>
+      </ds:SignedInfo>
+      <ds:SignatureValue>SIGNATURE</ds:SignatureValue>
+    </ds:Signature>
+    <saml:Subject>
+      <saml:NameID Format="urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress">%[2]s</saml:NameID>
+      <saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer">
+        <saml:SubjectConfirmationData NotOnOrAfter="%[4]s" Recipient="http://foo.com/__auth__/saml/acs"/>
+      </saml:SubjectConfirmation>
+    </saml:Subject>
+    <saml:Conditions NotBefore="%[3]s" NotOnOrAfter="%[4]s">
+      <saml:AudienceRestriction><saml:Audience>http://foo.com/__auth__/saml/metadata</saml:Audience></saml:AudienceRestriction>
+    </saml:Conditions>
+    <saml:AuthnStatement AuthnInstant="%[5]s"/>
+    <saml:AttributeStatement>
+      <saml:Attribute Name="displayName"><saml:AttributeValue xsi:type="xs:string" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">A &amp; B</saml:AttributeValue></saml:Attribute>
+    </saml:AttributeStatement>
+  </saml:Assertion>
+</samlp:Response>`
+
+// signedResponse builds a response for email whose assertion is signed with key.
+func signedResponse(t *testing.T, key *rsa.PrivateKey, id, email string) string {
+	return signedResponseAt(t, key, id, email, time.Now())
+}
+
+// signedResponseAt builds a signed response for email, who signed in at signedIn.
+func signedResponseAt(t *testing.T, key *rsa.PrivateKey, id, email string, signedIn time.Time) string {
+	now := time.Now().UTC()
+	doc := fmt.Sprintf(responseTmpl,
+		id,
+		email,
+		now.Add(-time.Minute).Format(time.RFC3339),
+		now.Add(5*time.Minute).Format(time.RFC3339),
+		signedIn.UTC().Format(time.RFC3339))
+
+	assertion := func(doc string) *element {
+		res, err := parseXML(strings.NewReader(doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.child(nsAssertion, "Assertion")
+	}
+
+	a := assertion(doc)
+	sig := a.child(nsDSig, "Signature")
+	d := sha256.Sum256(canonicalize(a, sig, []string{"xs"}))
+	doc = strings.Replace(doc, "DIGEST", base64.StdEncoding.EncodeToString(d[:]), 1)
+
+	si := assertion(doc).child(nsDSig, "Signature").child(nsDSig, "SignedInfo")
+	h := sha256.Sum256(canonicalize(si, nil, nil))
+	s, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.Replace(doc, "SIGNATURE", base64.StdEncoding.EncodeToString(s), 1)
+}
+
+func postResponse(doc, relayState string) *http.Request {
+	r := httptest.NewRequest("POST", "http://foo.com/__auth__/saml/acs",
+		strings.NewReader(url.Values{
+			"SAMLResponse": {base64.StdEncoding.EncodeToString([]byte(doc))},
+			"RelayState":   {relayState},
+		}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func TestCanonicalize(t *testing.T) {
+	e, err := parseXML(strings.NewReader(
+		`<a:x xmlns:a="urn:a" xmlns:b="urn:b" z="1" b:y="2" a:y="3"><b:c xmlns:a="urn:a">t&amp;&lt;</b:c><d/></a:x>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `<a:x xmlns:a="urn:a" xmlns:b="urn:b" z="1" a:y="3" b:y="2"><b:c>t&amp;&lt;</b:c><d></d></a:x>`
+	if got := string(canonicalize(e, nil, nil)); got != expected {
+		t.Fatalf("expected %s got %s", expected, got)
+	}
+
+	c := e.child("urn:b", "c")
+	expected = `<b:c xmlns:b="urn:b">t&amp;&lt;</b:c>`
+	if got := string(canonicalize(c, nil, nil)); got != expected {
+		t.Fatalf("expected %s got %s", expected, got)
+	}
+
+	expected = `<b:c xmlns:a="urn:a" xmlns:b="urn:b">t&amp;&lt;</b:c>`
+	if got := string(canonicalize(c, nil, []string{"a"})); got != expected {
+		t.Fatalf("expected %s got %s", expected, got)
+	}
+}
+
+func TestParseRejectsDirectives(t *testing.T) {
+	if _, err := parseXML(strings.NewReader(
+		`<!DOCTYPE x [<!ENTITY e "boom">]><x>&e;</x>`)); err == nil {
+		t.Fatal("expected document with a DTD to be rejected")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	key, cert := newCert(t)
+	ctx := newContext()
+	p := newProvider(ctx, cert)
+
+	doc := signedResponse(t, key, "_a1", "a@foo.com")
+
+	u, ret, err := p.Authenticate(ctx, postResponse(doc, relayState(ctx, "http://bar.com/x?y=z")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Email != "a@foo.com" || u.Name != "A & B" || !u.EmailVerified {
+		t.Fatalf("unexpected user %+v", u)
+	}
+
+	if ret.String() != "http://bar.com/x?y=z" {
+		t.Fatalf("unexpected return url %s", ret)
+	}
+
+	if _, _, err := p.Authenticate(ctx, postResponse(doc, relayState(ctx, "http://bar.com/"))); err == nil {
+		t.Fatal("expected replayed assertion to be rejected")
+	}
+}
+
+func TestAuthenticateWithLogin(t *testing.T) {
+	key, cert := newCert(t)
+	ctx := newContext()
+	p := newProvider(ctx, cert)
+
+	state := auth.EncodeState(ctx,
+		auth.WithLogin(httptest.NewRequest("GET", "http://bar.com/admin/", nil)))
+
+	stale := signedResponseAt(t, key, "_a1", "a@foo.com", time.Now().Add(-time.Hour))
+	if _, _, err := p.Authenticate(ctx, postResponse(stale, state)); err == nil {
+		t.Fatal("expected an earlier sign in to be refused")
+	}
+
+	signedIn := time.Now().Truncate(time.Second)
+	fresh := signedResponseAt(t, key, "_a2", "a@foo.com", signedIn)
+	u, _, err := p.Authenticate(ctx, postResponse(fresh, state))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !u.LastSignIn.Equal(signedIn) {
+		t.Fatalf("expected the user to have signed in at %s, got %s", signedIn, u.LastSignIn)
+	}
+}
+
+func TestAuthenticateRejectsTampering(t *testing.T) {
+	key, cert := newCert(t)
+	other, _ := newCert(t)
+	ctx := newContext()
+
+	tests := map[string]string{
+		"modified subject": strings.Replace(
+			signedResponse(t, key, "_a1", "a@foo.com"),
+			"a@foo.com", "evil@foo.com", 1),
+		"wrong key": signedResponse(t, other, "_a2", "a@foo.com"),
+		"unsigned": strings.Replace(
+			signedResponse(t, key, "_a3", "a@foo.com"),
+			"ds:Signature", "ds:Unsigned", 2),
+		"wrong audience": strings.Replace(
+			signedResponse(t, key, "_a4", "a@foo.com"),
+			"/__auth__/saml/metadata", "/other", 1),
+	}
+
+	for name, doc := range tests {
+		p := newProvider(ctx, cert)
+		if _, _, err := p.Authenticate(ctx, postResponse(doc, relayState(ctx, "http://bar.com/"))); err == nil {
+			t.Fatalf("%s: expected response to be rejected", name)
+		}
+	}
+}
+
+func TestGetAuthURL(t *testing.T) {
+	ctx := newContext()
+
+	r := &http.Request{
+		Host: "bar.com",
+		URL: &url.URL{
+			Path: "/x",
+		},
+	}
+
+	u, err := url.Parse(Provider.GetAuthURL(ctx, r))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := u.Query()
+	if u.Host != "idp.com" || q.Get("tenant") != "a" {
+		t.Fatalf("unexpected auth url %s", u)
+	}
+
+	if ret, err := auth.DecodeState(ctx, q.Get("RelayState")); err != nil || ret.String() != "http://bar.com/x" {
+		t.Fatalf("unexpected RelayState %s", q.Get("RelayState"))
+	}
+
+	b, err := base64.StdEncoding.DecodeString(q.Get("SAMLRequest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Contains(req, []byte(`AssertionConsumerServiceURL="http://foo.com/__auth__/saml/acs"`)) {
+		t.Fatalf("unexpected request %s", req)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	_, cert := newCert(t)
+
+	dir, err := ioutil.TempDir("", "saml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "idp.pem")
+	if err := ioutil.WriteFile(filename, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: cert.Raw,
+	}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := newContext().Info
+	cfg.Oauth.SAML.IdPCert = filename
+
+	p := newProvider(newContext(), nil)
+	if err := p.Validate(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	if !p.certs[filename].Equal(cert) {
+		t.Fatal("expected certificate to be loaded")
+	}
+
+	for _, bad := range []string{
+		"",
+		"idp.com/sso",
+		"/sso",
+		"ftp://idp.com/sso",
+		"https://%zz/sso",
+	} {
+		cfg.Oauth.SAML.IdPSSOURL = bad
+		if err := p.Validate(cfg); err == nil {
+			t.Fatalf("expected idp-sso-url %q to be rejected", bad)
+		}
+	}
+}
+
+func TestGetAuthURLInvalid(t *testing.T) {
+	ctx := newContext()
+	ctx.Oauth.SAML.IdPSSOURL = "https://%zz/sso"
+
+	u := Provider.GetAuthURL(ctx, httptest.NewRequest("GET", "http://bar.com/x", nil))
+	if u != "http://foo.com/__auth__/" {
+		t.Fatalf("expected the hub's callback, got %s", u)
+	}
+}
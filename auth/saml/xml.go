@@ -0,0 +1,295 @@
+package saml
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+)
+
+const (
+	nsXML   = "http://www.w3.org/XML/1998/namespace"
+	nsDSig  = "http://www.w3.org/2000/09/xmldsig#"
+	nsExcNS = "http://www.w3.org/2001/10/xml-exc-c14n#"
+)
+
+// attr is an attribute of an element, excluding namespace declarations.
+type attr struct {
+	prefix, local, value string
+}
+
+// element is a node in a minimal DOM that, unlike encoding/xml, retains the namespace
+// prefixes and declarations needed for canonicalization.
+type element struct {
+	prefix, local string
+	attrs         []attr
+
+	// ns holds the namespace declarations made on this element, the default
+	// namespace has the empty prefix.
+	ns map[string]string
+
+	// children holds *element and text (string) nodes. Comments and processing
+	// instructions are dropped since they are not part of the canonical form that
+	// is signed.
+	children []interface{}
+
+	parent *element
+}
+
+// parseXML parses a document into an element tree.
+func parseXML(r io.Reader) (*element, error) {
+	d := xml.NewDecoder(r)
+
+	var root, cur *element
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			e := &element{
+				prefix: t.Name.Space,
+				local:  t.Name.Local,
+				ns:     map[string]string{},
+				parent: cur,
+			}
+
+			for _, a := range t.Attr {
+				switch {
+				case a.Name.Space == "xmlns":
+					e.ns[a.Name.Local] = a.Value
+				case a.Name.Space == "" && a.Name.Local == "xmlns":
+					e.ns[""] = a.Value
+				default:
+					e.attrs = append(e.attrs, attr{a.Name.Space, a.Name.Local, a.Value})
+				}
+			}
+
+			if cur == nil {
+				if root != nil {
+					return nil, errors.New("document has multiple root elements")
+				}
+				root = e
+			} else {
+				cur.children = append(cur.children, e)
+			}
+			cur = e
+		case xml.EndElement:
+			if cur == nil {
+				return nil, errors.New("unbalanced end element")
+			}
+			cur = cur.parent
+		case xml.CharData:
+			if cur != nil {
+				cur.children = append(cur.children, string(t))
+			}
+		case xml.Directive:
+			// DTDs are a vector for entity expansion and signature confusion.
+			return nil, errors.New("documents with directives are not allowed")
+		}
+	}
+
+	if root == nil {
+		return nil, errors.New("empty document")
+	}
+
+	return root, nil
+}
+
+// lookupNS resolves a prefix to its namespace URI in the scope of the element.
+func (e *element) lookupNS(prefix string) string {
+	if prefix == "xml" {
+		return nsXML
+	}
+
+	for n := e; n != nil; n = n.parent {
+		if uri, ok := n.ns[prefix]; ok {
+			return uri
+		}
+	}
+	return ""
+}
+
+// is determines if the element has the given namespace URI and local name.
+func (e *element) is(ns, local string) bool {
+	return e.local == local && e.lookupNS(e.prefix) == ns
+}
+
+// attr returns the value of an unqualified attribute.
+func (e *element) attr(local string) string {
+	for _, a := range e.attrs {
+		if a.prefix == "" && a.local == local {
+			return a.value
+		}
+	}
+	return ""
+}
+
+// childrenNamed returns the child elements with the given namespace and local name.
+func (e *element) childrenNamed(ns, local string) []*element {
+	var res []*element
+	for _, c := range e.children {
+		if c, ok := c.(*element); ok && c.is(ns, local) {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// child returns the first child element with the given namespace and local name.
+func (e *element) child(ns, local string) *element {
+	if c := e.childrenNamed(ns, local); len(c) > 0 {
+		return c[0]
+	}
+	return nil
+}
+
+// text returns the concatenated text content of the element's immediate children.
+func (e *element) text() string {
+	var b strings.Builder
+	for _, c := range e.children {
+		if s, ok := c.(string); ok {
+			b.WriteString(s)
+		}
+	}
+	return b.String()
+}
+
+var textEscaper = strings.NewReplacer(
+	"&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+	"\r", "&#xD;")
+
+var attrEscaper = strings.NewReplacer(
+	"&", "&amp;",
+	"<", "&lt;",
+	"\"", "&quot;",
+	"\t", "&#x9;",
+	"\n", "&#xA;",
+	"\r", "&#xD;")
+
+// canonicalize serializes the element according to Exclusive XML Canonicalization
+// (without comments). The exclude element, if any, is omitted from the output which
+// implements the enveloped signature transform. Prefixes in inclusive (the
+// InclusiveNamespaces PrefixList) are rendered whenever they are in scope, as they
+// would be by inclusive canonicalization.
+func canonicalize(e, exclude *element, inclusive []string) []byte {
+	var b bytes.Buffer
+	writeCanonical(&b, e, exclude, map[string]string{}, inclusive)
+	return b.Bytes()
+}
+
+func writeCanonical(
+	b *bytes.Buffer,
+	e, exclude *element,
+	rendered map[string]string,
+	inclusive []string) {
+	// determine the namespaces this element visibly utilizes.
+	used := map[string]bool{e.prefix: true}
+	for _, a := range e.attrs {
+		if a.prefix != "" && a.prefix != "xml" {
+			used[a.prefix] = true
+		}
+	}
+	for _, p := range inclusive {
+		if p == "#default" {
+			p = ""
+		}
+		used[p] = true
+	}
+
+	var decls []string
+	scope := map[string]string{}
+	for p, v := range rendered {
+		scope[p] = v
+	}
+
+	for p := range used {
+		uri := e.lookupNS(p)
+		prev, ok := rendered[p]
+		if p == "" && uri == "" && !ok {
+			// the empty default namespace is never declared unless it overrides one
+			// that was rendered.
+			continue
+		}
+		if ok && prev == uri {
+			continue
+		}
+		if p != "" && uri == "" {
+			continue
+		}
+		scope[p] = uri
+		decls = append(decls, p)
+	}
+	sort.Strings(decls)
+
+	b.WriteByte('<')
+	writeQName(b, e.prefix, e.local)
+
+	for _, p := range decls {
+		if p == "" {
+			b.WriteString(` xmlns="`)
+		} else {
+			b.WriteString(` xmlns:`)
+			b.WriteString(p)
+			b.WriteString(`="`)
+		}
+		b.WriteString(attrEscaper.Replace(scope[p]))
+		b.WriteByte('"')
+	}
+
+	attrs := make([]attr, len(e.attrs))
+	copy(attrs, e.attrs)
+	sort.Slice(attrs, func(i, j int) bool {
+		ni, nj := "", ""
+		if attrs[i].prefix != "" {
+			ni = e.lookupNS(attrs[i].prefix)
+		}
+		if attrs[j].prefix != "" {
+			nj = e.lookupNS(attrs[j].prefix)
+		}
+		if ni != nj {
+			return ni < nj
+		}
+		return attrs[i].local < attrs[j].local
+	})
+
+	for _, a := range attrs {
+		b.WriteByte(' ')
+		writeQName(b, a.prefix, a.local)
+		b.WriteString(`="`)
+		b.WriteString(attrEscaper.Replace(a.value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('>')
+
+	for _, c := range e.children {
+		switch c := c.(type) {
+		case string:
+			b.WriteString(textEscaper.Replace(c))
+		case *element:
+			if c != exclude {
+				writeCanonical(b, c, exclude, scope, inclusive)
+			}
+		}
+	}
+
+	b.WriteString("</")
+	writeQName(b, e.prefix, e.local)
+	b.WriteByte('>')
+}
+
+func writeQName(b *bytes.Buffer, prefix, local string) {
+	if prefix != "" {
+		b.WriteString(prefix)
+		b.WriteByte(':')
+	}
+	b.WriteString(local)
+}
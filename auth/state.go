@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kellegous/underpants/config"
+)
+
+// stateMaxAge is how long users have to sign in with the identity provider before the
+// state it sends back is no longer accepted.
+const stateMaxAge = 30 * time.Minute
+
+// signInSkew is how far the identity provider's clock may be behind ours when it
+// reports when the user signed in.
+const signInSkew = time.Minute
+
+// State is what a state parameter created by EncodeState carries back from the
+// identity provider.
+type State struct {
+	// Return is the URL the user is returned to.
+	Return *url.URL
+
+	// Issued is when the user was sent to the identity provider.
+	Issued time.Time
+
+	// Login is set if the user was asked to enter their credentials again.
+	Login bool
+}
+
+// EncodeState creates the state parameter that identity providers send back after the
+// user signs in. It holds the URL of the current request, which the user is returned
+// to, and whether the request was marked by WithLogin, signed with an expiry so that
+// it cannot be forged or replayed later.
+func EncodeState(ctx *config.Context, r *http.Request) string {
+	return encodeState(ctx, GetCurrentURL(ctx, r).String(),
+		RequiresLogin(r), time.Now().Add(stateMaxAge))
+}
+
+func encodeState(ctx *config.Context, ret string, login bool, exp time.Time) string {
+	var flags string
+	if login {
+		flags = "login"
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(
+		[]byte(fmt.Sprintf("%d|%s|%s", exp.Unix(), flags, ret)))
+	return payload + "." + signState(ctx, payload)
+}
+
+// DecodeState verifies a state parameter created by EncodeState and returns the URL
+// the user is returned to, which must be on the hub or one of the routes.
+func DecodeState(ctx *config.Context, state string) (*url.URL, error) {
+	s, err := ParseState(ctx, state)
+	if err != nil {
+		return nil, err
+	}
+	return s.Return, nil
+}
+
+// ParseState verifies a state parameter created by EncodeState and returns all that it
+// carries.
+func ParseState(ctx *config.Context, state string) (*State, error) {
+	ix := strings.LastIndexByte(state, '.')
+	if ix < 0 {
+		return nil, errors.New("state parameter is malformed")
+	}
+
+	payload, sig := state[:ix], state[ix+1:]
+	if !hmac.Equal([]byte(sig), []byte(signState(ctx, payload))) {
+		return nil, errors.New("state parameter has an invalid signature")
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errors.New("state parameter is malformed")
+	}
+
+	parts := strings.SplitN(string(b), "|", 3)
+	if len(parts) != 3 {
+		return nil, errors.New("state parameter is malformed")
+	}
+
+	exp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, errors.New("state parameter is malformed")
+	}
+
+	if time.Now().Unix() > exp {
+		return nil, errors.New("state parameter has expired")
+	}
+
+	ret, err := url.Parse(parts[2])
+	if err != nil {
+		return nil, errors.New("invalid return URL")
+	}
+
+	if err := CheckReturnURL(ctx, ret); err != nil {
+		return nil, err
+	}
+
+	return &State{
+		Return: ret,
+		Issued: time.Unix(exp, 0).Add(-stateMaxAge),
+		Login:  parts[1] == "login",
+	}, nil
+}
+
+// CheckSignIn returns an error if the user was asked to enter their credentials again
+// but the identity provider reports that they last did so, at signedIn, before they
+// were sent to it. A zero signedIn means the provider did not report it, which is
+// only accepted when no login was asked for.
+func (s *State) CheckSignIn(signedIn time.Time) error {
+	if !s.Login {
+		return nil
+	}
+
+	if signedIn.IsZero() {
+		return errors.New("identity provider did not report when the user signed in")
+	}
+
+	if signedIn.Before(s.Issued.Add(-signInSkew)) {
+		return fmt.Errorf("identity provider reused a sign in from %s",
+			signedIn.UTC().Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// CheckReturnURL ensures that users are only ever sent back to the hub or one of the
+// routes after signing in.
+func CheckReturnURL(ctx *config.Context, u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid return URL scheme: %s", u.Scheme)
+	}
+
+	if !ctx.IsKnownHost(u.Host) {
+		return fmt.Errorf("invalid return URL host: %s", u.Host)
+	}
+
+	return nil
+}
+
+// signState is the signature of a state parameter's payload.
+func signState(ctx *config.Context, payload string) string {
+	m := hmac.New(sha256.New, ctx.Key)
+	m.Write([]byte("state|"))
+	m.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
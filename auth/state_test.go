@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kellegous/underpants/config"
+)
+
+func TestState(t *testing.T) {
+	ctx := &config.Context{
+		Info: &config.Info{
+			Host: "hub.com",
+			Routes: []*config.RouteInfo{
+				{From: "a.com"},
+				{From: "*.tools.com"},
+			},
+		},
+		Port: 80,
+		Key:  []byte("key"),
+	}
+
+	for _, raw := range []string{
+		"http://a.com/x?y=z",
+		"http://hub.com/",
+		"http://pr-1.tools.com/",
+	} {
+		ret, err := DecodeState(ctx, EncodeState(ctx, httptest.NewRequest("GET", raw, nil)))
+		if err != nil {
+			t.Fatalf("expected state for %s to be accepted, got %s", raw, err)
+		}
+
+		if ret.String() != raw {
+			t.Fatalf("expected %s, got %s", raw, ret)
+		}
+	}
+
+	future := time.Now().Add(time.Hour)
+	other := &config.Context{Info: ctx.Info, Key: []byte("other")}
+	for name, state := range map[string]string{
+		"unsigned":     "http://a.com/",
+		"unknown host": encodeState(ctx, "http://evil.com/", false, future),
+		"bad scheme":   encodeState(ctx, "javascript://a.com/", false, future),
+		"expired":      encodeState(ctx, "http://a.com/", false, time.Now().Add(-time.Minute)),
+		"wrong key":    encodeState(other, "http://a.com/", false, future),
+	} {
+		if _, err := DecodeState(ctx, state); err == nil {
+			t.Fatalf("%s: expected state to be rejected", name)
+		}
+	}
+}
+
+func TestStateLogin(t *testing.T) {
+	ctx := &config.Context{
+		Info: &config.Info{
+			Host:   "hub.com",
+			Routes: []*config.RouteInfo{{From: "a.com"}},
+		},
+		Port: 80,
+		Key:  []byte("key"),
+	}
+
+	r := httptest.NewRequest("GET", "http://a.com/admin/", nil)
+
+	s, err := ParseState(ctx, EncodeState(ctx, r))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Login {
+		t.Fatal("expected no login to be asked for")
+	}
+
+	if err := s.CheckSignIn(time.Time{}); err != nil {
+		t.Fatalf("expected any sign in to be accepted, got %s", err)
+	}
+
+	s, err = ParseState(ctx, EncodeState(ctx, WithLogin(r)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.Login {
+		t.Fatal("expected a login to be asked for")
+	}
+
+	if s.Return.String() != "http://a.com/admin/" {
+		t.Fatalf("expected http://a.com/admin/, got %s", s.Return)
+	}
+
+	now := time.Now()
+	for name, test := range map[string]struct {
+		SignedIn time.Time
+		Accepted bool
+	}{
+		"fresh":      {now, true},
+		"skewed":     {now.Add(-30 * time.Second), true},
+		"stale":      {now.Add(-time.Hour), false},
+		"unreported": {time.Time{}, false},
+	} {
+		if err := s.CheckSignIn(test.SignedIn); (err == nil) != test.Accepted {
+			t.Fatalf("%s: expected accepted to be %t, got %v", name, test.Accepted, err)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package authz
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kellegous/underpants/user"
+)
+
+// Request is the body posted to the webhook for each request that needs a decision.
+type Request struct {
+	User   RequestUser `json:"user"`
+	Route  string      `json:"route"`
+	Method string      `json:"method"`
+	Path   string      `json:"path"`
+}
+
+// RequestUser is the identity of the user making the request.
+type RequestUser struct {
+	Email    string `json:"email"`
+	Name     string `json:"name"`
+	Provider string `json:"provider,omitempty"`
+}
+
+// Decision is the body the webhook responds with.
+type Decision struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason"`
+}
+
+type entry struct {
+	decision *Decision
+	expires  time.Time
+}
+
+// Webhook asks an external service whether a user may make a request. Decisions are
+// cached for a TTL keyed by the user, route, method and path.
+type Webhook struct {
+	url string
+	c   *http.Client
+	ttl time.Duration
+
+	lck    sync.Mutex
+	cache  map[Request]*entry
+	hits   uint64
+	misses uint64
+}
+
+// NewWebhook creates a Webhook that posts to url, waiting at most timeout for a
+// decision and caching decisions for ttl.
+func NewWebhook(url string, timeout, ttl time.Duration) *Webhook {
+	return &Webhook{
+		url: url,
+		c: &http.Client{
+			Timeout: timeout,
+		},
+		ttl:   ttl,
+		cache: map[Request]*entry{},
+	}
+}
+
+func (w *Webhook) fetch(req *Request) (*Decision, error) {
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(req); err != nil {
+		return nil, err
+	}
+
+	res, err := w.c.Post(w.url, "application/json", &b)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("authorization webhook returned status %d", res.StatusCode)
+	}
+
+	var d Decision
+	if err := json.NewDecoder(res.Body).Decode(&d); err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+// CacheStats reports the number of decisions that were answered from the cache and
+// the number that called the webhook.
+func (w *Webhook) CacheStats() (hits, misses uint64) {
+	w.lck.Lock()
+	defer w.lck.Unlock()
+	return w.hits, w.misses
+}
+
+// Decide returns the webhook's decision on whether the user may make the request.
+func (w *Webhook) Decide(u *user.Info, route, method, path string) (*Decision, error) {
+	req := Request{
+		User: RequestUser{
+			Email:    u.Email,
+			Name:     u.Name,
+			Provider: u.Provider,
+		},
+		Route:  route,
+		Method: method,
+		Path:   path,
+	}
+
+	now := time.Now()
+
+	w.lck.Lock()
+	e := w.cache[req]
+	hit := e != nil && now.Before(e.expires)
+	if hit {
+		w.hits++
+	} else {
+		w.misses++
+	}
+	w.lck.Unlock()
+
+	if hit {
+		return e.decision, nil
+	}
+
+	d, err := w.fetch(&req)
+	if err != nil {
+		return nil, err
+	}
+
+	if w.ttl <= 0 {
+		return d, nil
+	}
+
+	w.lck.Lock()
+	defer w.lck.Unlock()
+
+	for k, v := range w.cache {
+		if !now.Before(v.expires) {
+			delete(w.cache, k)
+		}
+	}
+
+	w.cache[req] = &entry{
+		decision: d,
+		expires:  now.Add(w.ttl),
+	}
+
+	return d, nil
+}
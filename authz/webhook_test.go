@@ -0,0 +1,68 @@
+package authz
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kellegous/underpants/user"
+)
+
+func TestDecide(t *testing.T) {
+	calls := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+
+		var req Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatal(err)
+		}
+
+		json.NewEncoder(w).Encode(&Decision{
+			Allow:  req.User.Email == "a@a.com" && req.Method == "GET",
+			Reason: "nope",
+		})
+	}))
+	defer s.Close()
+
+	wh := NewWebhook(s.URL, time.Second, time.Minute)
+
+	tests := []struct {
+		Email, Method string
+		Allow         bool
+	}{
+		{"a@a.com", "GET", true},
+		{"a@a.com", "POST", false},
+		{"b@a.com", "GET", false},
+		{"a@a.com", "GET", true},
+	}
+
+	for _, test := range tests {
+		d, err := wh.Decide(&user.Info{Email: test.Email}, "a.com", test.Method, "/x")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if d.Allow != test.Allow {
+			t.Fatalf("%s %s: expected allow to be %t", test.Email, test.Method, test.Allow)
+		}
+	}
+
+	if calls != 3 {
+		t.Fatalf("expected repeated decision to be cached, got %d calls", calls)
+	}
+}
+
+func TestDecideFails(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	defer s.Close()
+
+	wh := NewWebhook(s.URL, time.Second, time.Minute)
+	if _, err := wh.Decide(&user.Info{Email: "a@a.com"}, "a.com", "GET", "/"); err == nil {
+		t.Fatal("expected an error from a failing webhook")
+	}
+}
@@ -1,161 +1,3795 @@
 package config
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+const (
+	// SessionStoreCookie is the session store that keeps all state in the cookie.
+	SessionStoreCookie = "cookie"
+
+	// SessionStoreMemory is the session store that keeps state in process memory.
+	SessionStoreMemory = "memory"
+
+	// SessionStoreRedis is the session store that keeps state in Redis.
+	SessionStoreRedis = "redis"
+)
+
+const (
+	// CookieCollisionRename renames backend cookies that collide with the session
+	// cookie, and restores their names on requests to the backend.
+	CookieCollisionRename = "rename"
+
+	// CookieCollisionDrop drops backend cookies that collide with the session cookie.
+	CookieCollisionDrop = "drop"
+
+	// CookieCollisionRefuse fails backend responses that try to set a cookie that
+	// collides with the session cookie.
+	CookieCollisionRefuse = "refuse"
+)
+
+const (
+	// UnknownHostsNotFound answers requests to hosts that are neither the hub nor
+	// routed with a 404.
+	UnknownHostsNotFound = "not-found"
+
+	// UnknownHostsRedirect redirects requests to hosts that are neither the hub nor
+	// routed to the hub's page.
+	UnknownHostsRedirect = "redirect"
+)
+
+const (
+	// BalanceRoundRobin sends requests to each of a route's backends in turn.
+	BalanceRoundRobin = "round-robin"
+
+	// BalanceLeastConnections sends requests to the backend with the fewest requests
+	// in progress.
+	BalanceLeastConnections = "least-connections"
+)
+
+const (
+	// AffinityCookie pins each client to a backend with a cookie.
+	AffinityCookie = "cookie"
+
+	// AffinityEmail pins each user to a backend by consistently hashing their email
+	// address.
+	AffinityEmail = "email"
+)
+
+const (
+	// BackendProtocolAuto uses HTTP/2 with https backends that support it and
+	// HTTP/1.1 otherwise.
+	BackendProtocolAuto = "auto"
+
+	// BackendProtocolHTTP1 always uses HTTP/1.1.
+	BackendProtocolHTTP1 = "http1"
+
+	// BackendProtocolH2 always uses HTTP/2 over TLS.
+	BackendProtocolH2 = "h2"
+
+	// BackendProtocolH2C always uses HTTP/2 over cleartext TCP, with prior knowledge.
+	BackendProtocolH2C = "h2c"
+)
+
+const (
+	// AccessLogCombined writes the access log in the combined log format.
+	AccessLogCombined = "combined"
+
+	// AccessLogJSON writes the access log as a JSON object per line.
+	AccessLogJSON = "json"
+)
+
+const (
+	// LogFormatJSON writes the log as a JSON object per line.
+	LogFormatJSON = "json"
+
+	// LogFormatConsole writes the log as human readable lines.
+	LogFormatConsole = "console"
+)
+
+// logLevels are the valid levels of the log.
+var logLevels = map[string]bool{
+	"debug": true,
+	"info":  true,
+	"warn":  true,
+	"error": true,
+}
+
+// defaultMetricsPath is the path metrics are served on when metrics does not specify
+// one.
+const defaultMetricsPath = "/metrics"
+
+// defaultReadinessTimeoutMs is how long (in milliseconds) each of the readiness
+// checks of the identity provider and backends may take when readiness does not
+// specify timeout-ms.
+const defaultReadinessTimeoutMs = 2000
+
+// defaultAllowedMethods are the methods that are allowed on a route that does not
+// specify allowed-methods.
+var defaultAllowedMethods = []string{
+	"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS", "CONNECT", "TRACE",
+}
+
+// defaultDrainTimeout is the number of seconds in-flight requests are given to finish
+// on shutdown when drain-timeout is not set.
+const defaultDrainTimeout = 30
+
+// defaultMaxAuthRedirects is the number of consecutive auth redirects that are allowed
+// before a user is considered to be in a redirect loop.
+const defaultMaxAuthRedirects = 5
+
+// defaultGroupsCacheTTL is the number of seconds a user's Google Groups are cached
+// when google-groups does not specify cache-ttl.
+const defaultGroupsCacheTTL = 300
+
+// defaultAuthzTimeoutMs and defaultAuthzCacheTTL are the timeout (in milliseconds)
+// and cache TTL (in seconds) of the authz-webhook when they are not specified.
+const (
+	defaultAuthzTimeoutMs = 1000
+	defaultAuthzCacheTTL  = 60
+)
+
+// defaultMaxIdleConns, defaultMaxIdleConnsPerHost and defaultIdleConnTimeout (in
+// seconds) size the pool of connections to backends when backend-transport does not.
+// defaultDialTimeout (in seconds) limits how long connecting to a backend takes.
+const (
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 32
+	defaultIdleConnTimeout     = 90
+	defaultDialTimeout         = 30
+)
+
+// defaultAssertionTTL is how long (in seconds) identity assertions are valid for and
+// defaultAssertionHeader is the header they are sent to backends in.
+const (
+	defaultAssertionTTL    = 60
+	defaultAssertionHeader = "Underpants-Assertion"
+)
+
+// defaultJWKSCacheTTL is how long (in seconds) the keys of the issuer of JWTs are
+// cached when jwt does not specify cache-ttl.
+const defaultJWKSCacheTTL = 3600
+
+// defaultAutocertCacheDir is where autocert keeps certificates when no cache-dir is
+// given.
+const defaultAutocertCacheDir = "autocert"
+
+// defaultFailoverCooldown is the number of seconds a failed backend is skipped when a
+// route does not specify failover-cooldown.
+const defaultFailoverCooldown = 30
+
+// defaultMirrorTimeoutMs is how long (in milliseconds) a route's shadow backend has to
+// respond when its mirror does not specify timeout-ms.
+const defaultMirrorTimeoutMs = 10000
+
+// defaultResolveInterval is how often (in seconds) the hosts of a route's backends
+// are looked up again when its resolve does not specify interval.
+const defaultResolveInterval = 30
+
+// defaultHealthCheckTimeoutMs, defaultHealthyThreshold and defaultUnhealthyThreshold
+// are the settings of active health checks when a route's health-check does not
+// specify them.
+const (
+	defaultHealthCheckTimeoutMs = 5000
+	defaultHealthyThreshold     = 2
+	defaultUnhealthyThreshold   = 3
+)
+
+// defaultRetryCount and defaultRetryBackoffMs are the number of retries and the delay
+// (in milliseconds) before the first of them when a route's retry does not specify
+// them.
+const (
+	defaultRetryCount     = 2
+	defaultRetryBackoffMs = 100
+)
+
+// defaultBreakerWindow, defaultBreakerMinRequests, defaultBreakerErrorRate and
+// defaultBreakerOpenFor are the settings of a route's circuit-breaker when they are
+// not specified. Durations are in seconds.
+const (
+	defaultBreakerWindow      = 30
+	defaultBreakerMinRequests = 20
+	defaultBreakerErrorRate   = 0.5
+	defaultBreakerOpenFor     = 30
+)
+
+// defaultQueueTimeoutMs is how long (in milliseconds) a request waits in a route's
+// concurrency queue when queue-timeout-ms is not specified.
+const defaultQueueTimeoutMs = 10000
+
+// defaultRetryStatusCodes are the backend responses that are retried when a route's
+// retry does not specify status-codes.
+var defaultRetryStatusCodes = []int{http.StatusBadGateway, http.StatusServiceUnavailable}
+
+// defaultCookieName is the name of the session cookie when none is given.
+const defaultCookieName = "u"
+
+// defaultCookieMaxAge is the number of seconds a session lasts when cookie.max-age is
+// not given.
+const defaultCookieMaxAge = 3600
+
+// defaultSessionMaxLifetime is the number of seconds a sliding session can last when
+// session.max-lifetime is not given.
+const defaultSessionMaxLifetime = 86400
+
+// defaultVaultField is the field of a Vault secret that holds the session key when
+// none is given.
+const defaultVaultField = "key"
+
+// defaultVaultTokenEnv is the environment variable holding the Vault token when none is
+// given.
+const defaultVaultTokenEnv = "VAULT_TOKEN"
+
+// defaultCaptureMaxBytes is the number of bytes of each body that will be captured
+// when a route's body-capture does not specify max-bytes.
+const defaultCaptureMaxBytes = 4096
+
+// defaultMaintenanceRetryAfter is the number of seconds clients are told to wait before
+// retrying a route in maintenance when its maintenance does not specify retry-after.
+const defaultMaintenanceRetryAfter = 300
+
+// defaultAPIKeyHeader is the header clients present API keys in when a route's
+// api-keys does not specify one.
+const defaultAPIKeyHeader = "X-Api-Key"
+
+// defaultRedactions are the patterns that are redacted from captured bodies when a
+// route's body-capture does not specify its own.
+var defaultRedactions = []string{
+	`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`,
+	`(?i)bearer\s+[A-Za-z0-9._~+/\-]+=*`,
+	`(?i)"?(access_token|refresh_token|id_token|token|password|secret|api_key)"?\s*[:=]\s*"?[^"&\s,}]*"?`,
+}
+
 // OAuthInfo is the part of the configuration info that contains information
 // about the oauth provider.
 type OAuthInfo struct {
 	Provider string `json:"provider"`
 
-	ClientID     string `json:"client-id"`
-	ClientSecret string `json:"client-secret"`
+	ClientID     string `json:"client-id"`
+	ClientSecret string `json:"client-secret"`
+
+	// Google provider properties
+	Domain  string   `json:"domain"`
+	Domains []string `json:"domains"`
+
+	// The email addresses of users outside of the domains who may sign in anyway,
+	// such as contractors and vendors.
+	Guests []string `json:"guests"`
+
+	// Okta provider properties
+	BaseURL string `json:"base-url"`
+
+	// GitHub provider properties. Users must be active members of the organization
+	// and, if teams are given, members of at least one of those teams.
+	Organization string   `json:"organization"`
+	Teams        []string `json:"teams"`
+
+	// OIDC provider properties. The endpoints are found through the issuer's
+	// discovery document unless they are given explicitly.
+	Issuer      string     `json:"issuer"`
+	AuthURL     string     `json:"auth-url"`
+	TokenURL    string     `json:"token-url"`
+	UserInfoURL string     `json:"userinfo-url"`
+	Scopes      []string   `json:"scopes"`
+	Claims      ClaimsInfo `json:"claims"`
+
+	// SAML provider properties.
+	SAML SAMLInfo `json:"saml"`
+
+	// Local provider properties. The file lists the users who may sign in with a
+	// password, one email:bcrypt-hash per line as written by htpasswd -B.
+	UsersFile string `json:"users-file"`
+
+	// Whether to reject users whose email address has not been verified by the
+	// provider. This is off by default but enabling it is recommended.
+	RequireVerifiedEmail bool `json:"require-verified-email"`
+
+	// Whether to keep the user's refresh token (encrypted) in their session so that,
+	// when the session expires, they can be silently re-validated with the provider
+	// for up to session.max-lifetime. Only the google provider supports this.
+	RefreshTokens bool `json:"refresh-tokens"`
+}
+
+// GoogleGroupsInfo is the part of the configuration info that enables looking up the
+// Google Groups users belong to through the Admin SDK Directory API.
+type GoogleGroupsInfo struct {
+	// A JSON key file for a service account that has been granted domain-wide
+	// delegation for the admin.directory.group.readonly scope.
+	ServiceAccountKey string `json:"service-account-key"`
+
+	// The admin user the service account acts on behalf of.
+	AdminEmail string `json:"admin-email"`
+
+	// How long (in seconds) a user's groups are cached, defaults to 300.
+	CacheTTL int `json:"cache-ttl"`
+}
+
+// AuthzWebhookInfo is the part of the configuration info that configures an external
+// service that authorizes each proxied request.
+type AuthzWebhookInfo struct {
+	// The URL that requests for decisions are posted to.
+	URL string `json:"url"`
+
+	// How long (in milliseconds) to wait for a decision, defaults to 1000.
+	TimeoutMs int `json:"timeout-ms"`
+
+	// How long (in seconds) decisions are cached, defaults to 60. A negative value
+	// disables caching.
+	CacheTTL int `json:"cache-ttl"`
+
+	// Whether requests are allowed when the webhook cannot be reached or fails. By
+	// default they are not.
+	FailOpen bool `json:"fail-open"`
+}
+
+// TransportInfo is the part of the configuration info that controls the pool of
+// connections shared by all backends.
+type TransportInfo struct {
+	// The maximum number of idle connections kept across all backends, defaults to
+	// 100.
+	MaxIdleConns int `json:"max-idle-conns"`
+
+	// The maximum number of idle connections kept to each backend, defaults to 32.
+	MaxIdleConnsPerHost int `json:"max-idle-conns-per-host"`
+
+	// The maximum number of connections to each backend, including those in use. By
+	// default there is no limit.
+	MaxConnsPerHost int `json:"max-conns-per-host"`
+
+	// How long (in seconds) an idle connection is kept, defaults to 90.
+	IdleConnTimeout int `json:"idle-conn-timeout"`
+
+	// Use a new connection for every request.
+	DisableKeepAlives bool `json:"disable-keep-alives"`
+
+	// How long (in seconds) connecting to a backend may take, defaults to 30.
+	DialTimeout int `json:"dial-timeout"`
+
+	// How long (in seconds) to wait for a backend's response headers once the request
+	// has been sent. By default there is no limit.
+	ResponseHeaderTimeout int `json:"response-header-timeout"`
+}
+
+// AssertionInfo is the part of the configuration info that configures the signed
+// identity assertions sent to backends.
+type AssertionInfo struct {
+	// A PEM encoded RSA or P-256 ECDSA private key that assertions are signed with.
+	Key string `json:"key"`
+
+	// How long (in seconds) assertions are valid for, defaults to 60.
+	TTL int `json:"ttl"`
+
+	// The header assertions are sent in, defaults to Underpants-Assertion.
+	Header string `json:"header"`
+}
+
+// JWTInfo is the part of the configuration info that lets requests be authenticated
+// by a JWT issued by the identity provider, presented as a bearer token.
+type JWTInfo struct {
+	// The issuer tokens must be issued by.
+	Issuer string `json:"issuer"`
+
+	// The URL of the issuer's JSON Web Key Set, defaults to the jwks_uri of the
+	// issuer's discovery document.
+	JWKSURL string `json:"jwks-url"`
+
+	// The audiences a token may be for, defaults to the oauth client-id.
+	Audiences []string `json:"audiences"`
+
+	// The claims user info is taken from, with the same meaning as oauth.claims.
+	Claims ClaimsInfo `json:"claims"`
+
+	// How long (in seconds) the issuer's keys are cached, defaults to 3600.
+	CacheTTL int `json:"cache-ttl"`
+}
+
+// LogInfo is the part of the configuration info that configures underpants' own log.
+type LogInfo struct {
+	// The least severe messages that are logged: debug, info (the default), warn or
+	// error.
+	Level string `json:"level"`
+
+	// Either json (the default) or console.
+	Format string `json:"format"`
+
+	// The file the log is appended to, defaults to stderr.
+	Path string `json:"path"`
+}
+
+// AccessLogInfo is the part of the configuration info that configures the log of
+// every request that is served.
+type AccessLogInfo struct {
+	// The file the log is appended to, defaults to stdout.
+	Path string `json:"path"`
+
+	// Either combined (the default) or json.
+	Format string `json:"format"`
+}
+
+// RouteSourceConsul and RouteSourceEtcd are the key-value stores routes can be read
+// from. With RouteSourceKubernetes, routes are built from a cluster's Ingresses.
+const (
+	RouteSourceConsul     = "consul"
+	RouteSourceEtcd       = "etcd"
+	RouteSourceKubernetes = "kubernetes"
+)
+
+// defaultRouteSourceAddrs are the addresses of the key-value stores when route-source
+// does not specify one.
+var defaultRouteSourceAddrs = map[string]string{
+	RouteSourceConsul:     "http://127.0.0.1:8500",
+	RouteSourceEtcd:       "http://127.0.0.1:2379",
+	RouteSourceKubernetes: "https://kubernetes.default.svc",
+}
+
+// defaultRouteSourcePrefix is the prefix of the keys holding routes when route-source
+// does not specify one.
+const defaultRouteSourcePrefix = "underpants/routes/"
+
+// defaultRouteSourcePollInterval is how often (in seconds) etcd is polled for changes
+// to the routes when route-source does not specify poll-interval.
+const defaultRouteSourcePollInterval = 10
+
+// RouteSourceInfo is the part of the configuration info that configures a key-value
+// store that routes are read from, in addition to the routes in the config file.
+type RouteSourceInfo struct {
+	// The store, either "consul", "etcd" or "kubernetes".
+	Type string `json:"type"`
+
+	// The address of the store's HTTP API, defaults to the local agent or, for
+	// kubernetes, the cluster's API server.
+	Address string `json:"address"`
+
+	// For kubernetes, the namespace whose Ingresses are watched. Defaults to all
+	// namespaces.
+	Namespace string `json:"namespace"`
+
+	// The prefix of the keys holding routes, each of which is a route as JSON.
+	// Defaults to "underpants/routes/".
+	Prefix string `json:"prefix"`
+
+	// The environment variable holding the token sent to the store, if any. For
+	// kubernetes, the pod's service account token is used if this is not given.
+	TokenEnv string `json:"token-env"`
+
+	// How often (in seconds) etcd and kubernetes are polled for changes. Consul is
+	// watched instead. Defaults to 10.
+	PollInterval int `json:"poll-interval"`
+}
+
+// ConsulInfo is the part of the configuration info that describes the Consul agent that
+// the instances of consul:// backends are found with.
+type ConsulInfo struct {
+	// The address of the agent's HTTP API, defaults to the local agent.
+	Address string `json:"address"`
+
+	// The environment variable holding the ACL token sent to the agent, if any.
+	TokenEnv string `json:"token-env"`
+
+	// The datacenter whose catalog is used, defaults to that of the agent.
+	Datacenter string `json:"datacenter"`
+}
+
+// AuditLogInfo is the part of the configuration info that configures the log of
+// security relevant events, such as sign ins and denied requests.
+type AuditLogInfo struct {
+	// The file the log is appended to, defaults to stdout.
+	Path string `json:"path"`
+}
+
+// MetricsInfo is the part of the configuration info that configures the Prometheus
+// metrics endpoint.
+type MetricsInfo struct {
+	// The path metrics are served on, defaults to /metrics.
+	Path string `json:"path"`
+
+	// The address (e.g. ":9100") of a separate plain http listener that serves
+	// metrics. By default they are served by the hub.
+	Addr string `json:"addr"`
+}
+
+const (
+	// ListenerProxy is a listener that serves the hub and the routes, over https if
+	// there are certs.
+	ListenerProxy = "proxy"
+
+	// ListenerRedirect is a plain http listener that redirects every request to
+	// https.
+	ListenerRedirect = "redirect"
+
+	// ListenerAdmin is a plain http listener that serves only the administrative API.
+	ListenerAdmin = "admin"
+)
+
+// ListenerInfo is an address that underpants listens on and what it serves there.
+type ListenerInfo struct {
+	// The address (e.g. ":443" or "10.0.0.1:9200") to listen on.
+	Addr string `json:"addr"`
+
+	// What is served, one of proxy (the default), redirect or admin.
+	Serve string `json:"serve"`
+
+	port int
+}
+
+// Port is the port of the listener's address.
+func (l *ListenerInfo) Port() int {
+	return l.port
+}
+
+// AdminInfo is the part of the configuration info that controls how the administrative
+// API is reached.
+type AdminInfo struct {
+	// The environment variable holding a token that automation can present as a
+	// bearer token in place of an admin's session.
+	TokenEnv string `json:"token-env"`
+
+	token string
+
+	// The address (e.g. ":9200") of a separate plain http listener that serves the
+	// administrative API. By default it is served by the hub.
+	Addr string `json:"addr"`
+
+	// The groups whose members, if they are also admins, may impersonate other users
+	// on routes. Nobody may impersonate unless this is configured.
+	ImpersonateGroups []string `json:"impersonate-groups"`
+}
+
+// Token is the bearer token accepted by the administrative API, it is empty unless
+// token-env is configured.
+func (a *AdminInfo) Token() string {
+	return a.token
+}
+
+// ReadinessInfo is the part of the configuration info that controls what the
+// readiness endpoint checks beyond the session key and store.
+type ReadinessInfo struct {
+	// Check that the identity provider can be reached.
+	CheckProvider bool `json:"check-provider"`
+
+	// Check that every route's backend passes its health check.
+	CheckBackends bool `json:"check-backends"`
+
+	// How long (in milliseconds) each check may take, defaults to 2000.
+	TimeoutMs int `json:"timeout-ms"`
+}
+
+// PathRuleInfo is a rule that applies to the requests for some of the paths of a
+// route.
+type PathRuleInfo struct {
+	// The path the rule applies to. A trailing * matches any path with the preceding
+	// prefix and any other * matches within a single path segment, otherwise the path
+	// must match exactly.
+	Path string `json:"path"`
+
+	// Whether requests for the path are proxied without requiring users to sign in.
+	Public bool `json:"public"`
+
+	// Access requirements for the path, in addition to those of the route. These have
+	// the same meaning as the route properties of the same names.
+	AllowedGroups []string `json:"allowed-groups"`
+	Allow         []string `json:"allow"`
+	Deny          []string `json:"deny"`
+
+	// The number of seconds within which users must have signed in with the identity
+	// provider to access the path. Users who signed in longer ago are sent to sign in
+	// again, and the identity provider is asked to have them enter their credentials
+	// even if they are signed in with it. Zero, the default, accepts any session.
+	StepUp int `json:"step-up"`
+}
+
+// Matches determines if the rule applies to the given path.
+func (p *PathRuleInfo) Matches(path string) bool {
+	return matchPath(p.Path, path)
+}
+
+// matchPath determines if the path matches the pattern of a path rule.
+func matchPath(pattern, path string) bool {
+	i := strings.IndexByte(pattern, '*')
+	if i < 0 {
+		return pattern == path
+	}
+
+	if !strings.HasPrefix(path, pattern[:i]) {
+		return false
+	}
+
+	pattern, path = pattern[i+1:], path[i:]
+	if pattern == "" {
+		return true
+	}
+
+	n := strings.IndexByte(path, '/')
+	if n < 0 {
+		n = len(path)
+	}
+
+	for j := 0; j <= n; j++ {
+		if matchPath(pattern, path[j:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// CertInfo is a TLS certificate and its key, both as PEM files.
+type CertInfo struct {
+	Crt string
+	Key string
+}
+
+// AutocertInfo is the part of the configuration info that has certificates obtained
+// and renewed automatically through ACME for the hub and every route.
+type AutocertInfo struct {
+	// The directory where certificates and the account key are kept, defaults to
+	// "autocert".
+	CacheDir string `json:"cache-dir"`
+
+	// The contact email given to the certificate authority.
+	Email string `json:"email"`
+
+	// The ACME directory of the certificate authority. Defaults to Let's Encrypt.
+	DirectoryURL string `json:"directory-url"`
+}
+
+// IdPInfo is an identity provider in the list of providers a user may choose from
+// when more than one is configured. It has all of the properties of OAuthInfo.
+type IdPInfo struct {
+	// A unique name identifying the provider, it is used to map routes to providers.
+	Name string `json:"name"`
+
+	// The label shown for the provider on the chooser page, defaults to the name.
+	Title string `json:"title"`
+
+	OAuthInfo
+}
+
+// HealthCheckInfo is the part of a route's configuration that describes how to check
+// the health of its backend.
+type HealthCheckInfo struct {
+	// The method used for the check, defaults to HEAD.
+	Method string `json:"method"`
+
+	// The path, relative to the backend's To URL, that is checked. Defaults to /.
+	Path string `json:"path"`
+
+	// How often (in seconds) each of the route's backends is checked. Zero, the
+	// default, only checks backends on demand.
+	Interval int `json:"interval"`
+
+	// How long (in milliseconds) to wait for a check, defaults to 5000.
+	TimeoutMs int `json:"timeout-ms"`
+
+	// The number of consecutive checks that must pass before an unhealthy backend is
+	// put back into rotation, defaults to 2.
+	HealthyThreshold int `json:"healthy-threshold"`
+
+	// The number of consecutive checks that must fail before a backend is taken out of
+	// rotation, defaults to 3.
+	UnhealthyThreshold int `json:"unhealthy-threshold"`
+}
+
+// CanaryInfo is the part of a route's configuration that sends some of its users to a
+// new version of the backend.
+type CanaryInfo struct {
+	// The URL of the new backend.
+	To string `json:"to"`
+
+	// The percentage of users, from 0 to 100, sent to the new backend. Users are chosen
+	// by their email address, or by their address for anonymous requests, so that each
+	// sticks with one version.
+	Percent float64 `json:"percent"`
+
+	// Users who are always sent to the new backend, in the same form as allow.
+	Users []string `json:"users"`
+
+	toURL *url.URL
+}
+
+// ToURL is the parsed URL of the new backend.
+func (c *CanaryInfo) ToURL() *url.URL {
+	return c.toURL
+}
+
+// RouteSessionInfo is the part of a route's configuration that changes how long its
+// sessions last.
+type RouteSessionInfo struct {
+	// The number of seconds a session on this route lasts, in place of the cookie's
+	// max-age. With sliding sessions, it is how long a session may be idle.
+	MaxAge int `json:"max-age"`
+
+	// The number of seconds after which users must sign in with the identity provider
+	// again, however recently their session was refreshed. Zero, the default, never
+	// asks users to sign in again while their session lasts.
+	ReauthAfter int `json:"reauth-after"`
+}
+
+// CORSInfo is the part of a route's configuration that lets pages on other origins
+// make requests to it.
+type CORSInfo struct {
+	// The origins (such as https://wiki.example.com) that may make requests, which may
+	// use * as a wildcard (as in https://*.example.com). A lone * allows any origin.
+	AllowedOrigins []string `json:"allowed-origins"`
+
+	// The methods cross-origin requests may use, defaults to the route's
+	// allowed-methods.
+	AllowedMethods []string `json:"allowed-methods"`
+
+	// The headers cross-origin requests may send, defaults to any the browser asks
+	// for.
+	AllowedHeaders []string `json:"allowed-headers"`
+
+	// The response headers, beyond the simple ones, that pages may read.
+	ExposedHeaders []string `json:"exposed-headers"`
+
+	// Set if cross-origin requests may carry cookies, including the session cookie.
+	// The allowed origins must then be within a domain, so * cannot be used.
+	AllowCredentials bool `json:"allow-credentials"`
+
+	// How long (in seconds) browsers may cache the answers to preflight requests.
+	MaxAge int `json:"max-age"`
+}
+
+// AllowsOrigin determines if pages on origin may make requests to the route.
+func (c *CORSInfo) AllowsOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			return true
+		}
+
+		if ok, _ := path.Match(strings.ToLower(o), origin); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// MirrorInfo is the part of a route's configuration that sends copies of its requests
+// to a shadow backend, whose responses are discarded.
+type MirrorInfo struct {
+	// The URL of the shadow backend.
+	To string `json:"to"`
+
+	// The percentage of requests, from 0 to 100, that are copied, defaults to 100.
+	Percent float64 `json:"percent"`
+
+	// The methods of the requests that are copied, defaults to all of them.
+	Methods []string `json:"methods"`
+
+	// How long (in milliseconds) the shadow backend has to respond, defaults to 10000.
+	TimeoutMs int `json:"timeout-ms"`
+
+	toURL *url.URL
+}
+
+// ToURL is the parsed URL of the shadow backend.
+func (m *MirrorInfo) ToURL() *url.URL {
+	return m.toURL
+}
+
+// Mirrors determines if requests with the method are copied.
+func (m *MirrorInfo) Mirrors(method string) bool {
+	if len(m.Methods) == 0 {
+		return true
+	}
+
+	for _, mm := range m.Methods {
+		if mm == method {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveInfo is the part of a route's configuration that describes how the addresses
+// of its backends are found by looking up the hosts of its To URLs.
+type ResolveInfo struct {
+	// Look up SRV records for the hosts, whose targets and ports are the backends,
+	// instead of their addresses.
+	SRV bool `json:"srv"`
+
+	// How often (in seconds) the hosts are looked up again, defaults to 30.
+	Interval int `json:"interval"`
+}
+
+// BackendTLSInfo is the part of a route's configuration that controls how
+// connections to https backends are verified.
+type BackendTLSInfo struct {
+	// A file of PEM encoded CA certificates used to verify the backend instead of the
+	// system's roots.
+	CA string `json:"ca"`
+
+	// Accept any certificate the backend presents. This is only suitable for
+	// development.
+	InsecureSkipVerify bool `json:"insecure-skip-verify"`
+
+	// The name sent via SNI and expected in the backend's certificate, defaults to the
+	// hostname of the backend URL.
+	ServerName string `json:"server-name"`
+
+	// A certificate and (unencrypted) key presented to backends that require
+	// clients to authenticate with mutual TLS.
+	ClientCert *CertInfo `json:"client-cert"`
+}
+
+// RetryInfo is the part of a route's configuration that controls the retrying of GET
+// and HEAD requests that fail.
+type RetryInfo struct {
+	// The number of times a request is retried, defaults to 2.
+	Count int `json:"count"`
+
+	// How long (in milliseconds) to wait before the first retry, defaults to 100. The
+	// wait doubles before each retry after that.
+	BackoffMs int `json:"backoff-ms"`
+
+	// The backend response statuses that are retried, defaults to 502 and 503.
+	// Requests that fail to reach the backend at all are always retried.
+	StatusCodes []int `json:"status-codes"`
+}
+
+// CircuitBreakerInfo is the part of a route's configuration that controls when
+// requests stop being sent to a backend that is failing.
+type CircuitBreakerInfo struct {
+	// The period (in seconds) over which the error rate is measured, defaults to 30.
+	Window int `json:"window"`
+
+	// The number of requests needed in a window before the circuit can open, defaults
+	// to 20.
+	MinRequests int `json:"min-requests"`
+
+	// The fraction of requests that must fail for the circuit to open, defaults to
+	// 0.5. Requests fail if they cannot reach the backend or receive a server error.
+	ErrorRate float64 `json:"error-rate"`
+
+	// How long (in seconds) the circuit stays open before a request is let through to
+	// see if the backend has recovered, defaults to 30.
+	OpenFor int `json:"open-for"`
+}
+
+// RateLimitInfo is the part of a route's configuration that limits how quickly each
+// user, or each address for anonymous requests, can make requests.
+type RateLimitInfo struct {
+	// The sustained number of requests allowed per second.
+	Rate float64 `json:"rate"`
+
+	// The number of requests that can be made in a burst, defaults to the rate rounded
+	// up.
+	Burst int `json:"burst"`
+}
+
+// ConcurrencyInfo is the part of a route's configuration that limits how many
+// requests are sent to the backend at once.
+type ConcurrencyInfo struct {
+	// The most requests that are in progress at the backend at once.
+	MaxInFlight int `json:"max-in-flight"`
+
+	// The number of requests that may wait for a request in progress to finish. When
+	// the queue is full, requests are answered with a 503. Zero, the default, answers
+	// every request over the limit with a 503.
+	Queue int `json:"queue"`
+
+	// How long (in milliseconds) a request waits in the queue before it is answered
+	// with a 503, defaults to 10000.
+	QueueTimeoutMs int `json:"queue-timeout-ms"`
+}
+
+// RequestSigningInfo is the part of a route's configuration that controls the signing
+// of each proxied request with a secret shared with the backend. Exactly one of
+// Secret and SecretEnv must be given.
+type RequestSigningInfo struct {
+	// The shared secret.
+	Secret string `json:"secret"`
+
+	// The name of an environment variable holding the shared secret.
+	SecretEnv string `json:"secret-env"`
+}
+
+// HeaderRulesInfo is the part of a route's configuration that changes the headers of
+// requests on their way to the backend or of responses on their way back. Headers are
+// removed, then rewritten, then set and finally added.
+type HeaderRulesInfo struct {
+	// The headers to remove.
+	Remove []string `json:"remove"`
+
+	// Rewrites of the values of headers.
+	Rewrite []*HeaderRewriteInfo `json:"rewrite"`
+
+	// Headers to set, replacing any values they have.
+	Set map[string]string `json:"set"`
+
+	// Headers to add alongside any values they have.
+	Add map[string]string `json:"add"`
+}
+
+// APIKeysInfo is the part of a route's configuration that identifies machine clients
+// by static keys, for clients such as legacy scripts that cannot sign in.
+type APIKeysInfo struct {
+	// The header clients present their key in, defaults to X-Api-Key.
+	Header string `json:"header"`
+
+	// The keys that are accepted.
+	Keys []*APIKeyInfo `json:"keys"`
+}
+
+// APIKeyInfo is a key and the identity of the clients that present it.
+type APIKeyInfo struct {
+	// The hex encoded SHA-256 hash of the key, so that the key itself is never part of
+	// the configuration.
+	SHA256 string `json:"sha256"`
+
+	// The identity requests made with the key are made as, which is subject to the
+	// route's access rules like any other user.
+	Email string `json:"email"`
+	Name  string `json:"name"`
+
+	hash []byte
+}
+
+// Lookup returns the key that matches the key presented by a client, or nil if none
+// do.
+func (k *APIKeysInfo) Lookup(key string) *APIKeyInfo {
+	sum := sha256.Sum256([]byte(key))
+
+	var match *APIKeyInfo
+	for _, key := range k.Keys {
+		// every key is compared, so the time taken does not reveal which one matched.
+		if subtle.ConstantTimeCompare(sum[:], key.hash) == 1 {
+			match = key
+		}
+	}
+	return match
+}
+
+// HeaderRewriteInfo replaces the matches of a regular expression in the values of a
+// header.
+type HeaderRewriteInfo struct {
+	Header string `json:"header"`
+
+	// The regular expression to match.
+	Match string `json:"match"`
+
+	// The replacement, which may refer to submatches as in regexp.ReplaceAllString.
+	Replace string `json:"replace"`
+
+	match *regexp.Regexp
+}
+
+// Regexp is the compiled Match.
+func (h *HeaderRewriteInfo) Regexp() *regexp.Regexp {
+	return h.match
+}
+
+// BodyCaptureInfo is the part of a route's configuration that controls the capture of
+// request and response bodies for debugging. Capture is never active until it is armed
+// by an admin and it automatically disables itself after the armed number of requests.
+type BodyCaptureInfo struct {
+	// The maximum number of bytes of each request and response body to capture.
+	MaxBytes int `json:"max-bytes"`
+
+	// Regular expressions whose matches are redacted from the captured bodies before
+	// they are logged. If none are given, a default set covering email addresses,
+	// bearer tokens and common secret-bearing fields is used.
+	Redact []string `json:"redact"`
+
+	redact []*regexp.Regexp
+}
+
+// Redactions returns the compiled redaction patterns.
+func (b *BodyCaptureInfo) Redactions() []*regexp.Regexp {
+	return b.redact
+}
+
+// MaintenanceInfo is the part of a route's configuration that controls the page served
+// in place of the backend while the route is in maintenance.
+type MaintenanceInfo struct {
+	// Whether the route starts in maintenance. Routes can also be put in and taken out
+	// of maintenance with the administrative API.
+	Enabled bool `json:"enabled"`
+
+	// An HTML file that is served in place of the default maintenance page.
+	Page string `json:"page"`
+
+	// The number of seconds clients are told to wait with Retry-After, defaults to 300.
+	RetryAfter int `json:"retry-after"`
+
+	page []byte
+}
+
+// PageHTML is the contents of the maintenance page file, it is nil if no page is
+// configured.
+func (m *MaintenanceInfo) PageHTML() []byte {
+	return m.page
+}
+
+// BrandingInfo is the part of the configuration info that customizes the hub's page to
+// match a company's branding.
+type BrandingInfo struct {
+	// The company name used as the title of the page.
+	CompanyName string `json:"company-name"`
+
+	// The URL of a logo shown at the top of the page, which can be one of the assets
+	// (e.g. /__auth__/assets/logo.png).
+	Logo string `json:"logo"`
+
+	// CSS colors (a name or #hex) used on the page.
+	Colors ColorsInfo `json:"colors"`
+
+	// A directory holding an index.html template that replaces the page and an assets
+	// directory whose files are served from /__auth__/assets/.
+	Dir string `json:"dir"`
+
+	template *template.Template
+}
+
+// ColorsInfo is the set of colors used on the hub's page.
+type ColorsInfo struct {
+	Background string `json:"background"`
+	Text       string `json:"text"`
+	Accent     string `json:"accent"`
+}
+
+// Template is the template parsed from the index.html of the branding dir, it is nil
+// if there is no dir.
+func (b *BrandingInfo) Template() *template.Template {
+	return b.template
+}
+
+// ClaimsInfo maps the claims returned by an OIDC provider's userinfo endpoint to the
+// properties of a user. Any that are omitted take the standard OIDC claim name.
+type ClaimsInfo struct {
+	Email         string `json:"email"`
+	EmailVerified string `json:"email-verified"`
+	Name          string `json:"name"`
+	Picture       string `json:"picture"`
+}
+
+// SAMLInfo is the part of the oauth configuration that describes the SAML 2.0
+// identity provider when underpants is acting as a SAML service provider.
+type SAMLInfo struct {
+	// The entity id of underpants as a service provider. Defaults to the URL of the
+	// metadata endpoint on the hub.
+	EntityID string `json:"entity-id"`
+
+	// The URL of the identity provider's single sign-on service (HTTP-Redirect
+	// binding).
+	IdPSSOURL string `json:"idp-sso-url"`
+
+	// A PEM file containing the certificate the identity provider signs with.
+	IdPCert string `json:"idp-cert"`
+
+	// The expected issuer of assertions. If empty, the issuer is not checked.
+	IdPIssuer string `json:"idp-issuer"`
+
+	// The attributes holding the user's email and name. The email defaults to the
+	// subject's NameID.
+	EmailAttribute string `json:"email-attribute"`
+	NameAttribute  string `json:"name-attribute"`
+}
+
+// SessionInfo is the part of the configuration info that controls where session
+// state is kept.
+type SessionInfo struct {
+	// The session store to use. The default, "cookie", carries the signed user in the
+	// cookie itself. "memory" keeps sessions on the server and only puts an opaque
+	// session id in the cookie, as does "redis", which shares sessions between
+	// instances and across restarts. Existing cookies are upgraded to server-side
+	// sessions as they are seen until accept-legacy-until.
+	Store string `json:"store"`
+
+	// The time, in RFC 3339 format, until which cookies carrying the signed user are
+	// upgraded to server-side sessions by the "memory" and "redis" stores. After it
+	// they are refused, so that a copy of one cannot outlive signing out. If omitted,
+	// they are refused right away and their users have to sign in again.
+	AcceptLegacyUntil string `json:"accept-legacy-until"`
+
+	acceptLegacyUntil time.Time
+
+	// The maximum number of sessions held by the memory store, the least recently used
+	// sessions are evicted first. The default of 0 is unbounded.
+	Capacity int `json:"capacity"`
+
+	// How the memory store evicts expired and excess sessions: "sync" evicts inline
+	// as sessions are stored, "async" evicts in small chunks on a background
+	// goroutine so that requests are not held up by a long eviction, and "batch"
+	// allows the store to overshoot its capacity by eviction-batch-size sessions
+	// before evicting them all at once.
+	Eviction string `json:"eviction"`
+
+	// The overshoot allowed by the "batch" eviction strategy.
+	EvictionBatchSize int `json:"eviction-batch-size"`
+
+	// The Redis server used by the "redis" store.
+	Redis *RedisInfo `json:"redis"`
+
+	// A Redis server through which instances using the cookie store share handoff codes
+	// and revocations, so that a user who signs in through one instance can land on
+	// another and a revocation on one applies on all of them. Memory sessions only
+	// exist on the instance that created them, so sharing them needs the redis store.
+	Shared *RedisInfo `json:"shared"`
+
+	// Enables sliding expiration. Sessions then expire once they have been idle for
+	// the cookie's max-age, and active sessions are refreshed as they are used.
+	Sliding bool `json:"sliding"`
+
+	// The number of seconds a sliding or refreshed session can last, however active
+	// it is. Defaults to 86400.
+	MaxLifetime int `json:"max-lifetime"`
+
+	// Encrypts the user carried by cookies with the "cookie" store, so that their
+	// email and name cannot be read by anything that sees the cookie. Cookies that are
+	// only signed are still accepted and are encrypted as they are seen.
+	Encrypt bool `json:"encrypt"`
+
+	// Where the key that signs sessions is loaded from. If omitted, a random key is
+	// generated at startup, which signs everyone out on restart and cannot be shared
+	// between instances.
+	Key *KeyInfo `json:"key"`
+}
+
+// LegacyUntil is when cookies carrying the signed user stop being upgraded to
+// server-side sessions, the zero time if they never are.
+func (s *SessionInfo) LegacyUntil() time.Time {
+	return s.acceptLegacyUntil
+}
+
+// RedisInfo is the part of the session configuration that locates the Redis server.
+type RedisInfo struct {
+	// The host:port of the server.
+	Addr string `json:"addr"`
+
+	// The password, if the server requires one.
+	Password string `json:"password"`
+
+	// The database to use, defaults to 0.
+	DB int `json:"db"`
+
+	// The prefix of the keys sessions are stored under, defaults to
+	// "underpants:session:".
+	Prefix string `json:"prefix"`
+}
+
+// CookieInfo is the part of the configuration info that controls the attributes of
+// the session cookie.
+type CookieInfo struct {
+	// The name of the cookie, defaults to "u".
+	Name string `json:"name"`
+
+	// The domain the cookie is sent to. By default it is only sent to the host that
+	// set it.
+	Domain string `json:"domain"`
+
+	// The number of seconds a session lasts after the user signs in, defaults to 3600.
+	MaxAge int `json:"max-age"`
+
+	// Whether the cookie is only sent over https, defaults to whether underpants is
+	// serving https.
+	Secure *bool `json:"secure"`
+
+	// Whether the cookie is hidden from javascript, defaults to true.
+	HTTPOnly *bool `json:"http-only"`
+
+	// The SameSite attribute of the cookie: "lax" (the default), "strict" or "none".
+	SameSite string `json:"same-site"`
+
+	sameSite http.SameSite
+}
+
+// SameSiteMode is the parsed SameSite attribute of the cookie.
+func (c *CookieInfo) SameSiteMode() http.SameSite {
+	return c.sameSite
+}
+
+// KeyInfo is the source of the session signing key. Exactly one source must be given
+// and, whatever the source, the key is base64 encoded and at least 32 bytes long.
+type KeyInfo struct {
+	// A file containing the key.
+	File string `json:"file"`
+
+	// An environment variable containing the key.
+	Env string `json:"env"`
+
+	// A secret in HashiCorp Vault containing the key.
+	Vault *VaultKeyInfo `json:"vault"`
+}
+
+// VaultKeyInfo locates a key stored in HashiCorp Vault.
+type VaultKeyInfo struct {
+	// The address of the Vault server (i.e. https://vault.example.com:8200).
+	Address string `json:"address"`
+
+	// The path of the secret (i.e. secret/data/underpants for a KV version 2 engine).
+	Path string `json:"path"`
+
+	// The field of the secret holding the key, defaults to "key".
+	Field string `json:"field"`
+
+	// The environment variable holding the Vault token, defaults to VAULT_TOKEN.
+	TokenEnv string `json:"token-env"`
+}
+
+// Upstreams are the backend URLs of a route. In JSON, they may be given as a list or,
+// when there is only one, as a string.
+type Upstreams []string
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (u *Upstreams) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*u = Upstreams{s}
+		return nil
+	}
+
+	var l []string
+	if err := json.Unmarshal(b, &l); err != nil {
+		return err
+	}
+	*u = Upstreams(l)
+	return nil
+}
+
+// PrefixOption is a path prefix. In JSON, it may also be given as true, which is kept
+// as "true", to mean the path of the route's from.
+type PrefixOption string
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (p *PrefixOption) UnmarshalJSON(b []byte) error {
+	var v bool
+	if err := json.Unmarshal(b, &v); err == nil {
+		*p = ""
+		if v {
+			*p = "true"
+		}
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	*p = PrefixOption(s)
+	return nil
+}
+
+// RouteInfo is the part of the configuration info that contains information
+// about an individual route.
+type RouteInfo struct {
+	// The hostname (excluding port) for the public facing hostname. It may be followed
+	// by a path, as in hub.example.com/grafana, to route only the requests under that
+	// path prefix.
+	From string
+
+	// A path prefix that is removed from requests before they are sent to the backend,
+	// or true to remove the path of from.
+	StripPrefix PrefixOption `json:"strip-prefix"`
+
+	// A path prefix that is added to requests, after strip-prefix is removed, before
+	// they are sent to the backend.
+	AddPrefix string `json:"add-prefix"`
+
+	stripPrefix string
+
+	// The base authority (i.e. http://backend.example.com:8080) for the backend. Backends
+	// can be referenced through either http:// or https:// base urls. If you provide a
+	// non-root (i.e. http://example.com/foo/bar/) URL, the path will be merged with the
+	// request path as per RFC 3986 Section 5.2. A list of URLs spreads requests over
+	// several replicas of the backend. A backend listening on a unix socket is given as
+	// unix:///path/to.sock, the healthy instances of a service in Consul's catalog
+	// as consul://service-name, and a local directory of files to serve as
+	// file:///path/to/dir.
+	To Upstreams
+
+	toURLs []*url.URL
+
+	// consul is set if the backends are the instances of Consul services.
+	consul bool
+
+	// sockets maps the hosts that stand in for unix socket backends in toURLs to the
+	// paths of the sockets.
+	sockets map[string]string
+
+	// staticDir is the directory of a file backend.
+	staticDir string
+
+	// How requests are spread over multiple backends: round-robin (the default) or
+	// least-connections.
+	Balance string `json:"balance"`
+
+	// The relative share of requests each of the To backends receives, in the same
+	// order. By default they receive an equal share. A backend with a weight of 0 only
+	// receives requests when no other backend is healthy.
+	Weights []int `json:"weights"`
+
+	// Sends some users to a new version of the backend instead of the To backends.
+	Canary *CanaryInfo `json:"canary"`
+
+	// Sends copies of requests to a shadow backend, to try it out on real traffic.
+	Mirror *MirrorInfo `json:"mirror"`
+
+	// Keeps users on the same one of multiple backends: cookie pins each client with a
+	// cookie and email pins each user by their email address. By default there is no
+	// affinity.
+	Affinity string `json:"affinity"`
+
+	// Backends to fail over to, in order, when the To backend is unreachable or
+	// responds with a server error. A backend that fails is skipped for
+	// failover-cooldown seconds.
+	Failover []string `json:"failover"`
+
+	failoverURLs []*url.URL
+
+	// The number of seconds a failed backend is skipped, defaults to 30.
+	FailoverCooldown int `json:"failover-cooldown"`
+
+	// Periodically looks up the hosts of the To backends and spreads requests over the
+	// addresses they resolve to, so that routes follow services whose addresses change.
+	Resolve *ResolveInfo `json:"resolve"`
+
+	// Retries GET and HEAD requests that fail to reach the backend or that receive
+	// one of a set of error statuses.
+	Retry *RetryInfo `json:"retry"`
+
+	// Stops sending requests to the backend for a while when most of them fail.
+	CircuitBreaker *CircuitBreakerInfo `json:"circuit-breaker"`
+
+	// Limits the rate of requests from each user.
+	RateLimit *RateLimitInfo `json:"rate-limit"`
+
+	// Limits the number of requests in progress at the backend at once.
+	Concurrency *ConcurrencyInfo `json:"concurrency"`
+
+	// The largest request body (in bytes) that is sent to the backend. Requests with
+	// larger bodies are answered with a 413. Zero, the default, allows any size.
+	MaxBodyBytes int64 `json:"max-body-bytes"`
+
+	// How often (in milliseconds) the response is flushed to the client while it is
+	// being copied from the backend. Streaming responses, such as Server-Sent Events
+	// and those of unknown length, are always flushed as they arrive. A negative value
+	// flushes after every write.
+	FlushInterval int `json:"flush-interval"`
+
+	// A list of groups which may access this route.  If groups are configured,
+	// users who are not a member of one of these groups will be denied access.
+	// A special group, `*`, may be specified which allows any authenticated
+	// user.
+	AllowedGroups []string `json:"allowed-groups"`
+
+	// Networks (in CIDR notation, or single addresses) that clients must connect from
+	// to reach this route, and networks that they must not. These are checked before
+	// users are asked to sign in. If ip-allow is empty, any address is allowed.
+	IPAllow []string `json:"ip-allow"`
+	IPDeny  []string `json:"ip-deny"`
+
+	ipAllow, ipDeny []*net.IPNet
+
+	// Rules for particular paths of the route. The first rule that matches a request's
+	// path applies.
+	Paths []*PathRuleInfo `json:"paths"`
+
+	// Paths (with the same patterns as path rules) that are proxied without requiring
+	// users to sign in, such as webhooks and health checks. These apply before the
+	// path rules.
+	PublicPaths []string `json:"public-paths"`
+
+	pathRules []*PathRuleInfo
+
+	// The Google Groups (by email address) users must belong to one of to access this
+	// route. This requires google-groups to be configured.
+	RequiredGroups []string `json:"required-groups"`
+
+	// Sends the groups the user belongs to, including their Google Groups if
+	// google-groups is configured, to the backend in the Underpants-Groups header and
+	// in the groups claim of identity assertions.
+	ForwardGroups bool `json:"forward-groups"`
+
+	// A certificate for this route's hostname that is selected via SNI instead of one
+	// of the global certs.
+	Cert *CertInfo `json:"cert"`
+
+	// Users who may access this route, in addition to the requirements of
+	// allowed-groups. Entries are email addresses, globs over email addresses (such as
+	// *@company.com) or, if they contain no @, the names of groups. If empty, all
+	// users are allowed.
+	Allow []string `json:"allow"`
+
+	// Users who may not access this route, in the same form as allow. Deny takes
+	// precedence over allow.
+	Deny []string `json:"deny"`
+
+	// A file of further users who may access this route, one entry per line in the
+	// same form as allow, that is reloaded when it changes. Blank lines and lines
+	// starting with # are ignored. While the file has no entries and allow is empty,
+	// no one may access the route.
+	AllowFile string `json:"allow-file"`
+
+	allowFile *allowFile
+
+	// The name of the identity provider, from providers, that users must have signed
+	// in with to access this route. If empty, any configured provider is accepted.
+	Provider string `json:"provider"`
+
+	// How long sessions on this route last, in place of the global session settings.
+	Session *RouteSessionInfo `json:"session"`
+
+	// Whether this route also serves requests for hosts that are neither the hub nor
+	// the host of another route. Users cannot sign in on those hosts, so only its
+	// public paths are served to them. At most one route can be the default.
+	Default bool `json:"default"`
+
+	// The Google Workspace domain whose users may access this route, in place of the
+	// oauth domain. Once any route has a domain, every route only admits users of its
+	// own domain.
+	Domain string `json:"domain"`
+
+	// The email addresses of users outside of the domain who may access this route,
+	// in addition to the oauth guests.
+	Guests []string `json:"guests"`
+
+	// The HTTP methods that will be proxied to the backend. Requests with any other
+	// method are rejected with a 405. If none are given, all of the standard methods
+	// are allowed.
+	AllowedMethods []string `json:"allowed-methods"`
+
+	allowedMethods map[string]bool
+
+	// What to do when the backend sets a cookie with the same name as one of the
+	// cookies underpants uses for itself: "rename" (the default), "drop" or "refuse".
+	CookieCollision string `json:"cookie-collision"`
+
+	// How the health of the backend is checked, if omitted the backend is checked with
+	// a HEAD request to /.
+	HealthCheck *HealthCheckInfo `json:"health-check"`
+
+	// Enables admin-armed capture of redacted request and response bodies for this
+	// route.
+	BodyCapture *BodyCaptureInfo `json:"body-capture"`
+
+	// How connections to https backends are verified.
+	BackendTLS *BackendTLSInfo `json:"backend-tls"`
+
+	// The protocol spoken to backends: auto (the default), http1, h2 or h2c. gRPC
+	// backends need h2, or h2c if they do not use TLS.
+	BackendProtocol string `json:"backend-protocol"`
+
+	// Signs each proxied request so that backends can reject requests that did not
+	// come through underpants.
+	RequestSigning *RequestSigningInfo `json:"request-signing"`
+
+	// Changes to the headers of requests sent to the backend. Headers that identify
+	// the user cannot be set this way.
+	RequestHeaders *HeaderRulesInfo `json:"request-headers"`
+
+	// Changes to the headers of responses, including those that underpants adds.
+	ResponseHeaders *HeaderRulesInfo `json:"response-headers"`
+
+	// Lets pages on other origins make requests to the route. Preflight requests are
+	// answered without asking users to sign in.
+	CORS *CORSInfo `json:"cors"`
+
+	// Static keys that machine clients that cannot sign in present to be identified.
+	APIKeys *APIKeysInfo `json:"api-keys"`
+
+	// Security headers that replace those of the same name in the top-level
+	// security-headers for this route. A header given an empty value is not sent.
+	SecurityHeaders map[string]string `json:"security-headers"`
+
+	// Serves a maintenance page instead of proxying, for planned backend downtime.
+	Maintenance *MaintenanceInfo `json:"maintenance"`
+
+	// The status, 301 or 302, of redirects to the To URL that are served instead of
+	// proxying. The request path is merged with the URL as it would be for a backend.
+	Redirect int `json:"redirect"`
+
+	backendTLS *tls.Config
+
+	signingKey []byte
+
+	// templated is set if a backend's host contains the * that the subdomain of a
+	// wildcard route is substituted for.
+	templated bool
+}
+
+// WildcardOf is the from of the wildcard route that would match host, which has its
+// first label replaced with *. It is empty if host has only one label.
+func WildcardOf(host string) string {
+	i := strings.IndexByte(host, '.')
+	if i <= 0 {
+		return ""
+	}
+	return "*" + host[i:]
+}
+
+// Host is the lowercase hostname part of the route's from.
+func (r *RouteInfo) Host() string {
+	host := r.From
+	if i := strings.IndexByte(host, '/'); i >= 0 {
+		host = host[:i]
+	}
+	return strings.ToLower(host)
+}
+
+// PathPrefix is the path part of the route's from, without a trailing slash. It is
+// empty if the route covers the whole host.
+func (r *RouteInfo) PathPrefix() string {
+	i := strings.IndexByte(r.From, '/')
+	if i < 0 {
+		return ""
+	}
+	return strings.TrimRight(r.From[i:], "/")
+}
+
+// StrippedPrefix is the path prefix removed from requests before they are sent to the
+// backend, if any.
+func (r *RouteInfo) StrippedPrefix() string {
+	return r.stripPrefix
+}
+
+// IsWildcard determines if the route's from, such as *.example.com, matches any
+// subdomain.
+func (r *RouteInfo) IsWildcard() bool {
+	return strings.HasPrefix(r.From, "*.")
+}
+
+// IsTemplated determines if the host of a backend depends on the subdomain a
+// wildcard route matched.
+func (r *RouteInfo) IsTemplated() bool {
+	return r.templated
+}
+
+// TargetFor is the backend URL base for a request to host, with the subdomain that
+// host has in place of the * in the wildcard route's from substituted for the * in
+// base's host.
+func (r *RouteInfo) TargetFor(base *url.URL, host string) *url.URL {
+	if !r.templated || !strings.Contains(base.Host, "*") {
+		return base
+	}
+
+	host = strings.ToLower(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	sub := strings.TrimSuffix(host, r.Host()[1:])
+
+	u := *base
+	u.Host = strings.Replace(u.Host, "*", sub, 1)
+	return &u
+}
+
+// ToURL is the parsed URL of the first To backend.
+func (r *RouteInfo) ToURL() *url.URL {
+	return r.toURLs[0]
+}
+
+// ToURLs are the parsed URLs of all of the To backends.
+func (r *RouteInfo) ToURLs() []*url.URL {
+	return r.toURLs
+}
+
+// UsesConsul determines if the route's backends are the instances of Consul services,
+// each named by the host of a To URL.
+func (r *RouteInfo) UsesConsul() bool {
+	return r.consul
+}
+
+// IsResolved determines if the route's backends are found at run time, either by
+// looking up their hosts or in Consul's catalog.
+func (r *RouteInfo) IsResolved() bool {
+	return r.Resolve != nil || r.consul
+}
+
+// SocketFor is the path of the unix socket of the backend whose URL has the host, or
+// empty if the backend is not reached over a unix socket.
+func (r *RouteInfo) SocketFor(host string) string {
+	return r.sockets[host]
+}
+
+// HasSockets determines if any of the route's backends are reached over unix sockets.
+func (r *RouteInfo) HasSockets() bool {
+	return len(r.sockets) > 0
+}
+
+// StaticDir is the directory of files the route serves, it is empty unless the
+// route's backend is a file:// URL.
+func (r *RouteInfo) StaticDir() string {
+	return r.staticDir
+}
+
+// addSocket records a unix socket backend and returns the http URL that stands in for
+// it, whose host is derived from the path of the socket.
+func (r *RouteInfo) addSocket(path string) *url.URL {
+	sum := sha256.Sum256([]byte(path))
+	host := hex.EncodeToString(sum[:8]) + ".sock"
+
+	if r.sockets == nil {
+		r.sockets = map[string]string{}
+	}
+	r.sockets[host] = path
+	return &url.URL{Scheme: "http", Host: host}
+}
+
+// BackendTLSConfig is the TLS configuration for connections to the route's backends,
+// or nil if the defaults should be used.
+func (r *RouteInfo) BackendTLSConfig() *tls.Config {
+	return r.backendTLS
+}
+
+// SigningKey is the secret proxied requests are signed with, or nil if they are not
+// signed.
+func (r *RouteInfo) SigningKey() []byte {
+	return r.signingKey
+}
+
+// FailoverURLs are the parsed URLs of the Failover backends.
+func (r *RouteInfo) FailoverURLs() []*url.URL {
+	return r.failoverURLs
+}
+
+// AllowsIP determines if clients connecting from the address may reach the route.
+func (r *RouteInfo) AllowsIP(ip net.IP) bool {
+	if containsIP(r.ipDeny, ip) {
+		return false
+	}
+	return len(r.ipAllow) == 0 || containsIP(r.ipAllow, ip)
+}
+
+// TrustedProxiesInfo is the part of the configuration info that describes the load
+// balancers or CDNs that underpants is behind.
+type TrustedProxiesInfo struct {
+	// The networks (in CIDR notation, or single addresses) of the proxies, whose
+	// X-Forwarded-For and X-Forwarded-Proto headers are believed.
+	Networks []string `json:"networks"`
+
+	// Set if the proxies terminate TLS on port 443 and forward requests over http.
+	// URLs are then built for https on the default port and cookies are secure.
+	TerminatesTLS bool `json:"terminates-tls"`
+
+	nets []*net.IPNet
+}
+
+// Trusts determines if ip is the address of one of the proxies.
+func (t *TrustedProxiesInfo) Trusts(ip net.IP) bool {
+	return containsIP(t.nets, ip)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNets parses a list of CIDR networks, where single addresses are treated as
+// networks of one address.
+func parseNets(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address: %s", cidr)
+			}
+
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// PathRuleFor returns the first path rule that matches the path, or nil if none do.
+func (r *RouteInfo) PathRuleFor(path string) *PathRuleInfo {
+	for _, p := range r.pathRules {
+		if p.Matches(path) {
+			return p
+		}
+	}
+	return nil
+}
+
+// AllowsMethod determines if requests with the given method may be proxied.
+func (r *RouteInfo) AllowsMethod(method string) bool {
+	return r.allowedMethods[method]
+}
+
+// AllowHeader is the value of the Allow header for responses that reject a method.
+func (r *RouteInfo) AllowHeader() string {
+	return strings.Join(r.AllowedMethods, ", ")
+}
+
+// Info is a configuration object that is loaded directly from the json config file.
+type Info struct {
+	// The host (without the port specification) that will be acting as the hub
+	Host string
+
+	// OAuth related settings
+	Oauth OAuthInfo
+
+	// Identity providers users can choose between. When given, these are used instead
+	// of Oauth.
+	Providers []*IdPInfo `json:"providers"`
+
+	// Session related settings
+	Session SessionInfo
+
+	// Attributes of the session cookie.
+	Cookie CookieInfo `json:"cookie"`
+
+	// An external service that is asked to authorize every proxied request.
+	AuthzWebhook *AuthzWebhookInfo `json:"authz-webhook"`
+
+	// The pool of connections to backends.
+	Transport TransportInfo `json:"backend-transport"`
+
+	// The Consul agent that the instances of consul:// backends are found with.
+	Consul ConsulInfo `json:"consul"`
+
+	// Signed assertions of the user's identity that are sent to backends.
+	Assertion *AssertionInfo `json:"assertion"`
+
+	// Accepts JWTs issued by the identity provider in place of a session.
+	JWT *JWTInfo `json:"jwt"`
+
+	// Where and how much underpants logs.
+	Log LogInfo `json:"log"`
+
+	// A log of every request that is served.
+	AccessLog *AccessLogInfo `json:"access-log"`
+
+	// A log of sign ins, sign outs and denied requests, for security review.
+	AuditLog *AuditLogInfo `json:"audit-log"`
+
+	// What the readiness endpoint checks.
+	Readiness ReadinessInfo `json:"readiness"`
+
+	// Serves metrics for Prometheus to scrape.
+	Metrics *MetricsInfo `json:"metrics"`
+
+	// The load balancers or CDNs in front of underpants, if there are any.
+	TrustedProxies *TrustedProxiesInfo `json:"trusted-proxies"`
+
+	// Additional headers that backends trust to identify users, such as
+	// X-Forwarded-User. They are removed from client requests before proxying, along
+	// with all Underpants-* and X-Underpants-* headers.
+	StripHeaders []string `json:"strip-headers"`
+
+	// Settings for looking up Google Groups membership, used by the required-groups
+	// of routes.
+	GoogleGroups *GoogleGroupsInfo `json:"google-groups"`
+
+	// Whether or not to add a set of security headers to all HTTP responses:
+	//
+	//    Strict-Transport-Security -- if certs are present, enforce HTTPS
+	//    Cache-Control: private, no-cache -- prevent downstream caching
+	//    Pragma: no-cache -- prevent HTTP/1.0 downstream caching
+	//    X-Frame-Options: SAMEORIGIN -- prevent clickjacking
+	//
+	// Enable this if it your applications are OK with it and you want additional
+	// security.
+	AddSecurityHeaders bool `json:"use-strict-security-headers"`
+
+	// Headers, such as Content-Security-Policy and X-Content-Type-Options, that are
+	// added to every response, from the hub and from backends, that does not already
+	// have them. Strict-Transport-Security is only sent over https. Routes can
+	// override these with their own security-headers.
+	SecurityHeaders map[string]string `json:"security-headers"`
+
+	// Template files, keyed by status code, that replace underpants' own pages for
+	// 403, 404, 502, 503 and 504 responses.
+	ErrorPages map[string]string `json:"error-pages"`
+
+	errorPages map[int]*template.Template
+
+	// Customizes the look of the hub's page.
+	Branding BrandingInfo `json:"branding"`
+
+	// The URL users are sent to after they sign out, such as the identity provider's
+	// logout page or an internal portal. If empty, they are shown a confirmation page.
+	LogoutURL string `json:"logout-url"`
+
+	// What happens to requests for hosts that are neither the hub nor the host of a
+	// route: not-found (the default) answers them with a 404 and redirect sends them to
+	// the hub's page. A route marked as the default serves them instead. The liveness,
+	// readiness and metrics endpoints are served on every host. Without a host, the hub
+	// is served on every host that is not routed.
+	UnknownHosts string `json:"unknown-hosts"`
+
+	// The number of times in quick succession a user can be redirected to authenticate
+	// before underpants decides authentication is looping and shows a diagnostic page
+	// instead. Defaults to 5, a negative value disables loop detection.
+	MaxAuthRedirects int `json:"max-auth-redirects"`
+
+	// TLS certificiate files to enable https on the hub and endpoints. TLS is highly
+	// recommended and it is global. You cannot run some routes over HTTP and others over
+	// HTTPS. If you need to do this, you should use two instances of underpants (one on
+	// port 80 and the other on 443).
+	Certs []CertInfo
+
+	// Obtain certificates automatically instead of loading them from Certs. This
+	// enables https just as Certs does.
+	Autocert *AutocertInfo `json:"autocert"`
+
+	// Serve HTTP/2 as well as HTTP/1.1, which gRPC clients require. Over https it is
+	// negotiated with ALPN, otherwise clients must use h2c with prior knowledge.
+	HTTP2 bool `json:"http2"`
+
+	// When serving https, the port of a plain http listener that redirects every
+	// request to https. Zero, the default, disables the listener.
+	HTTPRedirectPort int `json:"http-redirect-port"`
+
+	// The addresses underpants listens on, replacing the -port flag,
+	// http-redirect-port and admin.addr. Routes and the hub are reached on the port of
+	// the first proxy listener.
+	Listeners []*ListenerInfo `json:"listeners"`
+
+	// The number of seconds in-flight requests are given to finish when underpants is
+	// asked to stop with SIGTERM or SIGINT. Connections still open after that are
+	// closed. Defaults to 30.
+	DrainTimeout int `json:"drain-timeout"`
+
+	// The minimum TLS version ("1.0", "1.1", "1.2" or "1.3") accepted by the https
+	// listener. Defaults to 1.0.
+	TLSMinVersion string `json:"tls-min-version"`
+
+	tlsMinVersion uint16
+
+	// The names of the cipher suites (e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256)
+	// offered for TLS 1.2 and earlier. If none are given, a default set is used.
+	TLSCipherSuites []string `json:"tls-cipher-suites"`
+
+	tlsCipherSuites []uint16
+
+	// Files of PEM encoded CA certificates. Clients of the https listener that present
+	// a certificate issued by one of these CAs are signed in as the identity in the
+	// certificate without being sent to the identity provider.
+	ClientCAs []string `json:"client-cas"`
+
+	clientCAs *x509.CertPool
+
+	// A mapping of group names to lists of user email addresses that are members
+	// of that group.  If this section is present, then the default behaviour for
+	// a route is to deny all users not in a group on its allowed-groups list.
+	Groups map[string][]string
+
+	// The groups whose members are allowed to use the administrative endpoints. If no
+	// admin groups are configured, the administrative endpoints are unavailable.
+	AdminGroups []string `json:"admin-groups"`
+
+	// How the administrative API is reached.
+	Admin AdminInfo `json:"admin"`
+
+	// The mappings from hostname to backend server.
+	Routes []*RouteInfo
+
+	// A key-value store that further routes are read from and watched for changes.
+	RouteSource *RouteSourceInfo `json:"route-source"`
+
+	// The email of the user that everyone is signed in as, without an identity
+	// provider, when developing locally. It is set with the --dev-user flag and is
+	// never read from the config file.
+	DevUser string `json:"-"`
+}
+
+// ListenerPort is the port of the first proxy listener, which is the port routes and
+// the hub are reached on. It is 0 if there are no listeners.
+func (i *Info) ListenerPort() int {
+	for _, l := range i.Listeners {
+		if l.Serve == ListenerProxy {
+			return l.port
+		}
+	}
+	return 0
+}
+
+// HasAdminListener determines if the administrative API is served by a listener of
+// its own rather than on the hub.
+func (i *Info) HasAdminListener() bool {
+	if i.Admin.Addr != "" {
+		return true
+	}
+
+	for _, l := range i.Listeners {
+		if l.Serve == ListenerAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrorPage is the template configured for responses with the status code, it is nil
+// if underpants' own page is used.
+func (i *Info) ErrorPage(status int) *template.Template {
+	return i.errorPages[status]
+}
+
+// HasCerts is used to dermine if the instance is running over HTTP or HTTPS, this indicates whether
+// any certificates were included in the configuration or are obtained through autocert.
+func (i *Info) HasCerts() bool {
+	return len(i.Certs) > 0 || i.Autocert != nil
+}
+
+// IsSecure determines if clients reach underpants over https, either because it
+// serves https itself or because trusted proxies terminate TLS in front of it.
+func (i *Info) IsSecure() bool {
+	return i.HasCerts() || (i.TrustedProxies != nil && i.TrustedProxies.TerminatesTLS)
+}
+
+// TLSVersion is the minimum TLS version accepted by the https listener.
+func (i *Info) TLSVersion() uint16 {
+	return i.tlsMinVersion
+}
+
+// CipherSuites are the cipher suites offered by the https listener.
+func (i *Info) CipherSuites() []uint16 {
+	return i.tlsCipherSuites
+}
+
+// ClientCertPool is the pool of CAs that issue client certificates accepted in place
+// of signing in, or nil if client certificates are not accepted.
+func (i *Info) ClientCertPool() *x509.CertPool {
+	return i.clientCAs
+}
+
+// HasGroups is used to determine if the instance is configured for more granular group-based access
+// control lists.
+func (i *Info) HasGroups() bool {
+	return len(i.Groups) > 0
+}
+
+// Scheme is a convience method for getting the relevant scheme based on whether certificates were
+// included in the configuration.
+func (i *Info) Scheme() string {
+	if i.IsSecure() {
+		return "https"
+	}
+	return "http"
+}
+
+// initRoute initializes a RouteInfo by parsing and validating its contents.
+// tlsVersions are the names of the versions allowed in tls-min-version.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// defaultCipherSuites are offered when tls-cipher-suites is not given.
+var defaultCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+}
+
+func initTLS(n *Info) error {
+	n.tlsMinVersion = tls.VersionTLS10
+	if n.TLSMinVersion != "" {
+		v, ok := tlsVersions[n.TLSMinVersion]
+		if !ok {
+			return fmt.Errorf("invalid tls-min-version: %s", n.TLSMinVersion)
+		}
+		n.tlsMinVersion = v
+	}
+
+	n.tlsCipherSuites = defaultCipherSuites
+	if len(n.TLSCipherSuites) > 0 {
+		ids := map[string]uint16{}
+		for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			ids[cs.Name] = cs.ID
+		}
+
+		n.tlsCipherSuites = nil
+		for _, name := range n.TLSCipherSuites {
+			id, ok := ids[name]
+			if !ok {
+				return fmt.Errorf("invalid tls cipher suite: %s", name)
+			}
+			n.tlsCipherSuites = append(n.tlsCipherSuites, id)
+		}
+	}
+
+	if a := n.Autocert; a != nil {
+		if len(n.Certs) > 0 {
+			return errors.New("certs and autocert cannot both be used")
+		}
+
+		if a.CacheDir == "" {
+			a.CacheDir = defaultAutocertCacheDir
+		}
+	}
+
+	n.clientCAs = nil
+	if len(n.ClientCAs) > 0 {
+		if !n.HasCerts() {
+			return errors.New("client-cas requires certs")
+		}
+
+		p, err := loadCertPool(n.ClientCAs...)
+		if err != nil {
+			return fmt.Errorf("invalid client-cas: %s", err)
+		}
+		n.clientCAs = p
+	}
+
+	for _, route := range n.Routes {
+		if route.Cert != nil && !n.HasCerts() {
+			return fmt.Errorf("Route %s is invalid: a route cert requires certs for the hub",
+				route.From)
+		}
+	}
+
+	return nil
+}
+
+// validateAccess ensures the globs in allow and deny lists are valid.
+func validateAccess(lists ...[]string) error {
+	for _, list := range lists {
+		for _, entry := range list {
+			if !strings.Contains(entry, "@") {
+				continue
+			}
+
+			if _, err := path.Match(entry, ""); err != nil {
+				return fmt.Errorf("invalid access entry %q: %s", entry, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validateGuests ensures each guest is a single email address.
+func validateGuests(guests []string) error {
+	for _, g := range guests {
+		if strings.Count(g, "@") != 1 || strings.ContainsAny(g, "*?[") {
+			return fmt.Errorf("invalid guest %q: guests must be email addresses", g)
+		}
+	}
+	return nil
+}
+
+// initTemplate checks the use of * in the host of a backend URL, which is only allowed
+// once and in wildcard routes, and marks the route as templated if it is used.
+func (r *RouteInfo) initTemplate(u *url.URL) error {
+	switch strings.Count(u.Host, "*") {
+	case 0:
+		return nil
+	case 1:
+		if !r.IsWildcard() {
+			return fmt.Errorf("%s uses * but from is not a wildcard", u)
+		}
+		r.templated = true
+		return nil
+	}
+	return fmt.Errorf("%s uses * more than once", u)
+}
+
+func initRoute(r *RouteInfo) error {
+	if len(r.To) == 0 {
+		return errors.New("To is required")
+	}
+
+	host, prefix := r.Host(), r.PathPrefix()
+	if strings.Contains(host, "*") &&
+		(!r.IsWildcard() || strings.Count(host, "*") != 1 || len(host) < 3) {
+		return fmt.Errorf("invalid from %s: wildcards must be of the form *.example.com", r.From)
+	}
+
+	if strings.HasPrefix(prefix, "/__") {
+		return fmt.Errorf("invalid from %s: paths starting with /__ are reserved", r.From)
+	}
+
+	if r.Default && (prefix != "" || r.IsWildcard()) {
+		return errors.New("the default route cannot have a path or a wildcard in from")
+	}
+
+	if prefix != "" && (r.Domain != "" || len(r.Guests) > 0) {
+		return errors.New("domain and guests apply to a whole host and cannot be set with a path")
+	}
+
+	switch r.StripPrefix {
+	case "":
+		r.stripPrefix = ""
+	case "true":
+		if prefix == "" {
+			return errors.New("strip-prefix needs a path in from")
+		}
+		r.stripPrefix = prefix
+	default:
+		if !strings.HasPrefix(string(r.StripPrefix), "/") {
+			return fmt.Errorf("invalid strip-prefix %s: it must start with /", r.StripPrefix)
+		}
+		r.stripPrefix = strings.TrimRight(string(r.StripPrefix), "/")
+	}
+
+	if r.AddPrefix != "" {
+		if !strings.HasPrefix(r.AddPrefix, "/") {
+			return fmt.Errorf("invalid add-prefix %s: it must start with /", r.AddPrefix)
+		}
+		r.AddPrefix = strings.TrimRight(r.AddPrefix, "/")
+	}
+
+	r.templated = false
+	r.toURLs = nil
+	r.sockets = nil
+	r.staticDir = ""
+	r.consul = false
+	for i, to := range r.To {
+		u, err := url.Parse(to)
+		if err != nil {
+			return fmt.Errorf("invalid To URL: %s", err)
+		}
+
+		if (u.Scheme == "consul") != r.consul && i > 0 {
+			return errors.New("consul backends cannot be mixed with other backends")
+		}
+
+		if u.Scheme == "consul" {
+			if u.Host == "" || u.Port() != "" {
+				return fmt.Errorf("invalid To URL: %s must be of the form consul://service-name", to)
+			}
+
+			// the service name stands in for the instances until they are found.
+			r.consul = true
+			u.Scheme = "http"
+			r.toURLs = append(r.toURLs, u)
+			continue
+		}
+
+		if u.Scheme == "file" {
+			if len(r.To) > 1 || u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+				return fmt.Errorf("invalid To URL: %s must be the only backend and of the form file:///path/to/dir", to)
+			}
+
+			if fi, err := os.Stat(u.Path); err != nil || !fi.IsDir() {
+				return fmt.Errorf("invalid To URL: %s is not a directory", to)
+			}
+
+			// files are requested by their path within the directory.
+			r.staticDir = u.Path
+			r.toURLs = append(r.toURLs, &url.URL{Scheme: "file", Path: "/"})
+			continue
+		}
+
+		if u.Scheme == "unix" {
+			if u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+				return fmt.Errorf("invalid To URL: %s must be of the form unix:///path/to.sock", to)
+			}
+			r.toURLs = append(r.toURLs, r.addSocket(u.Path))
+			continue
+		}
+
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid To URL: %s is not an http or https URL", to)
+		}
+
+		if err := r.initTemplate(u); err != nil {
+			return fmt.Errorf("invalid To URL: %s", err)
+		}
+		r.toURLs = append(r.toURLs, u)
+	}
+
+	switch r.Redirect {
+	case 0:
+	case http.StatusMovedPermanently, http.StatusFound:
+		if len(r.To) > 1 || r.consul || len(r.sockets) > 0 || r.staticDir != "" {
+			return errors.New("redirect routes need a single http or https To URL")
+		}
+	default:
+		return fmt.Errorf("invalid redirect: %d", r.Redirect)
+	}
+
+	switch r.Balance {
+	case "":
+		r.Balance = BalanceRoundRobin
+	case BalanceRoundRobin, BalanceLeastConnections:
+	default:
+		return fmt.Errorf("invalid balance: %s", r.Balance)
+	}
+
+	if r.MaxBodyBytes < 0 {
+		return errors.New("max-body-bytes cannot be negative")
+	}
+
+	switch r.Affinity {
+	case "", AffinityCookie, AffinityEmail:
+	default:
+		return fmt.Errorf("invalid affinity: %s", r.Affinity)
+	}
+
+	if len(r.To) > 1 && len(r.Failover) > 0 {
+		return errors.New("failover cannot be used with multiple To backends")
+	}
+
+	var err error
+
+	if r.ipAllow, err = parseNets(r.IPAllow); err != nil {
+		return fmt.Errorf("invalid ip-allow: %s", err)
+	}
+
+	if r.ipDeny, err = parseNets(r.IPDeny); err != nil {
+		return fmt.Errorf("invalid ip-deny: %s", err)
+	}
+
+	if err := validateAccess(r.Allow, r.Deny); err != nil {
+		return err
+	}
+
+	r.allowFile = nil
+	if r.AllowFile != "" {
+		f, err := loadAllowFile(r.AllowFile)
+		if err != nil {
+			return fmt.Errorf("invalid allow-file: %s", err)
+		}
+		r.allowFile = f
+	}
+
+	if err := validateGuests(r.Guests); err != nil {
+		return err
+	}
+
+	r.pathRules = nil
+	for _, p := range r.PublicPaths {
+		r.pathRules = append(r.pathRules, &PathRuleInfo{Path: p, Public: true})
+	}
+	r.pathRules = append(r.pathRules, r.Paths...)
+
+	for _, p := range r.pathRules {
+		if !strings.HasPrefix(p.Path, "/") {
+			return fmt.Errorf("invalid path rule %q: paths must start with /", p.Path)
+		}
+
+		if p.Public && (len(p.AllowedGroups) > 0 || len(p.Allow) > 0 || len(p.Deny) > 0 || p.StepUp != 0) {
+			return fmt.Errorf("invalid path rule %q: public paths cannot restrict access", p.Path)
+		}
+
+		if p.StepUp < 0 {
+			return fmt.Errorf("invalid path rule %q: step-up cannot be negative", p.Path)
+		}
+
+		if err := validateAccess(p.Allow, p.Deny); err != nil {
+			return err
+		}
+	}
+
+	r.failoverURLs = nil
+	for _, to := range r.Failover {
+		u, err := url.Parse(to)
+		if err != nil {
+			return fmt.Errorf("invalid failover URL: %s", err)
+		}
+
+		if err := r.initTemplate(u); err != nil {
+			return fmt.Errorf("invalid failover URL: %s", err)
+		}
+		r.failoverURLs = append(r.failoverURLs, u)
+	}
+
+	if r.FailoverCooldown <= 0 {
+		r.FailoverCooldown = defaultFailoverCooldown
+	}
+
+	if rs := r.Resolve; rs != nil {
+		if err := r.initResolve(rs); err != nil {
+			return err
+		}
+	}
+
+	if r.consul && len(r.Failover) > 0 {
+		return errors.New("consul backends cannot be used with failover")
+	}
+
+	if r.staticDir != "" && (len(r.Failover) > 0 || r.Resolve != nil || r.Canary != nil || r.Mirror != nil) {
+		return errors.New("file backends cannot be used with failover, resolve, canary or mirror")
+	}
+
+	if err := r.initWeights(); err != nil {
+		return err
+	}
+
+	if c := r.Canary; c != nil {
+		if err := r.initCanary(c); err != nil {
+			return err
+		}
+	}
+
+	if m := r.Mirror; m != nil {
+		if err := r.initMirror(m); err != nil {
+			return err
+		}
+	}
+
+	if rt := r.Retry; rt != nil {
+		if err := initRetry(rt); err != nil {
+			return err
+		}
+	}
+
+	if rl := r.RateLimit; rl != nil {
+		if rl.Rate <= 0 {
+			return errors.New("rate-limit.rate must be positive")
+		}
+
+		if rl.Burst <= 0 {
+			rl.Burst = int(math.Ceil(rl.Rate))
+		}
+	}
+
+	if cb := r.CircuitBreaker; cb != nil {
+		if err := initCircuitBreaker(cb); err != nil {
+			return err
+		}
+	}
+
+	if c := r.Concurrency; c != nil {
+		if c.MaxInFlight <= 0 {
+			return errors.New("concurrency.max-in-flight must be positive")
+		}
+
+		if c.Queue < 0 {
+			return fmt.Errorf("invalid concurrency queue: %d", c.Queue)
+		}
+
+		if c.QueueTimeoutMs <= 0 {
+			c.QueueTimeoutMs = defaultQueueTimeoutMs
+		}
+	}
+
+	if len(r.AllowedMethods) == 0 {
+		r.AllowedMethods = append([]string(nil), defaultAllowedMethods...)
+	}
+
+	r.allowedMethods = map[string]bool{}
+	for i, method := range r.AllowedMethods {
+		if method == "" || strings.ContainsAny(method, " \t,") {
+			return fmt.Errorf("invalid allowed method: %q", method)
+		}
+
+		r.AllowedMethods[i] = strings.ToUpper(method)
+		r.allowedMethods[r.AllowedMethods[i]] = true
+	}
+
+	switch r.CookieCollision {
+	case "":
+		r.CookieCollision = CookieCollisionRename
+	case CookieCollisionRename, CookieCollisionDrop, CookieCollisionRefuse:
+	default:
+		return fmt.Errorf("invalid cookie-collision: %s", r.CookieCollision)
+	}
+
+	switch r.BackendProtocol {
+	case "":
+		r.BackendProtocol = BackendProtocolAuto
+	case BackendProtocolAuto, BackendProtocolHTTP1:
+	case BackendProtocolH2:
+		if !r.allSchemes("https") {
+			return errors.New("backend-protocol h2 requires https backends")
+		}
+	case BackendProtocolH2C:
+		if !r.allSchemes("http") {
+			return errors.New("backend-protocol h2c requires http backends")
+		}
+	default:
+		return fmt.Errorf("invalid backend-protocol: %s", r.BackendProtocol)
+	}
+
+	if r.HealthCheck == nil {
+		r.HealthCheck = &HealthCheckInfo{}
+	}
+
+	if r.HealthCheck.Method == "" {
+		r.HealthCheck.Method = "HEAD"
+	}
+
+	if r.HealthCheck.Path == "" {
+		r.HealthCheck.Path = "/"
+	}
+
+	if hc := r.HealthCheck; hc.Interval > 0 {
+		if r.templated {
+			return errors.New("health-check interval cannot be used with backends that depend on the subdomain")
+		}
+
+		if hc.TimeoutMs <= 0 {
+			hc.TimeoutMs = defaultHealthCheckTimeoutMs
+		}
+
+		if hc.HealthyThreshold <= 0 {
+			hc.HealthyThreshold = defaultHealthyThreshold
+		}
+
+		if hc.UnhealthyThreshold <= 0 {
+			hc.UnhealthyThreshold = defaultUnhealthyThreshold
+		}
+	}
+
+	if c := r.BodyCapture; c != nil {
+		if err := initBodyCapture(c); err != nil {
+			return err
+		}
+	}
+
+	if m := r.Maintenance; m != nil {
+		if err := initMaintenance(m); err != nil {
+			return err
+		}
+	}
+
+	r.backendTLS = nil
+	if t := r.BackendTLS; t != nil {
+		c, err := newBackendTLSConfig(t)
+		if err != nil {
+			return err
+		}
+		r.backendTLS = c
+	}
+
+	r.signingKey = nil
+	if sg := r.RequestSigning; sg != nil {
+		k, err := signingKey(sg)
+		if err != nil {
+			return err
+		}
+		r.signingKey = k
+	}
+
+	if err := initHeaderRules(r.RequestHeaders, "request-headers"); err != nil {
+		return err
+	}
+
+	if err := initHeaderRules(r.ResponseHeaders, "response-headers"); err != nil {
+		return err
+	}
+
+	if err := validateSecurityHeaders(r.SecurityHeaders); err != nil {
+		return err
+	}
+
+	if k := r.APIKeys; k != nil {
+		if err := initAPIKeys(k); err != nil {
+			return err
+		}
+	}
+
+	if c := r.CORS; c != nil {
+		if err := initCORS(c, r.AllowedMethods); err != nil {
+			return err
+		}
+	}
+
+	if s := r.Session; s != nil {
+		if s.MaxAge < 0 {
+			return fmt.Errorf("invalid session max-age: %d", s.MaxAge)
+		}
+
+		if s.ReauthAfter < 0 {
+			return fmt.Errorf("invalid session reauth-after: %d", s.ReauthAfter)
+		}
+	}
+
+	return nil
+}
+
+// allowFile holds the entries of a route's allow-file, as of when it was last read.
+type allowFile struct {
+	name string
+
+	lck     sync.RWMutex
+	entries []string
+	modTime time.Time
+	size    int64
+}
+
+// loadAllowFile reads the entries of an allow-file.
+func loadAllowFile(name string) (*allowFile, error) {
+	f := &allowFile{name: name}
+	if _, err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// reload reads the file again if it has changed since it was last read, returning
+// whether it had. If the file cannot be read, or has invalid entries, the entries
+// that were read before are kept.
+func (f *allowFile) reload() (bool, error) {
+	fi, err := os.Stat(f.name)
+	if err != nil {
+		return false, err
+	}
+
+	f.lck.RLock()
+	same := fi.ModTime().Equal(f.modTime) && fi.Size() == f.size
+	f.lck.RUnlock()
+	if same {
+		return false, nil
+	}
+
+	b, err := ioutil.ReadFile(f.name)
+	if err != nil {
+		return false, err
+	}
+
+	var entries []string
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+
+	if err := validateAccess(entries); err != nil {
+		return false, err
+	}
+
+	f.lck.Lock()
+	defer f.lck.Unlock()
+	f.entries = entries
+	f.modTime = fi.ModTime()
+	f.size = fi.Size()
+	return true, nil
+}
+
+// AllowEntries are the entries of the route's allow list, followed by those of its
+// allow-file.
+func (r *RouteInfo) AllowEntries() []string {
+	if r.allowFile == nil {
+		return r.Allow
+	}
+
+	r.allowFile.lck.RLock()
+	defer r.allowFile.lck.RUnlock()
+	return append(append([]string(nil), r.Allow...), r.allowFile.entries...)
+}
+
+// ReloadAllowFile reads the route's allow-file again if it has changed, returning
+// whether it had. The entries read before are kept if it cannot be read.
+func (r *RouteInfo) ReloadAllowFile() (bool, error) {
+	if r.allowFile == nil {
+		return false, nil
+	}
+	return r.allowFile.reload()
+}
+
+// initCORS validates a route's cors and fills in its defaults.
+func initCORS(c *CORSInfo, methods []string) error {
+	if len(c.AllowedOrigins) == 0 {
+		return errors.New("cors needs at least one allowed origin")
+	}
+
+	for _, o := range c.AllowedOrigins {
+		if _, err := path.Match(o, ""); err != nil {
+			return fmt.Errorf("invalid cors origin %q: %s", o, err)
+		}
+
+		if c.AllowCredentials && !isNarrowOrigin(o) {
+			return fmt.Errorf("invalid cors origin %q: allow-credentials needs origins within a domain, such as https://*.example.com", o)
+		}
+	}
+
+	if len(c.AllowedMethods) == 0 {
+		c.AllowedMethods = append([]string(nil), methods...)
+	}
+
+	for i, method := range c.AllowedMethods {
+		c.AllowedMethods[i] = strings.ToUpper(method)
+	}
+
+	if c.MaxAge < 0 {
+		return fmt.Errorf("invalid cors max-age: %d", c.MaxAge)
+	}
+
+	return nil
+}
+
+// isNarrowOrigin determines if the origin pattern only matches origins within a known
+// domain: its scheme and all but the first label of its host are literal, and the
+// host has at least three labels if the first is a pattern. Pages on any origin it
+// matches can read responses meant for signed in users once credentials are allowed.
+func isNarrowOrigin(o string) bool {
+	i := strings.Index(o, "://")
+	if i <= 0 || strings.ContainsAny(o[:i], `*?[\`) {
+		return false
+	}
+
+	host := o[i+3:]
+	j := strings.IndexByte(host, '.')
+	if j < 0 {
+		return !strings.ContainsAny(host, `*?[\`)
+	}
+
+	rest := host[j+1:]
+	if strings.ContainsAny(rest, `*?[\`) {
+		return false
+	}
+	return !strings.ContainsAny(host[:j], `*?[\`) || strings.Contains(rest, ".")
+}
+
+// initResolve validates a route's resolve and fills in its defaults. Backends found by
+// address are connected to by IP, so https backends need a server-name to verify.
+func (r *RouteInfo) initResolve(rs *ResolveInfo) error {
+	if r.templated || r.HasSockets() {
+		return errors.New("resolve cannot be used with backends that depend on the subdomain or unix sockets")
+	}
+
+	if len(r.Failover) > 0 {
+		return errors.New("resolve cannot be used with failover")
+	}
+
+	if r.consul {
+		return errors.New("resolve cannot be used with consul backends")
+	}
+
+	if !rs.SRV && !r.allSchemes("http") &&
+		(r.BackendTLS == nil || r.BackendTLS.ServerName == "") {
+		return errors.New("resolve needs a backend-tls server-name for https backends")
+	}
+
+	if rs.Interval <= 0 {
+		rs.Interval = defaultResolveInterval
+	}
+
+	return nil
+}
+
+// initWeights validates the weights of a route's backends, which must be given for
+// each of a fixed set of backends.
+func (r *RouteInfo) initWeights() error {
+	if len(r.Weights) == 0 {
+		return nil
+	}
+
+	if r.IsResolved() {
+		return errors.New("weights cannot be used with resolved backends")
+	}
+
+	if len(r.Weights) != len(r.To) {
+		return fmt.Errorf("expected %d weights, one for each To backend", len(r.To))
+	}
+
+	var total int
+	for _, w := range r.Weights {
+		if w < 0 {
+			return fmt.Errorf("invalid weight: %d", w)
+		}
+		total += w
+	}
+
+	if total == 0 {
+		return errors.New("at least one weight must be positive")
+	}
+
+	return nil
+}
+
+// initCanary validates a route's canary and parses its backend URL.
+func (r *RouteInfo) initCanary(c *CanaryInfo) error {
+	u, err := url.Parse(c.To)
+	if err != nil {
+		return fmt.Errorf("invalid canary URL: %s", err)
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid canary URL: %s is not an http or https URL", c.To)
+	}
+
+	if err := r.initTemplate(u); err != nil {
+		return fmt.Errorf("invalid canary URL: %s", err)
+	}
+
+	if c.Percent < 0 || c.Percent > 100 {
+		return fmt.Errorf("invalid canary percent: %g", c.Percent)
+	}
+
+	if err := validateAccess(c.Users); err != nil {
+		return err
+	}
+
+	c.toURL = u
+	return nil
+}
+
+// initMirror validates a route's mirror, parses its backend URL and fills in its
+// defaults.
+func (r *RouteInfo) initMirror(m *MirrorInfo) error {
+	u, err := url.Parse(m.To)
+	if err != nil {
+		return fmt.Errorf("invalid mirror URL: %s", err)
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid mirror URL: %s is not an http or https URL", m.To)
+	}
+
+	if err := r.initTemplate(u); err != nil {
+		return fmt.Errorf("invalid mirror URL: %s", err)
+	}
+
+	if m.Percent < 0 || m.Percent > 100 {
+		return fmt.Errorf("invalid mirror percent: %g", m.Percent)
+	}
+
+	if m.Percent == 0 {
+		m.Percent = 100
+	}
+
+	for i, method := range m.Methods {
+		m.Methods[i] = strings.ToUpper(method)
+	}
+
+	if m.TimeoutMs <= 0 {
+		m.TimeoutMs = defaultMirrorTimeoutMs
+	}
+
+	m.toURL = u
+	return nil
+}
+
+// initAPIKeys validates a route's api keys and fills in their defaults.
+func initAPIKeys(k *APIKeysInfo) error {
+	if k.Header == "" {
+		k.Header = defaultAPIKeyHeader
+	}
+
+	if len(k.Keys) == 0 {
+		return errors.New("api-keys needs at least one key")
+	}
+
+	seen := map[string]bool{}
+	for _, key := range k.Keys {
+		h, err := hex.DecodeString(key.SHA256)
+		if err != nil || len(h) != sha256.Size {
+			return fmt.Errorf("invalid api key sha256 %q: must be 64 hex digits", key.SHA256)
+		}
+
+		if seen[string(h)] {
+			return fmt.Errorf("duplicate api key sha256 %q", key.SHA256)
+		}
+		seen[string(h)] = true
+
+		if key.Email == "" {
+			return fmt.Errorf("api key %q needs an email", key.SHA256)
+		}
+
+		key.hash = h
+	}
+
+	return nil
+}
+
+// initHeaderRules validates a route's header rules and compiles its rewrites.
+func initHeaderRules(h *HeaderRulesInfo, name string) error {
+	if h == nil {
+		return nil
+	}
+
+	for _, rw := range h.Rewrite {
+		if rw.Header == "" {
+			return fmt.Errorf("%s.rewrite needs a header", name)
+		}
+
+		re, err := regexp.Compile(rw.Match)
+		if err != nil {
+			return fmt.Errorf("invalid %s.rewrite match for %s: %s", name, rw.Header, err)
+		}
+		rw.match = re
+	}
+
+	return nil
+}
+
+// validateSecurityHeaders ensures that the security headers are valid header fields.
+func validateSecurityHeaders(h map[string]string) error {
+	for name, val := range h {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+			return fmt.Errorf("invalid security header name: %q", name)
+		}
+
+		if strings.ContainsAny(val, "\r\n") {
+			return fmt.Errorf("invalid value for security header %s", name)
+		}
+	}
+	return nil
+}
+
+// SecurityHeadersFor is the set of security headers added to the responses of the
+// route, or of the hub if route is nil, keyed by canonical header name.
+func (i *Info) SecurityHeadersFor(route *RouteInfo) map[string]string {
+	h := map[string]string{}
+	for name, val := range i.SecurityHeaders {
+		h[http.CanonicalHeaderKey(name)] = val
+	}
+
+	if route != nil {
+		for name, val := range route.SecurityHeaders {
+			h[http.CanonicalHeaderKey(name)] = val
+		}
+	}
+
+	for name, val := range h {
+		if val == "" {
+			delete(h, name)
+		}
+	}
+	return h
+}
+
+// allSchemes determines if all of the route's To backends use the scheme.
+func (r *RouteInfo) allSchemes(scheme string) bool {
+	for _, u := range r.toURLs {
+		if u.Scheme != scheme {
+			return false
+		}
+	}
+	return true
+}
+
+// initRetry validates a route's retry and fills in its defaults.
+func initRetry(rt *RetryInfo) error {
+	if rt.Count < 0 {
+		return errors.New("retry.count cannot be negative")
+	}
+
+	if rt.Count == 0 {
+		rt.Count = defaultRetryCount
+	}
+
+	if rt.BackoffMs < 0 {
+		return errors.New("retry.backoff-ms cannot be negative")
+	}
+
+	if rt.BackoffMs == 0 {
+		rt.BackoffMs = defaultRetryBackoffMs
+	}
+
+	if len(rt.StatusCodes) == 0 {
+		rt.StatusCodes = defaultRetryStatusCodes
+	}
+
+	for _, code := range rt.StatusCodes {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("invalid retry status code: %d", code)
+		}
+	}
+
+	return nil
+}
+
+// initCircuitBreaker validates a route's circuit-breaker and fills in its defaults.
+func initCircuitBreaker(cb *CircuitBreakerInfo) error {
+	if cb.Window <= 0 {
+		cb.Window = defaultBreakerWindow
+	}
+
+	if cb.MinRequests <= 0 {
+		cb.MinRequests = defaultBreakerMinRequests
+	}
+
+	if cb.ErrorRate == 0 {
+		cb.ErrorRate = defaultBreakerErrorRate
+	}
+
+	if cb.ErrorRate < 0 || cb.ErrorRate > 1 {
+		return fmt.Errorf("invalid circuit-breaker error-rate: %v", cb.ErrorRate)
+	}
+
+	if cb.OpenFor <= 0 {
+		cb.OpenFor = defaultBreakerOpenFor
+	}
+
+	return nil
+}
+
+// initLog validates the log and fills in its defaults.
+func initLog(l *LogInfo) error {
+	if l.Level == "" {
+		l.Level = "info"
+	}
+
+	if !logLevels[l.Level] {
+		return fmt.Errorf("invalid log level: %s", l.Level)
+	}
+
+	switch l.Format {
+	case "":
+		l.Format = LogFormatJSON
+	case LogFormatJSON, LogFormatConsole:
+	default:
+		return fmt.Errorf("invalid log format: %s", l.Format)
+	}
+
+	return nil
+}
+
+// initTransport fills in the defaults of the backend transport.
+func initTransport(t *TransportInfo) {
+	if t.MaxIdleConns == 0 {
+		t.MaxIdleConns = defaultMaxIdleConns
+	}
+
+	if t.MaxIdleConnsPerHost == 0 {
+		t.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+
+	if t.IdleConnTimeout == 0 {
+		t.IdleConnTimeout = defaultIdleConnTimeout
+	}
+
+	if t.DialTimeout == 0 {
+		t.DialTimeout = defaultDialTimeout
+	}
+}
+
+// signingKey reads the shared secret of a route's request signing.
+func signingKey(sg *RequestSigningInfo) ([]byte, error) {
+	if (sg.Secret == "") == (sg.SecretEnv == "") {
+		return nil, errors.New("request-signing requires exactly one of secret and secret-env")
+	}
+
+	if sg.Secret != "" {
+		return []byte(sg.Secret), nil
+	}
+
+	v := os.Getenv(sg.SecretEnv)
+	if v == "" {
+		return nil, fmt.Errorf("request-signing secret-env %s is empty", sg.SecretEnv)
+	}
+	return []byte(v), nil
+}
+
+// newBackendTLSConfig creates the tls.Config used to connect to a route's backends.
+func newBackendTLSConfig(t *BackendTLSInfo) (*tls.Config, error) {
+	c := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+
+	if cc := t.ClientCert; cc != nil {
+		crt, err := tls.LoadX509KeyPair(cc.Crt, cc.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid backend-tls client-cert: %s", err)
+		}
+		c.Certificates = []tls.Certificate{crt}
+	}
+
+	if t.CA == "" {
+		return c, nil
+	}
+
+	p, err := loadCertPool(t.CA)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend-tls ca: %s", err)
+	}
+	c.RootCAs = p
+
+	return c, nil
+}
+
+// loadCertPool creates a pool of the certificates in the given PEM files.
+func loadCertPool(files ...string) (*x509.CertPool, error) {
+	p := x509.NewCertPool()
+	for _, file := range files {
+		pem, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		if !p.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", file)
+		}
+	}
+	return p, nil
+}
+
+// initCookie applies defaults to the cookie attributes and validates them.
+func initCookie(c *CookieInfo, https bool) error {
+	if c.Name == "" {
+		c.Name = defaultCookieName
+	}
+
+	if strings.ContainsAny(c.Name, " \t;,=") {
+		return fmt.Errorf("invalid cookie.name: %q", c.Name)
+	}
+
+	if c.MaxAge <= 0 {
+		c.MaxAge = defaultCookieMaxAge
+	}
+
+	if c.Secure == nil {
+		c.Secure = &https
+	}
+
+	if c.HTTPOnly == nil {
+		httpOnly := true
+		c.HTTPOnly = &httpOnly
+	}
+
+	switch strings.ToLower(c.SameSite) {
+	case "", "lax":
+		c.sameSite = http.SameSiteLaxMode
+	case "strict":
+		c.sameSite = http.SameSiteStrictMode
+	case "none":
+		if !*c.Secure {
+			return errors.New("cookie.same-site none requires a secure cookie")
+		}
+		c.sameSite = http.SameSiteNoneMode
+	default:
+		return fmt.Errorf("invalid cookie.same-site: %s", c.SameSite)
+	}
+
+	return nil
+}
+
+// initKey ensures exactly one source is given for the session key and applies defaults
+// to it.
+func initKey(k *KeyInfo) error {
+	n := 0
+	for _, set := range []bool{k.File != "", k.Env != "", k.Vault != nil} {
+		if set {
+			n++
+		}
+	}
+
+	if n != 1 {
+		return errors.New("session.key must have exactly one of file, env or vault")
+	}
+
+	if v := k.Vault; v != nil {
+		if v.Address == "" || v.Path == "" {
+			return errors.New("session.key.vault requires an address and path")
+		}
+
+		v.Address = strings.TrimRight(v.Address, "/")
+
+		if v.Field == "" {
+			v.Field = defaultVaultField
+		}
+
+		if v.TokenEnv == "" {
+			v.TokenEnv = defaultVaultTokenEnv
+		}
+	}
+
+	return nil
+}
+
+// initBodyCapture applies defaults to a BodyCaptureInfo and compiles its redaction
+// patterns.
+func initBodyCapture(c *BodyCaptureInfo) error {
+	if c.MaxBytes <= 0 {
+		c.MaxBytes = defaultCaptureMaxBytes
+	}
+
+	pats := c.Redact
+	if len(pats) == 0 {
+		pats = defaultRedactions
+	}
+
+	c.redact = nil
+	for _, pat := range pats {
+		re, err := regexp.Compile(pat)
+		if err != nil {
+			return fmt.Errorf("invalid body-capture redaction %q: %s", pat, err)
+		}
+		c.redact = append(c.redact, re)
+	}
+
+	return nil
+}
+
+// initMaintenance applies defaults to a MaintenanceInfo and reads its page.
+func initMaintenance(m *MaintenanceInfo) error {
+	if m.RetryAfter < 0 {
+		return fmt.Errorf("invalid maintenance.retry-after: %d", m.RetryAfter)
+	}
+
+	if m.RetryAfter == 0 {
+		m.RetryAfter = defaultMaintenanceRetryAfter
+	}
+
+	m.page = nil
+	if m.Page != "" {
+		b, err := ioutil.ReadFile(m.Page)
+		if err != nil {
+			return fmt.Errorf("unable to read maintenance.page: %s", err)
+		}
+		m.page = b
+	}
+
+	return nil
+}
+
+// AllowedDomains is the list of hosted domains whose users may sign in, combining
+// domain with domains. It is empty if users of any domain may sign in.
+func (o *OAuthInfo) AllowedDomains() []string {
+	if o.Domain == "" {
+		return o.Domains
+	}
+
+	for _, d := range o.Domains {
+		if strings.EqualFold(d, o.Domain) {
+			return o.Domains
+		}
+	}
+
+	return append([]string{o.Domain}, o.Domains...)
+}
+
+// HasDomain determines if d is one of the allowed domains.
+func (o *OAuthInfo) HasDomain(d string) bool {
+	for _, a := range o.AllowedDomains() {
+		if strings.EqualFold(a, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsGuest determines if the user with the given email is one of the guests.
+func (o *OAuthInfo) IsGuest(email string) bool {
+	for _, g := range o.Guests {
+		if strings.EqualFold(g, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// initDevUser ensures that the dev user is only ever used for a hub on this machine,
+// since it lets anyone who can reach the hub in as that user.
+func initDevUser(n *Info) error {
+	if !strings.Contains(n.DevUser, "@") {
+		return fmt.Errorf("dev-user must be an email: %s", n.DevUser)
+	}
+
+	if !isLocalHost(n.Host) {
+		return fmt.Errorf("dev-user cannot be used with a hub that is not localhost: %s", n.Host)
+	}
+
+	if n.HasCerts() {
+		return errors.New("dev-user cannot be used with certs or autocert")
+	}
+
+	if len(n.Listeners) > 0 {
+		return errors.New("dev-user cannot be used with listeners")
+	}
+
+	return nil
+}
+
+// isLocalHost determines if host (without a port) only ever refers to this machine.
+func isLocalHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
+
+func initOAuth(o *OAuthInfo, name string, dev bool) error {
+	if o.BaseURL != "" {
+		o.BaseURL = strings.TrimRight(o.BaseURL, "/")
+	}
+
+	if o.Issuer != "" {
+		o.Issuer = strings.TrimRight(o.Issuer, "/")
+	}
+
+	for _, d := range o.Domains {
+		if d == "" {
+			return fmt.Errorf("%s.domains cannot contain an empty domain", name)
+		}
+	}
+
+	if err := validateGuests(o.Guests); err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+
+	if o.RefreshTokens && o.Provider != "" && o.Provider != "google" {
+		return fmt.Errorf("%s.refresh-tokens is not supported by %s", name, o.Provider)
+	}
+
+	// SAML identity providers and local users do not need client credentials, and
+	// none are needed when everyone is signed in as the dev user.
+	if o.Provider == "saml" || o.Provider == "local" || dev {
+		return nil
+	}
 
-	// Google provider properties
-	Domain string `json:"domain"`
+	if o.ClientID == "" {
+		return fmt.Errorf("%s.client-id is required", name)
+	}
 
-	// Okta provider properties
-	BaseURL string `json:"base-url"`
+	if o.ClientSecret == "" {
+		return fmt.Errorf("%s.client-secret is required", name)
+	}
+
+	return nil
 }
 
-// RouteInfo is the part of the configuration info that contains information
-// about an individual route.
-type RouteInfo struct {
-	// The hostname (excluding port) for the public facing hostname.
-	From string
+func initInfo(n *Info) error {
+	if n.DevUser != "" {
+		if err := initDevUser(n); err != nil {
+			return err
+		}
+	}
 
-	// The base authority (i.e. http://backend.example.com:8080) for the backend. Backends
-	// can be referenced through either http:// or https:// base urls. If you provide a
-	// non-root (i.e. http://example.com/foo/bar/) URL, the path will be merged with the
-	// request path as per RFC 3986 Section 5.2.
-	To string
+	dev := n.DevUser != ""
+	names := map[string]bool{}
+	if len(n.Providers) == 0 {
+		if err := initOAuth(&n.Oauth, "oauth", dev); err != nil {
+			return err
+		}
+	} else {
+		for _, p := range n.Providers {
+			if p.Name == "" {
+				return errors.New("providers must have a name")
+			}
 
-	toURL *url.URL
+			if names[p.Name] {
+				return fmt.Errorf("duplicate provider name: %s", p.Name)
+			}
+			names[p.Name] = true
 
-	// A list of groups which may access this route.  If groups are configured,
-	// users who are not a member of one of these groups will be denied access.
-	// A special group, `*`, may be specified which allows any authenticated
-	// user.
-	AllowedGroups []string `json:"allowed-groups"`
-}
+			if p.Title == "" {
+				p.Title = p.Name
+			}
 
-// ToURL ...
-func (r *RouteInfo) ToURL() *url.URL {
-	return r.toURL
+			if err := initOAuth(&p.OAuthInfo, fmt.Sprintf("providers.%s", p.Name), dev); err != nil {
+				return err
+			}
+
+			if p.RefreshTokens {
+				return errors.New("refresh-tokens is not supported with multiple providers")
+			}
+		}
+	}
+
+	if g := n.GoogleGroups; g != nil {
+		if g.ServiceAccountKey == "" || g.AdminEmail == "" {
+			return errors.New("google-groups requires service-account-key and admin-email")
+		}
+
+		if g.CacheTTL == 0 {
+			g.CacheTTL = defaultGroupsCacheTTL
+		}
+	}
+
+	if a := n.AuthzWebhook; a != nil {
+		if a.URL == "" {
+			return errors.New("authz-webhook.url is required")
+		}
+
+		if a.TimeoutMs <= 0 {
+			a.TimeoutMs = defaultAuthzTimeoutMs
+		}
+
+		if a.CacheTTL == 0 {
+			a.CacheTTL = defaultAuthzCacheTTL
+		}
+	}
+
+	initTransport(&n.Transport)
+
+	if n.Consul.Address == "" {
+		n.Consul.Address = defaultRouteSourceAddrs[RouteSourceConsul]
+	}
+
+	if a := n.Assertion; a != nil {
+		if a.Key == "" {
+			return errors.New("assertion.key is required")
+		}
+
+		if a.TTL <= 0 {
+			a.TTL = defaultAssertionTTL
+		}
+
+		if a.Header == "" {
+			a.Header = defaultAssertionHeader
+		}
+	}
+
+	if j := n.JWT; j != nil {
+		if j.Issuer == "" {
+			return errors.New("jwt.issuer is required")
+		}
+
+		if len(j.Audiences) == 0 {
+			if n.Oauth.ClientID == "" {
+				return errors.New("jwt.audiences is required without an oauth client-id")
+			}
+			j.Audiences = []string{n.Oauth.ClientID}
+		}
+
+		if j.CacheTTL <= 0 {
+			j.CacheTTL = defaultJWKSCacheTTL
+		}
+	}
+
+	if err := initLog(&n.Log); err != nil {
+		return err
+	}
+
+	if l := n.AccessLog; l != nil {
+		switch l.Format {
+		case "":
+			l.Format = AccessLogCombined
+		case AccessLogCombined, AccessLogJSON:
+		default:
+			return fmt.Errorf("invalid access-log format: %s", l.Format)
+		}
+	}
+
+	if e := n.Admin.TokenEnv; e != "" {
+		n.Admin.token = os.Getenv(e)
+		if n.Admin.token == "" {
+			return fmt.Errorf("admin token-env %s is not set", e)
+		}
+	}
+
+	if n.Readiness.TimeoutMs <= 0 {
+		n.Readiness.TimeoutMs = defaultReadinessTimeoutMs
+	}
+
+	if m := n.Metrics; m != nil {
+		if m.Path == "" {
+			m.Path = defaultMetricsPath
+		}
+
+		if !strings.HasPrefix(m.Path, "/") {
+			return fmt.Errorf("invalid metrics path: %s", m.Path)
+		}
+	}
+
+	if err := initTLS(n); err != nil {
+		return err
+	}
+
+	if n.MaxAuthRedirects == 0 {
+		n.MaxAuthRedirects = defaultMaxAuthRedirects
+	}
+
+	if err := validateSecurityHeaders(n.SecurityHeaders); err != nil {
+		return err
+	}
+
+	switch n.UnknownHosts {
+	case "":
+		n.UnknownHosts = UnknownHostsNotFound
+	case UnknownHostsNotFound, UnknownHostsRedirect:
+	default:
+		return fmt.Errorf("invalid unknown-hosts: %s", n.UnknownHosts)
+	}
+
+	if n.DrainTimeout <= 0 {
+		n.DrainTimeout = defaultDrainTimeout
+	}
+
+	if t := n.TrustedProxies; t != nil {
+		if len(t.Networks) == 0 {
+			return errors.New("trusted-proxies.networks is required")
+		}
+
+		nets, err := parseNets(t.Networks)
+		if err != nil {
+			return fmt.Errorf("invalid trusted-proxies.networks: %s", err)
+		}
+		t.nets = nets
+	}
+
+	if err := initCookie(&n.Cookie, n.IsSecure()); err != nil {
+		return err
+	}
+
+	if n.Session.Sliding || n.Oauth.RefreshTokens {
+		if n.Session.MaxLifetime <= 0 {
+			n.Session.MaxLifetime = defaultSessionMaxLifetime
+		}
+
+		if n.Session.MaxLifetime < n.Cookie.MaxAge {
+			return errors.New("session.max-lifetime cannot be less than cookie.max-age")
+		}
+	}
+
+	switch n.Session.Store {
+	case "", SessionStoreCookie, SessionStoreMemory:
+	case SessionStoreRedis:
+		if r := n.Session.Redis; r == nil || r.Addr == "" {
+			return errors.New("session.store redis requires session.redis.addr")
+		}
+	default:
+		return fmt.Errorf("invalid session.store: %s", n.Session.Store)
+	}
+
+	if t := n.Session.AcceptLegacyUntil; t != "" {
+		if s := n.Session.Store; s == "" || s == SessionStoreCookie {
+			return errors.New("session.accept-legacy-until needs session.store memory or redis")
+		}
+
+		until, err := time.Parse(time.RFC3339, t)
+		if err != nil {
+			return fmt.Errorf("invalid session.accept-legacy-until: %s", err)
+		}
+		n.Session.acceptLegacyUntil = until
+	}
+
+	if r := n.Session.Shared; r != nil {
+		if s := n.Session.Store; s != "" && s != SessionStoreCookie {
+			return errors.New("session.shared can only be used with session.store cookie")
+		}
+
+		if r.Addr == "" {
+			return errors.New("session.shared requires an addr")
+		}
+	}
+
+	if k := n.Session.Key; k != nil {
+		if err := initKey(k); err != nil {
+			return err
+		}
+	}
+
+	if rs := n.RouteSource; rs != nil {
+		if _, ok := defaultRouteSourceAddrs[rs.Type]; !ok {
+			return fmt.Errorf("invalid route-source type: %s", rs.Type)
+		}
+
+		if rs.Address == "" {
+			rs.Address = defaultRouteSourceAddrs[rs.Type]
+		}
+
+		if rs.Prefix == "" {
+			rs.Prefix = defaultRouteSourcePrefix
+		}
+
+		if rs.PollInterval <= 0 {
+			rs.PollInterval = defaultRouteSourcePollInterval
+		}
+	}
+
+	if err := initListeners(n); err != nil {
+		return err
+	}
+
+	if err := initErrorPages(n); err != nil {
+		return err
+	}
+
+	if err := initBranding(&n.Branding); err != nil {
+		return err
+	}
+
+	if n.LogoutURL != "" {
+		u, err := url.Parse(n.LogoutURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid logout-url: %s", n.LogoutURL)
+		}
+	}
+
+	froms := map[string]bool{}
+	for _, route := range n.Routes {
+		if err := initInfoRoute(n, route, names, froms); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-// Info is a configuration object that is loaded directly from the json config file.
-type Info struct {
-	// The host (without the port specification) that will be acting as the hub
-	Host string
+// initListeners applies defaults to the listeners and checks that they serve the hub.
+func initListeners(n *Info) error {
+	if len(n.Listeners) == 0 {
+		return nil
+	}
 
-	// OAuth related settings
-	Oauth OAuthInfo
+	if n.HTTPRedirectPort != 0 {
+		return errors.New("http-redirect-port cannot be used with listeners, add a redirect listener")
+	}
 
-	// Whether or not to add a set of security headers to all HTTP responses:
-	//
-	//    Strict-Transport-Security -- if certs are present, enforce HTTPS
-	//    Cache-Control: private, no-cache -- prevent downstream caching
-	//    Pragma: no-cache -- prevent HTTP/1.0 downstream caching
-	//    X-Frame-Options: SAMEORIGIN -- prevent clickjacking
-	//
-	// Enable this if it your applications are OK with it and you want additional
-	// security.
-	AddSecurityHeaders bool `json:"use-strict-security-headers"`
+	if n.Admin.Addr != "" {
+		return errors.New("admin.addr cannot be used with listeners, add an admin listener")
+	}
 
-	// TLS certificiate files to enable https on the hub and endpoints. TLS is highly
-	// recommended and it is global. You cannot run some routes over HTTP and others over
-	// HTTPS. If you need to do this, you should use two instances of underpants (one on
-	// port 80 and the other on 443).
-	Certs []struct {
-		Crt string
-		Key string
+	for _, l := range n.Listeners {
+		_, p, err := net.SplitHostPort(l.Addr)
+		if err != nil {
+			return fmt.Errorf("invalid listener addr: %s", l.Addr)
+		}
+
+		l.port, err = strconv.Atoi(p)
+		if err != nil || l.port <= 0 || l.port > 65535 {
+			return fmt.Errorf("invalid listener port: %s", l.Addr)
+		}
+
+		switch l.Serve {
+		case "":
+			l.Serve = ListenerProxy
+		case ListenerProxy, ListenerAdmin:
+		case ListenerRedirect:
+			if !n.HasCerts() {
+				return fmt.Errorf("redirect listener %s requires certs or autocert", l.Addr)
+			}
+		default:
+			return fmt.Errorf("invalid listener serve: %s", l.Serve)
+		}
 	}
 
-	// A mapping of group names to lists of user email addresses that are members
-	// of that group.  If this section is present, then the default behaviour for
-	// a route is to deny all users not in a group on its allowed-groups list.
-	Groups map[string][]string
+	if n.ListenerPort() == 0 {
+		return errors.New("listeners must include a proxy listener")
+	}
 
-	// The mappings from hostname to backend server.
-	Routes []*RouteInfo
+	return nil
 }
 
-// HasCerts is used to dermine if the instance is running over HTTP or HTTPS, this indicates whether
-// any certificates were included in the configuration.
-func (i *Info) HasCerts() bool {
-	return len(i.Certs) > 0
+// errorPageStatuses are the status codes whose pages can be replaced with error-pages.
+var errorPageStatuses = map[int]bool{
+	http.StatusForbidden:          true,
+	http.StatusNotFound:           true,
+	http.StatusBadGateway:         true,
+	http.StatusServiceUnavailable: true,
+	http.StatusGatewayTimeout:     true,
 }
 
-// HasGroups is used to determine if the instance is configured for more granular group-based access
-// control lists.
-func (i *Info) HasGroups() bool {
-	return len(i.Groups) > 0
+// cssColor matches the colors that are accepted by branding, a name or a hex color.
+var cssColor = regexp.MustCompile(`^([a-zA-Z]+|#[0-9a-fA-F]{3,8})$`)
+
+// initBranding checks the colors of the branding and parses the template in its dir.
+func initBranding(b *BrandingInfo) error {
+	for name, c := range map[string]string{
+		"background": b.Colors.Background,
+		"text":       b.Colors.Text,
+		"accent":     b.Colors.Accent,
+	} {
+		if c != "" && !cssColor.MatchString(c) {
+			return fmt.Errorf("invalid branding.colors.%s: %s", name, c)
+		}
+	}
+
+	b.template = nil
+	if b.Dir != "" {
+		t, err := template.ParseFiles(filepath.Join(b.Dir, "index.html"))
+		if err != nil {
+			return fmt.Errorf("invalid branding.dir: %s", err)
+		}
+		b.template = t
+	}
+
+	return nil
 }
 
-// Scheme is a convience method for getting the relevant scheme based on whether certificates were
-// included in the configuration.
-func (i *Info) Scheme() string {
-	if len(i.Certs) > 0 {
-		return "https"
+// initErrorPages parses the templates of the error-pages.
+func initErrorPages(n *Info) error {
+	n.errorPages = map[int]*template.Template{}
+	for code, file := range n.ErrorPages {
+		status, err := strconv.Atoi(code)
+		if err != nil || !errorPageStatuses[status] {
+			return fmt.Errorf("invalid error-pages status: %s", code)
+		}
+
+		t, err := template.ParseFiles(file)
+		if err != nil {
+			return fmt.Errorf("invalid error-pages.%s: %s", code, err)
+		}
+		n.errorPages[status] = t
 	}
-	return "http"
+	return nil
 }
 
-// initRoute initializes a RouteInfo by parsing and validating its contents.
-func initRoute(r *RouteInfo) error {
-	toURL, err := url.Parse(r.To)
-	if err != nil {
-		return err
+// initInfoRoute initializes a route of the config and checks that it fits with the
+// rest of the config, given the names of its providers and the hosts of the routes
+// already initialized, to which the route's host is added.
+func initInfoRoute(
+	n *Info,
+	route *RouteInfo,
+	names map[string]bool,
+	froms map[string]bool) error {
+	if route.From == "" {
+		return errors.New("routes must have a from")
+	}
+
+	from := strings.ToLower(strings.TrimRight(route.From, "/"))
+	if froms[from] {
+		return fmt.Errorf("duplicate route from: %s", route.From)
+	}
+	froms[from] = true
+
+	if err := initRoute(route); err != nil {
+		return fmt.Errorf("Route %s is invalid: %s",
+			route.From,
+			err)
+	}
+
+	if len(route.RequiredGroups) > 0 && n.GoogleGroups == nil {
+		return fmt.Errorf("Route %s is invalid: required-groups needs google-groups",
+			route.From)
+	}
+
+	if route.Provider != "" && !names[route.Provider] {
+		return fmt.Errorf("Route %s is invalid: unknown provider %s",
+			route.From,
+			route.Provider)
+	}
+
+	if hub := strings.ToLower(n.Host); hub != "" && route.PathPrefix() == "" &&
+		(route.Host() == hub || route.Host() == WildcardOf(hub)) {
+		return fmt.Errorf("Route %s is invalid: it would shadow the hub at %s, give it a path",
+			route.From,
+			n.Host)
+	}
+
+	if route.Default && n.Host == "" {
+		return fmt.Errorf("Route %s is invalid: the default route needs the hub's host",
+			route.From)
+	}
+
+	if d := n.DefaultRoute(); route.Default && d != nil && d != route {
+		return fmt.Errorf("Route %s is invalid: %s is already the default route",
+			route.From,
+			d.From)
 	}
 
-	r.toURL = toURL
 	return nil
 }
 
-func initInfo(n *Info) error {
-	if n.Oauth.BaseURL != "" {
-		n.Oauth.BaseURL = strings.TrimRight(n.Oauth.BaseURL, "/")
+// DefaultRoute is the route that serves requests for unknown hosts, or nil if there
+// is none.
+func (i *Info) DefaultRoute() *RouteInfo {
+	for _, route := range i.Routes {
+		if route.Default {
+			return route
+		}
 	}
+	return nil
+}
 
-	if n.Oauth.ClientID == "" {
-		return errors.New("oauth.client-id is required")
+// AddRoute initializes a route that was not in the config file, such as one from a
+// route-source, and adds it to the config. The route is not added if it is invalid,
+// its from is already routed, or it asks for what only the config file may grant: to
+// be the default route or to be served from the hub's filesystem.
+func (i *Info) AddRoute(route *RouteInfo) error {
+	names := map[string]bool{}
+	for _, p := range i.Providers {
+		names[p.Name] = true
 	}
 
-	if n.Oauth.ClientSecret == "" {
-		return errors.New("oauth.client-secret is required")
+	froms := map[string]bool{}
+	for _, r := range i.Routes {
+		froms[strings.ToLower(strings.TrimRight(r.From, "/"))] = true
 	}
 
-	for _, route := range n.Routes {
-		if err := initRoute(route); err != nil {
-			return fmt.Errorf("Route %s has invalid To URL: %s",
-				route.From,
-				err)
-		}
+	if err := initInfoRoute(i, route, names, froms); err != nil {
+		return err
+	}
+
+	if route.Default {
+		return fmt.Errorf("Route %s is invalid: only routes in the config file can be the default",
+			route.From)
 	}
 
+	if route.staticDir != "" || len(route.sockets) > 0 {
+		return fmt.Errorf("Route %s is invalid: only routes in the config file can have file:// or unix:// backends",
+			route.From)
+	}
+
+	i.Routes = append(i.Routes, route)
 	return nil
 }
 
 // ReadFile loads the configuraiton info from the given file.
 func (i *Info) ReadFile(filename string) error {
-	*i = Info{}
-
 	r, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
 	defer r.Close()
 
-	if err := json.NewDecoder(r).Decode(i); err != nil {
+	return i.Read(r)
+}
+
+// Read loads the configuration info from the given reader. References to environment
+// variables (${VAR}) in string values are replaced with the variables' values.
+func (i *Info) Read(r io.Reader) error {
+	*i = Info{DevUser: i.DevUser}
+
+	var v interface{}
+	d := json.NewDecoder(r)
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return err
+	}
+
+	v, err := expandEnv(v)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(b, i); err != nil {
 		return err
 	}
 
 	return initInfo(i)
 }
+
+// envRef matches a reference to an environment variable, ${VAR}, or an escaped one,
+// $${VAR}, which stands for the literal text ${VAR}.
+var envRef = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces references to environment variables in all of the strings in v,
+// which was decoded from JSON. It is an error to refer to a variable that is not set.
+func expandEnv(v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case string:
+		var err error
+		s := envRef.ReplaceAllStringFunc(t, func(ref string) string {
+			if strings.HasPrefix(ref, "$$") {
+				return ref[1:]
+			}
+
+			name := ref[2 : len(ref)-1]
+			val, ok := os.LookupEnv(name)
+			if !ok && err == nil {
+				err = fmt.Errorf("undefined environment variable: %s", name)
+			}
+			return val
+		})
+		return s, err
+	case []interface{}:
+		for i, item := range t {
+			item, err := expandEnv(item)
+			if err != nil {
+				return nil, err
+			}
+			t[i] = item
+		}
+	case map[string]interface{}:
+		for key, item := range t {
+			item, err := expandEnv(item)
+			if err != nil {
+				return nil, err
+			}
+			t[key] = item
+		}
+	}
+	return v, nil
+}
@@ -0,0 +1,844 @@
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAllowedMethods(t *testing.T) {
+	r := &RouteInfo{
+		From: "a.com",
+		To:   Upstreams{"http://localhost:8080"},
+	}
+
+	if err := initRoute(r); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, method := range []string{"GET", "POST", "DELETE", "TRACE"} {
+		if !r.AllowsMethod(method) {
+			t.Fatalf("%s should be allowed by default", method)
+		}
+	}
+
+	if r.AllowsMethod("PROPFIND") {
+		t.Fatal("PROPFIND should not be allowed by default")
+	}
+
+	r = &RouteInfo{
+		From:           "a.com",
+		To:             Upstreams{"http://localhost:8080"},
+		AllowedMethods: []string{"get", "HEAD"},
+	}
+
+	if err := initRoute(r); err != nil {
+		t.Fatal(err)
+	}
+
+	if !r.AllowsMethod("GET") || !r.AllowsMethod("HEAD") {
+		t.Fatal("GET and HEAD should be allowed")
+	}
+
+	if r.AllowsMethod("POST") {
+		t.Fatal("POST should not be allowed")
+	}
+
+	if h := r.AllowHeader(); h != "GET, HEAD" {
+		t.Fatalf("expected Allow of GET, HEAD, got %s", h)
+	}
+
+	r = &RouteInfo{
+		From:           "a.com",
+		To:             Upstreams{"http://localhost:8080"},
+		AllowedMethods: []string{"GET, POST"},
+	}
+
+	if err := initRoute(r); err == nil {
+		t.Fatal("expected error for invalid method")
+	}
+}
+
+func TestProviders(t *testing.T) {
+	var cfg Info
+	if err := cfg.Read(strings.NewReader(`{
+		"providers": [
+			{"name": "employees", "client-id": "id", "client-secret": "secret"},
+			{"name": "contractors", "title": "Contractors", "provider": "saml"}
+		],
+		"routes": [
+			{"from": "a.com", "to": "http://localhost:8080", "provider": "contractors"}
+		]
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Providers[0].Title != "employees" {
+		t.Fatalf("expected title to default to the name, got %s", cfg.Providers[0].Title)
+	}
+
+	for _, conf := range []string{
+		`{"providers": [{"name": "a", "client-id": "id"}]}`,
+		`{"providers": [{"name": "a", "provider": "saml"}, {"name": "a", "provider": "saml"}]}`,
+		`{"providers": [{"name": "a", "provider": "saml"}],
+			"routes": [{"from": "a.com", "to": "http://localhost", "provider": "b"}]}`,
+	} {
+		if err := cfg.Read(strings.NewReader(conf)); err == nil {
+			t.Fatalf("expected %s to be invalid", conf)
+		}
+	}
+}
+
+func TestPathRuleFor(t *testing.T) {
+	r := &RouteInfo{
+		From: "a.com",
+		To:   Upstreams{"http://localhost:8080"},
+		Paths: []*PathRuleInfo{
+			{Path: "/admin/*"},
+			{Path: "/login"},
+			{Path: "/*", Public: true},
+		},
+	}
+
+	if err := initRoute(r); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"/admin/":  "/admin/*",
+		"/admin/x": "/admin/*",
+		"/admin":   "/*",
+		"/login":   "/login",
+		"/login/x": "/*",
+	}
+
+	for path, expected := range tests {
+		if rule := r.PathRuleFor(path); rule == nil || rule.Path != expected {
+			t.Fatalf("expected %s to match %s", path, expected)
+		}
+	}
+
+	r.Paths = []*PathRuleInfo{{Path: "/x/*", Public: true, Allow: []string{"a@a.com"}}}
+	if err := initRoute(r); err == nil {
+		t.Fatal("expected public rule with an allow list to be invalid")
+	}
+}
+
+func TestPublicPaths(t *testing.T) {
+	r := &RouteInfo{
+		From:        "a.com",
+		To:          Upstreams{"http://localhost:8080"},
+		PublicPaths: []string{"/hooks/*/events", "/healthz"},
+		Paths: []*PathRuleInfo{
+			{Path: "/*", Allow: []string{"a@a.com"}},
+		},
+	}
+
+	if err := initRoute(r); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]bool{
+		"/hooks/github/events":   true,
+		"/hooks/stripe/events":   true,
+		"/hooks/a/b/events":      false,
+		"/hooks/github/events/x": false,
+		"/healthz":               true,
+		"/healthz/x":             false,
+		"/":                      false,
+	}
+
+	for path, public := range tests {
+		rule := r.PathRuleFor(path)
+		if rule == nil || rule.Public != public {
+			t.Fatalf("expected %s to be public: %t, got %+v", path, public, rule)
+		}
+	}
+
+	r.PublicPaths = []string{"hooks"}
+	if err := initRoute(r); err == nil {
+		t.Fatal("expected public path not starting with / to be invalid")
+	}
+}
+
+func TestAllowsIP(t *testing.T) {
+	r := &RouteInfo{
+		From:    "a.com",
+		To:      Upstreams{"http://localhost:8080"},
+		IPAllow: []string{"10.0.0.0/8", "192.168.1.1", "2001:db8::/32"},
+		IPDeny:  []string{"10.1.0.0/16"},
+	}
+
+	if err := initRoute(r); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]bool{
+		"10.0.0.1":        true,
+		"10.1.0.1":        false,
+		"192.168.1.1":     true,
+		"192.168.1.2":     false,
+		"2001:db8::1":     true,
+		"2001:db9::1":     false,
+		"::ffff:10.0.0.1": true,
+	}
+
+	for ip, expected := range tests {
+		if r.AllowsIP(net.ParseIP(ip)) != expected {
+			t.Fatalf("%s allowed should have been %t", ip, expected)
+		}
+	}
+
+	r.IPAllow = []string{"10.0.0.0/33"}
+	if err := initRoute(r); err == nil {
+		t.Fatal("expected invalid network to be rejected")
+	}
+}
+
+func TestTLSSettings(t *testing.T) {
+	var cfg Info
+	if err := cfg.Read(strings.NewReader(`{
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"certs": [{"crt": "hub.crt", "key": "hub.key"}],
+		"tls-min-version": "1.2",
+		"tls-cipher-suites": ["TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"],
+		"routes": [
+			{"from": "a.com", "to": "http://localhost:8080", "cert": {"crt": "a.crt", "key": "a.key"}}
+		]
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.TLSVersion() != tls.VersionTLS12 {
+		t.Fatalf("expected TLS 1.2, got %x", cfg.TLSVersion())
+	}
+
+	if cs := cfg.CipherSuites(); len(cs) != 1 || cs[0] != tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384 {
+		t.Fatalf("unexpected cipher suites %v", cs)
+	}
+
+	for _, conf := range []string{
+		`{"oauth": {"client-id": "id", "client-secret": "secret"}, "tls-min-version": "1.4"}`,
+		`{"oauth": {"client-id": "id", "client-secret": "secret"}, "tls-cipher-suites": ["NOPE"]}`,
+		`{"oauth": {"client-id": "id", "client-secret": "secret"},
+			"routes": [{"from": "a.com", "to": "http://localhost", "cert": {"crt": "a.crt", "key": "a.key"}}]}`,
+		`{"oauth": {"client-id": "id", "client-secret": "secret"}, "client-cas": ["ca.pem"]}`,
+	} {
+		if err := cfg.Read(strings.NewReader(conf)); err == nil {
+			t.Fatalf("expected %s to be invalid", conf)
+		}
+	}
+}
+
+func TestAutocert(t *testing.T) {
+	var cfg Info
+	if err := cfg.Read(strings.NewReader(`{
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"autocert": {"email": "ops@a.com"}
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if !cfg.HasCerts() || cfg.Scheme() != "https" {
+		t.Fatal("expected autocert to enable https")
+	}
+
+	if cfg.Autocert.CacheDir != defaultAutocertCacheDir {
+		t.Fatalf("expected default cache dir, got %s", cfg.Autocert.CacheDir)
+	}
+
+	if err := cfg.Read(strings.NewReader(`{
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"certs": [{"crt": "hub.crt", "key": "hub.key"}],
+		"autocert": {}
+	}`)); err == nil {
+		t.Fatal("expected certs and autocert together to be invalid")
+	}
+}
+
+func TestBackendTLS(t *testing.T) {
+	var cfg Info
+	if err := cfg.Read(strings.NewReader(`{
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"routes": [
+			{"from": "a.com", "to": "https://localhost", "backend-tls": {"server-name": "b.com"}},
+			{"from": "b.com", "to": "https://localhost"}
+		]
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if c := cfg.Routes[0].BackendTLSConfig(); c == nil || c.ServerName != "b.com" {
+		t.Fatalf("expected server name b.com, got %+v", c)
+	}
+
+	if c := cfg.Routes[1].BackendTLSConfig(); c != nil {
+		t.Fatalf("expected default backend tls, got %+v", c)
+	}
+
+	if err := cfg.Read(strings.NewReader(`{
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"routes": [{"from": "a.com", "to": "https://localhost", "backend-tls": {"ca": "missing.pem"}}]
+	}`)); err == nil {
+		t.Fatal("expected a missing ca to be invalid")
+	}
+}
+
+func TestSessionKey(t *testing.T) {
+	var cfg Info
+	if err := cfg.Read(strings.NewReader(`{
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"session": {"key": {"vault": {"address": "https://vault.a.com/", "path": "secret/data/up"}}}
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	v := cfg.Session.Key.Vault
+	if v.Address != "https://vault.a.com" || v.Field != "key" || v.TokenEnv != "VAULT_TOKEN" {
+		t.Fatalf("unexpected vault defaults %+v", v)
+	}
+
+	for _, key := range []string{
+		`{}`,
+		`{"file": "key", "env": "KEY"}`,
+		`{"vault": {"address": "https://vault.a.com"}}`,
+	} {
+		conf := fmt.Sprintf(`{
+			"oauth": {"client-id": "id", "client-secret": "secret"},
+			"session": {"key": %s}
+		}`, key)
+		if err := cfg.Read(strings.NewReader(conf)); err == nil {
+			t.Fatalf("expected %s to be invalid", key)
+		}
+	}
+}
+
+func TestCookie(t *testing.T) {
+	var cfg Info
+	if err := cfg.Read(strings.NewReader(`{
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"certs": [{"crt": "hub.crt", "key": "hub.key"}]
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	c := cfg.Cookie
+	if c.Name != "u" || c.MaxAge != 3600 || !*c.Secure || !*c.HTTPOnly ||
+		c.SameSiteMode() != http.SameSiteLaxMode {
+		t.Fatalf("unexpected cookie defaults %+v", c)
+	}
+
+	if err := cfg.Read(strings.NewReader(`{
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"cookie": {"name": "sid", "secure": true, "same-site": "none"}
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if !*cfg.Cookie.Secure || cfg.Cookie.SameSiteMode() != http.SameSiteNoneMode {
+		t.Fatalf("unexpected cookie %+v", cfg.Cookie)
+	}
+
+	for _, cookie := range []string{
+		`{"same-site": "none"}`,
+		`{"same-site": "sometimes"}`,
+		`{"name": "a;b"}`,
+	} {
+		conf := fmt.Sprintf(`{
+			"oauth": {"client-id": "id", "client-secret": "secret"},
+			"cookie": %s
+		}`, cookie)
+		if err := cfg.Read(strings.NewReader(conf)); err == nil {
+			t.Fatalf("expected %s to be invalid", cookie)
+		}
+	}
+}
+
+func TestLog(t *testing.T) {
+	var cfg Info
+	if err := cfg.Read(strings.NewReader(`{
+		"oauth": {"client-id": "id", "client-secret": "secret"}
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if l := cfg.Log; l.Level != "info" || l.Format != LogFormatJSON || l.Path != "" {
+		t.Fatalf("unexpected log defaults %+v", l)
+	}
+
+	for _, log := range []string{
+		`{"level": "verbose"}`,
+		`{"format": "text"}`,
+	} {
+		conf := fmt.Sprintf(`{
+			"oauth": {"client-id": "id", "client-secret": "secret"},
+			"log": %s
+		}`, log)
+		if err := cfg.Read(strings.NewReader(conf)); err == nil {
+			t.Fatalf("expected %s to be invalid", log)
+		}
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("UNDERPANTS_TEST_SECRET", "s3cr3t")
+	defer os.Unsetenv("UNDERPANTS_TEST_SECRET")
+
+	var cfg Info
+	if err := cfg.Read(strings.NewReader(`{
+		"oauth": {"client-id": "id", "client-secret": "${UNDERPANTS_TEST_SECRET}"},
+		"routes": [{"from": "a.com", "to": "http://localhost:8080/$${PATH}"}],
+		"max-auth-redirects": 3
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Oauth.ClientSecret != "s3cr3t" {
+		t.Fatalf("expected client-secret s3cr3t, got %s", cfg.Oauth.ClientSecret)
+	}
+
+	if to := cfg.Routes[0].To[0]; to != "http://localhost:8080/${PATH}" {
+		t.Fatalf("expected the escaped reference to be kept, got %s", to)
+	}
+
+	if cfg.MaxAuthRedirects != 3 {
+		t.Fatalf("expected max-auth-redirects 3, got %d", cfg.MaxAuthRedirects)
+	}
+
+	if err := cfg.Read(strings.NewReader(`{
+		"oauth": {"client-id": "id", "client-secret": "${UNDERPANTS_TEST_UNSET}"}
+	}`)); err == nil {
+		t.Fatal("expected a reference to an unset variable to be invalid")
+	}
+}
+
+func TestInvalidRoutes(t *testing.T) {
+	for _, routes := range []string{
+		`[{"to": "http://localhost:8080"}]`,
+		`[{"from": "a.com", "to": "localhost:8080"}]`,
+		`[{"from": "a.com", "to": "ftp://localhost"}]`,
+		`[{"from": "a.com", "to": "unix://run/app.sock"}]`,
+		`[{"from": "a.com", "to": "https://svc.internal", "resolve": {}}]`,
+		`[{"from": "a.com", "to": ["consul://api", "http://localhost:8080"]}]`,
+		`[{"from": "a.com", "to": "consul://api:8080"}]`,
+		`[{"from": "a.com", "to": ["http://a", "http://b"], "weights": [1]}]`,
+		`[{"from": "a.com", "to": ["http://a", "http://b"], "weights": [0, 0]}]`,
+		`[{"from": "a.com", "to": "http://a", "canary": {"to": "http://b", "percent": 101}}]`,
+		`[{"from": "a.com", "to": "http://a", "canary": {"to": "b"}}]`,
+		`[{"from": "a.com", "to": "http://a", "mirror": {"to": "http://b", "percent": -1}}]`,
+		`[{"from": "a.com", "to": "http://a", "cors": {"allowed-origins": []}}]`,
+		`[{"from": "a.com", "to": "http://a", "cors": {"allowed-origins": ["*"], "allow-credentials": true}}]`,
+		`[{"from": "a.com", "to": "http://a", "cors": {"allowed-origins": ["https://*"], "allow-credentials": true}}]`,
+		`[{"from": "a.com", "to": "http://a", "cors": {"allowed-origins": ["https://*.com"], "allow-credentials": true}}]`,
+		`[{"from": "a.com", "to": "http://a", "cors": {"allowed-origins": ["*://b.a.com"], "allow-credentials": true}}]`,
+		`[{"from": "a.com", "to": "http://a", "cors": {"allowed-origins": ["https://b.*.com"], "allow-credentials": true}}]`,
+		`[{"from": "a.com", "to": "http://a", "session": {"max-age": -1}}]`,
+		`[{"from": "a.com", "to": "http://a", "session": {"reauth-after": -1}}]`,
+		`[{"from": "a.com", "to": "http://a", "allow-file": "/nonexistent/allow.txt"}]`,
+		`[{"from": "a.com", "to": "http://a", "redirect": 307}]`,
+		`[{"from": "a.com", "to": "http://a", "security-headers": {"X Frame": "DENY"}}]`,
+		`[{"from": "a.com", "to": "http://a", "security-headers": {"X-Frame-Options": "DENY\r\nX: y"}}]`,
+		`[{"from": "a.com", "to": "file:///nonexistent/docs"}]`,
+		`[{"from": "a.com", "to": ["file:///tmp", "http://a"]}]`,
+		`[{"from": "a.com", "to": "file:///tmp", "failover": ["http://b"]}]`,
+		`[{"from": "a.com", "to": ["http://a", "http://b"], "redirect": 302}]`,
+		`[{"from": "a.com", "to": "unix:///tmp/a.sock", "redirect": 302}]`,
+		`[{"from": "a.com", "to": "http://a", "paths": [{"path": "/*", "public": true, "step-up": 60}]}]`,
+		`[{"from": "a.com", "to": "http://a", "paths": [{"path": "/admin/*", "step-up": -1}]}]`,
+		`[{"from": "a.com", "to": "http://svc.internal", "failover": ["http://b"], "resolve": {}}]`,
+		`[{"from": "a.com", "to": "http://localhost:8080"},
+		  {"from": "A.com", "to": "http://localhost:8081"}]`,
+		`[{"from": "a.*.com", "to": "http://localhost:8080"}]`,
+		`[{"from": "a.com", "to": "http://*.localhost:8080"}]`,
+		`[{"from": "*.a.com", "to": "http://*.*.localhost:8080"}]`,
+		`[{"from": "*.a.com", "to": "http://*.svc", "health-check": {"interval": 5}}]`,
+		`[{"from": "a.com/__auth__", "to": "http://localhost:8080"}]`,
+		`[{"from": "a.com", "to": "http://localhost:8080", "strip-prefix": true}]`,
+		`[{"from": "a.com/x", "to": "http://localhost:8080", "domain": "b.com"}]`,
+		`[{"from": "a.com/x", "to": "http://localhost:8080"},
+		  {"from": "a.com/x/", "to": "http://localhost:8081"}]`,
+		`[{"from": "a.com", "to": "http://localhost:8080", "api-keys": {"keys": []}}]`,
+		`[{"from": "a.com", "to": "http://localhost:8080",
+		   "api-keys": {"keys": [{"sha256": "abc", "email": "a@a.com"}]}}]`,
+	} {
+		var cfg Info
+		conf := fmt.Sprintf(`{
+			"oauth": {"client-id": "id", "client-secret": "secret"},
+			"routes": %s
+		}`, routes)
+		if err := cfg.Read(strings.NewReader(conf)); err == nil {
+			t.Fatalf("expected %s to be invalid", routes)
+		}
+	}
+}
+
+func TestDefaultRoute(t *testing.T) {
+	read := func(extra, routes string) (*Info, error) {
+		var cfg Info
+		err := cfg.Read(strings.NewReader(fmt.Sprintf(`{
+			"host": "hub.com",
+			"oauth": {"client-id": "id", "client-secret": "secret"},
+			%s
+			"routes": %s
+		}`, extra, routes)))
+		return &cfg, err
+	}
+
+	cfg, err := read("", `[
+		{"from": "a.com", "to": "http://localhost:8080"},
+		{"from": "b.com", "to": "http://localhost:8081", "default": true}
+	]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d := cfg.DefaultRoute(); d == nil || d.From != "b.com" {
+		t.Fatalf("expected b.com to be the default route, got %v", d)
+	}
+
+	if cfg.UnknownHosts != UnknownHostsNotFound {
+		t.Fatalf("expected unknown-hosts to default to %s, got %s",
+			UnknownHostsNotFound, cfg.UnknownHosts)
+	}
+
+	for _, test := range []struct {
+		Extra  string
+		Routes string
+	}{
+		{"", `[{"from": "a.com", "to": "http://a", "default": true},
+		       {"from": "b.com", "to": "http://b", "default": true}]`},
+		{"", `[{"from": "a.com/x", "to": "http://a", "default": true}]`},
+		{"", `[{"from": "*.a.com", "to": "http://a", "default": true}]`},
+		{`"unknown-hosts": "hub",`, `[]`},
+	} {
+		if _, err := read(test.Extra, test.Routes); err == nil {
+			t.Fatalf("expected %s %s to be invalid", test.Extra, test.Routes)
+		}
+	}
+
+	if _, err := read(`"unknown-hosts": "redirect",`, `[]`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSocketRoute(t *testing.T) {
+	r := &RouteInfo{
+		From: "a.com",
+		To:   Upstreams{"unix:///run/app.sock", "http://localhost:8080"},
+	}
+
+	if err := initRoute(r); err != nil {
+		t.Fatal(err)
+	}
+
+	if !r.HasSockets() {
+		t.Fatal("expected the route to have sockets")
+	}
+
+	u := r.ToURLs()[0]
+	if u.Scheme != "http" || r.SocketFor(u.Hostname()) != "/run/app.sock" {
+		t.Fatalf("unexpected socket URL %s", u)
+	}
+
+	if r.SocketFor(r.ToURLs()[1].Hostname()) != "" {
+		t.Fatal("expected no socket for the tcp backend")
+	}
+}
+
+func TestAllowFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "allow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "allow.txt")
+	write := func(s string) {
+		if err := ioutil.WriteFile(name, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("# payroll\na@a.com\n\n")
+
+	r := &RouteInfo{
+		From:      "a.com",
+		To:        Upstreams{"http://localhost:8080"},
+		Allow:     []string{"admin@a.com"},
+		AllowFile: name,
+	}
+
+	if err := initRoute(r); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := BuildContext(&Info{}, 80, []byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(allowed, denied string) {
+		if !ctx.UserAllowedOnRoute(allowed, r) {
+			t.Fatalf("expected %s to be allowed", allowed)
+		}
+
+		if ctx.UserAllowedOnRoute(denied, r) {
+			t.Fatalf("expected %s to be denied", denied)
+		}
+	}
+
+	check("a@a.com", "b@a.com")
+
+	write("a@a.com\nb@a.com\n")
+	if changed, err := r.ReloadAllowFile(); err != nil || !changed {
+		t.Fatalf("expected the file to be reloaded, got %t %v", changed, err)
+	}
+	check("b@a.com", "c@a.com")
+
+	if changed, err := r.ReloadAllowFile(); err != nil || changed {
+		t.Fatalf("expected the unchanged file to be skipped, got %t %v", changed, err)
+	}
+
+	// invalid entries keep the entries that were read before.
+	write("[c@a.com\n")
+	if _, err := r.ReloadAllowFile(); err == nil {
+		t.Fatal("expected invalid entries to be refused")
+	}
+	check("b@a.com", "c@a.com")
+
+	// an empty file admits no one, rather than everyone.
+	r.Allow = nil
+	write("")
+	if _, err := r.ReloadAllowFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	if ctx.UserAllowedOnRoute("a@a.com", r) {
+		t.Fatal("expected an empty allow-file to admit no one")
+	}
+}
+
+func TestWildcardRoute(t *testing.T) {
+	var cfg Info
+	if err := cfg.Read(strings.NewReader(`{
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"routes": [{"from": "*.tools.com", "to": "http://*.preview.svc:8080/app/"}]
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	r := cfg.Routes[0]
+	if !r.IsWildcard() || !r.IsTemplated() {
+		t.Fatal("expected a templated wildcard route")
+	}
+
+	u := r.TargetFor(r.ToURL(), "PR-12.tools.com:443")
+	if u.String() != "http://pr-12.preview.svc:8080/app/" {
+		t.Fatalf("unexpected target %s", u)
+	}
+
+	if WildcardOf("a.tools.com") != "*.tools.com" || WildcardOf("localhost") != "" {
+		t.Fatal("unexpected WildcardOf")
+	}
+}
+
+func TestAddRoute(t *testing.T) {
+	var cfg Info
+	if err := cfg.Read(strings.NewReader(`{
+		"host": "hub.a.com",
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"route-source": {"type": "consul"},
+		"routes": [{"from": "a.com", "to": "http://localhost:8080"}]
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if rs := cfg.RouteSource; rs.Address != "http://127.0.0.1:8500" ||
+		rs.Prefix != "underpants/routes/" {
+		t.Fatalf("unexpected route-source defaults %+v", rs)
+	}
+
+	if err := cfg.AddRoute(&RouteInfo{
+		From: "b.com",
+		To:   Upstreams{"http://localhost:8081"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.Routes) != 2 || cfg.Routes[1].ToURLs()[0].Host != "localhost:8081" {
+		t.Fatalf("expected b.com to be added and initialized")
+	}
+
+	dir, err := ioutil.TempDir("", "routes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, r := range []*RouteInfo{
+		{From: "A.com", To: Upstreams{"http://localhost:8081"}},
+		{From: "c.com"},
+		{From: "hub.a.com", To: Upstreams{"http://localhost:8081"}},
+		{From: "HUB.a.com/", To: Upstreams{"http://localhost:8081"}},
+		{From: "*.a.com", To: Upstreams{"http://localhost:8081"}},
+		{From: "d.com", To: Upstreams{"http://localhost:8081"}, Default: true},
+		{From: "e.com", To: Upstreams{"file://" + dir}},
+		{From: "f.com", To: Upstreams{"unix:///var/run/f.sock"}},
+	} {
+		if err := cfg.AddRoute(r); err == nil {
+			t.Fatalf("expected route %s to be invalid", r.From)
+		}
+	}
+
+	if len(cfg.Routes) != 2 {
+		t.Fatalf("expected 2 routes, got %d", len(cfg.Routes))
+	}
+
+	if err := cfg.AddRoute(&RouteInfo{
+		From: "hub.a.com/grafana",
+		To:   Upstreams{"http://localhost:8082"},
+	}); err != nil {
+		t.Fatalf("expected a path on the hub's host to be allowed: %s", err)
+	}
+}
+
+func TestRouteShadowsHub(t *testing.T) {
+	for _, from := range []string{
+		"hub.a.com",
+		"Hub.A.com",
+		"*.a.com",
+	} {
+		var cfg Info
+		conf := fmt.Sprintf(`{
+			"host": "hub.a.com",
+			"oauth": {"client-id": "id", "client-secret": "secret"},
+			"routes": [{"from": "%s", "to": "http://localhost:8080"}]
+		}`, from)
+		if err := cfg.Read(strings.NewReader(conf)); err == nil {
+			t.Fatalf("expected route %s to be invalid", from)
+		}
+	}
+}
+
+func TestCORSCredentials(t *testing.T) {
+	var cfg Info
+	if err := cfg.Read(strings.NewReader(`{
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"routes": [
+			{"from": "a.com", "to": "http://a", "cors": {
+				"allowed-origins": ["https://*.example.com", "http://localhost:3000", "https://app-?.b.co.uk"],
+				"allow-credentials": true
+			}},
+			{"from": "b.com", "to": "http://b", "cors": {"allowed-origins": ["*"]}}
+		]
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAcceptLegacyUntil(t *testing.T) {
+	var cfg Info
+	if err := cfg.Read(strings.NewReader(`{
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"session": {"store": "memory", "accept-legacy-until": "2026-11-01T00:00:00Z"}
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if u := cfg.Session.LegacyUntil(); !u.Equal(time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected accept-legacy-until %s", u)
+	}
+
+	for _, session := range []string{
+		`{"store": "memory", "accept-legacy-until": "next week"}`,
+		`{"accept-legacy-until": "2026-11-01T00:00:00Z"}`,
+	} {
+		var cfg Info
+		conf := fmt.Sprintf(`{
+			"oauth": {"client-id": "id", "client-secret": "secret"},
+			"session": %s
+		}`, session)
+		if err := cfg.Read(strings.NewReader(conf)); err == nil {
+			t.Fatalf("expected %s to be invalid", session)
+		}
+	}
+}
+
+func TestInvalidErrorPages(t *testing.T) {
+	for _, pages := range []string{
+		`{"500": "/dev/null"}`,
+		`{"forbidden": "/dev/null"}`,
+		`{"404": "/does/not/exist.html"}`,
+	} {
+		var cfg Info
+		conf := fmt.Sprintf(`{
+			"oauth": {"client-id": "id", "client-secret": "secret"},
+			"error-pages": %s
+		}`, pages)
+		if err := cfg.Read(strings.NewReader(conf)); err == nil {
+			t.Fatalf("expected %s to be invalid", pages)
+		}
+	}
+}
+
+func TestInvalidBranding(t *testing.T) {
+	for _, branding := range []string{
+		`{"colors": {"background": "red; }"}}`,
+		`{"dir": "/does/not/exist"}`,
+	} {
+		var cfg Info
+		conf := fmt.Sprintf(`{
+			"oauth": {"client-id": "id", "client-secret": "secret"},
+			"branding": %s
+		}`, branding)
+		if err := cfg.Read(strings.NewReader(conf)); err == nil {
+			t.Fatalf("expected %s to be invalid", branding)
+		}
+	}
+}
+
+func TestListeners(t *testing.T) {
+	var cfg Info
+	if err := cfg.Read(strings.NewReader(`{
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"listeners": [
+			{"addr": "10.0.0.1:9200", "serve": "admin"},
+			{"addr": ":8443"},
+			{"addr": ":8080"}
+		]
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.ListenerPort() != 8443 || cfg.Listeners[1].Serve != ListenerProxy {
+		t.Fatalf("expected the hub on the first proxy listener, got %d", cfg.ListenerPort())
+	}
+
+	if !cfg.HasAdminListener() {
+		t.Fatal("expected the admin API to have a listener of its own")
+	}
+
+	for _, listeners := range []string{
+		`[{"addr": "10.0.0.1:9200", "serve": "admin"}]`,
+		`[{"addr": ":80", "serve": "redirect"}, {"addr": ":8080"}]`,
+		`[{"addr": ":http"}]`,
+		`[{"addr": "8080"}]`,
+		`[{"addr": ":8080", "serve": "metrics"}]`,
+	} {
+		var cfg Info
+		conf := fmt.Sprintf(`{
+			"oauth": {"client-id": "id", "client-secret": "secret"},
+			"listeners": %s
+		}`, listeners)
+		if err := cfg.Read(strings.NewReader(conf)); err == nil {
+			t.Fatalf("expected %s to be invalid", listeners)
+		}
+	}
+}
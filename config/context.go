@@ -1,6 +1,24 @@
 package config
 
-import "fmt"
+import (
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kellegous/underpants/assertion"
+	"github.com/kellegous/underpants/audit"
+	"github.com/kellegous/underpants/authz"
+	"github.com/kellegous/underpants/directory"
+	"github.com/kellegous/underpants/jwt"
+	"github.com/kellegous/underpants/metrics"
+	"github.com/kellegous/underpants/session"
+	"github.com/kellegous/underpants/user"
+)
 
 // Context is the configuration info plus all runtime parameters.
 type Context struct {
@@ -10,11 +28,43 @@ type Context struct {
 	// Port is the http port that was specified on the command line.
 	Port int
 
-	// Key is the hmac signing key for cookies, this is usually ephemeral.
+	// Key is the hmac signing key for cookies, it is ephemeral unless session.key is
+	// configured.
 	Key []byte
 
+	// Sessions encodes and decodes the user cookie.
+	Sessions *session.Manager
+
+	// Directory looks up users' Google Groups, it is nil unless google-groups is
+	// configured.
+	Directory *directory.Client
+
+	// Authz is the external authorization webhook, it is nil unless authz-webhook is
+	// configured.
+	Authz *authz.Webhook
+
+	// JWT verifies the JWTs that requests can be authenticated with, it is nil unless
+	// jwt is configured.
+	JWT *jwt.Verifier
+
+	// Assertions signs the identity assertions sent to backends, it is nil unless
+	// assertion is configured.
+	Assertions *assertion.Signer
+
+	// Audit records security relevant events, it is nil unless audit-log is
+	// configured. Recording to a nil Audit does nothing.
+	Audit *audit.Log
+
+	// Metrics are the metrics served for Prometheus to scrape. They are always
+	// collected, but only served if metrics is configured.
+	Metrics *metrics.Metrics
+
 	// groupIdx is an index of group membership that makes permission checking efficient.
 	groupIdx map[membership]bool
+
+	// domainRoutes are the routes that override the oauth domain or add guests, by
+	// the lowercase host of the route.
+	domainRoutes map[string]*RouteInfo
 }
 
 // membership is used as a key in the groupIdx of the Context.
@@ -24,6 +74,11 @@ type membership struct {
 
 // Host is the normalized host URLs to the hub.
 func (c *Context) Host() string {
+	// proxies that terminate TLS are reached on the default https port.
+	if t := c.TrustedProxies; t != nil && t.TerminatesTLS {
+		return c.Info.Host
+	}
+
 	switch c.Port {
 	case 80, 443:
 		return c.Info.Host
@@ -31,8 +86,13 @@ func (c *Context) Host() string {
 	return fmt.Sprintf("%s:%d", c.Info.Host, c.Port)
 }
 
-// ListenAddr is the address that should be passed to net.Listen.
+// ListenAddr is the address that should be passed to net.Listen. With a dev user, only
+// connections from this machine are accepted.
 func (c *Context) ListenAddr() string {
+	if c.DevUser != "" {
+		return fmt.Sprintf("127.0.0.1:%d", c.Port)
+	}
+
 	switch c.Port {
 	case 80:
 		return ":http"
@@ -43,7 +103,44 @@ func (c *Context) ListenAddr() string {
 }
 
 // BuildContext constructs a new context.
-func BuildContext(cfg *Info, port int, key []byte) *Context {
+func BuildContext(cfg *Info, port int, key []byte) (*Context, error) {
+	return buildContext(cfg, port, key, nil)
+}
+
+// ReloadContext constructs the context for a config that was reloaded while prev was
+// running. The session store, the audit log and the metrics of prev are kept, so that
+// users stay signed in and counters carry on, unless the config changed them.
+func ReloadContext(prev *Context, cfg *Info, key []byte) (*Context, error) {
+	return buildContext(cfg, prev.Port, key, prev)
+}
+
+// ReleaseContext closes the session state of a context that was replaced by a reload
+// and that next does not share, such as the background eviction of a memory store.
+func ReleaseContext(prev, next *Context) {
+	keep := map[interface{}]bool{
+		next.Sessions.Store:       true,
+		next.Sessions.Revocations: true,
+		next.Sessions.Handoffs:    true,
+	}
+
+	for _, v := range []interface{}{
+		prev.Sessions.Store,
+		prev.Sessions.Revocations,
+		prev.Sessions.Handoffs,
+	} {
+		if c, ok := v.(io.Closer); ok && !keep[v] {
+			keep[v] = true
+			c.Close()
+		}
+	}
+}
+
+// buildContext constructs a context, reusing what it can of prev if it is not nil.
+func buildContext(cfg *Info, port int, key []byte, prev *Context) (*Context, error) {
+	if cfg.DevUser != "" && (port == 80 || port == 443) {
+		return nil, fmt.Errorf("dev-user cannot be used on port %d", port)
+	}
+
 	idx := map[membership]bool{}
 	for name, emails := range cfg.Groups {
 		for _, email := range emails {
@@ -51,12 +148,284 @@ func BuildContext(cfg *Info, port int, key []byte) *Context {
 		}
 	}
 
-	return &Context{
-		Info:     cfg,
-		Port:     port,
-		Key:      key,
-		groupIdx: idx,
+	var store session.Store
+	var revs session.Revocations
+	var handoffs session.Handoffs
+	var err error
+	if prev != nil && sameSessionStore(prev.Info, cfg) {
+		store, revs, handoffs = prev.Sessions.Store, prev.Sessions.Revocations, prev.Sessions.Handoffs
+	} else {
+		store, err = newSessionStore(cfg)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := newSharedStore(cfg)
+		if err != nil {
+			return nil, err
+		}
+		revs = newRevocations(cfg, store, shared)
+		handoffs = newHandoffs(store, shared)
+	}
+
+	m := metrics.New()
+	if prev != nil {
+		m = prev.Metrics
 	}
+
+	var dir *directory.Client
+	if g := cfg.GoogleGroups; g != nil {
+		dir, err = directory.FromServiceAccount(
+			g.ServiceAccountKey,
+			g.AdminEmail,
+			time.Duration(g.CacheTTL)*time.Second)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var az *authz.Webhook
+	if a := cfg.AuthzWebhook; a != nil {
+		az = authz.NewWebhook(a.URL,
+			time.Duration(a.TimeoutMs)*time.Millisecond,
+			time.Duration(a.CacheTTL)*time.Second)
+	}
+
+	domains := map[string]*RouteInfo{}
+	for _, route := range cfg.Routes {
+		if route.Domain != "" || len(route.Guests) > 0 {
+			domains[route.Host()] = route
+		}
+	}
+
+	ctx := &Context{
+		Info: cfg,
+		Port: port,
+		Key:  key,
+		Sessions: &session.Manager{
+			Key:         key,
+			Store:       store,
+			Cookie:      cookieOptions(cfg),
+			Revocations: revs,
+			Handoffs:    handoffs,
+			Sliding:     cfg.Session.Sliding,
+			MaxLifetime: sessionLifetime(cfg),
+			Encrypt:     cfg.Session.Encrypt,
+			LegacyUntil: cfg.Session.LegacyUntil(),
+		},
+		Directory: dir,
+		Authz:     az,
+		Metrics:   m,
+		groupIdx:  idx,
+
+		domainRoutes: domains,
+	}
+	registerMetrics(ctx)
+
+	if a := cfg.Assertion; a != nil {
+		ctx.Assertions, err = assertion.LoadSigner(
+			a.Key,
+			fmt.Sprintf("%s://%s", cfg.Scheme(), ctx.Host()),
+			time.Duration(a.TTL)*time.Second)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if j := cfg.JWT; j != nil {
+		ctx.JWT = jwt.NewVerifier(j.Issuer, j.JWKSURL, j.Audiences,
+			time.Duration(j.CacheTTL)*time.Second)
+	}
+
+	if a := cfg.AuditLog; a != nil {
+		if prev != nil && prev.AuditLog != nil && prev.AuditLog.Path == a.Path {
+			ctx.Audit = prev.Audit
+		} else {
+			ctx.Audit, err = audit.Open(a.Path)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return ctx, nil
+}
+
+// sameSessionStore determines if the two configs describe the same session store, in
+// which case the sessions held in it remain valid.
+func sameSessionStore(a, b *Info) bool {
+	sa, sb := &a.Session, &b.Session
+	return sa.Store == sb.Store &&
+		sa.Capacity == sb.Capacity &&
+		sa.Eviction == sb.Eviction &&
+		sa.EvictionBatchSize == sb.EvictionBatchSize &&
+		reflect.DeepEqual(sa.Redis, sb.Redis) &&
+		reflect.DeepEqual(sa.Shared, sb.Shared) &&
+		sessionLifetime(a) == sessionLifetime(b)
+}
+
+// cache is a cache that reports how often it is hit.
+type cache interface {
+	CacheStats() (hits, misses uint64)
+}
+
+// registerMetrics adds the metrics that are computed as they are scraped, for the
+// caches and the session store.
+func registerMetrics(ctx *Context) {
+	if ctx.Authz != nil {
+		registerCacheMetrics(ctx.Metrics, "authz", ctx.Authz)
+	}
+
+	if ctx.Directory != nil {
+		registerCacheMetrics(ctx.Metrics, "groups", ctx.Directory)
+	}
+
+	if c, ok := ctx.Sessions.Store.(cache); ok {
+		registerCacheMetrics(ctx.Metrics, "sessions", c)
+	}
+
+	if s, ok := ctx.Sessions.Store.(interface{ Len() int }); ok {
+		ctx.Metrics.GaugeFunc("underpants_active_sessions",
+			"Sessions held in the memory session store.",
+			func() float64 {
+				return float64(s.Len())
+			})
+	}
+}
+
+// registerCacheMetrics adds the hits and misses of the named cache.
+func registerCacheMetrics(m *metrics.Metrics, name string, c cache) {
+	const help = "Lookups in each cache by whether they were answered from the cache."
+
+	m.CounterFunc("underpants_cache_requests_total", help,
+		func() float64 {
+			hits, _ := c.CacheStats()
+			return float64(hits)
+		},
+		"cache", name, "result", "hit")
+
+	m.CounterFunc("underpants_cache_requests_total", help,
+		func() float64 {
+			_, misses := c.CacheStats()
+			return float64(misses)
+		},
+		"cache", name, "result", "miss")
+}
+
+// cookieOptions are the attributes of the session cookie described in the config. The
+// defaults are used for any that were not initialized.
+func cookieOptions(cfg *Info) session.CookieOptions {
+	c := &cfg.Cookie
+	o := session.CookieOptions{
+		Name:     c.Name,
+		Domain:   c.Domain,
+		MaxAge:   c.MaxAge,
+		Secure:   cfg.IsSecure(),
+		HTTPOnly: true,
+		SameSite: c.SameSiteMode(),
+	}
+
+	if c.Secure != nil {
+		o.Secure = *c.Secure
+	}
+
+	if c.HTTPOnly != nil {
+		o.HTTPOnly = *c.HTTPOnly
+	}
+
+	return o
+}
+
+// sessionTTL is how long sessions last after the user signs in, on the route whose
+// sessions last the longest.
+func sessionTTL(cfg *Info) time.Duration {
+	ttl := user.CookieMaxAge * time.Second
+	if cfg.Cookie.MaxAge > 0 {
+		ttl = time.Duration(cfg.Cookie.MaxAge) * time.Second
+	}
+
+	for _, route := range cfg.Routes {
+		if s := route.Session; s != nil && time.Duration(s.MaxAge)*time.Second > ttl {
+			ttl = time.Duration(s.MaxAge) * time.Second
+		}
+	}
+	return ttl
+}
+
+// sessionLifetime is the longest a session can last.
+func sessionLifetime(cfg *Info) time.Duration {
+	if cfg.Session.Sliding || cfg.Oauth.RefreshTokens {
+		return time.Duration(cfg.Session.MaxLifetime) * time.Second
+	}
+	return sessionTTL(cfg)
+}
+
+// newRevocations creates the record of revoked sessions. Stores that are shared
+// between instances share revocations too, as does the shared Redis server of cookie
+// sessions, otherwise they are kept in memory.
+func newRevocations(cfg *Info, store session.Store, shared *session.RedisStore) session.Revocations {
+	if r, ok := store.(session.Revocations); ok {
+		return r
+	}
+
+	if shared != nil {
+		return shared
+	}
+	return session.NewMemoryRevocations(sessionLifetime(cfg))
+}
+
+// newHandoffs creates the holder of handoff codes. Stores that are shared between
+// instances, and the shared Redis server of cookie sessions, let any of them redeem a
+// code, otherwise codes are kept in memory.
+func newHandoffs(store session.Store, shared *session.RedisStore) session.Handoffs {
+	if h, ok := store.(session.Handoffs); ok {
+		return h
+	}
+
+	if shared != nil {
+		return shared
+	}
+	return session.NewMemoryHandoffs()
+}
+
+// newSharedStore creates the Redis store through which instances share handoff codes
+// and revocations, which is nil if none is configured.
+func newSharedStore(cfg *Info) (*session.RedisStore, error) {
+	r := cfg.Session.Shared
+	if r == nil {
+		return nil, nil
+	}
+
+	return session.NewRedisStore(session.RedisOptions{
+		Addr:     r.Addr,
+		Password: r.Password,
+		DB:       r.DB,
+		Prefix:   r.Prefix,
+		TTL:      sessionLifetime(cfg),
+	})
+}
+
+// newSessionStore creates the session.Store described in the config, which is nil
+// for cookie sessions.
+func newSessionStore(cfg *Info) (session.Store, error) {
+	switch cfg.Session.Store {
+	case SessionStoreMemory:
+		return session.NewMemoryStore(session.MemoryOptions{
+			TTL:       sessionLifetime(cfg),
+			Capacity:  cfg.Session.Capacity,
+			Eviction:  cfg.Session.Eviction,
+			BatchSize: cfg.Session.EvictionBatchSize,
+		})
+	case SessionStoreRedis:
+		r := cfg.Session.Redis
+		return session.NewRedisStore(session.RedisOptions{
+			Addr:     r.Addr,
+			Password: r.Password,
+			DB:       r.DB,
+			Prefix:   r.Prefix,
+			TTL:      sessionLifetime(cfg),
+		})
+	}
+	return nil, nil
 }
 
 // UserMemberOfAny determines if a user belongs to any of the given groups.
@@ -78,3 +447,214 @@ func (c *Context) UserMemberOfAny(email string, groups []string) bool {
 
 	return false
 }
+
+// matchesAny determines if the email matches any of the access entries, which are
+// email addresses, globs over email addresses or group names.
+func (c *Context) matchesAny(email string, entries []string) bool {
+	lower := strings.ToLower(email)
+	for _, entry := range entries {
+		if !strings.Contains(entry, "@") {
+			if entry == "*" || c.groupIdx[membership{email, entry}] {
+				return true
+			}
+			continue
+		}
+
+		if ok, _ := path.Match(strings.ToLower(entry), lower); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// UserMatches determines if a user matches any of the entries of an access list, such
+// as the users of a route's canary.
+func (c *Context) UserMatches(email string, entries []string) bool {
+	return c.matchesAny(email, entries)
+}
+
+// UserAllowed determines if a user passes the allow and deny lists of a route or path
+// rule.
+func (c *Context) UserAllowed(email string, allow, deny []string) bool {
+	if c.matchesAny(email, deny) {
+		return false
+	}
+
+	return len(allow) == 0 || c.matchesAny(email, allow)
+}
+
+// UserAllowedOnRoute determines if a user passes the allow and deny lists of a route,
+// including the entries of its allow-file. A route whose allow list and allow-file
+// are both empty admits no one.
+func (c *Context) UserAllowedOnRoute(email string, r *RouteInfo) bool {
+	allow := r.AllowEntries()
+	if r.AllowFile != "" && len(allow) == 0 {
+		return false
+	}
+	return c.UserAllowed(email, allow, r.Deny)
+}
+
+// UserGroups returns the names of the configured groups the user belongs to, in
+// order, followed by the email addresses of the user's Google Groups if google-groups
+// is configured.
+func (c *Context) UserGroups(email string) ([]string, error) {
+	var groups []string
+	for name := range c.Groups {
+		if c.groupIdx[membership{email, name}] {
+			groups = append(groups, name)
+		}
+	}
+	sort.Strings(groups)
+
+	if c.Directory == nil {
+		return groups, nil
+	}
+
+	gg, err := c.Directory.GroupsOf(email)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(groups, gg...), nil
+}
+
+// IsAdmin determines if a user is a member of one of the admin groups. Unlike
+// UserMemberOfAny, this denies everyone when no groups are configured.
+func (c *Context) IsAdmin(email string) bool {
+	for _, group := range c.AdminGroups {
+		if c.groupIdx[membership{email, group}] {
+			return true
+		}
+	}
+	return false
+}
+
+// CanImpersonate determines if the user with the given email may impersonate other
+// users.
+func (c *Context) CanImpersonate(email string) bool {
+	if !c.IsAdmin(email) {
+		return false
+	}
+
+	for _, group := range c.Admin.ImpersonateGroups {
+		if c.groupIdx[membership{email, group}] {
+			return true
+		}
+	}
+	return false
+}
+
+// ForHost returns the context for requests to the given host. If it is a route that
+// overrides the oauth domain or adds guests, this is a copy of the context with the
+// route's domain and guests.
+func (c *Context) ForHost(host string) *Context {
+	host = strings.ToLower(stripPort(host))
+	route, ok := c.domainRoutes[host]
+	if !ok {
+		route, ok = c.domainRoutes[WildcardOf(host)]
+	}
+	if !ok {
+		return c
+	}
+
+	o := c.Oauth
+	if route.Domain != "" {
+		o.Domain = route.Domain
+		o.Domains = nil
+	}
+	if len(route.Guests) > 0 {
+		o.Guests = append(append([]string{}, o.Guests...), route.Guests...)
+	}
+	return c.WithOAuth(&o)
+}
+
+// IsKnownHost determines if host, which may include a port, is the hub or the host of
+// one of the routes.
+func (c *Context) IsKnownHost(host string) bool {
+	host = strings.ToLower(stripPort(host))
+	if host == strings.ToLower(c.Info.Host) {
+		return true
+	}
+
+	wildcard := WildcardOf(host)
+	for _, route := range c.Routes {
+		if h := route.Host(); h == host || h == wildcard {
+			return true
+		}
+	}
+	return false
+}
+
+// RouteFor returns the route that serves requests for path on host, which may include
+// a port, or nil if there is none. As with the hub's mux, routes on the host itself
+// take precedence over a wildcard route, and the route with the longest path prefix
+// that covers path wins.
+func (c *Context) RouteFor(host, path string) *RouteInfo {
+	host = strings.ToLower(stripPort(host))
+	if route, ok := routeFor(c.Routes, host, path); ok {
+		return route
+	}
+
+	route, _ := routeFor(c.Routes, WildcardOf(host), path)
+	return route
+}
+
+// routeFor finds the route on host that serves path, reporting whether there are any
+// routes on host at all.
+func routeFor(routes []*RouteInfo, host, path string) (*RouteInfo, bool) {
+	var best *RouteInfo
+	found := false
+	for _, route := range routes {
+		if host == "" || route.Host() != host {
+			continue
+		}
+		found = true
+
+		prefix := route.PathPrefix()
+		if path != prefix && !strings.HasPrefix(path, prefix+"/") {
+			continue
+		}
+
+		if best == nil || len(prefix) > len(best.PathPrefix()) {
+			best = route
+		}
+	}
+	return best, found
+}
+
+// UserInDomain determines if the user may access the route with the given host based
+// on the domain of their email or their being a guest. Domains are only enforced by
+// routes once a route overrides the oauth domain or adds guests, otherwise the
+// identity provider enforces the domain.
+func (c *Context) UserInDomain(email, host string) bool {
+	if len(c.domainRoutes) == 0 {
+		return true
+	}
+
+	o := c.ForHost(host).Oauth
+	if len(o.AllowedDomains()) == 0 || o.IsGuest(email) {
+		return true
+	}
+
+	i := strings.LastIndex(email, "@")
+	return i >= 0 && o.HasDomain(email[i+1:])
+}
+
+// stripPort removes the port, if any, from a host.
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// WithOAuth returns a copy of the context that uses the given oauth settings. This is
+// how each of multiple identity providers sees its own settings.
+func (c *Context) WithOAuth(o *OAuthInfo) *Context {
+	info := *c.Info
+	info.Oauth = *o
+
+	ctx := *c
+	ctx.Info = &info
+	return &ctx
+}
@@ -1,8 +1,14 @@
 package config
 
 import (
+	"fmt"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/kellegous/underpants/session"
+	"github.com/kellegous/underpants/session/redistest"
+	"github.com/kellegous/underpants/user"
 )
 
 type userMemberOfAnyTest struct {
@@ -19,7 +25,10 @@ func TestUserMemberOfAny(t *testing.T) {
 		},
 	}
 
-	ctx := BuildContext(cfg, 80, []byte{})
+	ctx, err := BuildContext(cfg, 80, []byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	tests := []userMemberOfAnyTest{
 		{"c@c.com", []string{"a", "b"}, false},
@@ -42,3 +51,396 @@ func TestUserMemberOfAny(t *testing.T) {
 		}
 	}
 }
+
+func TestIsAdmin(t *testing.T) {
+	cfg := &Info{
+		Groups: map[string][]string{
+			"a": {"a@a.com"},
+			"b": {"b@a.com"},
+		},
+		AdminGroups: []string{"a"},
+	}
+
+	ctx, err := BuildContext(cfg, 80, []byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !ctx.IsAdmin("a@a.com") {
+		t.Fatal("a@a.com should be an admin")
+	}
+
+	if ctx.IsAdmin("b@a.com") {
+		t.Fatal("b@a.com should not be an admin")
+	}
+
+	ctx, err = BuildContext(&Info{}, 80, []byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx.IsAdmin("a@a.com") {
+		t.Fatal("no one should be an admin without admin groups")
+	}
+}
+
+func TestUserGroups(t *testing.T) {
+	ctx, err := BuildContext(&Info{
+		Groups: map[string][]string{
+			"ops": {"a@a.com"},
+			"eng": {"a@a.com", "b@a.com"},
+			"hr":  {"c@a.com"},
+		},
+	}, 80, []byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"a@a.com": "[eng ops]",
+		"b@a.com": "[eng]",
+		"d@a.com": "[]",
+	}
+
+	for email, want := range tests {
+		groups, err := ctx.UserGroups(email)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fmt.Sprint(groups) != want {
+			t.Fatalf("%s: expected groups %s, got %v", email, want, groups)
+		}
+	}
+}
+
+func TestUserAllowed(t *testing.T) {
+	cfg := &Info{
+		Groups: map[string][]string{
+			"a": {"a@a.com"},
+		},
+	}
+
+	ctx, err := BuildContext(cfg, 80, []byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &RouteInfo{
+		Allow: []string{"*@b.com", "a", "c@c.com"},
+		Deny:  []string{"bad@b.com"},
+	}
+
+	tests := map[string]bool{
+		"a@a.com":   true,
+		"b@b.com":   true,
+		"B@B.COM":   true,
+		"c@c.com":   true,
+		"bad@b.com": false,
+		"d@a.com":   false,
+	}
+
+	for email, expected := range tests {
+		if ctx.UserAllowed(email, r.Allow, r.Deny) != expected {
+			t.Fatalf("%s allowed should have been %t", email, expected)
+		}
+	}
+
+	if !ctx.UserAllowed("d@a.com", nil, nil) {
+		t.Fatal("everyone should be allowed without an allow list")
+	}
+
+	if ctx.UserAllowed("a@a.com", nil, []string{"a"}) {
+		t.Fatal("a@a.com should be denied by group")
+	}
+}
+
+func TestReloadContext(t *testing.T) {
+	var cfg Info
+	if err := cfg.Read(strings.NewReader(`{
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"session": {"store": "memory"},
+		"routes": [{"from": "a.com", "to": "http://localhost:8080"}]
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	prev, err := BuildContext(&cfg, 80, []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reloaded Info
+	if err := reloaded.Read(strings.NewReader(`{
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"session": {"store": "memory"},
+		"routes": [
+			{"from": "a.com", "to": "http://localhost:8080"},
+			{"from": "b.com", "to": "http://localhost:8081"}
+		]
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := ReloadContext(prev, &reloaded, prev.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ctx.Routes) != 2 {
+		t.Fatalf("expected 2 routes, got %d", len(ctx.Routes))
+	}
+
+	if ctx.Port != prev.Port {
+		t.Fatalf("expected port %d, got %d", prev.Port, ctx.Port)
+	}
+
+	if ctx.Sessions.Store != prev.Sessions.Store {
+		t.Fatal("expected the session store to be kept")
+	}
+
+	if ctx.Metrics != prev.Metrics {
+		t.Fatal("expected the metrics to be kept")
+	}
+
+	reloaded.Session.Capacity = 10
+	ctx, err = ReloadContext(prev, &reloaded, prev.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ctx.Sessions.Store == prev.Sessions.Store {
+		t.Fatal("expected a new session store when its settings change")
+	}
+}
+
+func TestSharedSessionState(t *testing.T) {
+	r := redistest.NewServer(t)
+
+	build := func(session string) (*Context, error) {
+		var cfg Info
+		if err := cfg.Read(strings.NewReader(fmt.Sprintf(`{
+			"oauth": {"client-id": "id", "client-secret": "secret"},
+			"session": %s
+		}`, session))); err != nil {
+			return nil, err
+		}
+		return BuildContext(&cfg, 80, []byte("key"))
+	}
+
+	shared := fmt.Sprintf(`{"store": "cookie", "shared": {"addr": %q}}`, r.Addr())
+
+	a, err := build(shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := build(shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := a.Sessions.Encode(&user.Info{
+		Email:             "a@a.com",
+		LastAuthenticated: time.Now().Add(-time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := a.Sessions.NewHandoff(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, u, err := b.Sessions.RedeemHandoff(code); err != nil {
+		t.Fatalf("expected the code to be redeemed on another instance, got %v", err)
+	} else if u.Email != "a@a.com" {
+		t.Fatalf("expected a@a.com, got %s", u.Email)
+	}
+
+	if _, _, err := a.Sessions.RedeemHandoff(code); err == nil {
+		t.Fatal("expected the code to be redeemed only once")
+	}
+
+	if err := a.Sessions.RevokeUser("a@a.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := b.Sessions.Decode(v); err == nil {
+		t.Fatal("expected the revocation to apply on another instance")
+	}
+
+	ctx, err := build(`{}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := ctx.Sessions.Handoffs.(*session.MemoryHandoffs); !ok {
+		t.Fatalf("expected handoffs to be kept in memory, got %T", ctx.Sessions.Handoffs)
+	}
+
+	for _, bad := range []string{
+		`{"shared": {}}`,
+		`{"store": "memory", "shared": {"addr": "localhost:6379"}}`,
+		`{"store": "redis", "redis": {"addr": "localhost:6379"}, "shared": {"addr": "localhost:6379"}}`,
+	} {
+		if _, err := build(bad); err == nil {
+			t.Fatalf("expected %s to be invalid", bad)
+		}
+	}
+}
+
+// closeCounter is a session store that counts how many times it is closed.
+type closeCounter struct {
+	session.Store
+	closed int
+}
+
+func (c *closeCounter) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestReleaseContext(t *testing.T) {
+	kept, replaced := &closeCounter{}, &closeCounter{}
+
+	prev := &Context{Sessions: &session.Manager{Store: kept}}
+	ReleaseContext(prev, &Context{Sessions: &session.Manager{Store: kept}})
+	if kept.closed != 0 {
+		t.Fatal("expected a store that is kept to stay open")
+	}
+
+	prev = &Context{Sessions: &session.Manager{
+		Store:    replaced,
+		Handoffs: session.NewMemoryHandoffs(),
+	}}
+	ReleaseContext(prev, &Context{Sessions: &session.Manager{Store: kept}})
+	if replaced.closed != 1 {
+		t.Fatalf("expected a replaced store to be closed once, got %d", replaced.closed)
+	}
+}
+
+func TestForHost(t *testing.T) {
+	cfg := &Info{
+		Oauth: OAuthInfo{Domain: "a.com"},
+		Routes: []*RouteInfo{
+			{From: "x.a.com"},
+			{From: "y.a.com", Domain: "b.com"},
+			{From: "z.a.com", Guests: []string{"v@c.com"}},
+		},
+	}
+
+	ctx, err := BuildContext(cfg, 80, []byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Host   string
+		Domain string
+	}{
+		{"x.a.com", "a.com"},
+		{"Y.a.com:8080", "b.com"},
+		{"hub.a.com", "a.com"},
+	}
+
+	for _, test := range tests {
+		if d := ctx.ForHost(test.Host).Oauth.Domain; d != test.Domain {
+			t.Fatalf("expected domain %s for %s, got %s", test.Domain, test.Host, d)
+		}
+	}
+
+	if ctx.Oauth.Domain != "a.com" {
+		t.Fatalf("ForHost should not change the context, got domain %s", ctx.Oauth.Domain)
+	}
+
+	if !ctx.UserInDomain("u@B.com", "y.a.com") || ctx.UserInDomain("u@a.com", "y.a.com") {
+		t.Fatal("expected y.a.com to only admit users of b.com")
+	}
+
+	if !ctx.UserInDomain("V@c.com", "z.a.com") || ctx.UserInDomain("v@c.com", "x.a.com") {
+		t.Fatal("expected only z.a.com to admit its guest")
+	}
+
+	if ctx.UserInDomain("u@b.com", "x.a.com") {
+		t.Fatal("expected x.a.com to only admit users of a.com")
+	}
+}
+
+func TestRouteFor(t *testing.T) {
+	cfg := &Info{
+		Routes: []*RouteInfo{
+			{From: "a.com"},
+			{From: "hub.com/grafana"},
+			{From: "hub.com/grafana/admin"},
+			{From: "*.tools.com"},
+			{From: "x.tools.com/api"},
+		},
+	}
+
+	ctx, err := BuildContext(cfg, 80, []byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Host string
+		Path string
+		From string
+	}{
+		{"A.com:8080", "/x", "a.com"},
+		{"hub.com", "/grafana", "hub.com/grafana"},
+		{"hub.com", "/grafana/d/1", "hub.com/grafana"},
+		{"hub.com", "/grafana/admin/users", "hub.com/grafana/admin"},
+		{"hub.com", "/grafanas", ""},
+		{"y.tools.com", "/", "*.tools.com"},
+		{"x.tools.com", "/api/v1", "x.tools.com/api"},
+		{"x.tools.com", "/", ""},
+		{"b.com", "/", ""},
+	}
+
+	for _, test := range tests {
+		var from string
+		if route := ctx.RouteFor(test.Host, test.Path); route != nil {
+			from = route.From
+		}
+
+		if from != test.From {
+			t.Fatalf("expected %s%s to be served by %q, got %q",
+				test.Host, test.Path, test.From, from)
+		}
+	}
+}
+
+func TestDevUser(t *testing.T) {
+	for conf, valid := range map[string]bool{
+		`{"host": "localhost"}`:                      true,
+		`{"host": "127.0.0.1"}`:                      true,
+		`{"host": "hub.com"}`:                        false,
+		`{"host": "localhost", "autocert": {}}`:      false,
+		`{"host": "hub.localhost", "providers": []}`: true,
+	} {
+		cfg := Info{DevUser: "a@a.com"}
+		if err := cfg.Read(strings.NewReader(conf)); (err == nil) != valid {
+			t.Fatalf("expected %s to be valid=%t, got %v", conf, valid, err)
+		}
+	}
+
+	cfg := Info{DevUser: "a@a.com"}
+	if err := cfg.Read(strings.NewReader(`{"host": "localhost"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := BuildContext(&cfg, 80, []byte("key")); err == nil {
+		t.Fatal("expected the dev user to be refused on port 80")
+	}
+
+	ctx, err := BuildContext(&cfg, 8080, []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ctx.ListenAddr() != "127.0.0.1:8080" {
+		t.Fatalf("expected to listen on loopback only, got %s", ctx.ListenAddr())
+	}
+}
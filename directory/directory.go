@@ -0,0 +1,198 @@
+package directory
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2/google"
+)
+
+// scope is the OAuth scope needed to list a user's groups.
+const scope = "https://www.googleapis.com/auth/admin.directory.group.readonly"
+
+// apiURL is the base URL of the Admin SDK Directory API.
+var apiURL = "https://admin.googleapis.com/admin/directory/v1"
+
+type entry struct {
+	groups  map[string]bool
+	expires time.Time
+}
+
+// Client looks up the Google Groups a user belongs to. Lookups are cached for a TTL
+// so that a user's requests do not each need a call to the Directory API.
+type Client struct {
+	c   *http.Client
+	ttl time.Duration
+
+	lck    sync.Mutex
+	cache  map[string]*entry
+	hits   uint64
+	misses uint64
+}
+
+// NewClient creates a Client that calls the Directory API with the given (authorized)
+// http.Client.
+func NewClient(c *http.Client, ttl time.Duration) *Client {
+	return &Client{
+		c:     c,
+		ttl:   ttl,
+		cache: map[string]*entry{},
+	}
+}
+
+// FromServiceAccount creates a Client that authorizes as a service account with
+// domain-wide delegation, acting on behalf of the given admin user.
+func FromServiceAccount(keyFile, admin string, ttl time.Duration) (*Client, error) {
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := google.JWTConfigFromJSON(key, scope)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Subject = admin
+
+	return NewClient(cfg.Client(context.Background()), ttl), nil
+}
+
+// fetch lists the emails of all of the groups the user is a direct member of.
+func (c *Client) fetch(email string) (map[string]bool, error) {
+	groups := map[string]bool{}
+
+	var page string
+	for {
+		q := url.Values{
+			"userKey": {email},
+		}
+		if page != "" {
+			q.Set("pageToken", page)
+		}
+
+		res, err := c.c.Get(fmt.Sprintf("%s/groups?%s", apiURL, q.Encode()))
+		if err != nil {
+			return nil, err
+		}
+
+		var body struct {
+			Groups []struct {
+				Email string `json:"email"`
+			} `json:"groups"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return nil, fmt.Errorf("listing groups for %s returned status %d",
+				email,
+				res.StatusCode)
+		}
+
+		err = json.NewDecoder(res.Body).Decode(&body)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, g := range body.Groups {
+			groups[strings.ToLower(g.Email)] = true
+		}
+
+		if body.NextPageToken == "" {
+			return groups, nil
+		}
+		page = body.NextPageToken
+	}
+}
+
+// groupsFor returns the groups of the user, from the cache if possible.
+func (c *Client) groupsFor(email string) (map[string]bool, error) {
+	now := time.Now()
+
+	c.lck.Lock()
+	e := c.cache[email]
+	hit := e != nil && now.Before(e.expires)
+	if hit {
+		c.hits++
+	} else {
+		c.misses++
+	}
+	c.lck.Unlock()
+
+	if hit {
+		return e.groups, nil
+	}
+
+	groups, err := c.fetch(email)
+	if err != nil {
+		return nil, err
+	}
+
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	// drop expired entries so that the cache only holds active users.
+	for k, v := range c.cache {
+		if !now.Before(v.expires) {
+			delete(c.cache, k)
+		}
+	}
+
+	c.cache[email] = &entry{
+		groups:  groups,
+		expires: now.Add(c.ttl),
+	}
+
+	return groups, nil
+}
+
+// CacheStats reports the number of lookups that were answered from the cache and the
+// number that called the Directory API.
+func (c *Client) CacheStats() (hits, misses uint64) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	return c.hits, c.misses
+}
+
+// IsMemberOfAny determines if the user is a member of any of the groups, which are
+// given by their email addresses.
+func (c *Client) IsMemberOfAny(email string, groups []string) (bool, error) {
+	ug, err := c.groupsFor(strings.ToLower(email))
+	if err != nil {
+		return false, err
+	}
+
+	for _, g := range groups {
+		if ug[strings.ToLower(g)] {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// GroupsOf returns the email addresses of the groups the user is a member of, in
+// order.
+func (c *Client) GroupsOf(email string) ([]string, error) {
+	ug, err := c.groupsFor(strings.ToLower(email))
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make([]string, 0, len(ug))
+	for g := range ug {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+
+	return groups, nil
+}
@@ -0,0 +1,102 @@
+package directory
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIsMemberOfAny(t *testing.T) {
+	calls := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Path != "/groups" || r.FormValue("userKey") != "a@a.com" {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.FormValue("pageToken") == "" {
+			fmt.Fprint(w, `{"groups": [{"email": "Eng@a.com"}], "nextPageToken": "2"}`)
+			return
+		}
+		fmt.Fprint(w, `{"groups": [{"email": "ops@a.com"}]}`)
+	}))
+	defer s.Close()
+
+	defer func(u string) { apiURL = u }(apiURL)
+	apiURL = s.URL
+
+	c := NewClient(http.DefaultClient, time.Minute)
+
+	ok, err := c.IsMemberOfAny("A@a.com", []string{"sales@a.com", "ops@a.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected a@a.com to be a member of ops@a.com")
+	}
+
+	ok, err = c.IsMemberOfAny("a@a.com", []string{"eng@a.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected a@a.com to be a member of eng@a.com")
+	}
+
+	if ok, _ := c.IsMemberOfAny("a@a.com", []string{"sales@a.com"}); ok {
+		t.Fatal("expected a@a.com not to be a member of sales@a.com")
+	}
+
+	if calls != 2 {
+		t.Fatalf("expected groups to be fetched once (2 pages), got %d calls", calls)
+	}
+
+	if _, err := c.IsMemberOfAny("b@a.com", []string{"eng@a.com"}); err == nil {
+		t.Fatal("expected failed lookup to return an error")
+	}
+}
+
+func TestGroupsOf(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"groups": [{"email": "ops@a.com"}, {"email": "Eng@a.com"}]}`)
+	}))
+	defer s.Close()
+
+	defer func(u string) { apiURL = u }(apiURL)
+	apiURL = s.URL
+
+	groups, err := NewClient(http.DefaultClient, time.Minute).GroupsOf("a@a.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(groups) != "[eng@a.com ops@a.com]" {
+		t.Fatalf("expected [eng@a.com ops@a.com], got %v", groups)
+	}
+}
+
+func TestCacheExpires(t *testing.T) {
+	calls := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		fmt.Fprint(w, `{"groups": []}`)
+	}))
+	defer s.Close()
+
+	defer func(u string) { apiURL = u }(apiURL)
+	apiURL = s.URL
+
+	c := NewClient(http.DefaultClient, -time.Second)
+	for i := 0; i < 2; i++ {
+		if _, err := c.IsMemberOfAny("a@a.com", []string{"eng@a.com"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if calls != 2 {
+		t.Fatalf("expected expired entries to be refetched, got %d calls", calls)
+	}
+}
@@ -0,0 +1,203 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kellegous/underpants/config"
+)
+
+// consulWait is how long Consul holds a blocking query open waiting for changes.
+const consulWait = 5 * time.Minute
+
+// consul reads routes from the Consul KV store, using blocking queries to watch for
+// changes.
+type consul struct {
+	addr   string
+	prefix string
+	token  string
+	client *http.Client
+}
+
+// Poll implements Source.
+func (c *consul) Poll(ctx context.Context, index uint64) ([]*Entry, uint64, error) {
+	u := fmt.Sprintf("%s/v1/kv/%s?recurse=true",
+		strings.TrimRight(c.addr, "/"),
+		strings.TrimLeft(c.prefix, "/"))
+	if index > 0 {
+		u += fmt.Sprintf("&index=%d&wait=%ds", index, int(consulWait.Seconds()))
+	}
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+
+	res, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+
+	next, err := strconv.ParseUint(res.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("consul returned an invalid index: %s",
+			res.Header.Get("X-Consul-Index"))
+	}
+
+	// consul's index can go backwards, after which the next query must not block.
+	if next < index {
+		next = 0
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		// no keys have the prefix.
+		return []*Entry{}, next, nil
+	default:
+		return nil, 0, fmt.Errorf("consul responded with %s", res.Status)
+	}
+
+	var kvs []struct {
+		Key   string
+		Value []byte
+	}
+	if err := json.NewDecoder(res.Body).Decode(&kvs); err != nil {
+		return nil, 0, err
+	}
+
+	entries := []*Entry{}
+	for _, kv := range kvs {
+		// folders have no value.
+		if len(kv.Value) == 0 {
+			continue
+		}
+		entries = append(entries, &Entry{Key: kv.Key, Value: kv.Value})
+	}
+
+	return entries, next, nil
+}
+
+// Instance is the address and port of one of the instances of a service.
+type Instance struct {
+	Address string
+	Port    int
+}
+
+// Catalog finds the healthy instances of services in Consul's catalog, using blocking
+// queries to watch for changes.
+type Catalog struct {
+	addr   string
+	dc     string
+	token  string
+	client *http.Client
+}
+
+// NewCatalog creates the Catalog of the Consul agent described by the consul config.
+func NewCatalog(cfg *config.ConsulInfo) *Catalog {
+	var token string
+	if cfg.TokenEnv != "" {
+		token = os.Getenv(cfg.TokenEnv)
+	}
+
+	return &Catalog{
+		addr:   cfg.Address,
+		dc:     cfg.Datacenter,
+		token:  token,
+		client: &http.Client{Timeout: consulWait + time.Minute},
+	}
+}
+
+// Instances returns the instances of the service that are passing their health checks,
+// ordered by address and port, and an index to pass to the next call. Given a non-zero
+// index, Instances waits until the instances may have changed.
+func (c *Catalog) Instances(ctx context.Context, service string, index uint64) ([]*Instance, uint64, error) {
+	q := url.Values{"passing": {"true"}}
+	if c.dc != "" {
+		q.Set("dc", c.dc)
+	}
+	if index > 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+		q.Set("wait", fmt.Sprintf("%ds", int(consulWait.Seconds())))
+	}
+
+	u := fmt.Sprintf("%s/v1/health/service/%s?%s",
+		strings.TrimRight(c.addr, "/"),
+		url.PathEscape(service),
+		q.Encode())
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+
+	res, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("consul responded with %s", res.Status)
+	}
+
+	next, err := strconv.ParseUint(res.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("consul returned an invalid index: %s",
+			res.Header.Get("X-Consul-Index"))
+	}
+
+	// consul's index can go backwards, after which the next query must not block.
+	if next < index {
+		next = 0
+	}
+
+	var entries []struct {
+		Node struct {
+			Address string
+		}
+		Service struct {
+			Address string
+			Port    int
+		}
+	}
+	if err := json.NewDecoder(res.Body).Decode(&entries); err != nil {
+		return nil, 0, err
+	}
+
+	instances := []*Instance{}
+	for _, e := range entries {
+		// services registered without an address are at the address of their node.
+		addr := e.Service.Address
+		if addr == "" {
+			addr = e.Node.Address
+		}
+		instances = append(instances, &Instance{Address: addr, Port: e.Service.Port})
+	}
+
+	sort.Slice(instances, func(i, j int) bool {
+		if instances[i].Address != instances[j].Address {
+			return instances[i].Address < instances[j].Address
+		}
+		return instances[i].Port < instances[j].Port
+	})
+
+	return instances, next, nil
+}
@@ -0,0 +1,109 @@
+// Package discovery reads routes from a key-value store or a Kubernetes cluster's
+// Ingresses, so that services can put themselves behind underpants without edits to
+// the config file, and finds the instances of backends in Consul's catalog.
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/kellegous/underpants/config"
+
+	"go.uber.org/zap"
+)
+
+// retryDelay is how long Watch waits to poll again after a failure.
+var retryDelay = 5 * time.Second
+
+// Entry is a key holding a route and its value, which is the route as JSON.
+type Entry struct {
+	Key   string
+	Value []byte
+}
+
+// Route decodes the route held by the entry. The route is not initialized.
+func (e *Entry) Route() (*config.RouteInfo, error) {
+	var r config.RouteInfo
+	if err := json.Unmarshal(e.Value, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Source is a key-value store holding routes under a prefix.
+type Source interface {
+	// Poll returns the entries under the prefix, ordered by key, and an index to pass
+	// to the next call. Given a non-zero index, Poll waits until the entries may have
+	// changed.
+	Poll(ctx context.Context, index uint64) ([]*Entry, uint64, error)
+}
+
+// New creates the Source described by the route-source config.
+func New(cfg *config.RouteSourceInfo) (Source, error) {
+	var token string
+	if cfg.TokenEnv != "" {
+		token = os.Getenv(cfg.TokenEnv)
+	}
+
+	switch cfg.Type {
+	case config.RouteSourceConsul:
+		return &consul{
+			addr:   cfg.Address,
+			prefix: cfg.Prefix,
+			token:  token,
+			client: &http.Client{Timeout: consulWait + time.Minute},
+		}, nil
+	case config.RouteSourceEtcd:
+		return &etcd{
+			addr:     cfg.Address,
+			prefix:   cfg.Prefix,
+			token:    token,
+			interval: time.Duration(cfg.PollInterval) * time.Second,
+			client:   &http.Client{Timeout: 30 * time.Second},
+		}, nil
+	case config.RouteSourceKubernetes:
+		return newKubernetes(cfg.Address,
+			cfg.Namespace,
+			token,
+			time.Duration(cfg.PollInterval)*time.Second)
+	}
+	return nil, fmt.Errorf("invalid route-source type: %s", cfg.Type)
+}
+
+// Watch polls src until ctx is done and calls fn with the entries each time they
+// change, including once with the entries first found.
+func Watch(ctx context.Context, src Source, fn func([]*Entry)) {
+	var index uint64
+	var last []*Entry
+	first := true
+	for {
+		entries, next, err := src.Poll(ctx, index)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			zap.L().Warn("unable to poll route-source",
+				zap.Error(err))
+			select {
+			case <-time.After(retryDelay):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		index = next
+		if !first && reflect.DeepEqual(entries, last) {
+			continue
+		}
+
+		first, last = false, entries
+		fn(entries)
+	}
+}
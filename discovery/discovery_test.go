@@ -0,0 +1,298 @@
+package discovery
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kellegous/underpants/config"
+)
+
+func TestConsul(t *testing.T) {
+	var query string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		if r.URL.Path != "/v1/kv/underpants/routes/" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+
+		if tok := r.Header.Get("X-Consul-Token"); tok != "token" {
+			t.Errorf("expected token, got %s", tok)
+		}
+
+		w.Header().Set("X-Consul-Index", "42")
+		fmt.Fprintf(w, `[
+			{"Key": "underpants/routes/", "Value": null},
+			{"Key": "underpants/routes/a", "Value": "%s"}
+		]`, base64.StdEncoding.EncodeToString([]byte(`{"from": "a.com"}`)))
+	}))
+	defer s.Close()
+
+	src := &consul{
+		addr:   s.URL,
+		prefix: "underpants/routes/",
+		token:  "token",
+		client: http.DefaultClient,
+	}
+
+	entries, index, err := src.Poll(context.Background(), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if query != "recurse=true&index=7&wait=300s" {
+		t.Fatalf("unexpected query %s", query)
+	}
+
+	if index != 42 {
+		t.Fatalf("expected index 42, got %d", index)
+	}
+
+	if len(entries) != 1 || entries[0].Key != "underpants/routes/a" {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+
+	route, err := entries[0].Route()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if route.From != "a.com" {
+		t.Fatalf("expected route from a.com, got %s", route.From)
+	}
+}
+
+func TestEtcd(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string][]byte
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+
+		if string(req["key"]) != "routes/" || string(req["range_end"]) != "routes0" {
+			t.Errorf("unexpected range %s to %s", req["key"], req["range_end"])
+		}
+
+		fmt.Fprintf(w, `{"header": {"revision": "9"}, "kvs": [{"key": "%s", "value": "%s"}]}`,
+			base64.StdEncoding.EncodeToString([]byte("routes/a")),
+			base64.StdEncoding.EncodeToString([]byte(`{"from": "a.com"}`)))
+	}))
+	defer s.Close()
+
+	src := &etcd{
+		addr:     s.URL,
+		prefix:   "routes/",
+		interval: time.Millisecond,
+		client:   http.DefaultClient,
+	}
+
+	entries, index, err := src.Poll(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if index != 9 {
+		t.Fatalf("expected revision 9, got %d", index)
+	}
+
+	if len(entries) != 1 || entries[0].Key != "routes/a" ||
+		string(entries[0].Value) != `{"from": "a.com"}` {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+}
+
+// stubSource returns each of its polls in turn, and then blocks.
+type stubSource struct {
+	polls [][]*Entry
+}
+
+func (s *stubSource) Poll(ctx context.Context, index uint64) ([]*Entry, uint64, error) {
+	if int(index) >= len(s.polls) {
+		<-ctx.Done()
+		return nil, 0, ctx.Err()
+	}
+	return s.polls[index], index + 1, nil
+}
+
+func TestWatch(t *testing.T) {
+	a := &Entry{Key: "a", Value: []byte(`{"from": "a.com"}`)}
+	b := &Entry{Key: "b", Value: []byte(`{"from": "b.com"}`)}
+
+	src := &stubSource{
+		polls: [][]*Entry{
+			{},
+			{a},
+			{a},
+			{a, b},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var calls [][]*Entry
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	Watch(ctx, src, func(entries []*Entry) {
+		calls = append(calls, entries)
+	})
+
+	// the unchanged poll is not passed on.
+	if len(calls) != 3 || len(calls[0]) != 0 || len(calls[1]) != 1 || len(calls[2]) != 2 {
+		t.Fatalf("unexpected calls %+v", calls)
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, typ := range []string{config.RouteSourceConsul, config.RouteSourceEtcd} {
+		if _, err := New(&config.RouteSourceInfo{Type: typ}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := New(&config.RouteSourceInfo{Type: "zookeeper"}); err == nil {
+		t.Fatal("expected zookeeper to be invalid")
+	}
+}
+
+func TestKubernetes(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "Bearer token" {
+			t.Errorf("unexpected authorization %s", auth)
+		}
+
+		switch r.URL.Path {
+		case "/apis/networking.k8s.io/v1/namespaces/apps/ingresses":
+			fmt.Fprint(w, `{"items": [
+				{
+					"metadata": {
+						"name": "wiki",
+						"namespace": "apps",
+						"annotations": {
+							"underpants.io/enabled": "true",
+							"underpants.io/route": "{\"allow\": [\"*@a.com\"]}"
+						}
+					},
+					"spec": {"rules": [
+						{"host": "wiki.a.com", "http": {"paths": [
+							{"path": "/api", "backend": {"service": {"name": "api", "port": {"number": 81}}}},
+							{"path": "/", "backend": {"service": {"name": "wiki", "port": {"name": "http"}}}}
+						]}},
+						{"host": "docs.a.com", "http": {"paths": [
+							{"path": "/", "backend": {"service": {"name": "docs", "port": {"number": 8080}}}}
+						]}}
+					]}
+				},
+				{
+					"metadata": {
+						"name": "open",
+						"namespace": "apps",
+						"annotations": {
+							"underpants.io/enabled": "true",
+							"underpants.io/route": "{\"Public-Paths\": [\"/*\"], \"default\": true}"
+						}
+					},
+					"spec": {"rules": [{"host": "open.a.com", "http": {"paths": [
+						{"path": "/", "backend": {"service": {"name": "open", "port": {"number": 80}}}}
+					]}}]}
+				},
+				{
+					"metadata": {"name": "other", "namespace": "apps"},
+					"spec": {"rules": [{"host": "other.a.com", "http": {"paths": [
+						{"path": "/", "backend": {"service": {"name": "other", "port": {"number": 80}}}}
+					]}}]}
+				}
+			]}`)
+		case "/api/v1/namespaces/apps/services/wiki":
+			fmt.Fprint(w, `{"spec": {"ports": [{"name": "http", "port": 8000}]}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+
+	src := &kubernetes{
+		addr:      s.URL,
+		namespace: "apps",
+		token:     "token",
+		interval:  time.Millisecond,
+		client:    http.DefaultClient,
+	}
+
+	entries, _, err := src.Poll(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+
+	expected := map[string]string{
+		"apps/wiki/docs.a.com": "http://docs.apps.svc:8080",
+		"apps/wiki/wiki.a.com": "http://wiki.apps.svc:8000",
+	}
+	for _, e := range entries {
+		route, err := e.Route()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if to := route.To[0]; to != expected[e.Key] {
+			t.Fatalf("expected %s to route to %s, got %s", e.Key, expected[e.Key], to)
+		}
+
+		if len(route.Allow) != 1 || route.Allow[0] != "*@a.com" {
+			t.Fatalf("expected %s to have the annotation's settings, got %v",
+				e.Key, route.Allow)
+		}
+	}
+}
+
+func TestCatalog(t *testing.T) {
+	var query string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		if tok := r.Header.Get("X-Consul-Token"); tok != "token" {
+			t.Errorf("expected token, got %s", tok)
+		}
+
+		w.Header().Set("X-Consul-Index", "3")
+		fmt.Fprint(w, `[
+			{"Node": {"Address": "10.0.0.2"}, "Service": {"Address": "", "Port": 80}},
+			{"Node": {"Address": "10.0.0.2"}, "Service": {"Address": "", "Port": 8080}}
+		]`)
+	}))
+	defer s.Close()
+
+	c := &Catalog{
+		addr:   s.URL,
+		dc:     "east",
+		token:  "token",
+		client: http.DefaultClient,
+	}
+
+	// the index went backwards, so the next query must not block.
+	instances, index, err := c.Instances(context.Background(), "api", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if query != "dc=east&index=7&passing=true&wait=300s" {
+		t.Fatalf("unexpected query %s", query)
+	}
+
+	if index != 0 {
+		t.Fatalf("expected index 0, got %d", index)
+	}
+
+	if len(instances) != 2 || instances[0].Port != 80 || instances[1].Address != "10.0.0.2" {
+		t.Fatalf("unexpected instances %+v", instances)
+	}
+}
@@ -0,0 +1,107 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// etcd reads routes from etcd through its v3 JSON gateway, polling for changes.
+type etcd struct {
+	addr     string
+	prefix   string
+	token    string
+	interval time.Duration
+	client   *http.Client
+}
+
+// Poll implements Source.
+func (e *etcd) Poll(ctx context.Context, index uint64) ([]*Entry, uint64, error) {
+	if index > 0 {
+		select {
+		case <-time.After(e.interval):
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	}
+
+	body, err := json.Marshal(map[string][]byte{
+		"key":       []byte(e.prefix),
+		"range_end": prefixEnd([]byte(e.prefix)),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequest("POST",
+		strings.TrimRight(e.addr, "/")+"/v3/kv/range",
+		bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if e.token != "" {
+		req.Header.Set("Authorization", e.token)
+	}
+
+	res, err := e.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("etcd responded with %s", res.Status)
+	}
+
+	// the gateway encodes 64-bit integers as strings and bytes as base64.
+	var rng struct {
+		Header struct {
+			Revision string `json:"revision"`
+		} `json:"header"`
+		Kvs []struct {
+			Key   []byte `json:"key"`
+			Value []byte `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&rng); err != nil {
+		return nil, 0, err
+	}
+
+	rev, err := strconv.ParseUint(rng.Header.Revision, 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("etcd returned an invalid revision: %s",
+			rng.Header.Revision)
+	}
+
+	// the range is ordered by key.
+	entries := []*Entry{}
+	for _, kv := range rng.Kvs {
+		if len(kv.Value) == 0 {
+			continue
+		}
+		entries = append(entries, &Entry{Key: string(kv.Key), Value: kv.Value})
+	}
+
+	return entries, rev, nil
+}
+
+// prefixEnd is the end of the range of keys that have the prefix p.
+func prefixEnd(p []byte) []byte {
+	end := append([]byte{}, p...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+
+	// every key is at or after a prefix of 0xff bytes.
+	return []byte{0}
+}
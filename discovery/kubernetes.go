@@ -0,0 +1,313 @@
+package discovery
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// EnabledAnnotation marks the Ingresses that underpants serves, when set to "true".
+	EnabledAnnotation = "underpants.io/enabled"
+
+	// RouteAnnotation holds the settings of the routes built from an Ingress, as a
+	// route in JSON without its from and to.
+	RouteAnnotation = "underpants.io/route"
+)
+
+// serviceAccountDir holds the credentials of the pod's service account.
+var serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubernetes builds routes from the Ingresses in a cluster, polling the API server for
+// changes.
+type kubernetes struct {
+	addr      string
+	namespace string
+	token     string
+	interval  time.Duration
+	client    *http.Client
+}
+
+// newKubernetes creates a source for the cluster whose API server is at addr. Unless a
+// token is given, the pod's service account is used.
+func newKubernetes(addr, namespace, token string, interval time.Duration) (*kubernetes, error) {
+	if token == "" {
+		b, err := ioutil.ReadFile(serviceAccountDir + "/token")
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(b))
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if pem, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt"); err == nil {
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(pem)
+		t.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &kubernetes{
+		addr:      addr,
+		namespace: namespace,
+		token:     token,
+		interval:  interval,
+		client:    &http.Client{Transport: t, Timeout: 30 * time.Second},
+	}, nil
+}
+
+// ingress is the part of an Ingress that routes are built from.
+type ingress struct {
+	Metadata struct {
+		Name        string            `json:"name"`
+		Namespace   string            `json:"namespace"`
+		Annotations map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec struct {
+		DefaultBackend *ingressBackend `json:"defaultBackend"`
+		Rules          []struct {
+			Host string `json:"host"`
+			HTTP *struct {
+				Paths []*ingressPath `json:"paths"`
+			} `json:"http"`
+		} `json:"rules"`
+	} `json:"spec"`
+}
+
+type ingressPath struct {
+	Path    string          `json:"path"`
+	Backend *ingressBackend `json:"backend"`
+}
+
+type ingressBackend struct {
+	Service *struct {
+		Name string `json:"name"`
+		Port struct {
+			Name   string `json:"name"`
+			Number int    `json:"number"`
+		} `json:"port"`
+	} `json:"service"`
+}
+
+// service is the part of a Service needed to resolve named ports.
+type service struct {
+	Spec struct {
+		Ports []struct {
+			Name string `json:"name"`
+			Port int    `json:"port"`
+		} `json:"ports"`
+	} `json:"spec"`
+}
+
+// Poll implements Source. Each host of an enabled Ingress is an entry.
+func (k *kubernetes) Poll(ctx context.Context, index uint64) ([]*Entry, uint64, error) {
+	if index > 0 {
+		select {
+		case <-time.After(k.interval):
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+	}
+
+	path := "/apis/networking.k8s.io/v1/ingresses"
+	if k.namespace != "" {
+		path = fmt.Sprintf("/apis/networking.k8s.io/v1/namespaces/%s/ingresses", k.namespace)
+	}
+
+	var list struct {
+		Items []*ingress `json:"items"`
+	}
+	if err := k.get(ctx, path, &list); err != nil {
+		return nil, 0, err
+	}
+
+	entries := []*Entry{}
+	for _, ing := range list.Items {
+		if ing.Metadata.Annotations[EnabledAnnotation] != "true" {
+			continue
+		}
+
+		for _, rule := range ing.Spec.Rules {
+			if rule.Host == "" {
+				continue
+			}
+
+			be := ing.Spec.DefaultBackend
+			if rule.HTTP != nil {
+				be = rootBackend(rule.HTTP.Paths, be)
+			}
+
+			if be == nil || be.Service == nil {
+				continue
+			}
+
+			to, err := k.serviceURL(ctx, ing.Metadata.Namespace, be)
+			if err != nil {
+				zap.L().Warn("ignoring ingress host",
+					zap.String("ingress", ing.Metadata.Namespace+"/"+ing.Metadata.Name),
+					zap.String("host", rule.Host),
+					zap.Error(err))
+				continue
+			}
+
+			b, err := routeJSON(ing.Metadata.Annotations[RouteAnnotation], rule.Host, to)
+			if err != nil {
+				zap.L().Warn("ignoring ingress host",
+					zap.String("ingress", ing.Metadata.Namespace+"/"+ing.Metadata.Name),
+					zap.String("host", rule.Host),
+					zap.Error(err))
+				continue
+			}
+
+			entries = append(entries, &Entry{
+				Key: fmt.Sprintf("%s/%s/%s",
+					ing.Metadata.Namespace,
+					ing.Metadata.Name,
+					rule.Host),
+				Value: b,
+			})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Key < entries[j].Key
+	})
+
+	return entries, index + 1, nil
+}
+
+// rootBackend is the backend of the path "/", or of the first path if there is none.
+// Routes cover a whole host, so the backends of other paths are not used.
+func rootBackend(paths []*ingressPath, def *ingressBackend) *ingressBackend {
+	for _, p := range paths {
+		if p.Path == "/" || p.Path == "" {
+			return p.Backend
+		}
+	}
+
+	if len(paths) > 0 {
+		return paths[0].Backend
+	}
+
+	return def
+}
+
+// serviceURL is the URL of the service backing an Ingress in namespace ns.
+func (k *kubernetes) serviceURL(
+	ctx context.Context,
+	ns string,
+	be *ingressBackend) (string, error) {
+	port := be.Service.Port.Number
+	if port == 0 {
+		var svc service
+		if err := k.get(ctx,
+			fmt.Sprintf("/api/v1/namespaces/%s/services/%s", ns, be.Service.Name),
+			&svc); err != nil {
+			return "", err
+		}
+
+		for _, p := range svc.Spec.Ports {
+			if p.Name == be.Service.Port.Name {
+				port = p.Port
+			}
+		}
+
+		if port == 0 {
+			return "", fmt.Errorf("service %s/%s has no port named %s",
+				ns, be.Service.Name, be.Service.Port.Name)
+		}
+	}
+
+	return fmt.Sprintf("http://%s.%s.svc:%d", be.Service.Name, ns, port), nil
+}
+
+// annotationKeys are the route settings that can be given in the route annotation.
+// They narrow who can reach the route or change how it is proxied; settings that make
+// paths public, send requests to other backends or read files on the hub can only be
+// given in the config file, since anyone who can create an Ingress can annotate it.
+var annotationKeys = map[string]bool{
+	"allow":            true,
+	"deny":             true,
+	"allowed-groups":   true,
+	"required-groups":  true,
+	"forward-groups":   true,
+	"provider":         true,
+	"session":          true,
+	"allowed-methods":  true,
+	"ip-allow":         true,
+	"ip-deny":          true,
+	"add-prefix":       true,
+	"balance":          true,
+	"affinity":         true,
+	"retry":            true,
+	"circuit-breaker":  true,
+	"rate-limit":       true,
+	"concurrency":      true,
+	"max-body-bytes":   true,
+	"flush-interval":   true,
+	"health-check":     true,
+	"backend-protocol": true,
+	"cookie-collision": true,
+	"request-headers":  true,
+	"response-headers": true,
+	"security-headers": true,
+	"cors":             true,
+}
+
+// routeJSON adds the host and backend URL to the route settings in the annotation.
+// If the annotation is invalid, it is returned as it is so that the route is reported
+// as invalid. It is an error for the annotation to give a setting not in
+// annotationKeys.
+func routeJSON(annotation, host, to string) ([]byte, error) {
+	route := map[string]interface{}{}
+	if annotation != "" {
+		if err := json.Unmarshal([]byte(annotation), &route); err != nil {
+			return []byte(annotation), nil
+		}
+	}
+
+	for key := range route {
+		if !annotationKeys[strings.ToLower(key)] {
+			return nil, fmt.Errorf("%s cannot be set in the %s annotation", key, RouteAnnotation)
+		}
+	}
+
+	route["from"] = host
+	route["to"] = to
+
+	b, err := json.Marshal(route)
+	if err != nil {
+		return []byte(annotation), nil
+	}
+	return b, nil
+}
+
+// get requests path from the API server and decodes the response into v.
+func (k *kubernetes) get(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequest("GET", strings.TrimRight(k.addr, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+k.token)
+	req.Header.Set("Accept", "application/json")
+
+	res, err := k.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("kubernetes responded to %s with %s", path, res.Status)
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
@@ -0,0 +1,56 @@
+package hub
+
+import (
+	"html/template"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/kellegous/underpants/auth"
+	"github.com/kellegous/underpants/config"
+)
+
+// AssetsPath is the path, on the hub and every route, that the assets of the branding
+// are served from.
+const AssetsPath = auth.BaseURI + "assets/"
+
+// brandingFor returns the template of the hub's page along with the assets it may
+// refer to, which are nil if there are none. The branding dir in the config takes
+// precedence over branding embedded in the binary, which takes precedence over the
+// built-in page.
+func brandingFor(ctx *config.Context) (*template.Template, http.FileSystem) {
+	if dir := ctx.Branding.Dir; dir != "" {
+		return ctx.Branding.Template(), http.Dir(filepath.Join(dir, "assets"))
+	}
+
+	t := template.Must(template.New("index.html").Parse(rootTmpl))
+
+	fsys := embeddedBranding()
+	if fsys == nil {
+		return t, nil
+	}
+
+	if _, err := fs.Stat(fsys, "index.html"); err == nil {
+		t = template.Must(template.ParseFS(fsys, "index.html"))
+	}
+
+	assets, err := fs.Sub(fsys, "assets")
+	if err != nil {
+		return t, nil
+	}
+	return t, http.FS(assets)
+}
+
+// serveAssets serves the files of the branding's assets, but not listings of its
+// directories.
+func serveAssets(assets http.FileSystem) http.Handler {
+	h := http.StripPrefix(AssetsPath, http.FileServer(assets))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,469 @@
+package hub
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kellegous/underpants/audit"
+	"github.com/kellegous/underpants/auth"
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/internal"
+	"github.com/kellegous/underpants/mux"
+	"github.com/kellegous/underpants/proxy"
+	"github.com/kellegous/underpants/user"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// deviceCodeTTL is how long a device has for the user to approve it.
+	deviceCodeTTL = 10 * time.Minute
+
+	// devicePollInterval is how often a device may poll for its token.
+	devicePollInterval = 5 * time.Second
+
+	// maxPendingDevices is the most devices that can be waiting for approval at once.
+	maxPendingDevices = 1000
+
+	// deviceStartRate and deviceStartBurst limit how often devices at one address can
+	// start the flow, so that no one client can use up maxPendingDevices: a burst of
+	// deviceStartBurst, then one every two minutes.
+	deviceStartRate  = 1.0 / 120
+	deviceStartBurst = 10
+
+	// userCodeAlphabet has no vowels, so that user codes never spell words, and no
+	// characters that are easily confused.
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+)
+
+const (
+	// DevicePath is where devices start the device authorization flow.
+	DevicePath = auth.BaseURI + "device"
+
+	// DeviceVerifyPath is where users approve devices.
+	DeviceVerifyPath = auth.BaseURI + "device/verify"
+
+	// DeviceTokenPath is where devices poll for their token.
+	DeviceTokenPath = auth.BaseURI + "device/token"
+)
+
+var deviceTmpl = template.Must(template.New("device").Parse(`<!DOCTYPE html>
+<html>
+  <head>
+    <title>Sign in a device</title>
+  </head>
+  <body>
+    <h1>Sign in a device</h1>
+    {{if .Done}}
+    <p>{{.Done}} You can close this window.</p>
+    {{else}}
+    <form method="POST" action="{{.Action}}">
+      <input name="csrf" type="hidden" value="{{.CSRF}}">
+      <p>
+        Enter the code shown by the device to let it act as {{.Email}}
+        {{with .Routes}}on {{range $i, $r := .}}{{if $i}}, {{end}}{{$r}}{{end}}{{end}}.
+      </p>
+      <input name="code" value="{{.Code}}" autocomplete="off">
+      <button name="approve" value="1" type="submit">Approve</button>
+      <button name="deny" value="1" type="submit">Deny</button>
+    </form>
+    {{end}}
+  </body>
+</html>
+`))
+
+// deviceAuth is a device waiting for the user to approve it.
+type deviceAuth struct {
+	deviceCode string
+	userCode   string
+	routes     []string
+	expires    time.Time
+	lastPoll   time.Time
+
+	// user is set once the user has approved the device.
+	user *user.Info
+
+	denied bool
+}
+
+// devices are the devices going through the device authorization flow. They are kept
+// in memory, so devices must poll the instance that they started with.
+type devices struct {
+	lck      sync.Mutex
+	byDevice map[string]*deviceAuth
+	byUser   map[string]*deviceAuth
+
+	// starts limits how often each address can start the flow.
+	starts *proxy.Limiter
+}
+
+func newDevices() *devices {
+	return &devices{
+		byDevice: map[string]*deviceAuth{},
+		byUser:   map[string]*deviceAuth{},
+		starts:   proxy.NewLimiter(deviceStartRate, deviceStartBurst),
+	}
+}
+
+// newUserCode generates a code that is easy for a user to type, like BDFG-HJKL. Random
+// bytes that would favor the start of the alphabet are discarded, so that each letter
+// is equally likely.
+func newUserCode() (string, error) {
+	max := 256 - 256%len(userCodeAlphabet)
+
+	c := make([]byte, 0, 9)
+	var b [1]byte
+	for len(c) < 9 {
+		if _, err := rand.Read(b[:]); err != nil {
+			return "", err
+		}
+
+		if int(b[0]) >= max {
+			continue
+		}
+
+		if len(c) == 4 {
+			c = append(c, '-')
+		}
+		c = append(c, userCodeAlphabet[int(b[0])%len(userCodeAlphabet)])
+	}
+	return string(c), nil
+}
+
+// clientIP is the address the request came from.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// normalizeUserCode puts a code typed by a user in the form it was issued in.
+func normalizeUserCode(c string) string {
+	c = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(c))
+	if len(c) != 8 {
+		return c
+	}
+	return c[:4] + "-" + c[4:]
+}
+
+// prune removes expired devices.
+func (d *devices) prune(now time.Time) {
+	for k, a := range d.byDevice {
+		if now.After(a.expires) {
+			delete(d.byDevice, k)
+			delete(d.byUser, a.userCode)
+		}
+	}
+}
+
+// start begins the flow for a device that wants access to the routes.
+func (d *devices) start(routes []string) (*deviceAuth, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	uc, err := newUserCode()
+	if err != nil {
+		return nil, err
+	}
+
+	d.lck.Lock()
+	defer d.lck.Unlock()
+
+	now := time.Now()
+	d.prune(now)
+	if len(d.byDevice) >= maxPendingDevices {
+		return nil, fmt.Errorf("too many devices are waiting for approval")
+	}
+
+	if d.byUser[uc] != nil {
+		return nil, fmt.Errorf("user code collision")
+	}
+
+	a := &deviceAuth{
+		deviceCode: base64.RawURLEncoding.EncodeToString(b),
+		userCode:   uc,
+		routes:     routes,
+		expires:    now.Add(deviceCodeTTL),
+	}
+	d.byDevice[a.deviceCode] = a
+	d.byUser[a.userCode] = a
+	return a, nil
+}
+
+// decide records the user's approval, or denial, of the device with the user code.
+func (d *devices) decide(userCode string, u *user.Info, approve bool) bool {
+	d.lck.Lock()
+	defer d.lck.Unlock()
+
+	a := d.byUser[normalizeUserCode(userCode)]
+	if a == nil || time.Now().After(a.expires) || a.user != nil || a.denied {
+		return false
+	}
+
+	if approve {
+		a.user = u
+	} else {
+		a.denied = true
+	}
+	return true
+}
+
+// routesFor returns the routes the device with the user code wants access to.
+func (d *devices) routesFor(userCode string) []string {
+	d.lck.Lock()
+	defer d.lck.Unlock()
+
+	if a := d.byUser[normalizeUserCode(userCode)]; a != nil {
+		return a.routes
+	}
+	return nil
+}
+
+// poll returns the device's state for the token endpoint. Once a device has been
+// approved or denied it is forgotten, so its code can only be redeemed once. The
+// error is one of the error codes of RFC 8628.
+func (d *devices) poll(deviceCode string) (*deviceAuth, string) {
+	d.lck.Lock()
+	defer d.lck.Unlock()
+
+	now := time.Now()
+	a := d.byDevice[deviceCode]
+	switch {
+	case a == nil:
+		return nil, "invalid_grant"
+	case now.After(a.expires):
+		return nil, "expired_token"
+	}
+
+	if a.user != nil || a.denied {
+		delete(d.byDevice, a.deviceCode)
+		delete(d.byUser, a.userCode)
+		if a.denied {
+			return nil, "access_denied"
+		}
+		return a, ""
+	}
+
+	last := a.lastPoll
+	a.lastPoll = now
+	if now.Sub(last) < devicePollInterval {
+		return nil, "slow_down"
+	}
+	return nil, "authorization_pending"
+}
+
+// writeDeviceJSON writes a response of the device authorization flow.
+func writeDeviceJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		zap.L().Error("unable to encode device response",
+			zap.Error(err))
+	}
+}
+
+// writeDeviceError writes an error response with one of the error codes of RFC 8628.
+func writeDeviceError(w http.ResponseWriter, code string) {
+	writeDeviceJSON(w, http.StatusBadRequest, struct {
+		Error string `json:"error"`
+	}{code})
+}
+
+// setupDevices adds the endpoints of the device authorization flow (RFC 8628), which
+// lets command line tools get an API token for routes after a user approves them in
+// a browser.
+func setupDevices(ctx *config.Context, prv auth.Provider, mb *mux.Builder) {
+	d := newDevices()
+
+	mb.ForAnyHost().Handle(DevicePath,
+		internal.AddSecurityHeadersFunc(ctx.Info,
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != "POST" {
+					w.Header().Set("Allow", "POST")
+					http.Error(w,
+						http.StatusText(http.StatusMethodNotAllowed),
+						http.StatusMethodNotAllowed)
+					return
+				}
+
+				r.ParseForm()
+				routes := r.PostForm["route"]
+				if len(routes) == 0 {
+					writeDeviceError(w, "invalid_request")
+					return
+				}
+
+				for _, route := range routes {
+					if !isRoute(ctx, route) {
+						writeDeviceError(w, "invalid_scope")
+						return
+					}
+				}
+
+				if ok, after := d.starts.Allow(clientIP(r), time.Now()); !ok {
+					zap.L().Info("device authorization rate limited",
+						zap.String("client", clientIP(r)))
+					w.Header().Set("Retry-After",
+						strconv.Itoa(int(math.Ceil(after.Seconds()))))
+					http.Error(w,
+						http.StatusText(http.StatusTooManyRequests),
+						http.StatusTooManyRequests)
+					return
+				}
+
+				a, err := d.start(routes)
+				if err != nil {
+					zap.L().Error("unable to start device authorization",
+						zap.Error(err))
+					http.Error(w,
+						http.StatusText(http.StatusServiceUnavailable),
+						http.StatusServiceUnavailable)
+					return
+				}
+
+				verify := fmt.Sprintf("%s://%s%s", ctx.Scheme(), ctx.Host(), DeviceVerifyPath)
+				writeDeviceJSON(w, http.StatusOK, struct {
+					DeviceCode              string `json:"device_code"`
+					UserCode                string `json:"user_code"`
+					VerificationURI         string `json:"verification_uri"`
+					VerificationURIComplete string `json:"verification_uri_complete"`
+					ExpiresIn               int    `json:"expires_in"`
+					Interval                int    `json:"interval"`
+				}{
+					a.deviceCode,
+					a.userCode,
+					verify,
+					verify + "?code=" + a.userCode,
+					int(deviceCodeTTL / time.Second),
+					int(devicePollInterval / time.Second),
+				})
+			}))
+
+	mb.ForAnyHost().Handle(DeviceVerifyPath,
+		internal.AddSecurityHeadersFunc(ctx.Info,
+			func(w http.ResponseWriter, r *http.Request) {
+				u, err := ctx.Sessions.FromRequest(w, r)
+				if err != nil {
+					http.Redirect(w, r, prv.GetAuthURL(ctx, r), http.StatusFound)
+					return
+				}
+
+				page := struct {
+					Action string
+					CSRF   string
+					Email  string
+					Code   string
+					Routes []string
+					Done   string
+				}{
+					Action: DeviceVerifyPath,
+					CSRF:   ctx.Sessions.CSRFToken(u),
+					Email:  u.Email,
+					Code:   r.FormValue("code"),
+					Routes: d.routesFor(r.FormValue("code")),
+				}
+
+				status := http.StatusOK
+				switch r.Method {
+				case "GET":
+				case "POST":
+					if err := ctx.Sessions.CheckCSRF(r, u); err != nil {
+						http.Error(w,
+							http.StatusText(http.StatusForbidden),
+							http.StatusForbidden)
+						return
+					}
+
+					approve := r.PostFormValue("approve") != ""
+					if !d.decide(page.Code, u, approve) {
+						status = http.StatusNotFound
+						page.Done = "That code is not valid or has expired."
+						break
+					}
+
+					if approve {
+						zap.L().Info("device approved",
+							zap.String("user", u.Email),
+							zap.Strings("routes", page.Routes))
+						ctx.Audit.Record(r, audit.Login, u.Email, "device approved")
+						page.Done = "The device has been signed in."
+					} else {
+						page.Done = "The device has been denied."
+					}
+				default:
+					w.Header().Set("Allow", "GET, POST")
+					http.Error(w,
+						http.StatusText(http.StatusMethodNotAllowed),
+						http.StatusMethodNotAllowed)
+					return
+				}
+
+				w.Header().Set("Content-Type", "text/html;charset=utf-8")
+				w.WriteHeader(status)
+				if err := deviceTmpl.Execute(w, &page); err != nil {
+					zap.L().Error("unable to render device page",
+						zap.Error(err))
+				}
+			}))
+
+	mb.ForAnyHost().Handle(DeviceTokenPath,
+		internal.AddSecurityHeadersFunc(ctx.Info,
+			func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != "POST" {
+					w.Header().Set("Allow", "POST")
+					http.Error(w,
+						http.StatusText(http.StatusMethodNotAllowed),
+						http.StatusMethodNotAllowed)
+					return
+				}
+
+				a, code := d.poll(r.PostFormValue("device_code"))
+				if a == nil {
+					writeDeviceError(w, code)
+					return
+				}
+
+				ttl := ctx.Sessions.MaxAge()
+				tok, err := ctx.Sessions.NewAPIToken(a.user.Email, a.routes, ttl)
+				if err != nil {
+					zap.L().Error("unable to issue device token",
+						zap.String("user", a.user.Email),
+						zap.Error(err))
+					http.Error(w,
+						http.StatusText(http.StatusInternalServerError),
+						http.StatusInternalServerError)
+					return
+				}
+
+				writeDeviceJSON(w, http.StatusOK, struct {
+					AccessToken string `json:"access_token"`
+					TokenType   string `json:"token_type"`
+					ExpiresIn   int    `json:"expires_in"`
+				}{tok, "Bearer", int(ttl / time.Second)})
+			}))
+}
+
+// isRoute determines if from is the from of one of the routes.
+func isRoute(ctx *config.Context, from string) bool {
+	for _, route := range ctx.Routes {
+		if route.From == from {
+			return true
+		}
+	}
+	return false
+}
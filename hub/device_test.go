@@ -0,0 +1,171 @@
+package hub
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/mux"
+	"github.com/kellegous/underpants/user"
+)
+
+func TestDeviceFlow(t *testing.T) {
+	var cfg config.Info
+	if err := cfg.Read(strings.NewReader(`{
+		"host": "hub.com",
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"routes": [{"from": "a.com", "to": "http://localhost:8080"}]
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := config.BuildContext(&cfg, 80, []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mb := mux.Create()
+	Setup(ctx, nil, nil, mb)
+	h := mb.Build()
+
+	u := &user.Info{Email: "a@a.com", LastAuthenticated: time.Now()}
+	v, err := ctx.Sessions.Encode(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(path string, form url.Values, signedIn bool) (int, map[string]interface{}) {
+		r := httptest.NewRequest("POST", "http://hub.com"+path,
+			strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if signedIn {
+			r.AddCookie(ctx.Sessions.NewCookie(v))
+		}
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		var res map[string]interface{}
+		json.NewDecoder(w.Body).Decode(&res)
+		return w.Code, res
+	}
+
+	if status, res := post(DevicePath, url.Values{"route": {"b.com"}}, false); status != http.StatusBadRequest ||
+		res["error"] != "invalid_scope" {
+		t.Fatalf("expected invalid_scope for an unknown route, got %d %v", status, res)
+	}
+
+	_, res := post(DevicePath, url.Values{"route": {"a.com"}}, false)
+	dc, uc := res["device_code"].(string), res["user_code"].(string)
+	if dc == "" || len(uc) != 9 || res["verification_uri"] != "http://hub.com"+DeviceVerifyPath {
+		t.Fatalf("unexpected device authorization %v", res)
+	}
+
+	poll := url.Values{"device_code": {dc}}
+	if _, res := post(DeviceTokenPath, poll, false); res["error"] != "authorization_pending" {
+		t.Fatalf("expected authorization_pending, got %v", res)
+	}
+
+	if _, res := post(DeviceTokenPath, poll, false); res["error"] != "slow_down" {
+		t.Fatalf("expected slow_down, got %v", res)
+	}
+
+	approve := url.Values{"code": {strings.ToLower(uc)}, "approve": {"1"}}
+	if status, _ := post(DeviceVerifyPath, approve, true); status != http.StatusForbidden {
+		t.Fatalf("expected approval without a csrf token to be forbidden, got %d", status)
+	}
+
+	approve.Set("csrf", ctx.Sessions.CSRFToken(u))
+	if status, _ := post(DeviceVerifyPath, approve, true); status != http.StatusOK {
+		t.Fatalf("expected approval to succeed, got %d", status)
+	}
+
+	_, res = post(DeviceTokenPath, poll, false)
+	tok, _ := res["access_token"].(string)
+	if nu, err := ctx.Sessions.DecodeAPIToken(tok, "a.com"); err != nil || nu.Email != "a@a.com" {
+		t.Fatalf("expected a token for a@a.com, got %v: %v", res, err)
+	}
+
+	if _, res := post(DeviceTokenPath, poll, false); res["error"] != "invalid_grant" {
+		t.Fatalf("expected the device code to be redeemed only once, got %v", res)
+	}
+}
+
+func TestDeviceStartLimit(t *testing.T) {
+	var cfg config.Info
+	if err := cfg.Read(strings.NewReader(`{
+		"host": "hub.com",
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"routes": [{"from": "a.com", "to": "http://localhost:8080"}]
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := config.BuildContext(&cfg, 80, []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mb := mux.Create()
+	Setup(ctx, nil, nil, mb)
+	h := mb.Build()
+
+	start := func(addr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "http://hub.com"+DevicePath,
+			strings.NewReader(url.Values{"route": {"a.com"}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = addr
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < deviceStartBurst; i++ {
+		if w := start("10.0.0.1:1234"); w.Code != http.StatusOK {
+			t.Fatalf("start %d should have been allowed, got %d", i, w.Code)
+		}
+	}
+
+	w := start("10.0.0.1:5678")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected starts from one address to be limited, got %d", w.Code)
+	}
+
+	if w := start("10.0.0.2:1234"); w.Code != http.StatusOK {
+		t.Fatalf("other addresses should not be limited, got %d", w.Code)
+	}
+}
+
+func TestNewUserCode(t *testing.T) {
+	counts := map[rune]int{}
+	for i := 0; i < 2000; i++ {
+		c, err := newUserCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(c) != 9 || c[4] != '-' || normalizeUserCode(strings.ToLower(c)) != c {
+			t.Fatalf("unexpected user code %s", c)
+		}
+
+		for _, r := range strings.Replace(c, "-", "", 1) {
+			if !strings.ContainsRune(userCodeAlphabet, r) {
+				t.Fatalf("unexpected character in user code %s", c)
+			}
+			counts[r]++
+		}
+	}
+
+	// each of the 20 letters is expected 800 times.
+	for _, r := range userCodeAlphabet {
+		if n := counts[r]; n < 650 || n > 950 {
+			t.Fatalf("expected %c to be drawn about 800 times, got %d", r, n)
+		}
+	}
+}
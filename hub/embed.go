@@ -0,0 +1,23 @@
+//go:build embedbranding
+
+package hub
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// branding is the contents of the branding directory, which is compiled into binaries
+// built with the embedbranding tag.
+//
+//go:embed branding
+var branding embed.FS
+
+// embeddedBranding is the branding compiled into the binary.
+func embeddedBranding() fs.FS {
+	fsys, err := fs.Sub(branding, "branding")
+	if err != nil {
+		panic(err)
+	}
+	return fsys
+}
@@ -0,0 +1,190 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kellegous/underpants/auth"
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/mux"
+	"github.com/kellegous/underpants/proxy"
+	"github.com/kellegous/underpants/session"
+	"github.com/kellegous/underpants/user"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// HealthPath is the path on the hub that reports that the process is alive.
+	HealthPath = "/__health__"
+
+	// ReadyPath is the path on the hub that reports whether underpants is ready to
+	// serve traffic.
+	ReadyPath = "/__ready__"
+)
+
+// readyCheck is the outcome of one of the readiness checks.
+type readyCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// readiness is the response of the readiness endpoint.
+type readiness struct {
+	Ready  bool          `json:"ready"`
+	Checks []*readyCheck `json:"checks"`
+}
+
+// SetupHealth adds the liveness and readiness endpoints to every host, including those
+// that are unknown. Neither requires authentication, so that load balancers and
+// orchestrators can use them.
+func SetupHealth(
+	ctx *config.Context,
+	prv auth.Provider,
+	backends []*proxy.Backend,
+	mb *mux.Builder) {
+	mb.ForEveryHost().Handle(HealthPath,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprintln(w, "ok.")
+		}))
+
+	mb.ForEveryHost().Handle(ReadyPath,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			serveReady(w, checkReady(ctx, prv, backends))
+		}))
+}
+
+// checkReady performs each of the readiness checks.
+func checkReady(
+	ctx *config.Context,
+	prv auth.Provider,
+	backends []*proxy.Backend) *readiness {
+	timeout := time.Duration(ctx.Readiness.TimeoutMs) * time.Millisecond
+
+	checks := []func() *readyCheck{
+		func() *readyCheck {
+			return newReadyCheck("session-key", checkKey(ctx.Key))
+		},
+		func() *readyCheck {
+			return newReadyCheck("session-store", checkStore(ctx.Sessions.Store))
+		},
+	}
+
+	if ctx.Readiness.CheckProvider {
+		checks = append(checks, func() *readyCheck {
+			return newReadyCheck("provider", auth.CheckReachable(ctx, prv, timeout))
+		})
+	}
+
+	if ctx.Readiness.CheckBackends {
+		for _, b := range backends {
+			b := b
+			if b.Route.IsTemplated() {
+				continue
+			}
+
+			checks = append(checks, func() *readyCheck {
+				c, cancel := context.WithTimeout(context.Background(), timeout)
+				defer cancel()
+
+				rc := &readyCheck{Name: "backend " + b.Route.From}
+				if res := b.Check(c); res.Healthy {
+					rc.OK = true
+				} else if res.Error != "" {
+					rc.Error = res.Error
+				} else {
+					rc.Error = fmt.Sprintf("status %d", res.Status)
+				}
+				return rc
+			})
+		}
+	}
+
+	res := &readiness{
+		Ready:  true,
+		Checks: make([]*readyCheck, len(checks)),
+	}
+
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check func() *readyCheck) {
+			defer wg.Done()
+			res.Checks[i] = check()
+		}(i, check)
+	}
+	wg.Wait()
+
+	for _, c := range res.Checks {
+		if !c.OK {
+			res.Ready = false
+		}
+	}
+
+	return res
+}
+
+func newReadyCheck(name string, err error) *readyCheck {
+	if err != nil {
+		return &readyCheck{Name: name, Error: err.Error()}
+	}
+	return &readyCheck{Name: name, OK: true}
+}
+
+// checkKey determines if users can be signed with the session key.
+func checkKey(key []byte) error {
+	if len(key) == 0 {
+		return errors.New("no session key")
+	}
+
+	v, err := (&user.Info{Email: "ready@underpants"}).Encode(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = user.Decode(v, key)
+	return err
+}
+
+// checkStore determines if the session store can be reached, by looking up a session
+// that does not exist.
+func checkStore(s session.Store) error {
+	if s == nil {
+		return nil
+	}
+
+	if _, err := s.Get("ready"); err != nil && err != session.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// serveReady responds with the outcome of the readiness checks, with a 503 if any of
+// them failed.
+func serveReady(w http.ResponseWriter, res *readiness) {
+	status := http.StatusOK
+	if !res.Ready {
+		status = http.StatusServiceUnavailable
+		for _, c := range res.Checks {
+			if !c.OK {
+				zap.L().Warn("not ready",
+					zap.String("check", c.Name),
+					zap.String("error", c.Error))
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		zap.L().Error("unable to encode readiness",
+			zap.Error(err))
+	}
+}
@@ -0,0 +1,103 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/mux"
+	"github.com/kellegous/underpants/proxy"
+	"github.com/kellegous/underpants/user"
+)
+
+// stubProvider sends users to sign in at url.
+type stubProvider struct {
+	url string
+}
+
+func (p *stubProvider) Validate(cfg *config.Info) error {
+	return nil
+}
+
+func (p *stubProvider) GetAuthURL(ctx *config.Context, r *http.Request) string {
+	return p.url
+}
+
+func (p *stubProvider) Authenticate(
+	ctx *config.Context,
+	r *http.Request) (*user.Info, *url.URL, error) {
+	return nil, nil, nil
+}
+
+func TestReady(t *testing.T) {
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer idp.Close()
+
+	be := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer be.Close()
+
+	var cfg config.Info
+	if err := cfg.Read(strings.NewReader(fmt.Sprintf(`{
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"readiness": {"check-provider": true, "check-backends": true},
+		"routes": [{"from": "a.com", "to": "%s"}]
+	}`, be.URL))); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := config.BuildContext(&cfg, 80, []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prv := &stubProvider{url: idp.URL + "/auth"}
+	mb := mux.Create()
+	backends := proxy.Setup(ctx, prv, mb)
+	SetupHealth(ctx, prv, backends, mb)
+	m := mb.Build()
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "http://hub.com"+HealthPath, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200 from %s, got %d", HealthPath, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "http://hub.com"+ReadyPath, nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503 from %s, got %d", ReadyPath, w.Code)
+	}
+
+	var res readiness
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	ok := map[string]bool{}
+	for _, c := range res.Checks {
+		ok[c.Name] = c.OK
+	}
+
+	expected := map[string]bool{
+		"session-key":   true,
+		"session-store": true,
+		"provider":      true,
+		"backend a.com": false,
+	}
+	if fmt.Sprint(ok) != fmt.Sprint(expected) {
+		t.Fatalf("expected checks %v, got %v", expected, ok)
+	}
+
+	// an unreachable identity provider also fails readiness.
+	idp.Close()
+	if c := checkReady(ctx, prv, nil).Checks[2]; c.Name != "provider" || c.OK {
+		t.Fatalf("expected the provider check to fail, got %+v", c)
+	}
+}
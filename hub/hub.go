@@ -5,20 +5,102 @@ import (
 	"html/template"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
+	"github.com/kellegous/underpants/audit"
 	"github.com/kellegous/underpants/auth"
 	"github.com/kellegous/underpants/config"
 	"github.com/kellegous/underpants/internal"
+	"github.com/kellegous/underpants/metrics"
 	"github.com/kellegous/underpants/mux"
+	"github.com/kellegous/underpants/proxy"
 	"github.com/kellegous/underpants/user"
+
+	"go.uber.org/zap"
 )
 
+// JWKSPath is the path on the hub of the JSON Web Key Set for identity assertions.
+const JWKSPath = "/.well-known/jwks.json"
+
+var logoutTmpl = template.Must(template.New("logout").Parse(`<!DOCTYPE html>
+<html>
+  <head>
+    <title>Signed out</title>
+  </head>
+  <body>
+    <h1>Signed out</h1>
+    <p>
+      {{if .Everywhere}}You have been signed out on every device.{{else}}You have been signed out.{{end}}
+    </p>
+    <p><a href="{{.Hub}}">Sign in again</a></p>
+  </body>
+</html>
+`))
+
+// routeLink is a route the user can access, as listed on the hub's root page.
+type routeLink struct {
+	From   string
+	URL    string
+	Health []*proxy.HealthState
+}
+
+// rootPage is the data of the hub's root page.
+type rootPage struct {
+	User   *user.Info
+	Routes []*routeLink
+
+	// Brand customizes the look of the page.
+	Brand *config.BrandingInfo
+
+	// CSRF is the token the page's forms must post along with the user's session.
+	CSRF string
+}
+
+// newRootPage lists the routes the user can access, along with the health of their
+// backends. Nobody has routes listed.
+func newRootPage(ctx *config.Context, u *user.Info, backends []*proxy.Backend) *rootPage {
+	p := &rootPage{User: u, Brand: &ctx.Branding}
+	if u == nil {
+		return p
+	}
+
+	p.CSRF = ctx.Sessions.CSRFToken(u)
+
+	for _, b := range backends {
+		// wildcard routes have no single address to link to.
+		if b.Route.IsWildcard() || !b.MayAccess(u) {
+			continue
+		}
+
+		host := b.Route.Host()
+		switch ctx.Port {
+		case 80, 443:
+		default:
+			host = fmt.Sprintf("%s:%d", host, ctx.Port)
+		}
+
+		p.Routes = append(p.Routes, &routeLink{
+			From:   b.Route.From,
+			URL:    fmt.Sprintf("%s://%s%s/", ctx.Scheme(), host, b.Route.PathPrefix()),
+			Health: b.Health(),
+		})
+	}
+	return p
+}
+
 // Setup ...
-func Setup(ctx *config.Context, prv auth.Provider, mb *mux.Builder) {
-	// load the template for the one piece of static content embedded in
-	// the server
-	t := template.Must(template.New("index.html").Parse(rootTmpl))
+func Setup(
+	ctx *config.Context,
+	prv auth.Provider,
+	backends []*proxy.Backend,
+	mb *mux.Builder) {
+	t, assets := brandingFor(ctx)
+
+	if assets != nil {
+		mb.ForAnyHost().Handle(AssetsPath,
+			internal.AddSecurityHeaders(ctx.Info, serveAssets(assets)))
+	}
 
 	// setup admin
 	mb.ForAnyHost().Handle("/",
@@ -26,19 +108,18 @@ func Setup(ctx *config.Context, prv auth.Provider, mb *mux.Builder) {
 			func(w http.ResponseWriter, r *http.Request) {
 				switch r.URL.Path {
 				case "/":
-					u, _ := user.DecodeFromRequest(r, ctx.Key)
+					u, _ := ctx.Sessions.FromRequest(w, r)
+					p := newRootPage(ctx, u, backends)
 					w.Header().Set("Content-Type", "text/html;charset=utf-8")
-					if debugTmpl {
-						t, err := template.ParseFiles("index.html")
-						if err != nil {
-							panic(err)
-						}
-						t.Execute(w, u)
-						return
+					if err := t.Execute(w, p); err != nil {
+						zap.L().Error("unable to render hub page",
+							zap.Error(err))
 					}
-					t.Execute(w, u)
 				default:
-					http.NotFound(w, r)
+					internal.ServeErrorPage(ctx, w, r, &internal.ErrorPage{
+						Status:  http.StatusNotFound,
+						Message: "There is nothing here.",
+					}, nil)
 				}
 			}))
 
@@ -47,35 +128,106 @@ func Setup(ctx *config.Context, prv auth.Provider, mb *mux.Builder) {
 			func(w http.ResponseWriter, r *http.Request) {
 				u, back, err := prv.Authenticate(ctx, r)
 				if err != nil {
+					zap.L().Warn("authentication failed",
+						zap.String("uri", r.RequestURI),
+						zap.Error(err))
+					ctx.Audit.Record(r, audit.LoginRejected, "", err.Error())
+					ctx.Metrics.Logins.Inc(metrics.LoginRejected)
 					http.Error(w,
 						http.StatusText(http.StatusForbidden),
 						http.StatusForbidden)
 					return
 				}
 
+				if ctx.Oauth.RequireVerifiedEmail && !u.EmailVerified {
+					zap.L().Info("access denied (email not verified)",
+						zap.String("user", u.Email))
+					ctx.Audit.Record(r, audit.LoginRejected, u.Email, "email not verified")
+					ctx.Metrics.Logins.Inc(metrics.LoginRejected)
+					http.Error(w,
+						"Forbidden: your email address has not been verified.",
+						http.StatusForbidden)
+					return
+				}
+
+				// providers that know when the user entered their credentials with the
+				// identity provider report it, otherwise it was just now.
 				u.LastAuthenticated = time.Now()
+				if u.LastSignIn.IsZero() {
+					u.LastSignIn = u.LastAuthenticated
+				}
 
-				v, err := u.Encode(ctx.Key)
+				if u.RefreshToken != "" {
+					t, err := ctx.Sessions.SealToken(u.RefreshToken)
+					if err != nil {
+						zap.L().Error("unable to seal refresh token",
+							zap.String("user", u.Email),
+							zap.Error(err))
+						http.Error(w,
+							http.StatusText(http.StatusInternalServerError),
+							http.StatusInternalServerError)
+						return
+					}
+					u.RefreshToken = t
+				}
+
+				v, err := ctx.Sessions.Encode(u)
 				if err != nil {
-					panic(err)
+					zap.L().Error("unable to encode session",
+						zap.String("user", u.Email),
+						zap.Error(err))
+					http.Error(w,
+						http.StatusText(http.StatusInternalServerError),
+						http.StatusInternalServerError)
+					return
 				}
 
-				http.SetCookie(w, user.CreateCookie(v, ctx.HasCerts()))
+				http.SetCookie(w, ctx.Sessions.NewCookie(v))
+				ctx.Audit.Record(r, audit.Login, u.Email, "")
+				ctx.Metrics.Logins.Inc(metrics.LoginSucceeded)
 
 				p := back.Path
 				if back.RawQuery != "" {
 					p += fmt.Sprintf("?%s", back.RawQuery)
 				}
 
+				// users returning to the hub itself already have its cookie.
+				if strings.EqualFold(back.Host, ctx.Host()) {
+					http.Redirect(w, r, p, http.StatusFound)
+					return
+				}
+
+				// the session is handed to the route's host with a one-time code so
+				// that it never appears in a URL.
+				code, err := ctx.Sessions.NewHandoff(v)
+				if err != nil {
+					zap.L().Error("unable to create session handoff",
+						zap.String("user", u.Email),
+						zap.Error(err))
+					http.Error(w,
+						http.StatusText(http.StatusInternalServerError),
+						http.StatusInternalServerError)
+					return
+				}
+
 				http.Redirect(w, r,
 					fmt.Sprintf("%s://%s%s?%s", ctx.Scheme(), back.Host, auth.BaseURI,
 						url.Values{
 							"p": {p},
-							"c": {v},
+							"c": {code},
 						}.Encode()),
 					http.StatusFound)
 			}))
 
+	if hp, ok := prv.(auth.HandlerProvider); ok {
+		for path, h := range hp.Handlers(ctx) {
+			mb.ForAnyHost().Handle(path,
+				internal.AddSecurityHeaders(ctx.Info, h))
+		}
+	}
+
+	setupDevices(ctx, prv, mb)
+
 	mb.ForAnyHost().Handle(fmt.Sprintf("%slogout", auth.BaseURI),
 		internal.AddSecurityHeadersFunc(ctx.Info,
 			func(w http.ResponseWriter, r *http.Request) {
@@ -86,15 +238,110 @@ func Setup(ctx *config.Context, prv auth.Provider, mb *mux.Builder) {
 					return
 				}
 
-				http.SetCookie(w, &http.Cookie{
-					Name:   user.CookieKey,
-					Value:  "",
-					Path:   "/",
-					MaxAge: 0,
-				})
+				u, _ := ctx.Sessions.FromRequest(w, r)
+
+				// other sites must not be able to sign users out. Requests without a
+				// session have nothing to protect.
+				if u != nil {
+					if err := ctx.Sessions.CheckCSRF(r, u); err != nil {
+						zap.L().Info("logout rejected",
+							zap.String("user", u.Email),
+							zap.Error(err))
+						http.Error(w,
+							http.StatusText(http.StatusForbidden),
+							http.StatusForbidden)
+						return
+					}
+				}
+
+				// signing out everywhere revokes every session the user has, on every
+				// route and device.
+				if r.FormValue("everywhere") != "" {
+					if u != nil {
+						if err := ctx.Sessions.RevokeUser(u.Email); err != nil {
+							zap.L().Error("unable to revoke sessions",
+								zap.String("user", u.Email),
+								zap.Error(err))
+							http.Error(w,
+								http.StatusText(http.StatusInternalServerError),
+								http.StatusInternalServerError)
+							return
+						}
+
+						zap.L().Info("user signed out everywhere",
+							zap.String("user", u.Email))
+					}
+				}
+
+				if err := ctx.Sessions.Destroy(r); err != nil {
+					zap.L().Error("unable to destroy session",
+						zap.Error(err))
+				}
+
+				http.SetCookie(w, ctx.Sessions.ClearCookie())
+
+				if u != nil {
+					ctx.Audit.Record(r, audit.Logout, u.Email, "")
+				}
+
+				if u := ctx.LogoutURL; u != "" {
+					http.Redirect(w, r, u, http.StatusSeeOther)
+					return
+				}
 
-				// TODO(knorton): Convert this to simple html page
-				w.Header().Set("Content-Type", "text/plain")
-				fmt.Fprintln(w, "ok.")
+				w.Header().Set("Content-Type", "text/html;charset=utf-8")
+				if err := logoutTmpl.Execute(w, struct {
+					Everywhere bool
+					Hub        string
+				}{
+					Everywhere: r.FormValue("everywhere") != "",
+					Hub:        fmt.Sprintf("%s://%s/", ctx.Scheme(), ctx.Host()),
+				}); err != nil {
+					zap.L().Error("unable to render logout page",
+						zap.Error(err))
+				}
 			}))
+
+	// publish the keys that backends use to verify identity assertions.
+	if ctx.Assertions != nil {
+		jwks := ctx.Assertions.JWKS()
+		mb.ForAnyHost().Handle(JWKSPath,
+			internal.AddSecurityHeadersFunc(ctx.Info,
+				func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Content-Type", "application/json")
+					w.Write(jwks)
+				}))
+	}
+
+	// hosts that are neither the hub nor routed do not get the hub's pages, unless a
+	// route is the default, which serves them itself. Without a host of its own, the
+	// hub is served on every host.
+	if ctx.DefaultRoute() == nil && ctx.Info.Host != "" {
+		mb.UnknownHost(
+			internal.AddSecurityHeadersFunc(ctx.Info,
+				func(w http.ResponseWriter, r *http.Request) {
+					serveUnknownHost(ctx, w, r)
+				}),
+			ctx.Info.Host)
+	}
+}
+
+// serveUnknownHost answers a request for a host that is neither the hub nor routed,
+// as unknown-hosts describes.
+func serveUnknownHost(ctx *config.Context, w http.ResponseWriter, r *http.Request) {
+	zap.L().Info("request for unknown host",
+		zap.String("host", r.Host),
+		zap.String("uri", r.RequestURI))
+
+	if ctx.UnknownHosts == config.UnknownHostsRedirect {
+		http.Redirect(w, r,
+			fmt.Sprintf("%s://%s/", ctx.Scheme(), ctx.Host()),
+			http.StatusFound)
+		return
+	}
+
+	internal.ServeErrorPage(ctx, w, r, &internal.ErrorPage{
+		Status:  http.StatusNotFound,
+		Message: "There is nothing here.",
+	}, nil)
 }
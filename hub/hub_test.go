@@ -0,0 +1,280 @@
+package hub
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/mux"
+	"github.com/kellegous/underpants/proxy"
+	"github.com/kellegous/underpants/user"
+)
+
+func TestRootPage(t *testing.T) {
+	var cfg config.Info
+	if err := cfg.Read(strings.NewReader(`{
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"routes": [
+			{"from": "a.com", "to": "http://localhost:8080"},
+			{"from": "b.com", "to": "http://localhost:8081", "allow": ["b@b.com"]}
+		]
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := config.BuildContext(&cfg, 8000, []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backends := proxy.Setup(ctx, nil, mux.Create())
+
+	if p := newRootPage(ctx, nil, backends); len(p.Routes) != 0 {
+		t.Fatalf("expected no routes for nobody, got %d", len(p.Routes))
+	}
+
+	p := newRootPage(ctx, &user.Info{Email: "a@a.com", Name: "A"}, backends)
+	if len(p.Routes) != 1 || p.Routes[0].URL != "http://a.com:8000/" {
+		t.Fatalf("expected a link to a.com only, got %+v", p.Routes)
+	}
+
+	var b bytes.Buffer
+	if err := template.Must(template.New("index.html").Parse(rootTmpl)).Execute(&b, p); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(b.String(), `<a href="http://a.com:8000/">a.com</a>`) {
+		t.Fatalf("expected the page to link to a.com, got:\n%s", b.String())
+	}
+
+	if !strings.Contains(b.String(), `name="csrf" type="hidden" value="`+p.CSRF+`"`) {
+		t.Fatalf("expected the page to include the csrf token, got:\n%s", b.String())
+	}
+}
+
+func TestLogoutCSRF(t *testing.T) {
+	var cfg config.Info
+	if err := cfg.Read(strings.NewReader(`{
+		"oauth": {"client-id": "id", "client-secret": "secret"}
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := config.BuildContext(&cfg, 80, []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mb := mux.Create()
+	Setup(ctx, nil, nil, mb)
+	h := mb.Build()
+
+	u := &user.Info{Email: "a@a.com", LastAuthenticated: time.Now()}
+	v, err := ctx.Sessions.Encode(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for tok, expected := range map[string]int{
+		"":                        http.StatusForbidden,
+		"forged":                  http.StatusForbidden,
+		ctx.Sessions.CSRFToken(u): http.StatusOK,
+	} {
+		r := httptest.NewRequest("POST", "http://hub.com/__auth__/logout",
+			strings.NewReader(url.Values{"csrf": {tok}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(ctx.Sessions.NewCookie(v))
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != expected {
+			t.Fatalf("expected status %d for token %q, got %d", expected, tok, w.Code)
+		}
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	var cfg config.Info
+	if err := cfg.Read(strings.NewReader(`{
+		"oauth": {"client-id": "id", "client-secret": "secret"}
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := config.BuildContext(&cfg, 80, []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mb := mux.Create()
+	Setup(ctx, nil, nil, mb)
+
+	w := httptest.NewRecorder()
+	mb.Build().ServeHTTP(w, httptest.NewRequest("GET", "http://unknown.com/x", nil))
+	if w.Code != http.StatusNotFound || w.Header().Get("X-Request-Id") == "" {
+		t.Fatalf("expected the not found page, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestBranding(t *testing.T) {
+	dir, err := ioutil.TempDir("", "branding")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Mkdir(filepath.Join(dir, "assets"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range map[string]string{
+		"index.html":      `<h1>{{.Brand.CompanyName}}</h1>`,
+		"assets/logo.svg": `<svg></svg>`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get := func(conf, path string) *httptest.ResponseRecorder {
+		var cfg config.Info
+		if err := cfg.Read(strings.NewReader(conf)); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, err := config.BuildContext(&cfg, 80, []byte("key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mb := mux.Create()
+		Setup(ctx, nil, nil, mb)
+
+		w := httptest.NewRecorder()
+		mb.Build().ServeHTTP(w, httptest.NewRequest("GET", "http://hub.com"+path, nil))
+		return w
+	}
+
+	conf := fmt.Sprintf(`{
+		"host": "hub.com",
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"branding": {"company-name": "Acme", "dir": "%s"}
+	}`, dir)
+
+	if w := get(conf, "/"); w.Body.String() != "<h1>Acme</h1>" {
+		t.Fatalf("expected the page from the branding dir, got %q", w.Body.String())
+	}
+
+	if w := get(conf, AssetsPath+"logo.svg"); w.Code != http.StatusOK || w.Body.String() != "<svg></svg>" {
+		t.Fatalf("expected the logo asset, got %d %q", w.Code, w.Body.String())
+	}
+
+	if w := get(conf, AssetsPath); w.Code != http.StatusNotFound {
+		t.Fatalf("expected assets not to be listed, got %d", w.Code)
+	}
+
+	w := get(`{
+		"host": "hub.com",
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"branding": {"company-name": "Acme", "logo": "https://acme.com/logo.png", "colors": {"accent": "#c00"}}
+	}`, "/")
+	for _, expected := range []string{
+		"<title>Acme</title>",
+		`<img id="logo" src="https://acme.com/logo.png" alt="Acme">`,
+		"color: #c00;",
+	} {
+		if !strings.Contains(w.Body.String(), expected) {
+			t.Fatalf("expected the built-in page to contain %q, got:\n%s", expected, w.Body.String())
+		}
+	}
+}
+
+func TestLogoutRedirect(t *testing.T) {
+	for conf, expected := range map[string]int{
+		`{"oauth": {"client-id": "id", "client-secret": "secret"}}`:                                        http.StatusOK,
+		`{"oauth": {"client-id": "id", "client-secret": "secret"}, "logout-url": "https://portal.a.com/"}`: http.StatusSeeOther,
+	} {
+		var cfg config.Info
+		if err := cfg.Read(strings.NewReader(conf)); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, err := config.BuildContext(&cfg, 80, []byte("key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mb := mux.Create()
+		Setup(ctx, nil, nil, mb)
+
+		w := httptest.NewRecorder()
+		mb.Build().ServeHTTP(w, httptest.NewRequest("POST", "http://hub.com/__auth__/logout", nil))
+		if w.Code != expected {
+			t.Fatalf("expected status %d for %s, got %d", expected, conf, w.Code)
+		}
+
+		if expected == http.StatusSeeOther && w.Header().Get("Location") != "https://portal.a.com/" {
+			t.Fatalf("expected a redirect to the portal, got %q", w.Header().Get("Location"))
+		}
+
+		if expected == http.StatusOK && !strings.Contains(w.Body.String(), "You have been signed out.") {
+			t.Fatalf("expected the confirmation page, got:\n%s", w.Body.String())
+		}
+	}
+}
+
+func TestUnknownHosts(t *testing.T) {
+	get := func(conf, rawurl string) *httptest.ResponseRecorder {
+		var cfg config.Info
+		if err := cfg.Read(strings.NewReader(conf)); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, err := config.BuildContext(&cfg, 80, []byte("key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mb := mux.Create()
+		Setup(ctx, nil, nil, mb)
+		SetupHealth(ctx, nil, nil, mb)
+
+		w := httptest.NewRecorder()
+		mb.Build().ServeHTTP(w, httptest.NewRequest("GET", rawurl, nil))
+		return w
+	}
+
+	if w := get(`{
+		"host": "hub.com",
+		"oauth": {"client-id": "id", "client-secret": "secret"}
+	}`, "http://10.0.0.1/x"); w.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404, got %d", w.Code)
+	}
+
+	w := get(`{
+		"host": "hub.com",
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"unknown-hosts": "redirect"
+	}`, "http://10.0.0.1/x")
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "http://hub.com/" {
+		t.Fatalf("expected a redirect to the hub, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+
+	if w := get(`{
+		"host": "hub.com",
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"unknown-hosts": "redirect"
+	}`, "http://10.0.0.1"+HealthPath); w.Code != http.StatusOK {
+		t.Fatalf("expected health checks to answer on any host, got %d", w.Code)
+	}
+}
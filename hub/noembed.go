@@ -0,0 +1,10 @@
+//go:build !embedbranding
+
+package hub
+
+import "io/fs"
+
+// embeddedBranding is nil unless the binary is built with the embedbranding tag.
+func embeddedBranding() fs.FS {
+	return nil
+}
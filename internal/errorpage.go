@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+
+	"github.com/kellegous/underpants/config"
+
+	"go.uber.org/zap"
+)
+
+// requestIDHeader is the header holding the id of a request, which a load balancer in
+// front of underpants may have already set.
+const requestIDHeader = "X-Request-Id"
+
+// maxRequestIDLen is the longest request id that is accepted from a client.
+const maxRequestIDLen = 128
+
+var errorTmpl = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+  <head>
+    <title>{{.Title}}</title>
+  </head>
+  <body>
+    <h1>{{.Title}}</h1>
+    <p>{{.Message}}</p>
+    {{if .RequestID}}<p><small>Request ID: {{.RequestID}}</small></p>{{end}}
+  </body>
+</html>
+`))
+
+// ErrorPage is what error pages, including the templates of error-pages, are rendered
+// with.
+type ErrorPage struct {
+	Status    int
+	Title     string
+	Message   string
+	Host      string
+	Route     string
+	Email     string
+	RequestID string
+	Hub       string
+}
+
+// RequestID is the id of the request, as set by a load balancer in front of
+// underpants, or a new random id if there is none.
+func RequestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); id != "" && len(id) <= maxRequestIDLen {
+		return id
+	}
+
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// ServeErrorPage responds with the page for p.Status. The operator's template from
+// error-pages is used if there is one, then def, then a generic page. The fields of p
+// that can be derived from the request are filled in if they are empty.
+func ServeErrorPage(
+	ctx *config.Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	p *ErrorPage,
+	def *template.Template) {
+	if p.Title == "" {
+		p.Title = http.StatusText(p.Status)
+	}
+
+	if p.Host == "" {
+		p.Host = r.Host
+	}
+
+	if p.RequestID == "" {
+		p.RequestID = RequestID(r)
+	}
+
+	if p.Hub == "" {
+		p.Hub = fmt.Sprintf("%s://%s/", ctx.Scheme(), ctx.Host())
+	}
+
+	t := ctx.ErrorPage(p.Status)
+	if t == nil {
+		t = def
+	}
+
+	if t == nil {
+		t = errorTmpl
+	}
+
+	w.Header().Set("Content-Type", "text/html;charset=utf-8")
+	w.Header().Set(requestIDHeader, p.RequestID)
+	w.WriteHeader(p.Status)
+	if err := t.Execute(w, p); err != nil {
+		zap.L().Error("unable to render error page",
+			zap.Int("status", p.Status),
+			zap.Error(err))
+	}
+}
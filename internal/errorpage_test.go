@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kellegous/underpants/config"
+)
+
+func TestServeErrorPage(t *testing.T) {
+	f, err := ioutil.TempFile("", "403")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString(`{{.Status}} {{.Email}} {{.Route}} {{.RequestID}} {{.Message}}`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	var cfg config.Info
+	if err := cfg.Read(strings.NewReader(fmt.Sprintf(`{
+		"host": "hub.com",
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"error-pages": {"403": "%s"}
+	}`, f.Name()))); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := &config.Context{Info: &cfg, Port: 80}
+
+	r := httptest.NewRequest("GET", "http://a.com/", nil)
+	r.Header.Set("X-Request-Id", "abc123")
+
+	w := httptest.NewRecorder()
+	ServeErrorPage(ctx, w, r, &ErrorPage{
+		Status:  http.StatusForbidden,
+		Message: "<no>",
+		Route:   "a.com",
+		Email:   "a@a.com",
+	}, nil)
+
+	if w.Code != http.StatusForbidden || w.Header().Get("X-Request-Id") != "abc123" {
+		t.Fatalf("expected 403 for request abc123, got %d %q", w.Code, w.Header().Get("X-Request-Id"))
+	}
+
+	if w.Body.String() != "403 a@a.com a.com abc123 &lt;no&gt;" {
+		t.Fatalf("unexpected page %q", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	ServeErrorPage(ctx, w, httptest.NewRequest("GET", "http://a.com/", nil), &ErrorPage{
+		Status:  http.StatusBadGateway,
+		Message: "a.com could not be reached.",
+	}, nil)
+
+	id := w.Header().Get("X-Request-Id")
+	if w.Code != http.StatusBadGateway || id == "" ||
+		!strings.Contains(w.Body.String(), "<h1>Bad Gateway</h1>") ||
+		!strings.Contains(w.Body.String(), id) {
+		t.Fatalf("expected the default page with a request id, got %d %q", w.Code, w.Body.String())
+	}
+}
@@ -8,19 +8,7 @@ import (
 
 // AddSecurityHeaders ...
 func AddSecurityHeaders(c *config.Info, next http.Handler) http.Handler {
-	if c.AddSecurityHeaders {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			if c.HasCerts() {
-				w.Header().Add("Strict-Transport-Security", "max-age=16070400; includeSubDomains")
-			}
-
-			w.Header().Add("X-Frame-Options", "SAMEORIGIN")
-			w.Header().Add("Cache-Control", "private, no-cache")
-			w.Header().Add("Pragma", "no-cache")
-			next.ServeHTTP(w, r)
-		})
-	}
-	return next
+	return AddRouteSecurityHeaders(c, nil, next)
 }
 
 // AddSecurityHeadersFunc ...
@@ -29,3 +17,91 @@ func AddSecurityHeadersFunc(
 	next func(http.ResponseWriter, *http.Request)) http.Handler {
 	return AddSecurityHeaders(c, http.HandlerFunc(next))
 }
+
+// AddRouteSecurityHeaders adds the security headers of the route, or of the hub if
+// route is nil, to the responses of next.
+func AddRouteSecurityHeaders(
+	c *config.Info,
+	route *config.RouteInfo,
+	next http.Handler) http.Handler {
+	h := c.SecurityHeadersFor(route)
+	if !c.IsSecure() {
+		delete(h, "Strict-Transport-Security")
+	}
+
+	if len(h) > 0 {
+		next = withSecurityHeaders(h, next)
+	}
+
+	if c.AddSecurityHeaders {
+		return addStrictSecurityHeaders(c, next)
+	}
+	return next
+}
+
+// addStrictSecurityHeaders adds the headers enabled by use-strict-security-headers.
+func addStrictSecurityHeaders(c *config.Info, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c.IsSecure() {
+			w.Header().Add("Strict-Transport-Security", "max-age=16070400; includeSubDomains")
+		}
+
+		w.Header().Add("X-Frame-Options", "SAMEORIGIN")
+		w.Header().Add("Cache-Control", "private, no-cache")
+		w.Header().Add("Pragma", "no-cache")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// securityHeadersWriter adds the security headers that a response does not already
+// have just before the response's headers are written, so that those set by the
+// backend are kept.
+type securityHeadersWriter struct {
+	*ResponseRecorder
+	headers map[string]string
+	applied bool
+}
+
+// withSecurityHeaders adds the headers to the responses of next that lack them.
+func withSecurityHeaders(headers map[string]string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&securityHeadersWriter{
+			ResponseRecorder: &ResponseRecorder{ResponseWriter: w},
+			headers:          headers,
+		}, r)
+	})
+}
+
+func (w *securityHeadersWriter) apply() {
+	if w.applied {
+		return
+	}
+	w.applied = true
+
+	h := w.Header()
+	for name, val := range w.headers {
+		if _, ok := h[name]; !ok {
+			h.Set(name, val)
+		}
+	}
+}
+
+// WriteHeader adds the headers to the final response and writes the status.
+func (w *securityHeadersWriter) WriteHeader(status int) {
+	if status >= 200 {
+		w.apply()
+	}
+	w.ResponseRecorder.WriteHeader(status)
+}
+
+// Write adds the headers, if they have not been written, and writes b.
+func (w *securityHeadersWriter) Write(b []byte) (int, error) {
+	w.apply()
+	return w.ResponseRecorder.Write(b)
+}
+
+// Flush adds the headers, if they have not been written, and flushes.
+func (w *securityHeadersWriter) Flush() {
+	w.apply()
+	w.ResponseRecorder.Flush()
+}
@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kellegous/underpants/config"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	info := &config.Info{
+		SecurityHeaders: map[string]string{
+			"strict-transport-security": "max-age=31536000",
+			"X-Content-Type-Options":    "nosniff",
+			"Content-Security-Policy":   "default-src 'self'",
+		},
+	}
+
+	route := &config.RouteInfo{
+		SecurityHeaders: map[string]string{
+			"Content-Security-Policy": "",
+			"Referrer-Policy":         "no-referrer",
+		},
+	}
+
+	h := AddRouteSecurityHeaders(info, route,
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// headers the backend sets itself are kept.
+			w.Header().Set("X-Content-Type-Options", "backend")
+			w.WriteHeader(http.StatusOK)
+		}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://a.com/", nil))
+
+	for name, expected := range map[string]string{
+		"X-Content-Type-Options":    "backend",
+		"Referrer-Policy":           "no-referrer",
+		"Content-Security-Policy":   "",
+		"Strict-Transport-Security": "",
+	} {
+		if v := w.Header().Get(name); v != expected {
+			t.Fatalf("expected %s of %q, got %q", name, expected, v)
+		}
+	}
+
+	// the hub gets the top-level headers, including HSTS over https.
+	info.TrustedProxies = &config.TrustedProxiesInfo{TerminatesTLS: true}
+	w = httptest.NewRecorder()
+	AddSecurityHeadersFunc(info, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hub"))
+	}).ServeHTTP(w, httptest.NewRequest("GET", "https://hub.com/", nil))
+
+	for name, expected := range map[string]string{
+		"X-Content-Type-Options":    "nosniff",
+		"Content-Security-Policy":   "default-src 'self'",
+		"Strict-Transport-Security": "max-age=31536000",
+	} {
+		if v := w.Header().Get(name); v != expected {
+			t.Fatalf("expected %s of %q, got %q", name, expected, v)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kellegous/underpants/config"
+)
+
+// minKeySize is the minimum number of bytes in a session signing key.
+const minKeySize = 32
+
+// vaultClient is used for requests to Vault.
+var vaultClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+// LoadKey loads the session signing key from the configured source.
+func LoadKey(k *config.KeyInfo) ([]byte, error) {
+	var enc string
+	switch {
+	case k.File != "":
+		b, err := ioutil.ReadFile(k.File)
+		if err != nil {
+			return nil, err
+		}
+		enc = string(b)
+	case k.Env != "":
+		enc = os.Getenv(k.Env)
+		if enc == "" {
+			return nil, fmt.Errorf("environment variable %s is not set", k.Env)
+		}
+	case k.Vault != nil:
+		v, err := readVault(k.Vault)
+		if err != nil {
+			return nil, err
+		}
+		enc = v
+	default:
+		return nil, errors.New("no source for the session key")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(enc))
+	if err != nil {
+		return nil, fmt.Errorf("session key is not base64 encoded: %s", err)
+	}
+
+	if len(key) < minKeySize {
+		return nil, fmt.Errorf("session key must be at least %d bytes, got %d",
+			minKeySize,
+			len(key))
+	}
+
+	return key, nil
+}
+
+// readVault reads the field holding the key from a Vault secret. Both the KV version 1
+// and version 2 engines are supported.
+func readVault(v *config.VaultKeyInfo) (string, error) {
+	req, err := http.NewRequest("GET",
+		fmt.Sprintf("%s/v1/%s", v.Address, strings.TrimLeft(v.Path, "/")),
+		nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv(v.TokenEnv))
+
+	res, err := vaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("reading %s from vault returned status %d",
+			v.Path,
+			res.StatusCode)
+	}
+
+	var body struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", err
+	}
+
+	data := body.Data
+
+	// KV version 2 nests the secret's fields in another data object.
+	var nested map[string]json.RawMessage
+	if raw, ok := data["data"]; ok && json.Unmarshal(raw, &nested) == nil {
+		if _, ok := nested[v.Field]; ok {
+			data = nested
+		}
+	}
+
+	var val string
+	if err := json.Unmarshal(data[v.Field], &val); err != nil {
+		return "", fmt.Errorf("vault secret %s has no string field %s", v.Path, v.Field)
+	}
+
+	return val, nil
+}
@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kellegous/underpants/config"
+)
+
+func TestLoadKey(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	enc := base64.StdEncoding.EncodeToString(key)
+
+	dir, err := ioutil.TempDir("", "internal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "key")
+	if err := ioutil.WriteFile(file, []byte(enc+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	short := filepath.Join(dir, "short")
+	if err := ioutil.WriteFile(short, []byte("c2hvcnQ="), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("UNDERPANTS_TEST_KEY", enc)
+	defer os.Unsetenv("UNDERPANTS_TEST_KEY")
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/v1/secret/data/underpants":
+			fmt.Fprintf(w, `{"data": {"data": {"key": %q}, "metadata": {}}}`, enc)
+		case "/v1/kv/underpants":
+			fmt.Fprintf(w, `{"data": {"signing": %q}}`, enc)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+
+	os.Setenv("UNDERPANTS_TEST_VAULT_TOKEN", "token")
+	defer os.Unsetenv("UNDERPANTS_TEST_VAULT_TOKEN")
+
+	vault := func(path, field string) *config.KeyInfo {
+		return &config.KeyInfo{
+			Vault: &config.VaultKeyInfo{
+				Address:  s.URL,
+				Path:     path,
+				Field:    field,
+				TokenEnv: "UNDERPANTS_TEST_VAULT_TOKEN",
+			},
+		}
+	}
+
+	for _, k := range []*config.KeyInfo{
+		{File: file},
+		{Env: "UNDERPANTS_TEST_KEY"},
+		vault("secret/data/underpants", "key"),
+		vault("kv/underpants", "signing"),
+	} {
+		v, err := LoadKey(k)
+		if err != nil {
+			t.Fatalf("unable to load key from %+v: %s", k, err)
+		}
+
+		if !bytes.Equal(v, key) {
+			t.Fatalf("expected key %x, got %x", key, v)
+		}
+	}
+
+	for _, k := range []*config.KeyInfo{
+		{File: short},
+		{File: filepath.Join(dir, "missing")},
+		{Env: "UNDERPANTS_TEST_MISSING_KEY"},
+		vault("secret/data/missing", "key"),
+		vault("kv/underpants", "key"),
+	} {
+		if _, err := LoadKey(k); err == nil {
+			t.Fatalf("expected loading key from %+v to fail", k)
+		}
+	}
+}
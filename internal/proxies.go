@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/kellegous/underpants/config"
+)
+
+// schemeKey is the context key of the scheme a trusted proxy says a request used.
+type schemeKey struct{}
+
+// TrustProxies believes the X-Forwarded-For and X-Forwarded-Proto headers of requests
+// from the trusted proxies. The client's address replaces the proxy's as the request's
+// RemoteAddr and the scheme is available from ForwardedScheme.
+func TrustProxies(c *config.Info, next http.Handler) http.Handler {
+	if c.TrustedProxies == nil {
+		return next
+	}
+	return TrustCurrentProxies(func() *config.Info { return c }, next)
+}
+
+// TrustCurrentProxies is TrustProxies for a config that may be replaced while serving,
+// such as one that is reloaded. Each request is checked against the trusted proxies of
+// the config that current returns at the time.
+func TrustCurrentProxies(current func() *config.Info, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := current().TrustedProxies
+		if t == nil || !t.Trusts(remoteIP(r)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		switch p := strings.ToLower(firstValue(r.Header.Get("X-Forwarded-Proto"))); p {
+		case "http", "https":
+			ctx = context.WithValue(ctx, schemeKey{}, p)
+		}
+
+		r = r.WithContext(ctx)
+		if ip := forwardedFor(r.Header, t); ip != nil {
+			r.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ForwardedScheme is the scheme a trusted proxy says the request was made with, or
+// empty if it did not come through one.
+func ForwardedScheme(r *http.Request) string {
+	s, _ := r.Context().Value(schemeKey{}).(string)
+	return s
+}
+
+// forwardedFor is the address of the client in the X-Forwarded-For header, which is
+// the last one that was not added by a trusted proxy.
+func forwardedFor(h http.Header, t *config.TrustedProxiesInfo) net.IP {
+	var ips []net.IP
+	for _, v := range h.Values("X-Forwarded-For") {
+		for _, s := range strings.Split(v, ",") {
+			ip := net.ParseIP(strings.TrimSpace(s))
+			if ip == nil {
+				// an address that cannot be parsed cannot be trusted either.
+				ips = nil
+				continue
+			}
+			ips = append(ips, ip)
+		}
+	}
+
+	for i := len(ips) - 1; i >= 0; i-- {
+		if !t.Trusts(ips[i]) || i == 0 {
+			return ips[i]
+		}
+	}
+	return nil
+}
+
+// remoteIP is the address of the peer that sent the request.
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// firstValue is the first of the comma separated values in v.
+func firstValue(v string) string {
+	if i := strings.IndexByte(v, ','); i >= 0 {
+		v = v[:i]
+	}
+	return strings.TrimSpace(v)
+}
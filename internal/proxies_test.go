@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kellegous/underpants/config"
+)
+
+func TestTrustProxies(t *testing.T) {
+	var cfg config.Info
+	if err := cfg.Read(strings.NewReader(`{
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"trusted-proxies": {"networks": ["10.0.0.0/8"], "terminates-tls": true}
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Scheme() != "https" || !*cfg.Cookie.Secure {
+		t.Fatal("expected proxies that terminate TLS to make underpants secure")
+	}
+
+	tests := []struct {
+		Peer   string
+		For    string
+		Proto  string
+		Addr   string
+		Scheme string
+	}{
+		{"10.0.0.1:1234", "1.2.3.4", "https", "1.2.3.4:0", "https"},
+		{"10.0.0.1:1234", "6.6.6.6, 1.2.3.4, 10.0.0.2", "http", "1.2.3.4:0", "http"},
+		{"10.0.0.1:1234", "10.0.0.3, 10.0.0.2", "", "10.0.0.3:0", ""},
+		{"10.0.0.1:1234", "", "ftp", "10.0.0.1:1234", ""},
+		{"5.5.5.5:1234", "1.2.3.4", "https", "5.5.5.5:1234", ""},
+	}
+
+	for _, test := range tests {
+		var addr, scheme string
+		h := TrustProxies(&cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			addr, scheme = r.RemoteAddr, ForwardedScheme(r)
+		}))
+
+		r := httptest.NewRequest("GET", "http://a.com/", nil)
+		r.RemoteAddr = test.Peer
+		if test.For != "" {
+			r.Header.Set("X-Forwarded-For", test.For)
+		}
+		if test.Proto != "" {
+			r.Header.Set("X-Forwarded-Proto", test.Proto)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+
+		if addr != test.Addr || scheme != test.Scheme {
+			t.Fatalf("expected %s over %q for %s, got %s over %q",
+				test.Addr, test.Scheme, test.For, addr, scheme)
+		}
+	}
+}
+
+func TestTrustCurrentProxies(t *testing.T) {
+	var trusting config.Info
+	if err := trusting.Read(strings.NewReader(`{
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"trusted-proxies": {"networks": ["10.0.0.0/8"]}
+	}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	cur := &trusting
+	var addr string
+	h := TrustCurrentProxies(func() *config.Info { return cur },
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			addr = r.RemoteAddr
+		}))
+
+	serve := func() string {
+		r := httptest.NewRequest("GET", "http://a.com/", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("X-Forwarded-For", "1.2.3.4")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		return addr
+	}
+
+	if a := serve(); a != "1.2.3.4:0" {
+		t.Fatalf("expected the proxy to be trusted, got %s", a)
+	}
+
+	// a reloaded config that no longer trusts the proxy applies to the next request.
+	cur = &config.Info{}
+	if a := serve(); a != "10.0.0.1:1234" {
+		t.Fatalf("expected the proxy no longer to be trusted, got %s", a)
+	}
+}
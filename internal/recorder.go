@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// ResponseRecorder records the status and size of a response as it is written to the
+// underlying ResponseWriter.
+type ResponseRecorder struct {
+	http.ResponseWriter
+
+	// Status is the status of the response, zero until it is written. Hijacked
+	// connections are recorded as switching protocols.
+	Status int
+
+	// Bytes is the size of the response body written so far.
+	Bytes int64
+}
+
+// WriteHeader records the status and writes it.
+func (w *ResponseRecorder) WriteHeader(status int) {
+	// informational responses are followed by the real one.
+	if w.Status == 0 && (status >= 200 || status == http.StatusSwitchingProtocols) {
+		w.Status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the size of b and writes it.
+func (w *ResponseRecorder) Write(b []byte) (int, error) {
+	if w.Status == 0 {
+		w.Status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.Bytes += int64(n)
+	return n, err
+}
+
+// Flush flushes the underlying ResponseWriter, if it can be.
+func (w *ResponseRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack passes the connection on, as is needed for WebSocket upgrades.
+func (w *ResponseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection cannot be hijacked")
+	}
+
+	c, rw, err := hj.Hijack()
+	if err == nil && w.Status == 0 {
+		w.Status = http.StatusSwitchingProtocols
+	}
+	return c, rw, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (w *ResponseRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
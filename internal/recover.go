@@ -0,0 +1,39 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"go.uber.org/zap"
+)
+
+// Recover answers requests whose handlers panic with a 500, logging the panic, rather
+// than letting the server drop the connection without a response.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+
+			// handlers abort responses that are already underway this way.
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+
+			zap.L().Error("panic serving request",
+				zap.String("host", r.Host),
+				zap.String("method", r.Method),
+				zap.String("uri", r.RequestURI),
+				zap.String("panic", fmt.Sprint(v)),
+				zap.ByteString("stack", debug.Stack()))
+			http.Error(w,
+				http.StatusText(http.StatusInternalServerError),
+				http.StatusInternalServerError)
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
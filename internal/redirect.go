@@ -0,0 +1,29 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/kellegous/underpants/config"
+)
+
+// RedirectToHTTPS permanently redirects every request to the https equivalent on the
+// port underpants serves https on.
+func RedirectToHTTPS(ctx *config.Context) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		if ctx.Port != 443 {
+			host = net.JoinHostPort(host, fmt.Sprintf("%d", ctx.Port))
+		}
+
+		u := *r.URL
+		u.Scheme = "https"
+		u.Host = host
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+	})
+}
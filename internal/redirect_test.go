@@ -0,0 +1,39 @@
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kellegous/underpants/config"
+)
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		Port     int
+		URL      string
+		Expected string
+	}{
+		{443, "http://a.com/x?y=z", "https://a.com/x?y=z"},
+		{443, "http://a.com:80/", "https://a.com/"},
+		{8443, "http://a.com:8080/x", "https://a.com:8443/x"},
+	}
+
+	for _, test := range tests {
+		ctx := &config.Context{
+			Info: &config.Info{},
+			Port: test.Port,
+		}
+
+		w := httptest.NewRecorder()
+		RedirectToHTTPS(ctx).ServeHTTP(w, httptest.NewRequest("POST", test.URL, nil))
+
+		if w.Code != http.StatusMovedPermanently {
+			t.Fatalf("expected status %d, got %d", http.StatusMovedPermanently, w.Code)
+		}
+
+		if loc := w.Header().Get("Location"); loc != test.Expected {
+			t.Fatalf("expected redirect to %s, got %s", test.Expected, loc)
+		}
+	}
+}
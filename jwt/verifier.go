@@ -0,0 +1,411 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// leeway is the clock skew allowed when checking the times in a token.
+	leeway = time.Minute
+
+	// refetchInterval is the least amount of time between fetches of the key set that
+	// are caused by tokens signed with unknown keys.
+	refetchInterval = time.Minute
+
+	// fetchTimeout is the maximum amount of time allowed to fetch the discovery
+	// document or the key set.
+	fetchTimeout = 10 * time.Second
+)
+
+// Claims are the claims of a verified token.
+type Claims map[string]interface{}
+
+// String returns the named string claim, or the standard claim if no name is given.
+func (c Claims) String(name, std string) string {
+	if name == "" {
+		name = std
+	}
+	s, _ := c[name].(string)
+	return s
+}
+
+// Bool returns the named boolean claim, or the standard claim if no name is given.
+// Claims that are the string "true" count as true, as some providers encode
+// booleans that way.
+func (c Claims) Bool(name, std string) bool {
+	if name == "" {
+		name = std
+	}
+	switch v := c[name].(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// Verifier verifies JWTs issued by an identity provider against the keys it
+// publishes. Keys are cached for a TTL, and fetched again early when a token is
+// signed with a key that is not known.
+type Verifier struct {
+	issuer    string
+	jwksURL   string
+	audiences []string
+	ttl       time.Duration
+	c         *http.Client
+
+	lck     sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+
+	// fetching is closed when the fetch of the key set that is in progress, if any,
+	// completes.
+	fetching chan struct{}
+}
+
+// NewVerifier creates a Verifier for tokens from issuer for one of audiences. Keys are
+// fetched from jwksURL, or from the jwks_uri of the issuer's discovery document if it
+// is empty, and are cached for ttl.
+func NewVerifier(issuer, jwksURL string, audiences []string, ttl time.Duration) *Verifier {
+	return &Verifier{
+		issuer:    issuer,
+		jwksURL:   jwksURL,
+		audiences: audiences,
+		ttl:       ttl,
+		c: &http.Client{
+			Timeout: fetchTimeout,
+		},
+	}
+}
+
+// LooksLike determines if the token has the shape of a JWT, so that other bearer
+// tokens can be told apart without verifying them.
+func LooksLike(tok string) bool {
+	s := strings.Split(tok, ".")
+	if len(s) != 3 {
+		return false
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(s[0])
+	if err != nil {
+		return false
+	}
+
+	var hdr struct {
+		Alg string `json:"alg"`
+	}
+	return json.Unmarshal(b, &hdr) == nil && hdr.Alg != ""
+}
+
+// Verify checks the token's signature, issuer, audience and times and returns its
+// claims.
+func (v *Verifier) Verify(tok string) (Claims, error) {
+	s := strings.Split(tok, ".")
+	if len(s) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var hdr struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodePart(s[0], &hdr); err != nil {
+		return nil, err
+	}
+
+	key, err := v.key(hdr.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(s[2])
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifySignature(hdr.Alg, key, s[0]+"."+s[1], sig); err != nil {
+		return nil, err
+	}
+
+	var c Claims
+	if err := decodePart(s[1], &c); err != nil {
+		return nil, err
+	}
+
+	if err := v.check(c, time.Now()); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// check verifies the issuer, audience and times of the claims.
+func (v *Verifier) check(c Claims, now time.Time) error {
+	if iss, _ := c["iss"].(string); iss != v.issuer {
+		return fmt.Errorf("token issued by %q", iss)
+	}
+
+	if !v.hasAudience(c["aud"]) {
+		return errors.New("token is not for an accepted audience")
+	}
+
+	exp, ok := c["exp"].(float64)
+	if !ok {
+		return errors.New("token has no expiry")
+	}
+
+	if now.Add(-leeway).After(time.Unix(int64(exp), 0)) {
+		return errors.New("token has expired")
+	}
+
+	if nbf, ok := c["nbf"].(float64); ok && now.Add(leeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token is not valid yet")
+	}
+
+	return nil
+}
+
+// hasAudience determines if the aud claim, which is either a string or a list of them,
+// includes one of the accepted audiences.
+func (v *Verifier) hasAudience(aud interface{}) bool {
+	var auds []string
+	switch a := aud.(type) {
+	case string:
+		auds = []string{a}
+	case []interface{}:
+		for _, s := range a {
+			if s, ok := s.(string); ok {
+				auds = append(auds, s)
+			}
+		}
+	}
+
+	for _, a := range auds {
+		for _, b := range v.audiences {
+			if a == b {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodePart(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// verifySignature verifies an RS256 or ES256 signature of msg.
+func verifySignature(alg string, key crypto.PublicKey, msg string, sig []byte) error {
+	sum := sha256.Sum256([]byte(msg))
+
+	switch alg {
+	case "RS256":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("RS256 token signed with a non-RSA key")
+		}
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig)
+	case "ES256":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return errors.New("invalid ES256 signature")
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, sum[:], r, s) {
+			return errors.New("invalid ES256 signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %q", alg)
+}
+
+// key returns the key with the given id, fetching the key set if it has expired or
+// does not have the key. The key set is fetched without holding the lock, so that a
+// slow issuer only holds up the requests that need the new keys, and a key that has
+// merely expired is used until its replacement arrives.
+func (v *Verifier) key(kid string) (crypto.PublicKey, error) {
+	v.lck.Lock()
+	now := time.Now()
+	k, ok := v.keys[kid]
+	if ok && now.Sub(v.fetched) < v.ttl {
+		v.lck.Unlock()
+		return k, nil
+	}
+
+	// unknown keys only cause a fetch once in a while, so that forged tokens can't be
+	// used to hammer the provider.
+	if !ok && v.keys != nil && now.Sub(v.fetched) < refetchInterval {
+		v.lck.Unlock()
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	// only one request fetches the key set at a time.
+	if wait := v.fetching; wait != nil {
+		v.lck.Unlock()
+		if ok {
+			return k, nil
+		}
+
+		<-wait
+		return v.cachedKey(kid)
+	}
+
+	done := make(chan struct{})
+	v.fetching = done
+	jwksURL := v.jwksURL
+	v.lck.Unlock()
+
+	keys, jwksURL, err := v.fetchKeys(jwksURL)
+
+	v.lck.Lock()
+	v.fetching = nil
+	if err == nil {
+		v.keys, v.fetched, v.jwksURL = keys, now, jwksURL
+	}
+	v.lck.Unlock()
+	close(done)
+
+	if err != nil {
+		return nil, err
+	}
+
+	k, ok = keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return k, nil
+}
+
+// cachedKey returns the key with the given id from the key set that was last fetched.
+func (v *Verifier) cachedKey(kid string) (crypto.PublicKey, error) {
+	v.lck.Lock()
+	defer v.lck.Unlock()
+
+	k, ok := v.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	return k, nil
+}
+
+// getJSON fetches the JSON document at url into dst.
+func (v *Verifier) getJSON(url string, dst interface{}) error {
+	res, err := v.c.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %d", url, res.StatusCode)
+	}
+
+	return json.NewDecoder(res.Body).Decode(dst)
+}
+
+// fetchKeys fetches the key set at jwksURL, discovering the URL first if it is empty,
+// and returns the keys along with the URL they were fetched from.
+func (v *Verifier) fetchKeys(jwksURL string) (map[string]crypto.PublicKey, string, error) {
+	if jwksURL == "" {
+		var d struct {
+			JWKSURL string `json:"jwks_uri"`
+		}
+		if err := v.getJSON(
+			strings.TrimSuffix(v.issuer, "/")+"/.well-known/openid-configuration",
+			&d); err != nil {
+			return nil, "", err
+		}
+
+		if d.JWKSURL == "" {
+			return nil, "", fmt.Errorf("discovery document for %s has no jwks_uri", v.issuer)
+		}
+		jwksURL = d.JWKSURL
+	}
+
+	var set struct {
+		Keys []*jwk `json:"keys"`
+	}
+	if err := v.getJSON(jwksURL, &set); err != nil {
+		return nil, "", err
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		// keys for other uses, or of types that cannot verify tokens, are skipped.
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		if pk, err := k.publicKey(); err == nil {
+			keys[k.Kid] = pk
+		}
+	}
+	return keys, jwksURL, nil
+}
+
+// jwk is the JSON Web Key representation of a public key.
+type jwk struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	dec := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := dec(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := dec(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := dec(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := dec(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
@@ -0,0 +1,140 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kellegous/underpants/assertion"
+	"github.com/kellegous/underpants/user"
+)
+
+// newIssuer serves the discovery document and key set of an issuer that signs with
+// the given signer.
+func newIssuer(t *testing.T, s *assertion.Signer, fetches *int) *httptest.Server {
+	jwks := s.JWKS()
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			fmt.Fprintf(w, `{"jwks_uri": "%s/keys"}`, srv.URL)
+		case "/keys":
+			*fetches++
+			w.Write(jwks)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return srv
+}
+
+func TestVerify(t *testing.T) {
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []crypto.Signer{rk, ek} {
+		var fetches int
+		var srv *httptest.Server
+
+		signer := func(issuer string) *assertion.Signer {
+			s, err := assertion.NewSigner(key, issuer, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		}
+
+		// the issuer's URL is not known until it is serving, but it only serves the
+		// public key which is the same for any issuer.
+		srv = newIssuer(t, signer(""), &fetches)
+		defer srv.Close()
+
+		s := signer(srv.URL)
+		v := NewVerifier(srv.URL, "", []string{"api"}, time.Hour)
+
+		tok, err := s.Sign(&user.Info{Email: "a@a.com", Name: "A"}, "api")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !LooksLike(tok) || LooksLike("upt_abc.def") {
+			t.Fatal("unexpected LooksLike")
+		}
+
+		c, err := v.Verify(tok)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if c.String("", "email") != "a@a.com" || c.String("name", "") != "A" {
+			t.Fatalf("unexpected claims %v", c)
+		}
+
+		other, err := s.Sign(&user.Info{Email: "a@a.com"}, "other")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := v.Verify(other); err == nil {
+			t.Fatal("expected token for another audience to be rejected")
+		}
+
+		forged, err := signer("https://evil.com").Sign(&user.Info{Email: "a@a.com"}, "api")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := v.Verify(forged); err == nil {
+			t.Fatal("expected token from another issuer to be rejected")
+		}
+
+		// the claims of one token with the signature of another.
+		p, q := strings.Split(tok, "."), strings.Split(other, ".")
+		if _, err := v.Verify(p[0] + "." + q[1] + "." + p[2]); err == nil {
+			t.Fatal("expected tampered token to be rejected")
+		}
+
+		if fetches != 1 {
+			t.Fatalf("expected keys to be fetched once, got %d", fetches)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	v := NewVerifier("https://idp.com", "", []string{"api"}, time.Hour)
+	now := time.Now()
+
+	tests := []struct {
+		Claims Claims
+		Valid  bool
+	}{
+		{Claims{"iss": "https://idp.com", "aud": "api", "exp": float64(now.Add(time.Minute).Unix())}, true},
+		{Claims{"iss": "https://idp.com", "aud": []interface{}{"x", "api"}, "exp": float64(now.Add(time.Minute).Unix())}, true},
+		{Claims{"iss": "https://idp.com", "aud": "api"}, false},
+		{Claims{"iss": "https://idp.com", "aud": "api", "exp": float64(now.Add(-time.Hour).Unix())}, false},
+		{Claims{"iss": "https://idp.com", "aud": "api", "exp": float64(now.Add(time.Hour).Unix()),
+			"nbf": float64(now.Add(time.Hour).Unix())}, false},
+	}
+
+	for i, test := range tests {
+		if err := v.check(test.Claims, now); (err == nil) != test.Valid {
+			t.Fatalf("test %d: expected valid: %t, got %v", i, test.Valid, err)
+		}
+	}
+}
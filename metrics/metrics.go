@@ -0,0 +1,320 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds (in seconds) of the buckets of latency
+// histograms.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// family is a set of samples with the same name, which is written as a whole in the
+// Prometheus text format.
+type family interface {
+	write(b *bytes.Buffer)
+}
+
+// Registry holds metrics and serves them in the Prometheus text format.
+type Registry struct {
+	lck      sync.Mutex
+	names    []string
+	families map[string]family
+}
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		families: map[string]family{},
+	}
+}
+
+func (r *Registry) register(name string, f family) {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	r.registerLocked(name, f)
+}
+
+func (r *Registry) registerLocked(name string, f family) {
+	if _, ok := r.families[name]; ok {
+		panic(fmt.Sprintf("metric %s is already registered", name))
+	}
+	r.names = append(r.names, name)
+	r.families[name] = f
+}
+
+// ServeHTTP writes all of the metrics in the Prometheus text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var b bytes.Buffer
+
+	r.lck.Lock()
+	for _, name := range r.names {
+		r.families[name].write(&b)
+	}
+	r.lck.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+// CounterVec is a counter for each combination of the values of its labels.
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	lck    sync.Mutex
+	values map[string]*sample
+}
+
+// sample is the value of a metric for one combination of label values.
+type sample struct {
+	labels []string
+	value  float64
+}
+
+// NewCounterVec registers a counter with the given labels.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: map[string]*sample{},
+	}
+	r.register(name, c)
+	return c
+}
+
+// Inc adds one to the counter with the given label values.
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v to the counter with the given label values.
+func (c *CounterVec) Add(v float64, values ...string) {
+	key := strings.Join(values, "\xff")
+
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	s := c.values[key]
+	if s == nil {
+		s = &sample{labels: pairs(c.labels, values)}
+		c.values[key] = s
+	}
+	s.value += v
+}
+
+func (c *CounterVec) write(b *bytes.Buffer) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	writeHeader(b, c.name, c.help, "counter")
+	for _, key := range keys {
+		s := c.values[key]
+		writeSample(b, c.name, s.labels, s.value)
+	}
+}
+
+// HistogramVec is a histogram for each combination of the values of its labels.
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	lck    sync.Mutex
+	values map[string]*histogram
+}
+
+type histogram struct {
+	labels []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogramVec registers a histogram with the given bucket upper bounds, in
+// increasing order, and labels.
+func (r *Registry) NewHistogramVec(
+	name, help string,
+	buckets []float64,
+	labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  map[string]*histogram{},
+	}
+	r.register(name, h)
+	return h
+}
+
+// Observe adds v to the histogram with the given label values.
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	key := strings.Join(values, "\xff")
+
+	h.lck.Lock()
+	defer h.lck.Unlock()
+
+	s := h.values[key]
+	if s == nil {
+		s = &histogram{
+			labels: pairs(h.labels, values),
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.values[key] = s
+	}
+
+	for i, le := range h.buckets {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *HistogramVec) write(b *bytes.Buffer) {
+	h.lck.Lock()
+	defer h.lck.Unlock()
+
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	writeHeader(b, h.name, h.help, "histogram")
+	for _, key := range keys {
+		s := h.values[key]
+		for i, le := range h.buckets {
+			writeSample(b, h.name+"_bucket",
+				append(s.labels[:len(s.labels):len(s.labels)], "le", formatFloat(le)),
+				float64(s.counts[i]))
+		}
+		writeSample(b, h.name+"_bucket",
+			append(s.labels[:len(s.labels):len(s.labels)], "le", "+Inf"),
+			float64(s.count))
+		writeSample(b, h.name+"_sum", s.labels, s.sum)
+		writeSample(b, h.name+"_count", s.labels, float64(s.count))
+	}
+}
+
+// funcFamily is a metric whose samples are computed as they are scraped.
+type funcFamily struct {
+	name    string
+	help    string
+	typ     string
+	samples []*funcSample
+}
+
+type funcSample struct {
+	labels []string
+	fn     func() float64
+}
+
+// CounterFunc registers a counter whose value is computed by fn when it is scraped.
+// The labels are given as alternating names and values. A counter may be registered
+// more than once with different labels, registering it again with the same labels
+// replaces fn.
+func (r *Registry) CounterFunc(name, help string, fn func() float64, labels ...string) {
+	r.addFunc(name, help, "counter", fn, labels)
+}
+
+// GaugeFunc registers a gauge whose value is computed by fn when it is scraped. The
+// labels are given as alternating names and values. As with CounterFunc, registering
+// it again with the same labels replaces fn.
+func (r *Registry) GaugeFunc(name, help string, fn func() float64, labels ...string) {
+	r.addFunc(name, help, "gauge", fn, labels)
+}
+
+func (r *Registry) addFunc(name, help, typ string, fn func() float64, labels []string) {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+
+	f, ok := r.families[name].(*funcFamily)
+	if !ok {
+		f = &funcFamily{name: name, help: help, typ: typ}
+		r.registerLocked(name, f)
+	}
+
+	for _, s := range f.samples {
+		if strings.Join(s.labels, "\xff") == strings.Join(labels, "\xff") {
+			s.fn = fn
+			return
+		}
+	}
+	f.samples = append(f.samples, &funcSample{labels: labels, fn: fn})
+}
+
+func (f *funcFamily) write(b *bytes.Buffer) {
+	writeHeader(b, f.name, f.help, f.typ)
+	for _, s := range f.samples {
+		writeSample(b, f.name, s.labels, s.fn())
+	}
+}
+
+// pairs interleaves label names and values.
+func pairs(names, values []string) []string {
+	if len(names) != len(values) {
+		panic(fmt.Sprintf("expected %d label values, got %d", len(names), len(values)))
+	}
+
+	p := make([]string, 0, 2*len(names))
+	for i, name := range names {
+		p = append(p, name, values[i])
+	}
+	return p
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+func writeHeader(b *bytes.Buffer, name, help, typ string) {
+	fmt.Fprintf(b, "# HELP %s %s\n", name, helpEscaper.Replace(help))
+	fmt.Fprintf(b, "# TYPE %s %s\n", name, typ)
+}
+
+// writeSample writes a sample, whose labels are alternating names and values.
+func writeSample(b *bytes.Buffer, name string, labels []string, v float64) {
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(b, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(formatFloat(v))
+	b.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
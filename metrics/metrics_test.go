@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	r := NewRegistry()
+
+	c := r.NewCounterVec("requests_total", "Requests.", "route", "code")
+	c.Inc("b.com", "200")
+	c.Inc("a.com", "200")
+	c.Add(2, "a.com", "200")
+
+	h := r.NewHistogramVec("latency_seconds", "Latency.", []float64{.1, 1}, "route")
+	h.Observe(.05, "a.com")
+	h.Observe(.5, "a.com")
+	h.Observe(5, "a.com")
+
+	n := 7
+	r.GaugeFunc("things", "Things.", func() float64 {
+		return float64(n)
+	}, "kind", `a"b`)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	expected := strings.Join([]string{
+		`# HELP requests_total Requests.`,
+		`# TYPE requests_total counter`,
+		`requests_total{route="a.com",code="200"} 3`,
+		`requests_total{route="b.com",code="200"} 1`,
+		`# HELP latency_seconds Latency.`,
+		`# TYPE latency_seconds histogram`,
+		`latency_seconds_bucket{route="a.com",le="0.1"} 1`,
+		`latency_seconds_bucket{route="a.com",le="1"} 2`,
+		`latency_seconds_bucket{route="a.com",le="+Inf"} 3`,
+		`latency_seconds_sum{route="a.com"} 5.55`,
+		`latency_seconds_count{route="a.com"} 3`,
+		`# HELP things Things.`,
+		`# TYPE things gauge`,
+		`things{kind="a\"b"} 7`,
+	}, "\n") + "\n"
+
+	if w.Body.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, w.Body.String())
+	}
+}
+
+func TestDuplicate(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("a", "A.")
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected registering a duplicate metric to panic")
+		}
+	}()
+	r.NewCounterVec("a", "A.")
+}
+
+func TestReplaceFunc(t *testing.T) {
+	r := NewRegistry()
+	r.GaugeFunc("a", "A.", func() float64 { return 1 }, "kind", "x")
+	r.GaugeFunc("a", "A.", func() float64 { return 2 }, "kind", "x")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	expected := "# HELP a A.\n# TYPE a gauge\na{kind=\"x\"} 2\n"
+	if w.Body.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, w.Body.String())
+	}
+}
@@ -0,0 +1,65 @@
+package metrics
+
+const (
+	// AuthAuthenticated is the outcome of requests made by a signed in user.
+	AuthAuthenticated = "authenticated"
+
+	// AuthRedirected is the outcome of requests that were sent to sign in.
+	AuthRedirected = "redirected"
+
+	// AuthDenied is the outcome of requests from users who may not access the route.
+	AuthDenied = "denied"
+)
+
+const (
+	// LoginSucceeded is the outcome of sign ins that created a session.
+	LoginSucceeded = "succeeded"
+
+	// LoginRejected is the outcome of sign ins that were refused.
+	LoginRejected = "rejected"
+)
+
+// Metrics are the metrics underpants exposes.
+type Metrics struct {
+	*Registry
+
+	// Requests counts the requests to each route, by status code.
+	Requests *CounterVec
+
+	// Latency is the time taken to answer requests to each route.
+	Latency *HistogramVec
+
+	// UpstreamErrors counts the requests to each route that were answered with a
+	// 502 or 504 because the backend failed.
+	UpstreamErrors *CounterVec
+
+	// Auth counts the outcome of authenticating the requests to each route.
+	Auth *CounterVec
+
+	// Logins counts sign ins by outcome.
+	Logins *CounterVec
+}
+
+// New creates the metrics underpants exposes.
+func New() *Metrics {
+	r := NewRegistry()
+	return &Metrics{
+		Registry: r,
+		Requests: r.NewCounterVec("underpants_requests_total",
+			"Requests to each route by status code.",
+			"route", "code"),
+		Latency: r.NewHistogramVec("underpants_request_duration_seconds",
+			"Time taken to answer requests to each route.",
+			DefaultBuckets,
+			"route"),
+		UpstreamErrors: r.NewCounterVec("underpants_upstream_errors_total",
+			"Requests to each route that failed because the backend failed.",
+			"route", "code"),
+		Auth: r.NewCounterVec("underpants_auth_total",
+			"Outcome of authenticating requests to each route.",
+			"route", "outcome"),
+		Logins: r.NewCounterVec("underpants_logins_total",
+			"Sign ins by outcome.",
+			"outcome"),
+	}
+}
@@ -1,17 +1,26 @@
 package mux
 
-import "strings"
+import (
+	"net/http"
+	"strings"
+)
 
 // Builder allows the construction of an http.Handler that is able to
 // route based on path and host.
 type Builder struct {
-	hosts map[string]*PathMux
-	any   *PathMux
+	hosts    map[string]*PathMux
+	any      *PathMux
+	every    *PathMux
+	notFound http.Handler
+
+	unknown http.Handler
+	known   map[string]bool
 }
 
 // ForHost creates or gets the PathMux associated with a given host. Note
 // that any ports are stripped from the host so that localhost and localhost:8080
-// are equivalent entries.
+// are equivalent entries. A host of the form *.example.com matches requests to
+// any subdomain that no other host matches.
 func (b *Builder) ForHost(host string) *PathMux {
 	h := hostWithoutPort(host)
 	if m := b.hosts[h]; m != nil {
@@ -28,6 +37,28 @@ func (b *Builder) ForAnyHost() *PathMux {
 	return b.any
 }
 
+// ForEveryHost gets the PathMux that matches a request to any host, including the
+// hosts that are unknown when an UnknownHost handler is set.
+func (b *Builder) ForEveryHost() *PathMux {
+	return b.every
+}
+
+// UnknownHost sets the handler for requests to hosts that are neither registered with
+// ForHost nor one of the known hosts, unless ForEveryHost matches them. If it is not
+// set, requests to unknown hosts are matched by ForAnyHost like any other.
+func (b *Builder) UnknownHost(h http.Handler, known ...string) {
+	b.unknown = h
+	for _, host := range known {
+		b.known[hostWithoutPort(host)] = true
+	}
+}
+
+// NotFound sets the handler for requests that no host or path matches. If it is not
+// set, http.NotFound is used.
+func (b *Builder) NotFound(h http.Handler) {
+	b.notFound = h
+}
+
 // Build constructs an http.Handler that can be used for serving requests.
 // Note that the Builder can no longer be used after Build is called.
 func (b *Builder) Build() *Serve {
@@ -39,11 +70,25 @@ func (b *Builder) Build() *Serve {
 	any := b.any
 	any.build()
 
+	every := b.every
+	every.build()
+
+	notFound := b.notFound
+	if notFound == nil {
+		notFound = http.HandlerFunc(http.NotFound)
+	}
+
+	unknown, known := b.unknown, b.known
+
 	*b = Builder{}
 
 	return &Serve{
-		hosts: hosts,
-		any:   any,
+		hosts:    hosts,
+		any:      any,
+		every:    every,
+		notFound: notFound,
+		unknown:  unknown,
+		known:    known,
 	}
 }
 
@@ -60,5 +105,7 @@ func Create() *Builder {
 	return &Builder{
 		hosts: map[string]*PathMux{},
 		any:   &PathMux{},
+		every: &PathMux{},
+		known: map[string]bool{},
 	}
 }
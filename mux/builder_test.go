@@ -183,3 +183,77 @@ func TestPortStripping(t *testing.T) {
 		t.Fatal("ah was called but shouldn't have been")
 	}
 }
+
+func TestWildcard(t *testing.T) {
+	b := Create()
+
+	var ah handler
+	b.ForHost("a.tools.com").Handle("/", &ah)
+
+	var wh handler
+	b.ForHost("*.tools.com").Handle("/", &wh)
+
+	s := b.Build()
+
+	rw := newResponseWriter()
+	s.ServeHTTP(rw, requestTo("b.tools.com:8080", "/"))
+	if !wh.WasCalled() || ah.WasCalled() {
+		t.Fatal("expected b.tools.com to be served by the wildcard")
+	}
+
+	resetAll(&ah, &wh, rw)
+	s.ServeHTTP(rw, requestTo("a.tools.com", "/"))
+	if !ah.WasCalled() || wh.WasCalled() {
+		t.Fatal("expected a.tools.com to be served by its own host")
+	}
+
+	for _, host := range []string{"tools.com", "c.b.tools.com"} {
+		resetAll(&ah, &wh, rw)
+		s.ServeHTTP(rw, requestTo(host, "/"))
+		if rw.status != http.StatusNotFound {
+			t.Fatalf("expected status 404 for %s, got %d", host, rw.status)
+		}
+	}
+}
+
+func TestUnknownHost(t *testing.T) {
+	b := Create()
+
+	var ah handler
+	b.ForHost("a.com").Handle("/foo", &ah)
+
+	var eh handler
+	b.ForEveryHost().Handle("/healthz", &eh)
+
+	var uh handler
+	b.UnknownHost(&uh, "hub.com")
+
+	s := b.Build()
+
+	rw := newResponseWriter()
+	s.ServeHTTP(rw, requestTo("c.com", "/"))
+	if !uh.WasCalled() {
+		t.Fatal("uh should have been called but wasn't")
+	}
+
+	resetAll(&ah, &eh, &uh, rw)
+	s.ServeHTTP(rw, requestTo("c.com", "/healthz"))
+	if !eh.WasCalled() {
+		t.Fatal("eh should have been called but wasn't")
+	}
+	if uh.WasCalled() {
+		t.Fatal("uh was called but shouldn't have been")
+	}
+
+	// known hosts are never handed to the unknown host handler.
+	for _, host := range []string{"a.com", "hub.com"} {
+		resetAll(&ah, &eh, &uh, rw)
+		s.ServeHTTP(rw, requestTo(host, "/bar"))
+		if rw.status != http.StatusNotFound {
+			t.Fatalf("expected status 404 for %s, got %d", host, rw.status)
+		}
+		if uh.WasCalled() {
+			t.Fatalf("uh was called for %s but shouldn't have been", host)
+		}
+	}
+}
@@ -1,25 +1,59 @@
 package mux
 
-import "net/http"
+import (
+	"net/http"
+	"strings"
+)
 
 // Serve ...
 type Serve struct {
-	hosts map[string]*PathMux
-	any   *PathMux
+	hosts    map[string]*PathMux
+	any      *PathMux
+	every    *PathMux
+	notFound http.Handler
+
+	unknown http.Handler
+	known   map[string]bool
 }
 
 func (s *Serve) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if hh := s.hosts[hostWithoutPort(r.Host)]; hh != nil {
+	host := hostWithoutPort(r.Host)
+	hh := s.forHost(host)
+	if hh != nil {
 		if ph := hh.findHandler(r.URL.Path); ph != nil {
 			ph.ServeHTTP(w, r)
 			return
 		}
 	}
 
+	if ph := s.every.findHandler(r.URL.Path); ph != nil {
+		ph.ServeHTTP(w, r)
+		return
+	}
+
+	if hh == nil && s.unknown != nil && !s.known[host] {
+		s.unknown.ServeHTTP(w, r)
+		return
+	}
+
 	if ph := s.any.findHandler(r.URL.Path); ph != nil {
 		ph.ServeHTTP(w, r)
 		return
 	}
 
-	http.NotFound(w, r)
+	s.notFound.ServeHTTP(w, r)
+}
+
+// forHost finds the PathMux for host, falling back to that of a wildcard host, such
+// as *.example.com, which matches any single label in place of the *.
+func (s *Serve) forHost(host string) *PathMux {
+	if hh := s.hosts[host]; hh != nil {
+		return hh
+	}
+
+	if ix := strings.IndexByte(host, '.'); ix > 0 {
+		return s.hosts["*"+host[ix:]]
+	}
+
+	return nil
 }
@@ -0,0 +1,377 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kellegous/underpants/audit"
+	"github.com/kellegous/underpants/auth"
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/internal"
+	"github.com/kellegous/underpants/jwt"
+	"github.com/kellegous/underpants/metrics"
+	"github.com/kellegous/underpants/session"
+	"github.com/kellegous/underpants/user"
+
+	"go.uber.org/zap"
+)
+
+// clientIP is the address of the client that made the request.
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// clientCertUser is the identity in the verified client certificate presented with
+// the request, or nil if there is none. The certificate's first email address is
+// used, falling back to its common name.
+func clientCertUser(r *http.Request) *user.Info {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+
+	crt := r.TLS.VerifiedChains[0][0]
+	email := crt.Subject.CommonName
+	if len(crt.EmailAddresses) > 0 {
+		email = crt.EmailAddresses[0]
+	}
+
+	if email == "" {
+		return nil
+	}
+
+	return &user.Info{
+		Email:             email,
+		EmailVerified:     true,
+		Name:              crt.Subject.CommonName,
+		LastAuthenticated: time.Now(),
+		Provider:          user.ProviderClientCert,
+	}
+}
+
+// sessions is the session manager for the route, whose sessions last for the route's
+// session max-age if it has one.
+func (b *Backend) sessions() *session.Manager {
+	if s := b.Route.Session; s != nil && s.MaxAge > 0 {
+		return b.Ctx.Sessions.WithMaxAge(time.Duration(s.MaxAge) * time.Second)
+	}
+	return b.Ctx.Sessions
+}
+
+// checkSignIn returns an error if the user signed in with the identity provider too
+// long ago to be let in to the route, or to the path of the rule if one is given,
+// without signing in again.
+func (b *Backend) checkSignIn(u *user.Info, rule *config.PathRuleInfo, now time.Time) error {
+	age := now.Sub(u.SignedIn())
+	if s := b.Route.Session; s != nil && s.ReauthAfter > 0 &&
+		age >= time.Duration(s.ReauthAfter)*time.Second {
+		return fmt.Errorf("route requires signing in again after %ds", s.ReauthAfter)
+	}
+
+	if rule != nil && rule.StepUp > 0 && age >= time.Duration(rule.StepUp)*time.Second {
+		return fmt.Errorf("path %s requires signing in within %ds", rule.Path, rule.StepUp)
+	}
+
+	return nil
+}
+
+// authenticate returns the signed in user. If there is none, the user is sent to
+// authenticate and false is returned. Clients with a trusted certificate, an API
+// token, a JWT from the identity provider or one of the route's API keys are signed
+// in as that identity, unless the route requires a particular provider.
+func (b *Backend) authenticate(w http.ResponseWriter, r *http.Request) (*user.Info, bool) {
+	if u := clientCertUser(r); u != nil && b.Route.Provider == "" {
+		b.Ctx.Metrics.Auth.Inc(b.Route.From, metrics.AuthAuthenticated)
+		return u, true
+	}
+
+	if tok := session.BearerToken(r); tok != "" && b.Route.Provider == "" {
+		return b.authenticateToken(w, r, tok)
+	}
+
+	if tok := bearerJWT(r); tok != "" && b.Ctx.JWT != nil && b.Route.Provider == "" {
+		return b.authenticateJWT(w, r, tok)
+	}
+
+	if k := b.Route.APIKeys; k != nil && b.Route.Provider == "" {
+		if key := r.Header.Get(k.Header); key != "" {
+			return b.authenticateAPIKey(w, r, key)
+		}
+	}
+
+	u, err := b.sessions().FromRequest(w, r)
+	if err != nil {
+		if v := b.refresh(w, r); v != nil {
+			u, err = v, nil
+		}
+	}
+
+	if err == nil && b.Route.Provider != "" && u.Provider != b.Route.Provider {
+		// the user must sign in again with the provider this route requires.
+		err = fmt.Errorf("route requires provider %s", b.Route.Provider)
+	}
+
+	// users who must sign in again are asked to enter their credentials, lest the
+	// identity provider sign them straight back in.
+	login := false
+	if err == nil {
+		if err = b.checkSignIn(u, b.Route.PathRuleFor(r.URL.Path), time.Now()); err != nil {
+			login = true
+		}
+	}
+
+	if err != nil {
+		n := b.loopCount(r) + 1
+		if limit := b.Ctx.MaxAuthRedirects; limit > 0 && n > limit {
+			b.serveAuthLoop(w, r, n, err)
+			return nil, false
+		}
+
+		zap.L().Info("authentication required",
+			zap.String("host", r.Host),
+			zap.String("uri", r.RequestURI),
+			zap.String("reason", err.Error()))
+		b.setLoopCount(w, n)
+		b.Ctx.Metrics.Auth.Inc(b.Route.From, metrics.AuthRedirected)
+		ar := r
+		if login {
+			ar = auth.WithLogin(r)
+		}
+
+		http.Redirect(w, r,
+			b.AuthProvider.GetAuthURL(b.Ctx, ar),
+			http.StatusFound)
+		return nil, false
+	}
+
+	b.Ctx.Metrics.Auth.Inc(b.Route.From, metrics.AuthAuthenticated)
+	return u, true
+}
+
+// authenticateToken returns the user identified by the API token. API clients cannot
+// sign in, so they are refused rather than redirected if the token is not valid.
+func (b *Backend) authenticateToken(
+	w http.ResponseWriter,
+	r *http.Request,
+	tok string) (*user.Info, bool) {
+	u, err := b.Ctx.Sessions.DecodeAPIToken(tok, b.Route.From)
+	if err != nil {
+		zap.L().Info("access denied (invalid api token)",
+			zap.String("from", b.Route.From),
+			zap.String("uri", r.RequestURI),
+			zap.Error(err))
+		b.Ctx.Audit.Record(r, audit.AccessDenied, "", err.Error())
+		b.Ctx.Metrics.Auth.Inc(b.Route.From, metrics.AuthDenied)
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w,
+			http.StatusText(http.StatusUnauthorized),
+			http.StatusUnauthorized)
+		return nil, false
+	}
+
+	b.Ctx.Metrics.Auth.Inc(b.Route.From, metrics.AuthAuthenticated)
+	return u, true
+}
+
+// bearerJWT returns the JWT presented as a bearer token with the request, or "" if
+// there is none.
+func bearerJWT(r *http.Request) string {
+	v := r.Header.Get("Authorization")
+	if !strings.HasPrefix(v, "Bearer ") || !jwt.LooksLike(v[len("Bearer "):]) {
+		return ""
+	}
+	return v[len("Bearer "):]
+}
+
+// authenticateJWT returns the user identified by a JWT from the identity provider.
+// Clients presenting tokens are refused rather than redirected if it is not valid.
+func (b *Backend) authenticateJWT(
+	w http.ResponseWriter,
+	r *http.Request,
+	tok string) (*user.Info, bool) {
+	c, err := b.Ctx.JWT.Verify(tok)
+	if err == nil && c.String(b.Ctx.Info.JWT.Claims.Email, "email") == "" {
+		err = errors.New("token has no email")
+	}
+
+	if err != nil {
+		zap.L().Info("access denied (invalid jwt)",
+			zap.String("from", b.Route.From),
+			zap.String("uri", r.RequestURI),
+			zap.Error(err))
+		b.Ctx.Audit.Record(r, audit.AccessDenied, "", err.Error())
+		b.Ctx.Metrics.Auth.Inc(b.Route.From, metrics.AuthDenied)
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w,
+			http.StatusText(http.StatusUnauthorized),
+			http.StatusUnauthorized)
+		return nil, false
+	}
+
+	m := &b.Ctx.Info.JWT.Claims
+	u := &user.Info{
+		Email:             c.String(m.Email, "email"),
+		EmailVerified:     c.Bool(m.EmailVerified, "email_verified"),
+		Name:              c.String(m.Name, "name"),
+		Picture:           c.String(m.Picture, "picture"),
+		LastAuthenticated: time.Now(),
+		Provider:          user.ProviderJWT,
+	}
+
+	if err := b.checkJWTUser(u, c.String("", "hd")); err != nil {
+		zap.L().Info("access denied (jwt user not permitted)",
+			zap.String("from", b.Route.From),
+			zap.String("user", u.Email),
+			zap.Error(err))
+		b.Ctx.Audit.Record(r, audit.AccessDenied, u.Email, err.Error())
+		b.Ctx.Metrics.Auth.Inc(b.Route.From, metrics.AuthDenied)
+		http.Error(w,
+			http.StatusText(http.StatusForbidden),
+			http.StatusForbidden)
+		return nil, false
+	}
+
+	b.Ctx.Metrics.Auth.Inc(b.Route.From, metrics.AuthAuthenticated)
+	return u, true
+}
+
+// checkJWTUser applies the checks the hub makes of users as they sign in to the user
+// of a JWT, since tokens from the identity provider never pass through the hub. hd is
+// the token's hosted domain claim, without it the domain of a verified email is used.
+func (b *Backend) checkJWTUser(u *user.Info, hd string) error {
+	o := &b.Ctx.ForHost(b.Route.Host()).Oauth
+	if o.RequireVerifiedEmail && !u.EmailVerified {
+		return errors.New("email not verified")
+	}
+
+	if len(o.AllowedDomains()) == 0 {
+		return nil
+	}
+
+	if hd == "" && u.EmailVerified {
+		if i := strings.LastIndex(u.Email, "@"); i >= 0 {
+			hd = u.Email[i+1:]
+		}
+	}
+
+	// guests are matched by email, so theirs must have been verified.
+	if o.HasDomain(hd) || (u.EmailVerified && o.IsGuest(u.Email)) {
+		return nil
+	}
+
+	return fmt.Errorf("user %s is not in an allowed domain", u.Email)
+}
+
+// authenticateAPIKey returns the identity of the route's API key that matches the
+// key presented. Clients with keys are not redirected to sign in.
+func (b *Backend) authenticateAPIKey(
+	w http.ResponseWriter,
+	r *http.Request,
+	key string) (*user.Info, bool) {
+	k := b.Route.APIKeys.Lookup(key)
+	if k == nil {
+		zap.L().Info("access denied (invalid api key)",
+			zap.String("from", b.Route.From),
+			zap.String("uri", r.RequestURI))
+		b.Ctx.Audit.Record(r, audit.AccessDenied, "", "invalid api key")
+		b.Ctx.Metrics.Auth.Inc(b.Route.From, metrics.AuthDenied)
+		http.Error(w,
+			http.StatusText(http.StatusUnauthorized),
+			http.StatusUnauthorized)
+		return nil, false
+	}
+
+	name := k.Name
+	if name == "" {
+		name = k.Email
+	}
+
+	b.Ctx.Metrics.Auth.Inc(b.Route.From, metrics.AuthAuthenticated)
+	return &user.Info{
+		Email:             k.Email,
+		EmailVerified:     true,
+		Name:              name,
+		LastAuthenticated: time.Now(),
+		Provider:          user.ProviderAPIKey,
+	}, true
+}
+
+// MayAccess determines if the user passes the route's groups and its allow and deny
+// lists. The checks that need a lookup, required-groups and the authz webhook, are
+// not made, so the user may still be refused.
+func (b *Backend) MayAccess(u *user.Info) bool {
+	return b.Ctx.UserInDomain(u.Email, b.Route.Host()) &&
+		b.Ctx.UserMemberOfAny(u.Email, b.Route.AllowedGroups) &&
+		b.Ctx.UserAllowedOnRoute(u.Email, b.Route)
+}
+
+// checkAccess determines if the user may access the route and, if a rule is given,
+// the path the rule covers. If not, a response is written and false is returned.
+func (b *Backend) checkAccess(
+	w http.ResponseWriter,
+	r *http.Request,
+	u *user.Info,
+	rule *config.PathRuleInfo) bool {
+	if !b.Ctx.UserInDomain(u.Email, b.Route.Host()) {
+		b.serveForbidden(w, r, u,
+			"Your account is not in a domain authorized to view this site.")
+		return false
+	}
+
+	if !b.Ctx.UserMemberOfAny(u.Email, b.Route.AllowedGroups) {
+		b.serveForbidden(w, r, u,
+			"You are not a member of a group authorized to view this site.")
+		return false
+	}
+
+	if !b.Ctx.UserAllowedOnRoute(u.Email, b.Route) {
+		b.serveForbidden(w, r, u,
+			"You are not on the list of users authorized to view this site.")
+		return false
+	}
+
+	if rule != nil {
+		if len(rule.AllowedGroups) > 0 && !b.Ctx.UserMemberOfAny(u.Email, rule.AllowedGroups) {
+			b.serveForbidden(w, r, u,
+				"You are not a member of a group authorized to view this page.")
+			return false
+		}
+
+		if !b.Ctx.UserAllowed(u.Email, rule.Allow, rule.Deny) {
+			b.serveForbidden(w, r, u,
+				"You are not on the list of users authorized to view this page.")
+			return false
+		}
+	}
+
+	if len(b.Route.RequiredGroups) > 0 {
+		ok, err := b.Ctx.Directory.IsMemberOfAny(u.Email, b.Route.RequiredGroups)
+		if err != nil {
+			zap.L().Error("unable to look up google groups",
+				zap.String("user", u.Email),
+				zap.Error(err))
+			internal.ServeErrorPage(b.Ctx, w, r, &internal.ErrorPage{
+				Status:  http.StatusServiceUnavailable,
+				Message: "Your group memberships could not be checked. Please try again in a little while.",
+				Route:   b.Route.From,
+				Email:   u.Email,
+			}, nil)
+			return false
+		}
+
+		if !ok {
+			b.serveForbidden(w, r, u,
+				"You are not a member of a Google Group authorized to view this site.")
+			return false
+		}
+	}
+
+	return b.authorize(w, r, u)
+}
@@ -0,0 +1,716 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kellegous/underpants/assertion"
+	"github.com/kellegous/underpants/auth"
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/jwt"
+	"github.com/kellegous/underpants/user"
+)
+
+// stubProvider sends every user to the same auth URL.
+type stubProvider struct{}
+
+func (p *stubProvider) Validate(cfg *config.Info) error {
+	return nil
+}
+
+func (p *stubProvider) GetAuthURL(ctx *config.Context, r *http.Request) string {
+	return "http://hub.com/auth"
+}
+
+func (p *stubProvider) Authenticate(ctx *config.Context, r *http.Request) (*user.Info, *url.URL, error) {
+	return nil, nil, fmt.Errorf("not implemented")
+}
+
+// loginProvider is a stubProvider whose auth URL shows if the user must enter their
+// credentials.
+type loginProvider struct {
+	stubProvider
+}
+
+func (p *loginProvider) GetAuthURL(ctx *config.Context, r *http.Request) string {
+	return fmt.Sprintf("http://hub.com/auth?login=%t", auth.RequiresLogin(r))
+}
+
+func TestPathRules(t *testing.T) {
+	var email string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		email = r.Header.Get("Underpants-Email")
+	}))
+	defer s.Close()
+
+	b := backendFor(t, fmt.Sprintf(`{
+		"from": "a.com",
+		"to": "%s",
+		"paths": [
+			{"path": "/public/*", "public": true},
+			{"path": "/admin/*", "allow": ["admin@a.com"]}
+		]
+	}`, s.URL))
+	b.AuthProvider = &stubProvider{}
+
+	cookie := func(email string) *http.Cookie {
+		v, err := b.Ctx.Sessions.Encode(&user.Info{
+			Email:             email,
+			LastAuthenticated: time.Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &http.Cookie{Name: user.CookieKey, Value: v}
+	}
+
+	tests := []struct {
+		Path   string
+		User   string
+		Status int
+	}{
+		{"/public/x", "", http.StatusOK},
+		{"/public/x", "a@a.com", http.StatusOK},
+		{"/x", "", http.StatusFound},
+		{"/x", "a@a.com", http.StatusOK},
+		{"/admin/x", "a@a.com", http.StatusForbidden},
+		{"/admin/x", "admin@a.com", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		email = ""
+
+		r := httptest.NewRequest("GET", "http://a.com"+test.Path, nil)
+		// clients cannot pass themselves off as someone else.
+		r.Header.Set("Underpants-Email", "admin@a.com")
+		if test.User != "" {
+			r.AddCookie(cookie(test.User))
+		}
+
+		w := httptest.NewRecorder()
+		b.serveHTTPProxy(w, r)
+
+		if w.Code != test.Status {
+			t.Fatalf("%s as %q: expected status %d, got %d",
+				test.Path, test.User, test.Status, w.Code)
+		}
+
+		if w.Code == http.StatusOK && email != url.QueryEscape(test.User) {
+			t.Fatalf("%s as %q: backend saw user %q", test.Path, test.User, email)
+		}
+	}
+}
+
+func TestIPRestriction(t *testing.T) {
+	b := backendFor(t, `{"from": "a.com", "to": "http://localhost:1", "ip-allow": ["10.0.0.0/8"]}`)
+	b.AuthProvider = &stubProvider{}
+
+	r := httptest.NewRequest("GET", "http://a.com/", nil)
+	r.RemoteAddr = "192.168.0.1:1234"
+
+	w := httptest.NewRecorder()
+	b.serveHTTPProxy(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %d", http.StatusForbidden, w.Code)
+	}
+
+	r = httptest.NewRequest("GET", "http://a.com/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+
+	w = httptest.NewRecorder()
+	b.serveHTTPProxy(w, r)
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected allowed address to be sent to sign in, got %d", w.Code)
+	}
+}
+
+func TestClientCertAuthentication(t *testing.T) {
+	var email string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		email = r.Header.Get("Underpants-Email")
+	}))
+	defer s.Close()
+
+	b := backendFor(t, fmt.Sprintf(`{"from": "a.com", "to": "%s", "allow": ["*@a.com"]}`, s.URL))
+	b.AuthProvider = &stubProvider{}
+
+	verified := func(crt *x509.Certificate) *tls.ConnectionState {
+		return &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{crt}},
+		}
+	}
+
+	tests := []struct {
+		TLS    *tls.ConnectionState
+		Status int
+		Email  string
+	}{
+		{nil, http.StatusFound, ""},
+		{&tls.ConnectionState{}, http.StatusFound, ""},
+		{verified(&x509.Certificate{
+			Subject:        pkix.Name{CommonName: "kiosk"},
+			EmailAddresses: []string{"kiosk@a.com"},
+		}), http.StatusOK, "kiosk@a.com"},
+		{verified(&x509.Certificate{
+			Subject: pkix.Name{CommonName: "kiosk@b.com"},
+		}), http.StatusForbidden, ""},
+	}
+
+	for i, test := range tests {
+		email = ""
+
+		r := httptest.NewRequest("GET", "https://a.com/", nil)
+		r.TLS = test.TLS
+
+		w := httptest.NewRecorder()
+		b.serveHTTPProxy(w, r)
+
+		if w.Code != test.Status {
+			t.Fatalf("test %d: expected status %d, got %d", i, test.Status, w.Code)
+		}
+
+		if email != url.QueryEscape(test.Email) {
+			t.Fatalf("test %d: expected backend to see %q, got %q", i, test.Email, email)
+		}
+	}
+}
+
+func TestAPITokenAuthentication(t *testing.T) {
+	var email, authz string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		email, authz = r.Header.Get("Underpants-Email"), r.Header.Get("Authorization")
+	}))
+	defer s.Close()
+
+	b := backendFor(t, fmt.Sprintf(`{"from": "a.com", "to": "%s", "allow": ["*@a.com"]}`, s.URL))
+	b.AuthProvider = &stubProvider{}
+
+	token := func(email, route string) string {
+		tok, err := b.Ctx.Sessions.NewAPIToken(email, []string{route}, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "Bearer " + tok
+	}
+
+	tests := []struct {
+		Authz  string
+		Status int
+		Email  string
+	}{
+		{"", http.StatusFound, ""},
+		{"Bearer upt_forged.sig", http.StatusUnauthorized, ""},
+		{token("ci@a.com", "b.com"), http.StatusUnauthorized, ""},
+		{token("ci@b.com", "a.com"), http.StatusForbidden, ""},
+		{token("ci@a.com", "a.com"), http.StatusOK, "ci@a.com"},
+	}
+
+	for i, test := range tests {
+		email, authz = "", ""
+
+		r := httptest.NewRequest("GET", "http://a.com/", nil)
+		if test.Authz != "" {
+			r.Header.Set("Authorization", test.Authz)
+		}
+
+		w := httptest.NewRecorder()
+		b.serveHTTPProxy(w, r)
+
+		if w.Code != test.Status {
+			t.Fatalf("test %d: expected status %d, got %d", i, test.Status, w.Code)
+		}
+
+		if email != url.QueryEscape(test.Email) {
+			t.Fatalf("test %d: expected backend to see %q, got %q", i, test.Email, email)
+		}
+
+		if authz != "" {
+			t.Fatalf("test %d: expected api token to be stripped, got %q", i, authz)
+		}
+	}
+}
+
+func TestAPIKeyAuthentication(t *testing.T) {
+	var email, key string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		email, key = r.Header.Get("Underpants-Email"), r.Header.Get("X-Key")
+	}))
+	defer s.Close()
+
+	// the key is "s3cret".
+	b := backendFor(t, fmt.Sprintf(`{
+		"from": "a.com",
+		"to": "%s",
+		"allow": ["*@a.com"],
+		"api-keys": {
+			"header": "x-key",
+			"keys": [{"sha256": "1ec1c26b50d5d3c58d9583181af8076655fe00756bf7285940ba3670f99fcba0", "email": "cron@a.com"}]
+		}
+	}`, s.URL))
+	b.AuthProvider = &stubProvider{}
+
+	tests := []struct {
+		Key    string
+		Status int
+		Email  string
+	}{
+		{"", http.StatusFound, ""},
+		{"wrong", http.StatusUnauthorized, ""},
+		{"s3cret", http.StatusOK, "cron@a.com"},
+	}
+
+	for i, test := range tests {
+		email, key = "", ""
+
+		r := httptest.NewRequest("GET", "http://a.com/", nil)
+		if test.Key != "" {
+			r.Header.Set("X-Key", test.Key)
+		}
+
+		w := httptest.NewRecorder()
+		b.serveHTTPProxy(w, r)
+
+		if w.Code != test.Status {
+			t.Fatalf("test %d: expected status %d, got %d", i, test.Status, w.Code)
+		}
+
+		if email != url.QueryEscape(test.Email) {
+			t.Fatalf("test %d: expected backend to see %q, got %q", i, test.Email, email)
+		}
+
+		if key != "" {
+			t.Fatalf("test %d: expected api key to be stripped, got %q", i, key)
+		}
+	}
+}
+
+func TestJWTAuthentication(t *testing.T) {
+	var email string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		email = r.Header.Get("Underpants-Email")
+	}))
+	defer s.Close()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := assertion.NewSigner(key, "https://idp.com", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks := signer.JWKS()
+
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jwks)
+	}))
+	defer idp.Close()
+
+	b := backendFor(t, fmt.Sprintf(`{"from": "a.com", "to": "%s", "allow": ["*@a.com"]}`, s.URL))
+	b.AuthProvider = &stubProvider{}
+	b.Ctx.Info.JWT = &config.JWTInfo{Issuer: "https://idp.com", Audiences: []string{"api"}}
+	b.Ctx.JWT = jwt.NewVerifier("https://idp.com", idp.URL, []string{"api"}, time.Hour)
+
+	token := func(email, aud string) string {
+		tok, err := signer.Sign(&user.Info{Email: email}, aud)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "Bearer " + tok
+	}
+
+	tests := []struct {
+		Authz  string
+		Status int
+		Email  string
+	}{
+		{"Bearer opaque", http.StatusFound, ""},
+		{token("a@a.com", "other"), http.StatusUnauthorized, ""},
+		{token("a@b.com", "api"), http.StatusForbidden, ""},
+		{token("a@a.com", "api"), http.StatusOK, "a@a.com"},
+	}
+
+	for i, test := range tests {
+		email = ""
+
+		r := httptest.NewRequest("GET", "http://a.com/", nil)
+		r.Header.Set("Authorization", test.Authz)
+
+		w := httptest.NewRecorder()
+		b.serveHTTPProxy(w, r)
+
+		if w.Code != test.Status {
+			t.Fatalf("test %d: expected status %d, got %d", i, test.Status, w.Code)
+		}
+
+		if email != url.QueryEscape(test.Email) {
+			t.Fatalf("test %d: expected backend to see %q, got %q", i, test.Email, email)
+		}
+	}
+}
+
+// signClaims signs the claims with key, in place of those of tok, a token signed with
+// the same key whose header is kept.
+func signClaims(t *testing.T, key *ecdsa.PrivateKey, tok string, claims map[string]interface{}) string {
+	body, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := strings.Split(tok, ".")[0] + "." + base64.RawURLEncoding.EncodeToString(body)
+	sum := sha256.Sum256([]byte(msg))
+	r, ss, err := ecdsa.Sign(rand.Reader, key, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	ss.FillBytes(sig[32:])
+	return msg + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTSignInChecks(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer s.Close()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := assertion.NewSigner(key, "https://idp.com", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks := signer.JWKS()
+
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jwks)
+	}))
+	defer idp.Close()
+
+	proto, err := signer.Sign(&user.Info{Email: "a@a.com"}, "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := func(email, hd string, verified bool) string {
+		now := time.Now()
+		c := map[string]interface{}{
+			"iss":            "https://idp.com",
+			"aud":            "api",
+			"iat":            now.Unix(),
+			"exp":            now.Add(time.Minute).Unix(),
+			"email":          email,
+			"email_verified": verified,
+		}
+		if hd != "" {
+			c["hd"] = hd
+		}
+		return "Bearer " + signClaims(t, key, proto, c)
+	}
+
+	backend := func(oauth string) *Backend {
+		var cfg config.Info
+		if err := cfg.Read(strings.NewReader(fmt.Sprintf(`{
+			"oauth": %s,
+			"routes": [{"from": "a.com", "to": "%s"}]
+		}`, oauth, s.URL))); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, err := config.BuildContext(&cfg, 80, []byte("key"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx.Info.JWT = &config.JWTInfo{Issuer: "https://idp.com", Audiences: []string{"api"}}
+		ctx.JWT = jwt.NewVerifier("https://idp.com", idp.URL, []string{"api"}, time.Hour)
+
+		return &Backend{Ctx: ctx, Route: cfg.Routes[0], AuthProvider: &stubProvider{}}
+	}
+
+	domain := backend(`{"client-id": "id", "client-secret": "secret", "domain": "a.com"}`)
+	verified := backend(`{"client-id": "id", "client-secret": "secret", "require-verified-email": true}`)
+
+	tests := []struct {
+		Backend *Backend
+		Authz   string
+		Status  int
+	}{
+		{domain, token("a@a.com", "a.com", false), http.StatusOK},
+		{domain, token("a@a.com", "", true), http.StatusOK},
+		{domain, token("a@b.com", "b.com", true), http.StatusForbidden},
+		{domain, token("a@b.com", "", true), http.StatusForbidden},
+		// the email's domain is only trusted if the email has been verified.
+		{domain, token("a@a.com", "", false), http.StatusForbidden},
+		{verified, token("a@b.com", "", true), http.StatusOK},
+		{verified, token("a@b.com", "", false), http.StatusForbidden},
+	}
+
+	for i, test := range tests {
+		r := httptest.NewRequest("GET", "http://a.com/", nil)
+		r.Header.Set("Authorization", test.Authz)
+
+		w := httptest.NewRecorder()
+		test.Backend.serveHTTPProxy(w, r)
+		if w.Code != test.Status {
+			t.Fatalf("test %d: expected status %d, got %d", i, test.Status, w.Code)
+		}
+	}
+}
+
+func TestIdentityAssertion(t *testing.T) {
+	var token string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token = r.Header.Get("Underpants-Assertion")
+	}))
+	defer s.Close()
+
+	b := backendFor(t, fmt.Sprintf(`{"from": "a.com", "to": "%s"}`, s.URL))
+	b.AuthProvider = &stubProvider{}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.Ctx.Assertion = &config.AssertionInfo{Header: "Underpants-Assertion"}
+	b.Ctx.Assertions, err = assertion.NewSigner(key, "http://hub.com", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := b.Ctx.Sessions.Encode(&user.Info{
+		Email:             "a@a.com",
+		LastAuthenticated: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "http://a.com/", nil)
+	r.Header.Set("Underpants-Assertion", "forged")
+	r.AddCookie(&http.Cookie{Name: user.CookieKey, Value: v})
+
+	w := httptest.NewRecorder()
+	b.serveHTTPProxy(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("expected a signed assertion, got %q", token)
+	}
+
+	c, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(c), `"email":"a@a.com"`) ||
+		!strings.Contains(string(c), `"aud":"a.com"`) {
+		t.Fatalf("unexpected claims %s", c)
+	}
+}
+
+func TestForwardGroups(t *testing.T) {
+	var groups, token string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		groups = r.Header.Get("Underpants-Groups")
+		token = r.Header.Get("Underpants-Assertion")
+	}))
+	defer s.Close()
+
+	var cfg config.Info
+	if err := cfg.Read(strings.NewReader(fmt.Sprintf(`{
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"groups": {"eng": ["a@a.com"], "on call": ["a@a.com"], "hr": ["b@a.com"]},
+		"routes": [{"from": "a.com", "to": "%s", "forward-groups": true, "allowed-groups": ["*"]}]
+	}`, s.URL))); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := config.BuildContext(&cfg, 80, []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx.Assertion = &config.AssertionInfo{Header: "Underpants-Assertion"}
+	ctx.Assertions, err = assertion.NewSigner(key, "http://hub.com", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Backend{
+		Ctx:          ctx,
+		Route:        cfg.Routes[0],
+		AuthProvider: &stubProvider{},
+	}
+
+	v, err := b.Ctx.Sessions.Encode(&user.Info{
+		Email:             "a@a.com",
+		LastAuthenticated: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "http://a.com/", nil)
+	r.Header.Set("Underpants-Groups", "hr")
+	r.AddCookie(&http.Cookie{Name: user.CookieKey, Value: v})
+
+	w := httptest.NewRecorder()
+	b.serveHTTPProxy(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	if groups != "eng,on+call" {
+		t.Fatalf("expected groups eng,on+call, got %q", groups)
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("expected a signed assertion, got %q", token)
+	}
+
+	c, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(c), `"groups":["eng","on call"]`) {
+		t.Fatalf("expected groups claim, got %s", c)
+	}
+}
+
+func TestRouteSession(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer s.Close()
+
+	b := backendFor(t, fmt.Sprintf(`{
+		"from": "a.com",
+		"to": "%s",
+		"session": {"max-age": 604800, "reauth-after": 28800}
+	}`, s.URL))
+	b.AuthProvider = &stubProvider{}
+
+	if c := b.sessions().NewCookie("v"); c.MaxAge != 604800 {
+		t.Fatalf("expected cookie max-age of 604800, got %d", c.MaxAge)
+	}
+
+	now := time.Now()
+	tests := []struct {
+		Name     string
+		Authed   time.Time
+		SignedIn time.Time
+		Status   int
+	}{
+		{"longer than the cookie", now.Add(-2 * time.Hour), time.Time{}, http.StatusOK},
+		{"expired", now.Add(-8 * 24 * time.Hour), time.Time{}, http.StatusFound},
+		{"refreshed", now.Add(-10 * time.Minute), now.Add(-7 * time.Hour), http.StatusOK},
+		{"reauth", now.Add(-10 * time.Minute), now.Add(-9 * time.Hour), http.StatusFound},
+	}
+
+	for _, test := range tests {
+		v, err := b.Ctx.Sessions.Encode(&user.Info{
+			Email:             "a@a.com",
+			LastAuthenticated: test.Authed,
+			LastSignIn:        test.SignedIn,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := httptest.NewRequest("GET", "http://a.com/", nil)
+		r.AddCookie(&http.Cookie{Name: user.CookieKey, Value: v})
+
+		w := httptest.NewRecorder()
+		b.serveHTTPProxy(w, r)
+
+		if w.Code != test.Status {
+			t.Fatalf("%s: expected status %d, got %d", test.Name, test.Status, w.Code)
+		}
+	}
+}
+
+func TestStepUp(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer s.Close()
+
+	b := backendFor(t, fmt.Sprintf(`{
+		"from": "a.com",
+		"to": "%s",
+		"paths": [{"path": "/admin/*", "step-up": 300}]
+	}`, s.URL))
+	b.AuthProvider = &loginProvider{}
+
+	now := time.Now()
+	tests := []struct {
+		Path     string
+		SignedIn time.Time
+		Location string
+	}{
+		{"/x", now.Add(-30 * time.Minute), ""},
+		{"/admin/x", now.Add(-time.Minute), ""},
+		{"/admin/x", now.Add(-30 * time.Minute), "http://hub.com/auth?login=true"},
+		{"/admin/x", time.Time{}, "http://hub.com/auth?login=false"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "http://a.com"+test.Path, nil)
+		if !test.SignedIn.IsZero() {
+			v, err := b.Ctx.Sessions.Encode(&user.Info{
+				Email:             "a@a.com",
+				LastAuthenticated: now.Add(-time.Minute),
+				LastSignIn:        test.SignedIn,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.AddCookie(&http.Cookie{Name: user.CookieKey, Value: v})
+		}
+
+		w := httptest.NewRecorder()
+		b.serveHTTPProxy(w, r)
+
+		if test.Location == "" {
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s signed in at %s: expected status 200, got %d",
+					test.Path, test.SignedIn, w.Code)
+			}
+			continue
+		}
+
+		if w.Code != http.StatusFound || w.Header().Get("Location") != test.Location {
+			t.Fatalf("%s signed in at %s: expected redirect to %s, got %d %s",
+				test.Path, test.SignedIn, test.Location, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/kellegous/underpants/config"
+
+	"go.uber.org/zap"
+)
+
+// allowFileInterval is how often a route's allow-file is checked for changes.
+var allowFileInterval = 5 * time.Second
+
+// allowFileWatcher reloads a route's allow-file as it changes.
+type allowFileWatcher struct {
+	stop chan struct{}
+}
+
+// newAllowFileWatcher creates the watcher of a route's allow-file, which is nil if
+// the route does not have one.
+func newAllowFileWatcher(route *config.RouteInfo) *allowFileWatcher {
+	if route.AllowFile == "" {
+		return nil
+	}
+
+	return &allowFileWatcher{
+		stop: make(chan struct{}),
+	}
+}
+
+// watchAllowFile reloads the route's allow-file each time it changes, until the
+// backend is closed.
+func (b *Backend) watchAllowFile() {
+	w := b.allowFile
+	if w == nil {
+		return
+	}
+
+	t := time.NewTicker(allowFileInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+		case <-w.stop:
+			return
+		}
+
+		changed, err := b.Route.ReloadAllowFile()
+		if err != nil {
+			zap.L().Error("unable to reload allow-file, keeping its previous entries",
+				zap.String("from", b.Route.From),
+				zap.String("file", b.Route.AllowFile),
+				zap.Error(err))
+			continue
+		}
+
+		if changed {
+			zap.L().Info("allow-file reloaded",
+				zap.String("from", b.Route.From),
+				zap.String("file", b.Route.AllowFile))
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/kellegous/underpants/internal"
+	"github.com/kellegous/underpants/user"
+
+	"go.uber.org/zap"
+)
+
+// authorize asks the authz webhook, if one is configured, whether the user may make
+// the request. If not, a response is written and false is returned.
+func (b *Backend) authorize(w http.ResponseWriter, r *http.Request, u *user.Info) bool {
+	if b.Ctx.Authz == nil {
+		return true
+	}
+
+	d, err := b.Ctx.Authz.Decide(u, b.Route.From, r.Method, r.URL.Path)
+	if err != nil {
+		zap.L().Error("authz webhook failed",
+			zap.String("from", b.Route.From),
+			zap.String("user", u.Email),
+			zap.Bool("fail-open", b.Ctx.AuthzWebhook.FailOpen),
+			zap.Error(err))
+
+		if b.Ctx.AuthzWebhook.FailOpen {
+			return true
+		}
+
+		internal.ServeErrorPage(b.Ctx, w, r, &internal.ErrorPage{
+			Status:  http.StatusServiceUnavailable,
+			Message: "Your request could not be authorized. Please try again in a little while.",
+			Route:   b.Route.From,
+			Email:   u.Email,
+		}, nil)
+		return false
+	}
+
+	if !d.Allow {
+		reason := d.Reason
+		if reason == "" {
+			reason = "You are not authorized to make this request."
+		}
+		b.serveForbidden(w, r, u, reason)
+		return false
+	}
+
+	return true
+}
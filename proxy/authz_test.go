@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kellegous/underpants/authz"
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/user"
+)
+
+func TestAuthorizeFailPolicy(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	defer s.Close()
+
+	for _, failOpen := range []bool{true, false} {
+		b := backendFor(t, `{"from": "a.com", "to": "http://localhost:1"}`)
+		b.Ctx.AuthzWebhook = &config.AuthzWebhookInfo{
+			URL:      s.URL,
+			FailOpen: failOpen,
+		}
+		b.Ctx.Authz = authz.NewWebhook(s.URL, 0, 0)
+
+		w := httptest.NewRecorder()
+		ok := b.authorize(w, httptest.NewRequest("GET", "http://a.com/", nil),
+			&user.Info{Email: "a@a.com"})
+		if ok != failOpen {
+			t.Fatalf("fail-open %t: expected authorize to return %t", failOpen, failOpen)
+		}
+
+		if !failOpen && w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("expected status %d, got %d", http.StatusServiceUnavailable, w.Code)
+		}
+	}
+}
+
+func TestAuthorizeDenied(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"allow": false, "reason": "not on the project"}`)
+	}))
+	defer s.Close()
+
+	b := backendFor(t, `{"from": "a.com", "to": "http://localhost:1"}`)
+	b.Ctx.AuthzWebhook = &config.AuthzWebhookInfo{URL: s.URL}
+	b.Ctx.Authz = authz.NewWebhook(s.URL, 0, 0)
+
+	w := httptest.NewRecorder()
+	if b.authorize(w, httptest.NewRequest("GET", "http://a.com/", nil),
+		&user.Info{Email: "a@a.com"}) {
+		t.Fatal("expected request to be denied")
+	}
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %d", http.StatusForbidden, w.Code)
+	}
+}
@@ -1,13 +1,21 @@
 package proxy
 
 import (
+	"errors"
 	"io"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
+	"github.com/kellegous/underpants/accesslog"
+	"github.com/kellegous/underpants/audit"
 	"github.com/kellegous/underpants/auth"
 	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/internal"
+	"github.com/kellegous/underpants/metrics"
+	"github.com/kellegous/underpants/session"
+	"github.com/kellegous/underpants/signature"
 	"github.com/kellegous/underpants/user"
 
 	"go.uber.org/zap"
@@ -20,6 +28,52 @@ type Backend struct {
 	Route *config.RouteInfo
 
 	AuthProvider auth.Provider
+
+	capture *capture
+
+	failover *failover
+
+	balancer *balancer
+
+	health *health
+
+	resolver *resolver
+
+	allowFile *allowFileWatcher
+
+	retry *retry
+
+	breaker *breaker
+
+	limiter *Limiter
+
+	concurrency *concurrency
+
+	maintenance *maintenance
+
+	mirror *mirror
+
+	transport http.RoundTripper
+}
+
+// ArmCapture enables body capture for the next n requests to this backend. It fails
+// if the route is not configured for body capture.
+func (b *Backend) ArmCapture(n int) error {
+	if b.capture == nil {
+		return errors.New("body capture is not configured for this route")
+	}
+
+	b.capture.arm(n)
+	return nil
+}
+
+// CaptureRemaining is the number of requests that will still have their bodies
+// captured.
+func (b *Backend) CaptureRemaining() int {
+	if b.capture == nil {
+		return 0
+	}
+	return b.capture.Remaining()
 }
 
 // Copy the HTTP headers from one collection to another.
@@ -32,90 +86,326 @@ func copyHeaders(dst, src http.Header) {
 }
 
 func (b *Backend) serveHTTPAuth(w http.ResponseWriter, r *http.Request) {
+	// p must be a path on this host, not a protocol relative URL of another one.
 	c, p := r.FormValue("c"), r.FormValue("p")
-	if c == "" || !strings.HasPrefix(p, "/") {
+	if c == "" ||
+		!strings.HasPrefix(p, "/") ||
+		strings.HasPrefix(p, "//") ||
+		strings.HasPrefix(p, "/\\") {
 		http.Error(w,
 			http.StatusText(http.StatusBadRequest),
 			http.StatusBadRequest)
 		return
 	}
 
-	// verify the cookie
-	if _, err := user.DecodeAndVerify(c, b.Ctx.Key); err != nil {
+	// exchange the code for the session it hands off.
+	v, _, err := b.Ctx.Sessions.RedeemHandoff(c)
+	if err != nil {
+		b.Ctx.Audit.Record(r, audit.InvalidSignature, "", err.Error())
+
 		// do not redirect out of here because this indicates a big
 		// problem and we're likely to get into a redir loop.
-		http.Error(w,
-			http.StatusText(http.StatusForbidden),
-			http.StatusForbidden)
+		internal.ServeErrorPage(b.Ctx, w, r, &internal.ErrorPage{
+			Status:  http.StatusForbidden,
+			Message: "Your sign in could not be completed. Please try again.",
+			Route:   b.Route.From,
+		}, nil)
 		return
 	}
 
-	http.SetCookie(w, user.CreateCookie(c, b.Ctx.HasCerts()))
+	http.SetCookie(w, b.sessions().NewCookie(v))
+	b.resetLoopCount(w)
 
 	// Redirect validates the redirect path.
 	http.Redirect(w, r, p, http.StatusFound)
 }
 
 func (b *Backend) serveHTTPProxy(w http.ResponseWriter, r *http.Request) {
-	u, err := user.DecodeFromRequest(r, b.Ctx.Key)
-	if err != nil {
-		zap.L().Info("authentication required",
-			zap.String("host", r.Host),
-			zap.String("uri", r.RequestURI))
-		http.Redirect(w, r,
-			b.AuthProvider.GetAuthURL(b.Ctx, r),
-			http.StatusFound)
+	if b.InMaintenance() {
+		b.serveMaintenance(w, r)
 		return
 	}
 
-	if !b.Ctx.UserMemberOfAny(u.Email, b.Route.AllowedGroups) {
-		zap.L().Info("access denied (not in group)",
+	if b.Route.CORS != nil && isPreflight(r) {
+		b.servePreflight(w, r)
+		return
+	}
+	b.setCORSHeaders(w, r)
+
+	if !b.Route.AllowsMethod(r.Method) {
+		zap.L().Info("method not allowed",
 			zap.String("from", b.Route.From),
-			zap.String("user", u.Email))
+			zap.String("method", r.Method))
+		w.Header().Set("Allow", b.Route.AllowHeader())
 		http.Error(w,
-			"Forbidden: you are not a member of a group authorized to view this site.",
-			http.StatusForbidden)
+			http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !b.Route.AllowsIP(clientIP(r)) {
+		zap.L().Info("access denied (address not allowed)",
+			zap.String("from", b.Route.From),
+			zap.String("addr", r.RemoteAddr))
+		b.Ctx.Audit.Record(r, audit.AccessDenied, "", "address not allowed")
+		b.Ctx.Metrics.Auth.Inc(b.Route.From, metrics.AuthDenied)
+		internal.ServeErrorPage(b.Ctx, w, r, &internal.ErrorPage{
+			Status:  http.StatusForbidden,
+			Message: "Your network address is not permitted to view " + r.Host + ".",
+			Route:   b.Route.From,
+		}, nil)
+		return
+	}
+
+	var u *user.Info
+	if rule := b.Route.PathRuleFor(r.URL.Path); rule != nil && rule.Public {
+		// users who happen to be signed in are still identified to the backend.
+		if v, err := b.sessions().FromRequest(w, r); err == nil {
+			u = v
+		}
+	} else {
+		var ok bool
+		if u, ok = b.authenticate(w, r); !ok {
+			return
+		}
+
+		if !b.checkAccess(w, r, u, rule) {
+			return
+		}
+	}
+
+	if u != nil {
+		accesslog.SetUser(r, u.Email)
+
+		if u.Impersonator != "" {
+			b.Ctx.Audit.RecordImpersonated(r, audit.ImpersonatedAccess, u.Email, u.Impersonator, "")
+		}
+	}
+
+	if b.Route.Redirect != 0 {
+		b.serveRedirect(w, r)
 		return
 	}
 
-	rebase, err := b.Route.ToURL().Parse(
-		strings.TrimLeft(r.URL.RequestURI(), "/"))
+	if l := b.limiter; l != nil {
+		key := rateLimitKey(r, u)
+		if ok, after := l.Allow(key, time.Now()); !ok {
+			b.serveRateLimited(w, r, key, after)
+			return
+		}
+	}
+
+	if b.breaker != nil {
+		if ok, after := b.breaker.allow(time.Now()); !ok {
+			b.serveUnavailable(w, r, after)
+			return
+		}
+	}
+
+	if max := b.Route.MaxBodyBytes; max > 0 {
+		if r.ContentLength > max {
+			b.serveTooLarge(w, r)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, max)
+	}
+
+	// websockets would hold their slot for as long as they are open.
+	upgrade := isWebSocketUpgrade(r)
+	if c := b.concurrency; c != nil && !upgrade {
+		if err := c.acquire(r.Context()); err != nil {
+			b.serveOverloaded(w, r, err)
+			return
+		}
+		defer c.release()
+	}
+
+	st := &proxyState{in: r, user: u}
+	// the body of an upgraded connection has to stay writable, so it is not captured.
+	if b.capture != nil && !upgrade && b.capture.take() {
+		st.reqBody, st.resBody = b.capture.newBuffer(), b.capture.newBuffer()
+	}
+
+	r = withState(r, st)
+	if st.reqBody != nil {
+		r.Body = newTeeBody(r.Body, st.reqBody)
+	}
+
+	b.reverseProxy().ServeHTTP(w, r)
+}
+
+// backendURL is the URL of the request on the backend at base, with the route's path
+// prefixes stripped and added.
+func (b *Backend) backendURL(r *http.Request, base *url.URL) (*url.URL, error) {
+	uri := r.URL.RequestURI()
+	if s, ok := trimPathPrefix(uri, b.Route.StrippedPrefix()); ok {
+		uri = s
+	}
+	uri = b.Route.AddPrefix + uri
+
+	return b.Route.TargetFor(base, r.Host).Parse(
+		strings.TrimLeft(uri, "/"))
+}
+
+// newBackendRequest creates the request that is sent to the backend at base on behalf
+// of the user.
+func (b *Backend) newBackendRequest(
+	r *http.Request,
+	base *url.URL,
+	body io.Reader,
+	u *user.Info) (*http.Request, error) {
+	rebase, err := b.backendURL(r, base)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	br, err := http.NewRequest(r.Method, rebase.String(), r.Body)
+	br, err := http.NewRequestWithContext(r.Context(), r.Method, rebase.String(), body)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
+	setSocketHost(br, b.Route)
+
 	// Without passing on the original Content-Length, http.Client will use
 	// Transfer-Encoding: chunked which some HTTP servers fall down on.
 	br.ContentLength = r.ContentLength
 
+	// gRPC and other streaming clients may send trailers after the body.
+	br.Trailer = r.Trailer
+
 	copyHeaders(br.Header, r.Header)
+	b.filterCookies(br.Header)
+	applyHeaderRules(br.Header, b.Route.RequestHeaders)
+
+	// User information is passed to backends as headers, which clients (and header
+	// rules) must not be able to supply themselves. Requests for public paths may
+	// have no user.
+	b.stripIdentityHeaders(br.Header)
 
-	// User information is passed to backends as headers.
-	br.Header.Add("Underpants-Email", url.QueryEscape(u.Email))
-	br.Header.Add("Underpants-Name", url.QueryEscape(u.Name))
+	// API tokens and keys are only for underpants, backends must not be able to replay
+	// them.
+	if session.BearerToken(br) != "" {
+		br.Header.Del("Authorization")
+	}
+
+	if k := b.Route.APIKeys; k != nil {
+		br.Header.Del(k.Header)
+	}
+
+	// backends behind a stripped prefix need it to build their own URLs.
+	if p := b.Route.StrippedPrefix(); p != "" {
+		br.Header.Set("X-Forwarded-Prefix", p)
+	}
+
+	a := b.Ctx.Assertion
+
+	var email string
+	if u != nil {
+		email = u.Email
+		br.Header.Add("Underpants-Email", url.QueryEscape(u.Email))
+		br.Header.Add("Underpants-Name", url.QueryEscape(u.Name))
+		if u.Impersonator != "" {
+			br.Header.Add("Underpants-Impersonator", url.QueryEscape(u.Impersonator))
+		}
+
+		var groups []string
+		if b.Route.ForwardGroups {
+			var err error
+			if groups, err = b.Ctx.UserGroups(u.Email); err != nil {
+				return nil, err
+			}
+
+			names := make([]string, len(groups))
+			for i, g := range groups {
+				names[i] = url.QueryEscape(g)
+			}
+			br.Header.Add("Underpants-Groups", strings.Join(names, ","))
+		}
+
+		// the plain headers can only be trusted by backends that cannot be reached
+		// directly, the signed assertion can be verified by any backend.
+		if a != nil {
+			t, err := b.Ctx.Assertions.SignWithGroups(u, b.Route.From, groups)
+			if err != nil {
+				return nil, err
+			}
+			br.Header.Set(a.Header, t)
+		}
+	}
+
+	if key := b.Route.SigningKey(); key != nil {
+		if err := signature.Sign(br, key); err != nil {
+			return nil, err
+		}
+	}
 
 	zap.L().Info("proxying request",
 		zap.String("from", b.Route.From),
 		zap.String("uri", r.RequestURI),
 		zap.String("dest", rebase.String()),
-		zap.String("user", u.Email))
+		zap.String("user", email))
 
-	bp, err := http.DefaultTransport.RoundTrip(br)
+	return br, nil
+}
+
+// roundTrip sends the request to the backend, retrying it and failing over to other
+// backends if the route is configured to do so. A copy is sent to the route's shadow
+// backend if it is mirrored.
+func (b *Backend) roundTrip(r *http.Request, u *user.Info, body io.ReadCloser) (*http.Response, error) {
+	body, err := b.sendMirror(r, u, body)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer bp.Body.Close()
 
-	copyHeaders(w.Header(), bp.Header)
-	w.WriteHeader(bp.StatusCode)
-	if _, err := io.Copy(w, bp.Body); err != nil {
-		panic(err)
+	if b.retry == nil || !b.retry.applies(r) {
+		return b.roundTripOnce(r, u, body)
 	}
+
+	return b.retry.roundTrip(b, r, func() (*http.Response, error) {
+		return b.roundTripOnce(r, u, http.NoBody)
+	})
+}
+
+// roundTripOnce sends the request to the backend, failing over to other backends or
+// balancing over them if the route is configured to do so. Users in the route's canary
+// are sent to its canary backend instead.
+func (b *Backend) roundTripOnce(r *http.Request, u *user.Info, body io.ReadCloser) (*http.Response, error) {
+	if b.inCanary(r, u) {
+		br, err := b.newBackendRequest(r, b.Route.Canary.ToURL(), body, u)
+		if err != nil {
+			return nil, err
+		}
+		return b.roundTripper().RoundTrip(br)
+	}
+
+	if b.failover != nil {
+		return b.failover.roundTrip(b, r, u, body)
+	}
+
+	if b.balancer != nil {
+		return b.balancer.roundTrip(b, r, u, body)
+	}
+
+	br, err := b.newBackendRequest(r, b.Route.ToURL(), body, u)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.roundTripper().RoundTrip(br)
+}
+
+// logCapture logs the redacted request and response bodies captured for a request.
+func (b *Backend) logCapture(r *http.Request, status int, req, res *limitedBuffer) {
+	zap.L().Info("body capture",
+		zap.String("from", b.Route.From),
+		zap.String("method", r.Method),
+		zap.String("uri", r.RequestURI),
+		zap.Int("status", status),
+		zap.String("request-body", b.capture.sanitize(req)),
+		zap.Bool("request-truncated", req.Truncated()),
+		zap.String("response-body", b.capture.sanitize(res)),
+		zap.Bool("response-truncated", res.Truncated()),
+		zap.Int("remaining", b.capture.Remaining()))
 }
 
 func (b *Backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -125,3 +415,18 @@ func (b *Backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		b.serveHTTPProxy(w, r)
 	}
 }
+
+// serveUnknownHost serves a request for a host that is not routed, on behalf of the
+// default route. Users cannot sign in on such hosts, so only public paths are served.
+func (b *Backend) serveUnknownHost(w http.ResponseWriter, r *http.Request) {
+	if rule := b.Route.PathRuleFor(r.URL.Path); rule == nil || !rule.Public {
+		internal.ServeErrorPage(b.Ctx, w, r, &internal.ErrorPage{
+			Status:  http.StatusNotFound,
+			Message: "There is nothing here.",
+			Route:   b.Route.From,
+		}, nil)
+		return
+	}
+
+	b.serveHTTPProxy(w, r)
+}
@@ -0,0 +1,335 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/user"
+)
+
+// affinityCookieKey is the name of the cookie that pins a client to one of the
+// backends of a route with cookie affinity.
+const affinityCookieKey = "u_backend"
+
+// upstream is one of the backends of a balanced route.
+type upstream struct {
+	url *url.URL
+
+	// host is the Host requests to the upstream are sent with when it is not the
+	// host of url, as is the case for upstreams found by address.
+	host string
+
+	// id identifies the upstream in affinity cookies without revealing its URL.
+	id string
+
+	// weight is the upstream's share of requests relative to the other upstreams.
+	weight int
+
+	// active is the number of requests to the upstream that are in progress.
+	active int64
+}
+
+// balancer spreads the requests to a route over its backends.
+type balancer struct {
+	lck       sync.RWMutex
+	upstreams []*upstream
+
+	leastConns bool
+	weighted   bool
+	affinity   string
+
+	// next is the number of requests that have been balanced, which determines the
+	// next upstream in round-robin order.
+	next uint64
+}
+
+// newBalancer creates the balancer for a route, which is nil if the route has a single
+// backend that is not resolved.
+func newBalancer(route *config.RouteInfo) *balancer {
+	urls := route.ToURLs()
+	if len(urls) < 2 && !route.IsResolved() {
+		return nil
+	}
+
+	lb := &balancer{
+		leastConns: route.Balance == config.BalanceLeastConnections,
+		weighted:   len(route.Weights) > 0,
+		affinity:   route.Affinity,
+	}
+
+	var ups []*upstream
+	for i, u := range urls {
+		up := &upstream{url: u, weight: 1}
+		if lb.weighted {
+			up.weight = route.Weights[i]
+		}
+		ups = append(ups, up)
+	}
+	lb.update(ups)
+
+	return lb
+}
+
+// update replaces the balancer's upstreams. Upstreams that were already in rotation
+// keep their requests in progress.
+func (lb *balancer) update(ups []*upstream) {
+	lb.lck.Lock()
+	defer lb.lck.Unlock()
+
+	current := map[string]*upstream{}
+	for _, up := range lb.upstreams {
+		current[up.url.String()] = up
+	}
+
+	lb.upstreams = nil
+	for _, up := range ups {
+		if c := current[up.url.String()]; c != nil {
+			up = c
+		} else {
+			sum := sha256.Sum256([]byte(up.url.String()))
+			up.id = hex.EncodeToString(sum[:8])
+		}
+		lb.upstreams = append(lb.upstreams, up)
+	}
+}
+
+// current is the balancer's upstreams.
+func (lb *balancer) current() []*upstream {
+	lb.lck.RLock()
+	defer lb.lck.RUnlock()
+	return lb.upstreams
+}
+
+// urls are the URLs of the balancer's upstreams.
+func (lb *balancer) urls() []*url.URL {
+	var urls []*url.URL
+	for _, up := range lb.current() {
+		urls = append(urls, up.url)
+	}
+	return urls
+}
+
+// acquire picks the upstream for a request from those that are healthy and have a
+// weight, which must be released once the request is complete. If there are none, the
+// healthy upstreams without weight are candidates and, failing that, all of them are. Users are kept on the same upstream if the route has affinity.
+func (lb *balancer) acquire(
+	r *http.Request,
+	u *user.Info,
+	healthy func(*url.URL) bool) *upstream {
+	n := atomic.AddUint64(&lb.next, 1) - 1
+
+	// candidates are in round-robin order, starting with this request's turn.
+	ups := lb.current()
+	var candidates, reserves []*upstream
+	for i := range ups {
+		up := ups[(n+uint64(i))%uint64(len(ups))]
+		if !healthy(up.url) {
+			continue
+		}
+
+		if up.weight > 0 {
+			candidates = append(candidates, up)
+		} else {
+			reserves = append(reserves, up)
+		}
+	}
+
+	if len(candidates) == 0 {
+		candidates = reserves
+	}
+
+	if len(candidates) == 0 {
+		candidates = ups
+	}
+
+	up := lb.pinned(r, u, candidates)
+	if up == nil {
+		up = lb.balance(candidates)
+	}
+
+	atomic.AddInt64(&up.active, 1)
+	return up
+}
+
+// pinned returns the candidate the user is pinned to, nil if they are not pinned to
+// any of them.
+func (lb *balancer) pinned(r *http.Request, u *user.Info, candidates []*upstream) *upstream {
+	switch lb.affinity {
+	case config.AffinityCookie:
+		c, err := r.Cookie(affinityCookieKey)
+		if err != nil {
+			return nil
+		}
+
+		for _, up := range candidates {
+			if up.id == c.Value {
+				return up
+			}
+		}
+	case config.AffinityEmail:
+		if u == nil {
+			return nil
+		}
+
+		// rendezvous hashing moves only the users of an upstream that leaves
+		// rotation.
+		var pin *upstream
+		var max uint64
+		email := strings.ToLower(u.Email)
+		for _, up := range candidates {
+			sum := sha256.Sum256([]byte(up.id + email))
+			if w := binary.BigEndian.Uint64(sum[:]); pin == nil || w > max {
+				pin, max = up, w
+			}
+		}
+		return pin
+	}
+
+	return nil
+}
+
+// balance picks one of the candidates according to the route's balance and the
+// weights of the candidates.
+func (lb *balancer) balance(candidates []*upstream) *upstream {
+	up := candidates[0]
+	if !lb.leastConns {
+		if lb.weighted {
+			return pickWeighted(candidates)
+		}
+		return up
+	}
+
+	// the upstream with the fewest requests in progress for its weight wins, ties are
+	// broken in round-robin order.
+	w, min := weightOf(up), atomic.LoadInt64(&up.active)
+	for _, c := range candidates[1:] {
+		if a := atomic.LoadInt64(&c.active); a*w < min*weightOf(c) {
+			up, w, min = c, weightOf(c), a
+		}
+	}
+	return up
+}
+
+// weightOf is the weight of the upstream, where upstreams that have no weight, and are
+// only candidates when there are no others, count as having a weight of 1.
+func weightOf(up *upstream) int64 {
+	if up.weight <= 0 {
+		return 1
+	}
+	return int64(up.weight)
+}
+
+// pickWeighted picks one of the candidates at random, in proportion to their weights.
+func pickWeighted(candidates []*upstream) *upstream {
+	var total int64
+	for _, c := range candidates {
+		total += weightOf(c)
+	}
+
+	n := rand.Int63n(total)
+	for _, c := range candidates {
+		if n -= weightOf(c); n < 0 {
+			return c
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// setHost sets the Host of a request to the upstream, if it is not that of its URL.
+func (up *upstream) setHost(br *http.Request) {
+	if up.host != "" {
+		br.Host = up.host
+	}
+}
+
+// setHost sets the Host of a request to the upstream at base, if it is not that of
+// base.
+func (lb *balancer) setHost(br *http.Request, base *url.URL) {
+	for _, up := range lb.current() {
+		if up.url.String() == base.String() {
+			up.setHost(br)
+			return
+		}
+	}
+}
+
+// release marks a request to the upstream as complete.
+func (lb *balancer) release(up *upstream) {
+	atomic.AddInt64(&up.active, -1)
+}
+
+// releaseBody is a response body that releases its upstream when it is closed, since
+// the request is in progress until the response has been read.
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// releaseConn is the releaseBody of an upgraded connection, which the reverse proxy
+// also writes to.
+type releaseConn struct {
+	*releaseBody
+	w io.Writer
+}
+
+func (c *releaseConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func (lb *balancer) roundTrip(
+	b *Backend,
+	r *http.Request,
+	u *user.Info,
+	body io.ReadCloser) (*http.Response, error) {
+	up := lb.acquire(r, u, b.isHealthy)
+
+	br, err := b.newBackendRequest(r, up.url, body, u)
+	if err != nil {
+		lb.release(up)
+		return nil, err
+	}
+	up.setHost(br)
+
+	// clients that are not yet pinned to this upstream are told to stick with it.
+	if lb.affinity == config.AffinityCookie {
+		if c, err := r.Cookie(affinityCookieKey); err != nil || c.Value != up.id {
+			stateFrom(r).affinity = up.id
+		}
+	}
+
+	bp, err := b.roundTripper().RoundTrip(br)
+	if err != nil {
+		lb.release(up)
+		return nil, err
+	}
+
+	rb := &releaseBody{
+		ReadCloser: bp.Body,
+		release: func() {
+			lb.release(up)
+		},
+	}
+
+	if w, ok := bp.Body.(io.Writer); ok && bp.StatusCode == http.StatusSwitchingProtocols {
+		bp.Body = &releaseConn{releaseBody: rb, w: w}
+	} else {
+		bp.Body = rb
+	}
+	return bp, nil
+}
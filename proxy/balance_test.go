@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/kellegous/underpants/user"
+)
+
+func TestRoundRobin(t *testing.T) {
+	var hits []string
+	newServer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits = append(hits, name)
+		}))
+	}
+
+	a, b2 := newServer("a"), newServer("b")
+	defer a.Close()
+	defer b2.Close()
+
+	b := backendFor(t, fmt.Sprintf(`{
+		"from": "a.com",
+		"to": ["%s", "%s"],
+		"paths": [{"path": "/*", "public": true}]
+	}`, a.URL, b2.URL))
+	b.AuthProvider = &stubProvider{}
+	b.balancer = newBalancer(b.Route)
+
+	for i := 0; i < 4; i++ {
+		w := httptest.NewRecorder()
+		b.serveHTTPProxy(w, httptest.NewRequest("GET", "http://a.com/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+	}
+
+	if fmt.Sprint(hits) != "[a b a b]" {
+		t.Fatalf("expected requests to alternate, got %v", hits)
+	}
+
+	for _, up := range b.balancer.upstreams {
+		if up.active != 0 {
+			t.Fatalf("expected all requests to be released, %s has %d",
+				up.url, up.active)
+		}
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	b := backendFor(t, `{
+		"from": "a.com",
+		"to": ["http://a:8080", "http://b:8080", "http://c:8080"],
+		"balance": "least-connections"
+	}`)
+
+	lb := newBalancer(b.Route)
+
+	var ups []*upstream
+	for i := 0; i < 3; i++ {
+		ups = append(ups, lb.acquire(nil, nil, alwaysHealthy))
+	}
+
+	// b is the only idle backend once its request completes, even though it is a's
+	// turn in round-robin order.
+	lb.release(ups[1])
+	if up := lb.acquire(nil, nil, alwaysHealthy); up.url.Host != "b:8080" {
+		t.Fatalf("expected b, got %s", up.url.Host)
+	}
+
+	// all are equally busy now, so the tie goes to the next in round-robin order.
+	if up := lb.acquire(nil, nil, alwaysHealthy); up.url.Host != "b:8080" {
+		t.Fatalf("expected b, got %s", up.url.Host)
+	}
+}
+
+// alwaysHealthy considers every backend healthy.
+func alwaysHealthy(u *url.URL) bool {
+	return true
+}
+
+func TestAffinity(t *testing.T) {
+	var hits []string
+	newServer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits = append(hits, name)
+		}))
+	}
+
+	a, c := newServer("a"), newServer("c")
+	defer a.Close()
+	defer c.Close()
+
+	b := backendFor(t, fmt.Sprintf(`{
+		"from": "a.com",
+		"to": ["%s", "%s"],
+		"paths": [{"path": "/*", "public": true}],
+		"affinity": "cookie"
+	}`, a.URL, c.URL))
+	b.AuthProvider = &stubProvider{}
+	b.balancer = newBalancer(b.Route)
+
+	// the first request is balanced as usual and pins the client to c.
+	b.balancer.next = 1
+	w := httptest.NewRecorder()
+	b.serveHTTPProxy(w, httptest.NewRequest("GET", "http://a.com/", nil))
+
+	var pin *http.Cookie
+	for _, ck := range w.Result().Cookies() {
+		if ck.Name == affinityCookieKey {
+			pin = ck
+		}
+	}
+
+	if pin == nil {
+		t.Fatal("expected an affinity cookie")
+	}
+
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest("GET", "http://a.com/", nil)
+		r.AddCookie(pin)
+
+		w := httptest.NewRecorder()
+		b.serveHTTPProxy(w, r)
+
+		if len(w.Result().Cookies()) != 0 {
+			t.Fatalf("pinned clients should not be sent the cookie again")
+		}
+	}
+
+	if fmt.Sprint(hits) != "[c c c c]" {
+		t.Fatalf("expected the client to stick to c, got %v", hits)
+	}
+}
+
+func TestEmailAffinity(t *testing.T) {
+	b := backendFor(t, `{
+		"from": "a.com",
+		"to": ["http://a:8080", "http://b:8080", "http://c:8080"],
+		"affinity": "email"
+	}`)
+
+	lb := newBalancer(b.Route)
+
+	pins := map[string]string{}
+	used := map[string]bool{}
+	for i := 0; i < 30; i++ {
+		email := fmt.Sprintf("%d@a.com", i)
+		up := lb.acquire(nil, &user.Info{Email: email}, alwaysHealthy)
+		pins[email] = up.url.Host
+		used[up.url.Host] = true
+	}
+
+	if len(used) != 3 {
+		t.Fatalf("expected users to be spread over all backends, got %v", used)
+	}
+
+	for email, host := range pins {
+		if up := lb.acquire(nil, &user.Info{Email: email}, alwaysHealthy); up.url.Host != host {
+			t.Fatalf("%s moved from %s to %s", email, host, up.url.Host)
+		}
+	}
+
+	// only the users of a backend that leaves rotation move.
+	healthy := func(u *url.URL) bool {
+		return u.Host != "b:8080"
+	}
+
+	for email, host := range pins {
+		up := lb.acquire(nil, &user.Info{Email: email}, healthy)
+		if host != "b:8080" && up.url.Host != host {
+			t.Fatalf("%s moved from %s to %s", email, host, up.url.Host)
+		}
+
+		if up.url.Host == "b:8080" {
+			t.Fatalf("%s was sent to an unhealthy backend", email)
+		}
+	}
+}
+
+func TestWeights(t *testing.T) {
+	b := backendFor(t, `{
+		"from": "a.com",
+		"to": ["http://a:8080", "http://b:8080", "http://c:8080"],
+		"weights": [3, 1, 0]
+	}`)
+
+	lb := newBalancer(b.Route)
+
+	counts := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		up := lb.acquire(nil, nil, alwaysHealthy)
+		counts[up.url.Host]++
+		lb.release(up)
+	}
+
+	if counts["c:8080"] != 0 {
+		t.Fatalf("expected no requests to c, got %d", counts["c:8080"])
+	}
+
+	if a := counts["a:8080"]; a < 2800 || a > 3200 {
+		t.Fatalf("expected about 3000 requests to a, got %d", a)
+	}
+
+	// backends without weight are still used when nothing else is healthy.
+	up := lb.acquire(nil, nil, func(u *url.URL) bool {
+		return u.Host == "c:8080"
+	})
+	if up.url.Host != "c:8080" {
+		t.Fatalf("expected c when it is the only healthy backend, got %s", up.url.Host)
+	}
+}
@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"html/template"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/internal"
+
+	"go.uber.org/zap"
+)
+
+var unavailableTmpl = template.Must(template.New("unavailable").Parse(`<!DOCTYPE html>
+<html>
+  <head>
+    <title>Temporarily unavailable</title>
+  </head>
+  <body>
+    <h1>Temporarily unavailable</h1>
+    <p>
+      {{.Host}} is having trouble right now. Please try again in a little while.
+    </p>
+  </body>
+</html>
+`))
+
+// breakerState is the state of a circuit breaker.
+type breakerState int
+
+const (
+	// breakerClosed sends requests to the backend while counting failures.
+	breakerClosed breakerState = iota
+
+	// breakerOpen refuses requests without sending them to the backend.
+	breakerOpen
+
+	// breakerHalfOpen lets a single request through to test the backend.
+	breakerHalfOpen
+)
+
+// breaker is a circuit breaker that stops requests from being sent to a backend when
+// too many of them are failing, and lets them through again once it recovers.
+type breaker struct {
+	window      time.Duration
+	minRequests int
+	errorRate   float64
+	openFor     time.Duration
+
+	lck       sync.Mutex
+	state     breakerState
+	start     time.Time
+	requests  int
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// newBreaker creates the circuit breaker for a route, which is nil if the route does
+// not have one.
+func newBreaker(cfg *config.CircuitBreakerInfo) *breaker {
+	if cfg == nil {
+		return nil
+	}
+
+	return &breaker{
+		window:      time.Duration(cfg.Window) * time.Second,
+		minRequests: cfg.MinRequests,
+		errorRate:   cfg.ErrorRate,
+		openFor:     time.Duration(cfg.OpenFor) * time.Second,
+	}
+}
+
+// allow determines if a request may be sent to the backend. When it may not, the time
+// until the next request will be let through is returned.
+func (c *breaker) allow(now time.Time) (bool, time.Duration) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	if c.state == breakerClosed {
+		return true, 0
+	}
+
+	// while the backend is being probed, openUntil is when the probe is abandoned if
+	// its outcome was never recorded.
+	if now.Before(c.openUntil) && (c.state == breakerOpen || c.probing) {
+		return false, c.openUntil.Sub(now)
+	}
+
+	c.state = breakerHalfOpen
+	c.probing = true
+	c.openUntil = now.Add(c.openFor)
+	return true, 0
+}
+
+// record notes the outcome of a request that was sent to the backend.
+func (c *breaker) record(now time.Time, failed bool) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+
+	switch c.state {
+	case breakerHalfOpen:
+		c.probing = false
+		if failed {
+			c.open(now)
+		} else {
+			c.state = breakerClosed
+			c.reset(now)
+		}
+		return
+	case breakerOpen:
+		return
+	}
+
+	if now.Sub(c.start) >= c.window {
+		c.reset(now)
+	}
+
+	c.requests++
+	if failed {
+		c.failures++
+	}
+
+	if c.requests >= c.minRequests &&
+		float64(c.failures)/float64(c.requests) >= c.errorRate {
+		c.open(now)
+	}
+}
+
+func (c *breaker) open(now time.Time) {
+	c.state = breakerOpen
+	c.openUntil = now.Add(c.openFor)
+}
+
+func (c *breaker) reset(now time.Time) {
+	c.start = now
+	c.requests = 0
+	c.failures = 0
+}
+
+// serveUnavailable responds with a page explaining that the backend is unavailable
+// because its circuit is open.
+func (b *Backend) serveUnavailable(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	id := internal.RequestID(r)
+	zap.L().Info("circuit open",
+		zap.String("from", b.Route.From),
+		zap.String("uri", r.RequestURI),
+		zap.String("request-id", id))
+
+	w.Header().Set("Retry-After",
+		strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	internal.ServeErrorPage(b.Ctx, w, r, &internal.ErrorPage{
+		Status:    http.StatusServiceUnavailable,
+		Message:   r.Host + " is having trouble right now. Please try again in a little while.",
+		Route:     b.Route.From,
+		RequestID: id,
+	}, unavailableTmpl)
+}
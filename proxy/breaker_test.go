@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kellegous/underpants/config"
+)
+
+func TestBreaker(t *testing.T) {
+	c := newBreaker(&config.CircuitBreakerInfo{
+		Window:      10,
+		MinRequests: 4,
+		ErrorRate:   0.5,
+		OpenFor:     5,
+	})
+
+	now := time.Now()
+	for _, failed := range []bool{false, true, false} {
+		c.record(now, failed)
+	}
+
+	if ok, _ := c.allow(now); !ok {
+		t.Fatal("circuit should be closed below min-requests")
+	}
+
+	c.record(now, true)
+
+	ok, after := c.allow(now)
+	if ok || after != 5*time.Second {
+		t.Fatalf("expected circuit to be open for 5s, got %v %s", ok, after)
+	}
+
+	// after open-for, a single probe is let through.
+	now = now.Add(5 * time.Second)
+	if ok, _ := c.allow(now); !ok {
+		t.Fatal("expected a probe to be let through")
+	}
+
+	if ok, _ := c.allow(now); ok {
+		t.Fatal("expected only one probe to be let through")
+	}
+
+	c.record(now, true)
+	if ok, _ := c.allow(now); ok {
+		t.Fatal("expected a failed probe to reopen the circuit")
+	}
+
+	now = now.Add(5 * time.Second)
+	if ok, _ := c.allow(now); !ok {
+		t.Fatal("expected a probe to be let through")
+	}
+
+	c.record(now, false)
+	if ok, _ := c.allow(now); !ok {
+		t.Fatal("expected a successful probe to close the circuit")
+	}
+
+	// failures in a previous window are forgotten.
+	now = now.Add(time.Second)
+	for i := 0; i < 3; i++ {
+		c.record(now, true)
+	}
+	now = now.Add(10 * time.Second)
+	c.record(now, true)
+	if ok, _ := c.allow(now); !ok {
+		t.Fatal("expected failures from the last window to be forgotten")
+	}
+}
+
+func TestBreakerUnavailable(t *testing.T) {
+	var calls int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer s.Close()
+
+	b := backendFor(t, fmt.Sprintf(`{
+		"from": "a.com",
+		"to": "%s",
+		"paths": [{"path": "/*", "public": true}],
+		"circuit-breaker": {"min-requests": 2}
+	}`, s.URL))
+	b.AuthProvider = &stubProvider{}
+	b.breaker = newBreaker(b.Route.CircuitBreaker)
+
+	for i, status := range []int{500, 500, 503, 503} {
+		w := httptest.NewRecorder()
+		b.serveHTTPProxy(w, httptest.NewRequest("GET", "http://a.com/", nil))
+		if w.Code != status {
+			t.Fatalf("request %d: expected status %d, got %d", i, status, w.Code)
+		}
+
+		if status == http.StatusServiceUnavailable && w.Header().Get("Retry-After") != "30" {
+			t.Fatalf("expected Retry-After of 30, got %q", w.Header().Get("Retry-After"))
+		}
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("expected the backend to see 2 requests, got %d", n)
+	}
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/user"
+)
+
+// canaryURLs are the URLs of the route's canary backend, if it has one.
+func canaryURLs(route *config.RouteInfo) []*url.URL {
+	if c := route.Canary; c != nil {
+		return []*url.URL{c.ToURL()}
+	}
+	return nil
+}
+
+// inCanary determines if the request should be sent to the route's canary backend
+// rather than its To backends. The canary's users are always sent to it, and others
+// are sent to it if they fall within its percentage. Requests are not sent to a
+// canary that fails its health checks.
+func (b *Backend) inCanary(r *http.Request, u *user.Info) bool {
+	c := b.Route.Canary
+	if c == nil || !b.isHealthy(c.ToURL()) {
+		return false
+	}
+
+	if u != nil && b.Ctx.UserMatches(u.Email, c.Users) {
+		return true
+	}
+
+	if c.Percent <= 0 {
+		return false
+	}
+
+	// users are hashed into one of 10000 buckets, so that each always lands on the
+	// same side of the percentage.
+	key := clientIP(r).String()
+	if u != nil {
+		key = strings.ToLower(u.Email)
+	}
+	sum := sha256.Sum256([]byte(b.Route.From + "\n" + key))
+	return float64(binary.BigEndian.Uint64(sum[:])%10000) < c.Percent*100
+}
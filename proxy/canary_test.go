@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kellegous/underpants/user"
+)
+
+func TestCanary(t *testing.T) {
+	var hits []string
+	newServer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits = append(hits, name)
+		}))
+	}
+
+	stable, canary := newServer("stable"), newServer("canary")
+	defer stable.Close()
+	defer canary.Close()
+
+	tests := []struct {
+		Canary string
+		Email  string
+		Hit    string
+	}{
+		{`{"to": "%s"}`, "a@a.com", "stable"},
+		{`{"to": "%s", "users": ["a@a.com"]}`, "a@a.com", "canary"},
+		{`{"to": "%s", "users": ["*@b.com"]}`, "a@a.com", "stable"},
+		{`{"to": "%s", "percent": 100}`, "a@a.com", "canary"},
+		{`{"to": "%s", "percent": 100}`, "", "canary"},
+	}
+
+	for _, test := range tests {
+		hits = nil
+		b := backendFor(t, fmt.Sprintf(`{
+			"from": "a.com",
+			"to": "%s",
+			"canary": %s
+		}`, stable.URL, fmt.Sprintf(test.Canary, canary.URL)))
+
+		var u *user.Info
+		if test.Email != "" {
+			u = &user.Info{Email: test.Email}
+		}
+
+		r := httptest.NewRequest("GET", "http://a.com/", nil)
+		bp, err := b.roundTripOnce(r, u, http.NoBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bp.Body.Close()
+
+		if fmt.Sprint(hits) != "["+test.Hit+"]" {
+			t.Fatalf("expected %s for %s with %s, got %v",
+				test.Hit, test.Email, test.Canary, hits)
+		}
+	}
+}
+
+func TestCanaryPercent(t *testing.T) {
+	b := backendFor(t, `{
+		"from": "a.com",
+		"to": "http://stable",
+		"canary": {"to": "http://canary", "percent": 25}
+	}`)
+
+	r := httptest.NewRequest("GET", "http://a.com/", nil)
+
+	var n int
+	for i := 0; i < 1000; i++ {
+		u := &user.Info{Email: fmt.Sprintf("user%d@a.com", i)}
+		in := b.inCanary(r, u)
+		if in {
+			n++
+		}
+
+		// users stay on the same side of the percentage.
+		if b.inCanary(r, u) != in {
+			t.Fatalf("expected %s to stick with one backend", u.Email)
+		}
+	}
+
+	if n < 200 || n > 300 {
+		t.Fatalf("expected about 250 users in the canary, got %d", n)
+	}
+}
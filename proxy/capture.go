@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"sync"
+	"sync/atomic"
+
+	"github.com/kellegous/underpants/config"
+)
+
+// capture is the runtime state of body capture for a single route. It is disabled
+// until armed, and each request that is captured decrements the remaining count.
+type capture struct {
+	remaining int64
+	maxBytes  int
+	redact    []*regexp.Regexp
+}
+
+func newCapture(cfg *config.BodyCaptureInfo) *capture {
+	if cfg == nil {
+		return nil
+	}
+
+	return &capture{
+		maxBytes: cfg.MaxBytes,
+		redact:   cfg.Redactions(),
+	}
+}
+
+// arm enables capture for the next n requests. Arming with 0 disables capture.
+func (c *capture) arm(n int) {
+	atomic.StoreInt64(&c.remaining, int64(n))
+}
+
+// take claims one of the remaining captures, returning false if capture is disabled.
+func (c *capture) take() bool {
+	for {
+		n := atomic.LoadInt64(&c.remaining)
+		if n <= 0 {
+			return false
+		}
+
+		if atomic.CompareAndSwapInt64(&c.remaining, n, n-1) {
+			return true
+		}
+	}
+}
+
+// Remaining is the number of requests that will still be captured.
+func (c *capture) Remaining() int {
+	return int(atomic.LoadInt64(&c.remaining))
+}
+
+// newBuffer creates a buffer suitable for holding a captured body.
+func (c *capture) newBuffer() *limitedBuffer {
+	return &limitedBuffer{max: c.maxBytes}
+}
+
+// sanitize returns the captured contents of the buffer with all redactions applied.
+func (c *capture) sanitize(b *limitedBuffer) string {
+	s := b.Bytes()
+	for _, re := range c.redact {
+		s = re.ReplaceAll(s, []byte("[redacted]"))
+	}
+	return string(s)
+}
+
+// limitedBuffer retains only the first max bytes that are written to it. Writes
+// always succeed so that it can be used to tee a stream without disrupting it.
+type limitedBuffer struct {
+	lck       sync.Mutex
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.lck.Lock()
+	defer b.lck.Unlock()
+
+	room := b.max - b.buf.Len()
+	if len(p) > room {
+		b.truncated = true
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+
+	b.buf.Write(p)
+	return len(p), nil
+}
+
+// Bytes returns a copy of the bytes that have been retained.
+func (b *limitedBuffer) Bytes() []byte {
+	b.lck.Lock()
+	defer b.lck.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+// Truncated indicates whether any bytes were discarded.
+func (b *limitedBuffer) Truncated() bool {
+	b.lck.Lock()
+	defer b.lck.Unlock()
+	return b.truncated
+}
+
+// teeBody is a request body that copies everything read from it into a
+// limitedBuffer.
+type teeBody struct {
+	io.Reader
+	io.Closer
+}
+
+func newTeeBody(body io.ReadCloser, w io.Writer) io.ReadCloser {
+	return &teeBody{
+		Reader: io.TeeReader(body, w),
+		Closer: body,
+	}
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestCaptureArming(t *testing.T) {
+	c := &capture{maxBytes: 10}
+
+	if c.take() {
+		t.Fatal("capture should be disabled until armed")
+	}
+
+	c.arm(2)
+	for i := 0; i < 2; i++ {
+		if !c.take() {
+			t.Fatalf("take %d should have succeeded", i)
+		}
+	}
+
+	if c.take() {
+		t.Fatal("capture should have disabled itself")
+	}
+
+	if c.Remaining() != 0 {
+		t.Fatalf("expected 0 remaining, got %d", c.Remaining())
+	}
+}
+
+func TestLimitedBuffer(t *testing.T) {
+	b := &limitedBuffer{max: 5}
+
+	n, err := b.Write([]byte("abc"))
+	if err != nil || n != 3 {
+		t.Fatalf("expected write of 3, got %d, %v", n, err)
+	}
+
+	if b.Truncated() {
+		t.Fatal("buffer should not be truncated")
+	}
+
+	n, err = b.Write([]byte("defgh"))
+	if err != nil || n != 5 {
+		t.Fatalf("expected write of 5, got %d, %v", n, err)
+	}
+
+	if string(b.Bytes()) != "abcde" {
+		t.Fatalf("expected abcde, got %s", b.Bytes())
+	}
+
+	if !b.Truncated() {
+		t.Fatal("buffer should be truncated")
+	}
+}
+
+func TestTeeBody(t *testing.T) {
+	b := &limitedBuffer{max: 4}
+	body := newTeeBody(ioutil.NopCloser(strings.NewReader("streaming")), b)
+
+	s, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(s) != "streaming" {
+		t.Fatalf("tee altered the body: %s", s)
+	}
+
+	if string(b.Bytes()) != "stre" {
+		t.Fatalf("expected stre, got %s", b.Bytes())
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	c := &capture{
+		maxBytes: 100,
+		redact: []*regexp.Regexp{
+			regexp.MustCompile(`[a-z]+@[a-z]+\.com`),
+		},
+	}
+
+	b := c.newBuffer()
+	b.Write([]byte(`{"email":"a@b.com","n":1}`))
+
+	if s := c.sanitize(b); s != `{"email":"[redacted]","n":1}` {
+		t.Fatalf("unexpected sanitized body: %s", s)
+	}
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// CheckResult is the outcome of checking the health of a backend.
+type CheckResult struct {
+	Route   string  `json:"route"`
+	URL     string  `json:"url"`
+	Healthy bool    `json:"healthy"`
+	Status  int     `json:"status,omitempty"`
+	Latency float64 `json:"latency-ms"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// Check performs the route's health check against the backend. A backend is healthy
+// if it responds with anything other than a server error.
+func (b *Backend) Check(ctx context.Context) *CheckResult {
+	if lb := b.balancer; lb != nil {
+		return b.check(ctx, lb.current()[0].url)
+	}
+	return b.check(ctx, b.Route.ToURL())
+}
+
+// check performs the route's health check against the backend at base.
+func (b *Backend) check(ctx context.Context, base *url.URL) *CheckResult {
+	hc := b.Route.HealthCheck
+
+	res := &CheckResult{
+		Route: b.Route.From,
+	}
+
+	u, err := base.Parse(strings.TrimLeft(hc.Path, "/"))
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	res.URL = u.String()
+
+	req, err := http.NewRequest(hc.Method, u.String(), nil)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	setSocketHost(req, b.Route)
+	if lb := b.balancer; lb != nil {
+		lb.setHost(req, base)
+	}
+
+	t := time.Now()
+	bp, err := b.roundTripper().RoundTrip(req.WithContext(ctx))
+	res.Latency = float64(time.Since(t)) / float64(time.Millisecond)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	bp.Body.Close()
+
+	res.Status = bp.StatusCode
+	res.Healthy = bp.StatusCode < 500
+	return res
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kellegous/underpants/config"
+)
+
+func backendFor(t *testing.T, route string) *Backend {
+	var cfg config.Info
+	if err := cfg.Read(strings.NewReader(fmt.Sprintf(`{
+		"oauth": {"client-id": "id", "client-secret": "secret"},
+		"routes": [%s]
+	}`, route))); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, err := config.BuildContext(&cfg, 80, []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Backend{
+		Ctx:   ctx,
+		Route: cfg.Routes[0],
+	}
+}
+
+func TestCheck(t *testing.T) {
+	var method, path string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		if r.URL.Path == "/sick" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer s.Close()
+
+	b := backendFor(t, fmt.Sprintf(`{"from": "a.com", "to": "%s/app/"}`, s.URL))
+	res := b.Check(context.Background())
+	if !res.Healthy || res.Status != http.StatusOK {
+		t.Fatalf("expected healthy backend, got %+v", res)
+	}
+
+	if method != "HEAD" || path != "/app/" {
+		t.Fatalf("expected HEAD /app/, got %s %s", method, path)
+	}
+
+	b = backendFor(t, fmt.Sprintf(`{
+		"from": "a.com",
+		"to": "%s",
+		"health-check": {"method": "GET", "path": "/sick"}
+	}`, s.URL))
+	res = b.Check(context.Background())
+	if res.Healthy || res.Status != http.StatusServiceUnavailable {
+		t.Fatalf("expected unhealthy backend, got %+v", res)
+	}
+
+	if method != "GET" {
+		t.Fatalf("expected GET, got %s", method)
+	}
+
+	s.Close()
+	res = b.Check(context.Background())
+	if res.Healthy || res.Error == "" {
+		t.Fatalf("expected unreachable backend, got %+v", res)
+	}
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/internal"
+
+	"go.uber.org/zap"
+)
+
+var (
+	// errQueueFull is returned when a request cannot be queued because too many
+	// requests are already waiting.
+	errQueueFull = errors.New("concurrency queue is full")
+
+	// errQueueTimeout is returned when a request waited too long in the queue.
+	errQueueTimeout = errors.New("timed out waiting in concurrency queue")
+)
+
+// concurrency limits the number of requests in progress at a route's backend,
+// queueing a limited number of the requests over the limit.
+type concurrency struct {
+	slots   chan struct{}
+	queue   int
+	timeout time.Duration
+
+	lck     sync.Mutex
+	waiting int
+}
+
+// newConcurrency creates the concurrency limit for a route, which is nil if the route
+// is not limited.
+func newConcurrency(cfg *config.ConcurrencyInfo) *concurrency {
+	if cfg == nil {
+		return nil
+	}
+
+	return &concurrency{
+		slots:   make(chan struct{}, cfg.MaxInFlight),
+		queue:   cfg.Queue,
+		timeout: time.Duration(cfg.QueueTimeoutMs) * time.Millisecond,
+	}
+}
+
+// acquire waits for a request to be allowed to proceed to the backend. Requests that
+// are allowed must call release once they are done.
+func (c *concurrency) acquire(ctx context.Context) error {
+	select {
+	case c.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	c.lck.Lock()
+	if c.waiting >= c.queue {
+		c.lck.Unlock()
+		return errQueueFull
+	}
+	c.waiting++
+	c.lck.Unlock()
+
+	defer func() {
+		c.lck.Lock()
+		c.waiting--
+		c.lck.Unlock()
+	}()
+
+	t := time.NewTimer(c.timeout)
+	defer t.Stop()
+
+	select {
+	case c.slots <- struct{}{}:
+		return nil
+	case <-t.C:
+		return errQueueTimeout
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release lets the next request proceed.
+func (c *concurrency) release() {
+	<-c.slots
+}
+
+// serveOverloaded answers requests that were shed because too many requests are in
+// progress at the backend.
+func (b *Backend) serveOverloaded(w http.ResponseWriter, r *http.Request, err error) {
+	id := internal.RequestID(r)
+	zap.L().Info("request shed",
+		zap.String("from", b.Route.From),
+		zap.String("uri", r.RequestURI),
+		zap.String("request-id", id),
+		zap.Error(err))
+	internal.ServeErrorPage(b.Ctx, w, r, &internal.ErrorPage{
+		Status:    http.StatusServiceUnavailable,
+		Message:   r.Host + " is busy right now. Please try again in a little while.",
+		Route:     b.Route.From,
+		RequestID: id,
+	}, nil)
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kellegous/underpants/config"
+)
+
+func TestConcurrencyQueueTimeout(t *testing.T) {
+	c := newConcurrency(&config.ConcurrencyInfo{
+		MaxInFlight:    1,
+		Queue:          1,
+		QueueTimeoutMs: 10,
+	})
+
+	if err := c.acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.acquire(context.Background()); err != errQueueTimeout {
+		t.Fatalf("expected %v, got %v", errQueueTimeout, err)
+	}
+
+	c.release()
+	if err := c.acquire(context.Background()); err != nil {
+		t.Fatalf("expected the released slot to be available, got %v", err)
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	arrived := make(chan struct{}, 2)
+	unblock := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-unblock
+	}))
+	defer s.Close()
+
+	b := backendFor(t, fmt.Sprintf(`{
+		"from": "a.com",
+		"to": "%s",
+		"paths": [{"path": "/*", "public": true}],
+		"concurrency": {"max-in-flight": 1, "queue": 1}
+	}`, s.URL))
+	b.AuthProvider = &stubProvider{}
+	b.concurrency = newConcurrency(b.Route.Concurrency)
+
+	serve := func() chan int {
+		ch := make(chan int, 1)
+		go func() {
+			w := httptest.NewRecorder()
+			b.serveHTTPProxy(w, httptest.NewRequest("GET", "http://a.com/", nil))
+			ch <- w.Code
+		}()
+		return ch
+	}
+
+	// the first request is in progress at the backend.
+	first := serve()
+	<-arrived
+
+	// the second waits in the queue.
+	second := serve()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		b.concurrency.lck.Lock()
+		waiting := b.concurrency.waiting
+		b.concurrency.lck.Unlock()
+		if waiting == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("second request was never queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// and the third is shed since the queue is full.
+	if code := <-serve(); code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d, got %d", http.StatusServiceUnavailable, code)
+	}
+
+	close(unblock)
+	if code := <-first; code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+	}
+	if code := <-second; code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+	}
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/kellegous/underpants/config"
+
+	"go.uber.org/zap"
+)
+
+// renamedCookiePrefix is prepended to backend cookies whose names collide with one
+// of the cookies used by underpants when the collision policy is rename.
+const renamedCookiePrefix = "upstream-"
+
+// isReservedCookie determines if a cookie name is one that underpants uses for itself
+// on every route.
+func (b *Backend) isReservedCookie(name string) bool {
+	return name == b.Ctx.Sessions.CookieName() ||
+		name == loopCookieKey ||
+		name == affinityCookieKey
+}
+
+// cookieName extracts the name of the cookie from a Set-Cookie header value.
+func cookieName(setCookie string) string {
+	ix := strings.IndexByte(setCookie, '=')
+	if ix == -1 {
+		return ""
+	}
+	return strings.TrimSpace(setCookie[:ix])
+}
+
+// filterSetCookies applies the route's cookie collision policy to the Set-Cookie
+// headers of a backend response. An error is returned if the policy is to refuse a
+// response that collides.
+func (b *Backend) filterSetCookies(h http.Header) error {
+	vals := h["Set-Cookie"]
+	if len(vals) == 0 {
+		return nil
+	}
+
+	var res []string
+	for _, val := range vals {
+		name := cookieName(val)
+		if !b.isReservedCookie(name) {
+			res = append(res, val)
+			continue
+		}
+
+		switch b.Route.CookieCollision {
+		case config.CookieCollisionRename:
+			res = append(res, renamedCookiePrefix+strings.TrimSpace(val))
+		case config.CookieCollisionDrop:
+			zap.L().Warn("dropped backend cookie that collides with session cookie",
+				zap.String("from", b.Route.From),
+				zap.String("cookie", name))
+		case config.CookieCollisionRefuse:
+			return fmt.Errorf("backend set reserved cookie %s", name)
+		}
+	}
+
+	if len(res) == 0 {
+		h.Del("Set-Cookie")
+	} else {
+		h["Set-Cookie"] = res
+	}
+	return nil
+}
+
+// filterCookies rewrites the Cookie headers of a request to a backend whose cookies
+// are renamed on collision. The underpants cookies are removed and renamed backend
+// cookies are restored to their original names.
+func (b *Backend) filterCookies(h http.Header) {
+	if b.Route.CookieCollision != config.CookieCollisionRename {
+		return
+	}
+
+	vals := h["Cookie"]
+	if len(vals) == 0 {
+		return
+	}
+
+	var res []string
+	for _, val := range vals {
+		for _, c := range strings.Split(val, ";") {
+			c = strings.TrimSpace(c)
+			name := cookieName(c)
+			if b.isReservedCookie(name) {
+				continue
+			}
+
+			if b.isReservedCookie(strings.TrimPrefix(name, renamedCookiePrefix)) {
+				c = strings.TrimPrefix(c, renamedCookiePrefix)
+			}
+
+			res = append(res, c)
+		}
+	}
+
+	if len(res) == 0 {
+		h.Del("Cookie")
+	} else {
+		h.Set("Cookie", strings.Join(res, "; "))
+	}
+}
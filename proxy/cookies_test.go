@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/session"
+)
+
+func TestFilterSetCookies(t *testing.T) {
+	tests := []struct {
+		Policy   string
+		Expected []string
+		Error    bool
+	}{
+		{config.CookieCollisionRename, []string{"a=1", "upstream-u=2; Path=/"}, false},
+		{config.CookieCollisionDrop, []string{"a=1"}, false},
+		{config.CookieCollisionRefuse, nil, true},
+	}
+
+	for _, test := range tests {
+		b := &Backend{
+			Ctx: &config.Context{Sessions: &session.Manager{}},
+			Route: &config.RouteInfo{
+				From:            "a.com",
+				CookieCollision: test.Policy,
+			},
+		}
+
+		h := http.Header{}
+		h.Add("Set-Cookie", "a=1")
+		h.Add("Set-Cookie", "u=2; Path=/")
+
+		err := b.filterSetCookies(h)
+		if test.Error {
+			if err == nil {
+				t.Fatalf("%s: expected error", test.Policy)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%s: %s", test.Policy, err)
+		}
+
+		if !reflect.DeepEqual(h["Set-Cookie"], test.Expected) {
+			t.Fatalf("%s: expected %v, got %v", test.Policy, test.Expected, h["Set-Cookie"])
+		}
+	}
+}
+
+func TestFilterCookies(t *testing.T) {
+	b := &Backend{
+		Ctx: &config.Context{Sessions: &session.Manager{}},
+		Route: &config.RouteInfo{
+			From:            "a.com",
+			CookieCollision: config.CookieCollisionRename,
+		},
+	}
+
+	h := http.Header{}
+	h.Set("Cookie", "u=session; a=1; upstream-u=2; u_loop=1")
+	b.filterCookies(h)
+
+	if c := h.Get("Cookie"); c != "a=1; u=2" {
+		t.Fatalf("expected a=1; u=2, got %s", c)
+	}
+
+	h = http.Header{}
+	h.Set("Cookie", "u=session")
+	b.filterCookies(h)
+
+	if _, ok := h["Cookie"]; ok {
+		t.Fatalf("expected no cookies, got %s", h.Get("Cookie"))
+	}
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// corsResponseHeaders are the headers that the route's CORS policy decides, any set
+// by the backend are replaced.
+var corsResponseHeaders = []string{
+	"Access-Control-Allow-Origin",
+	"Access-Control-Allow-Credentials",
+	"Access-Control-Allow-Methods",
+	"Access-Control-Allow-Headers",
+	"Access-Control-Expose-Headers",
+	"Access-Control-Max-Age",
+}
+
+// isPreflight determines if the request is a CORS preflight request.
+func isPreflight(r *http.Request) bool {
+	return r.Method == "OPTIONS" &&
+		r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// setCORSHeaders adds the headers that let the page making a cross-origin request read
+// the response, if the route's CORS policy allows its origin.
+func (b *Backend) setCORSHeaders(w http.ResponseWriter, r *http.Request) {
+	c := b.Route.CORS
+	if c == nil {
+		return
+	}
+
+	origin := r.Header.Get("Origin")
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	if origin == "" || !c.AllowsOrigin(origin) {
+		return
+	}
+
+	// browsers refuse credentials with a wildcard origin, so the origin is echoed.
+	if len(c.AllowedOrigins) == 1 && c.AllowedOrigins[0] == "*" && !c.AllowCredentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+
+	if c.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if len(c.ExposedHeaders) > 0 {
+		h.Set("Access-Control-Expose-Headers", strings.Join(c.ExposedHeaders, ", "))
+	}
+}
+
+// servePreflight answers a CORS preflight request on behalf of the backend, since
+// browsers send preflight requests without the session cookie.
+func (b *Backend) servePreflight(w http.ResponseWriter, r *http.Request) {
+	c := b.Route.CORS
+	method := r.Header.Get("Access-Control-Request-Method")
+
+	allowed := false
+	for _, m := range c.AllowedMethods {
+		if m == method {
+			allowed = true
+			break
+		}
+	}
+
+	if !c.AllowsOrigin(r.Header.Get("Origin")) || !allowed {
+		zap.L().Info("cors preflight refused",
+			zap.String("from", b.Route.From),
+			zap.String("origin", r.Header.Get("Origin")),
+			zap.String("method", method))
+		w.Header().Add("Vary", "Origin")
+		http.Error(w,
+			http.StatusText(http.StatusForbidden),
+			http.StatusForbidden)
+		return
+	}
+
+	b.setCORSHeaders(w, r)
+
+	h := w.Header()
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+	h.Set("Access-Control-Allow-Methods", strings.Join(c.AllowedMethods, ", "))
+
+	if len(c.AllowedHeaders) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+	} else if req := r.Header.Get("Access-Control-Request-Headers"); req != "" {
+		h.Set("Access-Control-Allow-Headers", req)
+	}
+
+	if c.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(c.MaxAge))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// stripCORSHeaders removes the CORS headers set by the backend from its response, if
+// the route has a CORS policy of its own.
+func (b *Backend) stripCORSHeaders(h http.Header) {
+	if b.Route.CORS == nil {
+		return
+	}
+
+	for _, name := range corsResponseHeaders {
+		h.Del(name)
+	}
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSPreflight(t *testing.T) {
+	b := backendFor(t, `{
+		"from": "a.com",
+		"to": "http://localhost:1",
+		"cors": {
+			"allowed-origins": ["https://*.example.com"],
+			"allowed-methods": ["GET", "post"],
+			"allow-credentials": true,
+			"max-age": 600
+		}
+	}`)
+	b.AuthProvider = &stubProvider{}
+
+	tests := []struct {
+		Origin string
+		Method string
+		Status int
+	}{
+		{"https://wiki.example.com", "POST", http.StatusNoContent},
+		{"https://wiki.example.com", "DELETE", http.StatusForbidden},
+		{"https://evil.com", "GET", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("OPTIONS", "http://a.com/api", nil)
+		r.Header.Set("Origin", test.Origin)
+		r.Header.Set("Access-Control-Request-Method", test.Method)
+		r.Header.Set("Access-Control-Request-Headers", "X-Requested-With")
+
+		// preflights are answered without asking users to sign in.
+		w := httptest.NewRecorder()
+		b.serveHTTPProxy(w, r)
+		if w.Code != test.Status {
+			t.Fatalf("expected %d for %s %s, got %d", test.Status, test.Origin, test.Method, w.Code)
+		}
+
+		if w.Code != http.StatusNoContent {
+			if o := w.Header().Get("Access-Control-Allow-Origin"); o != "" {
+				t.Fatalf("expected no allowed origin, got %s", o)
+			}
+			continue
+		}
+
+		h := w.Header()
+		if h.Get("Access-Control-Allow-Origin") != test.Origin ||
+			h.Get("Access-Control-Allow-Credentials") != "true" ||
+			h.Get("Access-Control-Allow-Methods") != "GET, POST" ||
+			h.Get("Access-Control-Allow-Headers") != "X-Requested-With" ||
+			h.Get("Access-Control-Max-Age") != "600" {
+			t.Fatalf("unexpected preflight headers %v", h)
+		}
+	}
+}
+
+func TestCORSResponse(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	}))
+	defer s.Close()
+
+	b := backendFor(t, fmt.Sprintf(`{
+		"from": "a.com",
+		"to": "%s",
+		"cors": {"allowed-origins": ["https://wiki.example.com"], "exposed-headers": ["X-Total"]},
+		"paths": [{"path": "/*", "public": true}]
+	}`, s.URL))
+	b.AuthProvider = &stubProvider{}
+
+	r := httptest.NewRequest("GET", "http://a.com/api", nil)
+	r.Header.Set("Origin", "https://wiki.example.com")
+
+	w := httptest.NewRecorder()
+	b.serveHTTPProxy(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	// the route's policy replaces the backend's.
+	h := w.Header()
+	if o := h.Values("Access-Control-Allow-Origin"); len(o) != 1 || o[0] != "https://wiki.example.com" {
+		t.Fatalf("unexpected allowed origin %v", o)
+	}
+
+	if h.Get("Access-Control-Expose-Headers") != "X-Total" || h.Get("Vary") != "Origin" {
+		t.Fatalf("unexpected headers %v", h)
+	}
+}
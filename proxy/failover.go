@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/user"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// maxFailoverBody is the largest request body that is buffered so that it can be
+// replayed to another backend. Requests with larger bodies are only sent to the first
+// backend.
+const maxFailoverBody = 1 << 20
+
+// target is one of the backends of a failover route.
+type target struct {
+	url *url.URL
+
+	// downUntil is the time (in unix nanoseconds) until which the target is
+	// considered unhealthy.
+	downUntil int64
+}
+
+func (t *target) isDown(now time.Time) bool {
+	return now.UnixNano() < atomic.LoadInt64(&t.downUntil)
+}
+
+func (t *target) markDown(until time.Time) {
+	atomic.StoreInt64(&t.downUntil, until.UnixNano())
+}
+
+// failover sends requests to an ordered list of backends, moving on to the next
+// when one is unreachable or responds with a server error.
+type failover struct {
+	targets  []*target
+	cooldown time.Duration
+}
+
+// newFailover creates the failover for a route, which is nil if the route has no
+// failover backends.
+func newFailover(route *config.RouteInfo) *failover {
+	urls := route.FailoverURLs()
+	if len(urls) == 0 {
+		return nil
+	}
+
+	f := &failover{
+		targets:  []*target{{url: route.ToURL()}},
+		cooldown: time.Duration(route.FailoverCooldown) * time.Second,
+	}
+
+	for _, u := range urls {
+		f.targets = append(f.targets, &target{url: u})
+	}
+
+	return f
+}
+
+// order returns the targets in the order they should be tried, healthy targets come
+// first and targets that recently failed or that fail health checks are only tried as
+// a last resort.
+func (f *failover) order(now time.Time, healthy func(*url.URL) bool) []*target {
+	var up, down []*target
+	for _, t := range f.targets {
+		if t.isDown(now) || !healthy(t.url) {
+			down = append(down, t)
+		} else {
+			up = append(up, t)
+		}
+	}
+	return append(up, down...)
+}
+
+// bufferBody reads up to max bytes of the body into memory. If the entire body fits,
+// it is returned and ok is true. Otherwise the returned reader yields the full body,
+// including the part that was already read.
+func bufferBody(body io.ReadCloser, max int64) (buf []byte, rest io.ReadCloser, ok bool, err error) {
+	buf, err = ioutil.ReadAll(io.LimitReader(body, max+1))
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	if int64(len(buf)) <= max {
+		return buf, nil, true, nil
+	}
+
+	return nil, &teeBody{
+		Reader: io.MultiReader(bytes.NewReader(buf), body),
+		Closer: body,
+	}, false, nil
+}
+
+func (f *failover) roundTrip(
+	b *Backend,
+	r *http.Request,
+	u *user.Info,
+	body io.ReadCloser) (*http.Response, error) {
+	targets := f.order(time.Now(), b.isHealthy)
+
+	buf, rest, ok, err := bufferBody(body, maxFailoverBody)
+	if err != nil {
+		return nil, err
+	}
+
+	// if the body is too large to replay, there is only one shot.
+	if !ok {
+		targets = targets[:1]
+	}
+
+	for i, t := range targets {
+		var rb io.Reader = rest
+		if ok {
+			rb = bytes.NewReader(buf)
+		}
+
+		br, err := b.newBackendRequest(r, t.url, rb, u)
+		if err != nil {
+			return nil, err
+		}
+
+		bp, err := b.roundTripper().RoundTrip(br)
+		last := i == len(targets)-1
+		if err == nil && (bp.StatusCode < 500 || last) {
+			return bp, nil
+		}
+
+		// a client that went away says nothing about the health of the backend.
+		if cerr := r.Context().Err(); cerr != nil {
+			if err == nil {
+				bp.Body.Close()
+			}
+			return nil, cerr
+		}
+
+		if err != nil && last {
+			return nil, err
+		}
+
+		fields := []zapcore.Field{
+			zap.String("from", b.Route.From),
+			zap.String("uri", r.RequestURI),
+			zap.String("failed", t.url.String()),
+			zap.String("next", targets[i+1].url.String()),
+		}
+
+		if err != nil {
+			fields = append(fields, zap.Error(err))
+		} else {
+			fields = append(fields, zap.Int("status", bp.StatusCode))
+			bp.Body.Close()
+		}
+
+		zap.L().Warn("backend failover", fields...)
+		t.markDown(time.Now().Add(f.cooldown))
+	}
+
+	// not reached, the last target always returns.
+	return nil, nil
+}
@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kellegous/underpants/user"
+)
+
+func TestFailover(t *testing.T) {
+	var primaryHits int
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryHits++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer primary.Close()
+
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "secondary:%s", b)
+	}))
+	defer secondary.Close()
+
+	b := backendFor(t, fmt.Sprintf(`{
+		"from": "a.com",
+		"to": "%s",
+		"failover": ["%s"]
+	}`, primary.URL, secondary.URL))
+	b.failover = newFailover(b.Route)
+
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest("POST", "http://a.com/x", strings.NewReader("body"))
+		bp, err := b.roundTrip(r, &user.Info{Email: "a@a.com"}, r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, _ := ioutil.ReadAll(bp.Body)
+		bp.Body.Close()
+
+		if string(res) != "secondary:body" {
+			t.Fatalf("expected secondary:body, got %s", res)
+		}
+	}
+
+	// the primary is skipped while it cools down.
+	if primaryHits != 1 {
+		t.Fatalf("expected 1 request to the primary, got %d", primaryHits)
+	}
+}
+
+func TestFailoverUnreachable(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	b := backendFor(t, fmt.Sprintf(`{
+		"from": "a.com",
+		"to": "%s",
+		"failover": ["%s"]
+	}`, dead.URL, dead.URL))
+	b.failover = newFailover(b.Route)
+
+	r := httptest.NewRequest("GET", "http://a.com/x", nil)
+	if _, err := b.roundTrip(r, &user.Info{}, r.Body); err == nil {
+		t.Fatal("expected error when all backends are unreachable")
+	}
+}
+
+func TestFailoverCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var secondaryHits int
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the client gives up while the primary is working on its request.
+		cancel()
+		<-r.Context().Done()
+	}))
+	defer primary.Close()
+
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secondaryHits++
+	}))
+	defer secondary.Close()
+
+	b := backendFor(t, fmt.Sprintf(`{
+		"from": "a.com",
+		"to": "%s",
+		"failover": ["%s"]
+	}`, primary.URL, secondary.URL))
+	b.failover = newFailover(b.Route)
+
+	r := httptest.NewRequest("GET", "http://a.com/x", nil).WithContext(ctx)
+	if _, err := b.roundTrip(r, &user.Info{}, r.Body); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	if secondaryHits != 0 {
+		t.Fatalf("expected no failover, got %d requests to the secondary", secondaryHits)
+	}
+
+	if b.failover.targets[0].isDown(time.Now()) {
+		t.Fatal("expected the primary not to be marked down")
+	}
+}
+
+func TestBufferBody(t *testing.T) {
+	buf, rest, ok, err := bufferBody(ioutil.NopCloser(strings.NewReader("abc")), 3)
+	if err != nil || !ok || rest != nil || string(buf) != "abc" {
+		t.Fatalf("expected abc to be buffered, got %q, %t, %v", buf, ok, err)
+	}
+
+	_, rest, ok, err = bufferBody(ioutil.NopCloser(strings.NewReader("abcdef")), 3)
+	if err != nil || ok {
+		t.Fatalf("expected body to be too large, got %t, %v", ok, err)
+	}
+
+	all, err := ioutil.ReadAll(rest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(all) != "abcdef" {
+		t.Fatalf("expected abcdef, got %s", all)
+	}
+}
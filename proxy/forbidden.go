@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/kellegous/underpants/audit"
+	"github.com/kellegous/underpants/internal"
+	"github.com/kellegous/underpants/metrics"
+	"github.com/kellegous/underpants/user"
+
+	"go.uber.org/zap"
+)
+
+var forbiddenTmpl = template.Must(template.New("forbidden").Parse(`<!DOCTYPE html>
+<html>
+  <head>
+    <title>Access denied</title>
+  </head>
+  <body>
+    <h1>Access denied</h1>
+    <p>
+      You are signed in as <strong>{{.Email}}</strong>, but you are not permitted to
+      view {{.Host}}.
+    </p>
+    <p>{{.Message}}</p>
+    <p><a href="{{.Hub}}">Go to underpants</a></p>
+  </body>
+</html>
+`))
+
+// serveForbidden responds with a page explaining that the user may not access the
+// route.
+func (b *Backend) serveForbidden(w http.ResponseWriter, r *http.Request, u *user.Info, reason string) {
+	id := internal.RequestID(r)
+	zap.L().Info("access denied",
+		zap.String("from", b.Route.From),
+		zap.String("user", u.Email),
+		zap.String("reason", reason),
+		zap.String("request-id", id))
+	b.Ctx.Audit.Record(r, audit.AccessDenied, u.Email, reason)
+	b.Ctx.Metrics.Auth.Inc(b.Route.From, metrics.AuthDenied)
+
+	internal.ServeErrorPage(b.Ctx, w, r, &internal.ErrorPage{
+		Status:    http.StatusForbidden,
+		Message:   reason,
+		Route:     b.Route.From,
+		Email:     u.Email,
+		RequestID: id,
+	}, forbiddenTmpl)
+}
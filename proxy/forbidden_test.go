@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kellegous/underpants/audit"
+	"github.com/kellegous/underpants/user"
+)
+
+func TestDeniedUserIsForbidden(t *testing.T) {
+	b := backendFor(t, `{"from": "a.com", "to": "http://localhost:1", "deny": ["*@b.com"]}`)
+
+	var buf bytes.Buffer
+	b.Ctx.Audit = audit.New(&buf)
+
+	v, err := b.Ctx.Sessions.Encode(&user.Info{
+		Email:             "x@b.com",
+		LastAuthenticated: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "http://a.com/", nil)
+	r.AddCookie(&http.Cookie{Name: user.CookieKey, Value: v})
+
+	w := httptest.NewRecorder()
+	b.serveHTTPProxy(w, r)
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected status %d, got %d", http.StatusForbidden, w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), "x@b.com") {
+		t.Fatalf("expected forbidden page to name the user, got %s", w.Body.String())
+	}
+
+	var e audit.Event
+	if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+
+	if e.Type != audit.AccessDenied || e.User != "x@b.com" || e.Host != "a.com" {
+		t.Fatalf("unexpected audit event %+v", e)
+	}
+}
+
+func TestRouteDomain(t *testing.T) {
+	b := backendFor(t, `{"from": "a.com", "to": "http://localhost:1", "domain": "b.com"}`)
+
+	for email, forbidden := range map[string]bool{
+		"x@a.com": true,
+		"x@b.com": false,
+	} {
+		v, err := b.Ctx.Sessions.Encode(&user.Info{
+			Email:             email,
+			LastAuthenticated: time.Now(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := httptest.NewRequest("GET", "http://a.com/", nil)
+		r.AddCookie(&http.Cookie{Name: user.CookieKey, Value: v})
+
+		w := httptest.NewRecorder()
+		b.serveHTTPProxy(w, r)
+
+		if (w.Code == http.StatusForbidden) != forbidden {
+			t.Fatalf("expected %s to be forbidden: %t, got status %d", email, forbidden, w.Code)
+		}
+	}
+}
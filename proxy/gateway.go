@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/kellegous/underpants/internal"
+	"github.com/kellegous/underpants/user"
+
+	"go.uber.org/zap"
+)
+
+// gatewayStatus is the status that answers a request whose backend failed with err,
+// a 504 if the backend took too long and a 502 otherwise.
+func gatewayStatus(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return http.StatusGatewayTimeout
+	}
+
+	return http.StatusBadGateway
+}
+
+// serveGatewayError responds with a page explaining that the backend could not be
+// reached, or did not respond in time, to a request made on behalf of the user.
+func (b *Backend) serveGatewayError(
+	w http.ResponseWriter,
+	r *http.Request,
+	u *user.Info,
+	err error) {
+	status := gatewayStatus(err)
+
+	var email string
+	if u != nil {
+		email = u.Email
+	}
+
+	id := internal.RequestID(r)
+	zap.L().Error("unable to proxy request",
+		zap.String("from", b.Route.From),
+		zap.String("method", r.Method),
+		zap.String("uri", r.RequestURI),
+		zap.String("user", email),
+		zap.Int("status", status),
+		zap.String("request-id", id),
+		zap.Error(err))
+	b.Ctx.Metrics.UpstreamErrors.Inc(b.Route.From, strconv.Itoa(status))
+
+	msg := r.Host + " could not be reached. Please try again in a little while."
+	if status == http.StatusGatewayTimeout {
+		msg = r.Host + " took too long to respond. Please try again in a little while."
+	}
+
+	internal.ServeErrorPage(b.Ctx, w, r, &internal.ErrorPage{
+		Status:    status,
+		Message:   msg,
+		Route:     b.Route.From,
+		Email:     email,
+		RequestID: id,
+	}, nil)
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGatewayStatus(t *testing.T) {
+	tests := []struct {
+		Err    error
+		Status int
+	}{
+		{errors.New("connection refused"), http.StatusBadGateway},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{fmt.Errorf("read: %w", context.DeadlineExceeded), http.StatusGatewayTimeout},
+	}
+
+	for _, test := range tests {
+		if s := gatewayStatus(test.Err); s != test.Status {
+			t.Fatalf("expected status %d for %v, got %d", test.Status, test.Err, s)
+		}
+	}
+}
+
+func TestGatewayTimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer s.Close()
+	defer close(unblock)
+
+	b := backendFor(t, fmt.Sprintf(`{
+		"from": "a.com",
+		"to": "%s",
+		"paths": [{"path": "/*", "public": true}]
+	}`, s.URL))
+	b.AuthProvider = &stubProvider{}
+	b.transport = &http.Transport{ResponseHeaderTimeout: 50 * time.Millisecond}
+
+	w := httptest.NewRecorder()
+	b.serveHTTPProxy(w, httptest.NewRequest("GET", "http://a.com/", nil))
+
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected status 504, got %d", w.Code)
+	}
+
+	if !strings.Contains(w.Body.String(), "a.com took too long to respond") {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newH2CServer creates a server that speaks both HTTP/1.1 and h2c.
+func newH2CServer(h http.Handler) *httptest.Server {
+	s := httptest.NewUnstartedServer(h)
+	s.Config.Protocols = &http.Protocols{}
+	s.Config.Protocols.SetHTTP1(true)
+	s.Config.Protocols.SetUnencryptedHTTP2(true)
+	s.Start()
+	return s
+}
+
+func TestH2C(t *testing.T) {
+	var proto, body string
+	be := newH2CServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		proto, body = r.Proto, string(b)
+
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		fmt.Fprint(w, "reply")
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	defer be.Close()
+
+	b := backendFor(t, fmt.Sprintf(`{
+		"from": "a.com",
+		"to": "%s",
+		"paths": [{"path": "/*", "public": true}],
+		"backend-protocol": "h2c"
+	}`, be.URL))
+	b.AuthProvider = &stubProvider{}
+	b.transport = newTransport(newSharedTransport(&b.Ctx.Transport), b.Route)
+
+	s := newH2CServer(http.HandlerFunc(b.serveHTTPProxy))
+	defer s.Close()
+
+	tr := &http.Transport{Protocols: &http.Protocols{}}
+	tr.Protocols.SetUnencryptedHTTP2(true)
+	defer tr.CloseIdleConnections()
+
+	req, err := http.NewRequest("POST", s.URL+"/svc/Method", strings.NewReader("request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	b2, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.ProtoMajor != 2 || proto != "HTTP/2.0" {
+		t.Fatalf("expected HTTP/2 on both sides, got %s and %s", res.Proto, proto)
+	}
+
+	if body != "request" || string(b2) != "reply" {
+		t.Fatalf("expected request and reply, got %q and %q", body, b2)
+	}
+
+	if v := res.Trailer.Get("Grpc-Status"); v != "0" {
+		t.Fatalf("expected Grpc-Status trailer of 0, got %q", v)
+	}
+}
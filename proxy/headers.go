@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/internal"
+)
+
+// identityHeaderPrefixes are the prefixes of the headers underpants uses to pass
+// information to backends. Clients can never supply headers with these prefixes.
+var identityHeaderPrefixes = []string{
+	"Underpants-",
+	"X-Underpants-",
+}
+
+// isIdentityHeader determines if the canonical header name is one that backends trust
+// to identify the user.
+func (b *Backend) isIdentityHeader(name string) bool {
+	for _, prefix := range identityHeaderPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+
+	if a := b.Ctx.Assertion; a != nil &&
+		name == http.CanonicalHeaderKey(a.Header) {
+		return true
+	}
+
+	for _, h := range b.Ctx.StripHeaders {
+		if name == http.CanonicalHeaderKey(h) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stripIdentityHeaders removes every header a client might use to impersonate a user
+// from a request that is about to be sent to the backend.
+func (b *Backend) stripIdentityHeaders(h http.Header) {
+	for name := range h {
+		if b.isIdentityHeader(http.CanonicalHeaderKey(name)) {
+			delete(h, name)
+		}
+	}
+}
+
+// applyHeaderRules changes the headers as the rules describe.
+func applyHeaderRules(h http.Header, rules *config.HeaderRulesInfo) {
+	if rules == nil {
+		return
+	}
+
+	for _, name := range rules.Remove {
+		h.Del(name)
+	}
+
+	for _, rw := range rules.Rewrite {
+		vals := h[http.CanonicalHeaderKey(rw.Header)]
+		for i, val := range vals {
+			vals[i] = rw.Regexp().ReplaceAllString(val, rw.Replace)
+		}
+	}
+
+	for name, val := range rules.Set {
+		h.Set(name, val)
+	}
+
+	for name, val := range rules.Add {
+		h.Add(name, val)
+	}
+}
+
+// headerRulesWriter applies the route's response header rules just before the
+// response's headers are written.
+type headerRulesWriter struct {
+	*internal.ResponseRecorder
+	rules   *config.HeaderRulesInfo
+	applied bool
+}
+
+// withResponseHeaderRules applies the response header rules, if there are any, to the
+// responses of next.
+func withResponseHeaderRules(rules *config.HeaderRulesInfo, next http.Handler) http.Handler {
+	if rules == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&headerRulesWriter{
+			ResponseRecorder: &internal.ResponseRecorder{ResponseWriter: w},
+			rules:            rules,
+		}, r)
+	})
+}
+
+func (w *headerRulesWriter) apply() {
+	if !w.applied {
+		w.applied = true
+		applyHeaderRules(w.Header(), w.rules)
+	}
+}
+
+// WriteHeader applies the rules to the final response and writes the status.
+func (w *headerRulesWriter) WriteHeader(status int) {
+	if status >= 200 {
+		w.apply()
+	}
+	w.ResponseRecorder.WriteHeader(status)
+}
+
+// Write applies the rules, if the headers have not been written, and writes b.
+func (w *headerRulesWriter) Write(b []byte) (int, error) {
+	w.apply()
+	return w.ResponseRecorder.Write(b)
+}
+
+// Flush applies the rules, if the headers have not been written, and flushes.
+func (w *headerRulesWriter) Flush() {
+	w.apply()
+	w.ResponseRecorder.Flush()
+}
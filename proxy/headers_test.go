@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStripIdentityHeaders(t *testing.T) {
+	var hdr http.Header
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hdr = r.Header
+	}))
+	defer s.Close()
+
+	b := backendFor(t, fmt.Sprintf(`{"from": "a.com", "to": "%s", "paths": [{"path": "/*", "public": true}]}`, s.URL))
+	b.AuthProvider = &stubProvider{}
+	b.Ctx.StripHeaders = []string{"x-forwarded-user"}
+
+	r := httptest.NewRequest("GET", "http://a.com/", nil)
+	r.Header.Set("Underpants-Email", "admin@a.com")
+	r.Header.Set("Underpants-Groups", "admin")
+	r.Header.Set("X-Underpants-Email", "admin@a.com")
+	r.Header["x-underpants-name"] = []string{"Admin"}
+	r.Header.Set("X-Forwarded-User", "admin")
+	r.Header.Set("X-Other", "ok")
+
+	w := httptest.NewRecorder()
+	b.serveHTTPProxy(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	for _, name := range []string{
+		"Underpants-Email",
+		"Underpants-Groups",
+		"X-Underpants-Email",
+		"X-Underpants-Name",
+		"X-Forwarded-User",
+	} {
+		if v := hdr.Get(name); v != "" {
+			t.Fatalf("expected %s to be stripped, got %q", name, v)
+		}
+	}
+
+	if v := hdr.Get("X-Other"); v != "ok" {
+		t.Fatalf("expected X-Other to be passed on, got %q", v)
+	}
+}
+
+func TestHeaderRules(t *testing.T) {
+	var hdr http.Header
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hdr = r.Header
+		w.Header().Set("Server", "internal/1.0")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("Link", "<http://internal/a>; rel=next")
+	}))
+	defer s.Close()
+
+	b := backendFor(t, fmt.Sprintf(`{
+		"from": "a.com",
+		"to": "%s",
+		"paths": [{"path": "/*", "public": true}],
+		"request-headers": {
+			"remove": ["x-debug"],
+			"set": {"X-Api-Key": "secret", "Underpants-Email": "admin@a.com"}
+		},
+		"response-headers": {
+			"remove": ["Server", "X-Frame-Options"],
+			"rewrite": [{"header": "link", "match": "http://internal/", "replace": "https://a.com/"}],
+			"add": {"X-Served-By": "underpants"}
+		}
+	}`, s.URL))
+	b.AuthProvider = &stubProvider{}
+
+	h := withResponseHeaderRules(b.Route.ResponseHeaders, b)
+
+	r := httptest.NewRequest("GET", "http://a.com/", nil)
+	r.Header.Set("X-Debug", "1")
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if hdr.Get("X-Debug") != "" ||
+		hdr.Get("X-Api-Key") != "secret" ||
+		hdr.Get("Underpants-Email") != "" {
+		t.Fatalf("unexpected request headers %v", hdr)
+	}
+
+	if w.Header().Get("Server") != "" ||
+		w.Header().Get("X-Frame-Options") != "" ||
+		w.Header().Get("Link") != "<https://a.com/a>; rel=next" ||
+		w.Header().Get("X-Served-By") != "underpants" {
+		t.Fatalf("unexpected response headers %v", w.Header())
+	}
+}
@@ -0,0 +1,234 @@
+package proxy
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/kellegous/underpants/config"
+
+	"go.uber.org/zap"
+)
+
+// HealthState is the health of one of a route's backends, as determined by active
+// health checks.
+type HealthState struct {
+	URL       string       `json:"url"`
+	Healthy   bool         `json:"healthy"`
+	Successes int          `json:"consecutive-successes"`
+	Failures  int          `json:"consecutive-failures"`
+	Last      *CheckResult `json:"last-check,omitempty"`
+}
+
+// health periodically checks each of a route's backends so that those that are
+// unhealthy can be taken out of rotation.
+type health struct {
+	interval           time.Duration
+	timeout            time.Duration
+	healthyThreshold   int
+	unhealthyThreshold int
+
+	lck    sync.Mutex
+	states map[string]*HealthState
+
+	stop chan struct{}
+}
+
+// backendURLs are the URLs of all of the route's backends.
+func backendURLs(route *config.RouteInfo) []*url.URL {
+	var urls []*url.URL
+	urls = append(urls, route.ToURLs()...)
+	urls = append(urls, route.FailoverURLs()...)
+	return append(urls, canaryURLs(route)...)
+}
+
+// newHealth creates the active health checks for a route, which is nil if the route
+// does not have them. Backends start out healthy.
+func newHealth(route *config.RouteInfo) *health {
+	hc := route.HealthCheck
+	if hc == nil || hc.Interval <= 0 {
+		return nil
+	}
+
+	h := &health{
+		interval:           time.Duration(hc.Interval) * time.Second,
+		timeout:            time.Duration(hc.TimeoutMs) * time.Millisecond,
+		healthyThreshold:   hc.HealthyThreshold,
+		unhealthyThreshold: hc.UnhealthyThreshold,
+		states:             map[string]*HealthState{},
+		stop:               make(chan struct{}),
+	}
+
+	for _, u := range backendURLs(route) {
+		h.states[u.String()] = &HealthState{
+			URL:     u.String(),
+			Healthy: true,
+		}
+	}
+
+	return h
+}
+
+// update tracks the health of the backends at urls, which start out healthy if they
+// are new, and stops tracking backends that are no longer among them.
+func (h *health) update(urls []*url.URL) {
+	if h == nil {
+		return
+	}
+
+	h.lck.Lock()
+	defer h.lck.Unlock()
+
+	states := map[string]*HealthState{}
+	for _, u := range urls {
+		s := h.states[u.String()]
+		if s == nil {
+			s = &HealthState{
+				URL:     u.String(),
+				Healthy: true,
+			}
+		}
+		states[u.String()] = s
+	}
+	h.states = states
+}
+
+// isHealthy determines if the backend at u is in rotation.
+func (h *health) isHealthy(u *url.URL) bool {
+	if h == nil {
+		return true
+	}
+
+	h.lck.Lock()
+	defer h.lck.Unlock()
+
+	s := h.states[u.String()]
+	return s == nil || s.Healthy
+}
+
+// record updates the health of the backend at base with the result of a check.
+func (h *health) record(route string, base *url.URL, res *CheckResult) {
+	h.lck.Lock()
+	defer h.lck.Unlock()
+
+	s := h.states[base.String()]
+	if s == nil {
+		return
+	}
+	s.Last = res
+
+	if res.Healthy {
+		s.Successes++
+		s.Failures = 0
+		if !s.Healthy && s.Successes >= h.healthyThreshold {
+			s.Healthy = true
+			zap.L().Info("backend is healthy",
+				zap.String("from", route),
+				zap.String("url", s.URL))
+		}
+		return
+	}
+
+	s.Failures++
+	s.Successes = 0
+	if s.Healthy && s.Failures >= h.unhealthyThreshold {
+		s.Healthy = false
+		zap.L().Warn("backend is unhealthy",
+			zap.String("from", route),
+			zap.String("url", s.URL),
+			zap.String("error", res.Error),
+			zap.Int("status", res.Status))
+	}
+}
+
+// Health reports the health of each of the route's backends, it is empty unless the
+// route has active health checks.
+func (b *Backend) Health() []*HealthState {
+	h := b.health
+	if h == nil {
+		return nil
+	}
+
+	h.lck.Lock()
+	defer h.lck.Unlock()
+
+	var states []*HealthState
+	for _, u := range b.upstreamURLs() {
+		if s := h.states[u.String()]; s != nil {
+			c := *s
+			states = append(states, &c)
+		}
+	}
+	return states
+}
+
+// upstreamURLs are the URLs of all of the route's backends, including those that have
+// been found by resolving its hosts.
+func (b *Backend) upstreamURLs() []*url.URL {
+	if b.balancer == nil {
+		return backendURLs(b.Route)
+	}
+	urls := append(b.balancer.urls(), b.Route.FailoverURLs()...)
+	return append(urls, canaryURLs(b.Route)...)
+}
+
+// isHealthy determines if the backend at u is in rotation.
+func (b *Backend) isHealthy(u *url.URL) bool {
+	return b.health.isHealthy(u)
+}
+
+// checkHealth checks each of the route's backends once.
+func (b *Backend) checkHealth() {
+	h := b.health
+
+	var wg sync.WaitGroup
+	for _, u := range b.upstreamURLs() {
+		wg.Add(1)
+		go func(u *url.URL) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+			defer cancel()
+			h.record(b.Route.From, u, b.check(ctx, u))
+		}(u)
+	}
+	wg.Wait()
+}
+
+// runHealthChecks checks each of the route's backends every interval until the
+// backend is closed.
+func (b *Backend) runHealthChecks() {
+	h := b.health
+	if h == nil {
+		return
+	}
+
+	t := time.NewTicker(h.interval)
+	defer t.Stop()
+
+	for {
+		b.checkHealth()
+
+		select {
+		case <-t.C:
+		case <-h.stop:
+			return
+		}
+	}
+}
+
+// Close stops the backend's active health checks, the resolution of its hosts and the
+// watching of its allow-file.
+func (b *Backend) Close() {
+	if b.health != nil {
+		close(b.health.stop)
+	}
+
+	if b.resolver != nil {
+		close(b.resolver.stop)
+	}
+
+	if b.allowFile != nil {
+		close(b.allowFile.stop)
+	}
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestActiveHealthChecks(t *testing.T) {
+	var sick int32 = 1
+	var hits []string
+	newServer := func(name string, flaky bool) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/healthz" {
+				if flaky && atomic.LoadInt32(&sick) == 1 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+				return
+			}
+			hits = append(hits, name)
+		}))
+	}
+
+	a, c := newServer("a", true), newServer("c", false)
+	defer a.Close()
+	defer c.Close()
+
+	b := backendFor(t, fmt.Sprintf(`{
+		"from": "a.com",
+		"to": ["%s", "%s"],
+		"paths": [{"path": "/*", "public": true}],
+		"health-check": {"path": "/healthz", "interval": 10, "unhealthy-threshold": 2}
+	}`, a.URL, c.URL))
+	b.AuthProvider = &stubProvider{}
+	b.balancer = newBalancer(b.Route)
+	b.health = newHealth(b.Route)
+
+	get := func() {
+		w := httptest.NewRecorder()
+		b.serveHTTPProxy(w, httptest.NewRequest("GET", "http://a.com/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+	}
+
+	// a single failed check is not enough to take a out of rotation.
+	b.checkHealth()
+	get()
+	get()
+	if fmt.Sprint(hits) != "[a c]" {
+		t.Fatalf("expected both backends in rotation, got %v", hits)
+	}
+
+	b.checkHealth()
+	hits = nil
+	get()
+	get()
+	if fmt.Sprint(hits) != "[c c]" {
+		t.Fatalf("expected only c in rotation, got %v", hits)
+	}
+
+	states := b.Health()
+	if len(states) != 2 || states[0].Healthy || states[0].Failures != 2 ||
+		!states[1].Healthy {
+		t.Fatalf("unexpected health %+v %+v", states[0], states[1])
+	}
+
+	// a comes back after healthy-threshold checks pass.
+	atomic.StoreInt32(&sick, 0)
+	b.checkHealth()
+	if b.isHealthy(b.Route.ToURLs()[0]) {
+		t.Fatal("a should not be back in rotation after one check")
+	}
+
+	b.checkHealth()
+	if !b.isHealthy(b.Route.ToURLs()[0]) {
+		t.Fatal("a should be back in rotation")
+	}
+}
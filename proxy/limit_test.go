@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMaxBodyBytes(t *testing.T) {
+	var got string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		got = string(b)
+	}))
+	defer s.Close()
+
+	b := backendFor(t, fmt.Sprintf(`{
+		"from": "a.com",
+		"to": "%s",
+		"paths": [{"path": "/*", "public": true}],
+		"max-body-bytes": 8
+	}`, s.URL))
+	b.AuthProvider = &stubProvider{}
+
+	tests := []struct {
+		Body    string
+		Chunked bool
+		Status  int
+	}{
+		{"12345678", false, http.StatusOK},
+		{"123456789", false, http.StatusRequestEntityTooLarge},
+		{"12345678", true, http.StatusOK},
+		{"123456789", true, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, test := range tests {
+		got = ""
+
+		var body io.Reader = strings.NewReader(test.Body)
+		if test.Chunked {
+			// hide the length, as with a chunked upload.
+			body = ioutil.NopCloser(body)
+		}
+
+		r := httptest.NewRequest("POST", "http://a.com/", body)
+		if test.Chunked {
+			r.ContentLength = -1
+		}
+
+		w := httptest.NewRecorder()
+		b.serveHTTPProxy(w, r)
+
+		if w.Code != test.Status {
+			t.Fatalf("%q (chunked %v): expected status %d, got %d",
+				test.Body, test.Chunked, test.Status, w.Code)
+		}
+
+		if test.Status == http.StatusOK && got != test.Body {
+			t.Fatalf("expected backend to get %q, got %q", test.Body, got)
+		}
+	}
+}
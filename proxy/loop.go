@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/kellegous/underpants/internal"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// loopCookieKey is the name of the cookie that counts the number of times a user
+	// has been sent through the auth flow without coming back authenticated.
+	loopCookieKey = "u_loop"
+
+	// loopCookieMaxAge is the age (in seconds) of the loop cookie. Only redirects that
+	// happen in quick succession count towards a loop.
+	loopCookieMaxAge = 60
+)
+
+var loopTmpl = template.Must(template.New("loop").Parse(`<!DOCTYPE html>
+<html>
+  <head>
+    <title>Authentication is looping</title>
+  </head>
+  <body>
+    <h1>Authentication is looping</h1>
+    <p>
+      You have been sent to sign in {{.Count}} times in a row for {{.Host}} without
+      coming back signed in, so underpants has stopped redirecting you.
+    </p>
+    <p>The last attempt failed because: <code>{{.Reason}}</code></p>
+    <ul>
+      {{range .Hints}}<li>{{.}}</li>{{end}}
+    </ul>
+    <p><a href="{{.Retry}}">Try again</a></p>
+  </body>
+</html>
+`))
+
+// signLoopCount signs a loop count with the given key.
+func signLoopCount(key []byte, n int) string {
+	h := hmac.New(sha256.New, key)
+	fmt.Fprintf(h, "loop:%d", n)
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// loopCount is the number of consecutive auth redirects recorded in the request's
+// loop cookie. Missing or invalid cookies count as 0.
+func (b *Backend) loopCount(r *http.Request) int {
+	c, err := r.Cookie(loopCookieKey)
+	if err != nil {
+		return 0
+	}
+
+	s := strings.SplitN(c.Value, ".", 2)
+	if len(s) != 2 {
+		return 0
+	}
+
+	n, err := strconv.Atoi(s[0])
+	if err != nil || n < 0 {
+		return 0
+	}
+
+	if !hmac.Equal([]byte(s[1]), []byte(signLoopCount(b.Ctx.Key, n))) {
+		return 0
+	}
+
+	return n
+}
+
+// setLoopCount records the number of consecutive auth redirects in the loop cookie.
+func (b *Backend) setLoopCount(w http.ResponseWriter, n int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     loopCookieKey,
+		Value:    fmt.Sprintf("%d.%s", n, signLoopCount(b.Ctx.Key, n)),
+		Path:     "/",
+		MaxAge:   loopCookieMaxAge,
+		HttpOnly: true,
+		Secure:   b.Ctx.IsSecure(),
+	})
+}
+
+// resetLoopCount clears the loop cookie.
+func (b *Backend) resetLoopCount(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   loopCookieKey,
+		Value:  "",
+		Path:   "/",
+		MaxAge: -1,
+	})
+}
+
+// loopHints returns the likely causes of an auth loop given the current request.
+func (b *Backend) loopHints(r *http.Request) []string {
+	var hints []string
+
+	if b.Ctx.IsSecure() && r.TLS == nil && internal.ForwardedScheme(r) != "https" {
+		hints = append(hints,
+			"This request arrived over http but session cookies are https only. "+
+				"If underpants is behind a load balancer that terminates TLS, it needs "+
+				"to be in trusted-proxies or cookies will never be sent back.")
+	}
+
+	if _, err := r.Cookie(b.Ctx.Sessions.CookieName()); err != nil {
+		hints = append(hints,
+			"Your browser is not sending the session cookie for this site. It may be "+
+				"blocking cookies.")
+	}
+
+	return append(hints,
+		"Your session may have been signed by a different instance of underpants "+
+			"or by one that has since been restarted.",
+		"Your account may not be permitted by the configured domain, or the clock "+
+			"on this server may be wrong so new sessions appear expired.")
+}
+
+// serveAuthLoop responds with a page explaining that authentication is looping.
+func (b *Backend) serveAuthLoop(w http.ResponseWriter, r *http.Request, n int, reason error) {
+	zap.L().Warn("authentication loop detected",
+		zap.String("host", r.Host),
+		zap.String("uri", r.RequestURI),
+		zap.Int("count", n),
+		zap.Error(reason))
+
+	b.resetLoopCount(w)
+	w.Header().Set("Content-Type", "text/html;charset=utf-8")
+	w.WriteHeader(http.StatusLoopDetected)
+	if err := loopTmpl.Execute(w, struct {
+		Count  int
+		Host   string
+		Reason string
+		Hints  []string
+		Retry  string
+	}{n, r.Host, reason.Error(), b.loopHints(r), r.URL.RequestURI()}); err != nil {
+		zap.L().Error("unable to render auth loop page",
+			zap.Error(err))
+	}
+}
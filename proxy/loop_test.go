@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kellegous/underpants/config"
+)
+
+func loopCookieFrom(w *httptest.ResponseRecorder) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == loopCookieKey {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestLoopCount(t *testing.T) {
+	ctx, err := config.BuildContext(&config.Info{}, 80, []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Backend{Ctx: ctx}
+
+	r := httptest.NewRequest("GET", "http://a.com/", nil)
+	if n := b.loopCount(r); n != 0 {
+		t.Fatalf("expected 0 without a cookie, got %d", n)
+	}
+
+	w := httptest.NewRecorder()
+	b.setLoopCount(w, 3)
+
+	r = httptest.NewRequest("GET", "http://a.com/", nil)
+	r.AddCookie(loopCookieFrom(w))
+	if n := b.loopCount(r); n != 3 {
+		t.Fatalf("expected 3, got %d", n)
+	}
+
+	// a forged count is ignored.
+	c := loopCookieFrom(w)
+	c.Value = "1" + c.Value[1:]
+	r = httptest.NewRequest("GET", "http://a.com/", nil)
+	r.AddCookie(c)
+	if n := b.loopCount(r); n != 0 {
+		t.Fatalf("expected forged count to be ignored, got %d", n)
+	}
+}
+
+func TestServeAuthLoop(t *testing.T) {
+	ctx, err := config.BuildContext(&config.Info{}, 80, []byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Backend{Ctx: ctx}
+
+	w := httptest.NewRecorder()
+	b.serveAuthLoop(w,
+		httptest.NewRequest("GET", "http://a.com/x", nil),
+		6,
+		errors.New("empty cookie"))
+
+	if w.Code != http.StatusLoopDetected {
+		t.Fatalf("expected status %d, got %d", http.StatusLoopDetected, w.Code)
+	}
+
+	if c := loopCookieFrom(w); c == nil || c.MaxAge >= 0 {
+		t.Fatal("loop cookie should have been cleared")
+	}
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"html/template"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/internal"
+)
+
+var maintenanceTmpl = template.Must(template.New("maintenance").Parse(`<!DOCTYPE html>
+<html>
+  <head>
+    <title>Down for maintenance</title>
+  </head>
+  <body>
+    <h1>Down for maintenance</h1>
+    <p>
+      {{.Host}} is down for planned maintenance. Please try again in a little while.
+    </p>
+  </body>
+</html>
+`))
+
+// defaultRetryAfter is the Retry-After (in seconds) of routes without a maintenance
+// config that are put in maintenance through the administrative API.
+const defaultRetryAfter = 300
+
+// maintenance is the runtime state of a route's maintenance mode. Every route has one,
+// so that any route can be put in maintenance through the administrative API.
+type maintenance struct {
+	enabled    int32
+	retryAfter int
+	page       []byte
+}
+
+func newMaintenance(cfg *config.MaintenanceInfo) *maintenance {
+	if cfg == nil {
+		return &maintenance{
+			retryAfter: defaultRetryAfter,
+		}
+	}
+
+	m := &maintenance{
+		retryAfter: cfg.RetryAfter,
+		page:       cfg.PageHTML(),
+	}
+	if cfg.Enabled {
+		m.enabled = 1
+	}
+	return m
+}
+
+// SetMaintenance puts the backend in, or takes it out of, maintenance. It lasts until
+// the config is reloaded.
+func (b *Backend) SetMaintenance(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&b.maintenance.enabled, v)
+}
+
+// InMaintenance determines if the backend is serving its maintenance page instead of
+// proxying.
+func (b *Backend) InMaintenance() bool {
+	return b.maintenance != nil && atomic.LoadInt32(&b.maintenance.enabled) == 1
+}
+
+// serveMaintenance responds with the route's maintenance page.
+func (b *Backend) serveMaintenance(w http.ResponseWriter, r *http.Request) {
+	m := b.maintenance
+
+	w.Header().Set("Retry-After", strconv.Itoa(m.retryAfter))
+
+	if m.page != nil {
+		w.Header().Set("Content-Type", "text/html;charset=utf-8")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write(m.page)
+		return
+	}
+
+	internal.ServeErrorPage(b.Ctx, w, r, &internal.ErrorPage{
+		Status:  http.StatusServiceUnavailable,
+		Message: r.Host + " is down for planned maintenance. Please try again in a little while.",
+		Route:   b.Route.From,
+	}, maintenanceTmpl)
+}
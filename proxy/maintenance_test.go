@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMaintenance(t *testing.T) {
+	var calls int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer s.Close()
+
+	f, err := ioutil.TempFile("", "maintenance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.WriteString("<h1>Back at noon</h1>"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	b := backendFor(t, fmt.Sprintf(`{
+		"from": "a.com",
+		"to": "%s",
+		"paths": [{"path": "/*", "public": true}],
+		"maintenance": {"enabled": true, "page": "%s", "retry-after": 600}
+	}`, s.URL, f.Name()))
+	b.AuthProvider = &stubProvider{}
+	b.maintenance = newMaintenance(b.Route.Maintenance)
+
+	w := httptest.NewRecorder()
+	b.serveHTTPProxy(w, httptest.NewRequest("GET", "http://a.com/", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "600" {
+		t.Fatalf("expected 503 with Retry-After of 600, got %d %q",
+			w.Code, w.Header().Get("Retry-After"))
+	}
+
+	if w.Body.String() != "<h1>Back at noon</h1>" {
+		t.Fatalf("expected the configured page, got %q", w.Body.String())
+	}
+
+	b.SetMaintenance(false)
+
+	w = httptest.NewRecorder()
+	b.serveHTTPProxy(w, httptest.NewRequest("GET", "http://a.com/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 out of maintenance, got %d", w.Code)
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Fatalf("expected the backend to see 1 request, got %d", n)
+	}
+
+	// routes without a maintenance config get the default page.
+	b.maintenance = newMaintenance(nil)
+	b.SetMaintenance(true)
+
+	w = httptest.NewRecorder()
+	b.serveHTTPProxy(w, httptest.NewRequest("GET", "http://a.com/", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "300" ||
+		!strings.Contains(w.Body.String(), "a.com is down for planned maintenance") {
+		t.Fatalf("expected the default maintenance page, got %d %q", w.Code, w.Body.String())
+	}
+}
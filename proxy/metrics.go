@@ -0,0 +1,26 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/kellegous/underpants/internal"
+	"github.com/kellegous/underpants/metrics"
+)
+
+// instrument records the status and latency of each request to the route.
+func instrument(m *metrics.Metrics, route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := &internal.ResponseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rw, r)
+
+		status := rw.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		m.Requests.Inc(route, strconv.Itoa(status))
+		m.Latency.Observe(time.Since(start).Seconds(), route)
+	})
+}
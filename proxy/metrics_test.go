@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer s.Close()
+
+	b := backendFor(t, fmt.Sprintf(`{
+		"from": "a.com",
+		"to": "%s",
+		"paths": [{"path": "/public/*", "public": true}]
+	}`, s.URL))
+	b.AuthProvider = &stubProvider{}
+
+	h := instrument(b.Ctx.Metrics, b.Route.From, b)
+	for _, path := range []string{"/public/x", "/private"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://a.com"+path, nil))
+	}
+
+	// the backend goes away.
+	s.Close()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://a.com/public/x", nil))
+
+	w := httptest.NewRecorder()
+	b.Ctx.Metrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	for _, line := range []string{
+		`underpants_requests_total{route="a.com",code="418"} 1`,
+		`underpants_requests_total{route="a.com",code="302"} 1`,
+		`underpants_requests_total{route="a.com",code="502"} 1`,
+		`underpants_request_duration_seconds_count{route="a.com"} 3`,
+		`underpants_upstream_errors_total{route="a.com",code="502"} 1`,
+		`underpants_auth_total{route="a.com",outcome="redirected"} 1`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Fatalf("expected %s in metrics:\n%s", line, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/user"
+
+	"go.uber.org/zap"
+)
+
+// maxMirrorBody is the largest request body that is copied to a shadow backend.
+// Requests with larger bodies are not mirrored.
+const maxMirrorBody = 1 << 20
+
+// maxMirrorsInFlight is the number of copies of requests that may be waiting on the
+// shadow backend at once. Requests beyond that are not mirrored, so that a slow shadow
+// backend cannot pile up work in underpants.
+const maxMirrorsInFlight = 100
+
+// mirror sends copies of a route's requests to its shadow backend.
+type mirror struct {
+	cfg     *config.MirrorInfo
+	timeout time.Duration
+
+	// inFlight is the number of copies waiting on the shadow backend.
+	inFlight int64
+}
+
+// newMirror creates the mirror for a route, which is nil if the route is not mirrored.
+func newMirror(cfg *config.MirrorInfo) *mirror {
+	if cfg == nil {
+		return nil
+	}
+
+	return &mirror{
+		cfg:     cfg,
+		timeout: time.Duration(cfg.TimeoutMs) * time.Millisecond,
+	}
+}
+
+// applies determines if a copy of the request should be sent to the shadow backend.
+// Websocket upgrades are not copied, since there is no one to talk to the copy.
+func (m *mirror) applies(r *http.Request) bool {
+	return m.cfg.Mirrors(r.Method) && !isWebSocketUpgrade(r) &&
+		(m.cfg.Percent >= 100 || rand.Float64()*100 < m.cfg.Percent)
+}
+
+// sendMirror copies the request to the route's shadow backend, in the background, and
+// returns the body to send on to the route's backend in its place. The shadow
+// backend's response is discarded.
+func (b *Backend) sendMirror(r *http.Request, u *user.Info, body io.ReadCloser) (io.ReadCloser, error) {
+	m := b.mirror
+	if m == nil || !m.applies(r) {
+		return body, nil
+	}
+
+	var mb io.Reader = http.NoBody
+	if body != http.NoBody {
+		buf, rest, ok, err := bufferBody(body, maxMirrorBody)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			return rest, nil
+		}
+		body = ioutil.NopCloser(bytes.NewReader(buf))
+		mb = bytes.NewReader(buf)
+	}
+
+	if atomic.AddInt64(&m.inFlight, 1) > maxMirrorsInFlight {
+		atomic.AddInt64(&m.inFlight, -1)
+		return body, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	br, err := b.newBackendRequest(r.WithContext(ctx), m.cfg.ToURL(), mb, u)
+	if err != nil {
+		cancel()
+		atomic.AddInt64(&m.inFlight, -1)
+		return body, nil
+	}
+
+	go func() {
+		defer atomic.AddInt64(&m.inFlight, -1)
+		defer cancel()
+
+		bp, err := b.roundTripper().RoundTrip(br)
+		if err != nil {
+			zap.L().Debug("mirrored request failed",
+				zap.String("from", b.Route.From),
+				zap.String("uri", r.RequestURI),
+				zap.Error(err))
+			return
+		}
+		defer bp.Body.Close()
+		io.Copy(ioutil.Discard, bp.Body)
+	}()
+
+	return body, nil
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirror(t *testing.T) {
+	var body string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+		fmt.Fprint(w, "primary")
+	}))
+	defer s.Close()
+
+	mirrored := make(chan string, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mirrored <- r.Method + " " + r.URL.Path + " " + string(b)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadow.Close()
+
+	b := backendFor(t, fmt.Sprintf(`{
+		"from": "a.com",
+		"to": "%s",
+		"mirror": {"to": "%s", "methods": ["post"]},
+		"paths": [{"path": "/*", "public": true}]
+	}`, s.URL, shadow.URL))
+	b.AuthProvider = &stubProvider{}
+	b.mirror = newMirror(b.Route.Mirror)
+
+	w := httptest.NewRecorder()
+	b.serveHTTPProxy(w, httptest.NewRequest("POST", "http://a.com/x", strings.NewReader("hello")))
+	if w.Code != http.StatusOK || w.Body.String() != "primary" || body != "hello" {
+		t.Fatalf("expected the primary response, got %d %q (sent %q)",
+			w.Code, w.Body.String(), body)
+	}
+
+	select {
+	case m := <-mirrored:
+		if m != "POST /x hello" {
+			t.Fatalf("unexpected mirrored request %q", m)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the request to be mirrored")
+	}
+
+	// only the configured methods are mirrored.
+	w = httptest.NewRecorder()
+	b.serveHTTPProxy(w, httptest.NewRequest("GET", "http://a.com/y", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	select {
+	case m := <-mirrored:
+		t.Fatalf("expected GET not to be mirrored, got %q", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
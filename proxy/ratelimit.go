@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/user"
+
+	"go.uber.org/zap"
+)
+
+// sweepInterval is how often buckets that have refilled are forgotten.
+const sweepInterval = time.Minute
+
+// bucket is a token bucket, holding the requests a client may still make.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter limits the rate of requests of each client with a token bucket per client.
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	lck       sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// NewLimiter creates a rate limiter that lets each client make rate requests per
+// second on average, with bursts of up to burst requests.
+func NewLimiter(rate float64, burst int) *Limiter {
+	return &Limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: map[string]*bucket{},
+	}
+}
+
+// newLimiter creates the rate limiter for a route, which is nil if the route is not
+// rate limited.
+func newLimiter(cfg *config.RateLimitInfo) *Limiter {
+	if cfg == nil {
+		return nil
+	}
+	return NewLimiter(cfg.Rate, cfg.Burst)
+}
+
+// Allow takes a token from the client's bucket. If the bucket is empty, the time
+// until a token will be available is returned.
+func (l *Limiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	l.lck.Lock()
+	defer l.lck.Unlock()
+
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		l.sweep(now)
+	}
+
+	bk := l.buckets[key]
+	if bk == nil {
+		bk = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = bk
+	}
+
+	bk.tokens = math.Min(l.burst, bk.tokens+now.Sub(bk.last).Seconds()*l.rate)
+	bk.last = now
+
+	if bk.tokens < 1 {
+		return false, time.Duration((1 - bk.tokens) / l.rate * float64(time.Second))
+	}
+
+	bk.tokens--
+	return true, 0
+}
+
+// sweep forgets the buckets that would have refilled by now, since they are the same
+// as new buckets.
+func (l *Limiter) sweep(now time.Time) {
+	for key, bk := range l.buckets {
+		if bk.tokens+now.Sub(bk.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// rateLimitKey identifies the client for rate limiting, by email for users and by
+// address for anonymous requests.
+func rateLimitKey(r *http.Request, u *user.Info) string {
+	if u != nil {
+		return "user:" + strings.ToLower(u.Email)
+	}
+	return "ip:" + clientIP(r).String()
+}
+
+// serveRateLimited answers requests from clients that have exceeded the route's rate
+// limit.
+func (b *Backend) serveRateLimited(
+	w http.ResponseWriter,
+	r *http.Request,
+	key string,
+	retryAfter time.Duration) {
+	zap.L().Info("rate limited",
+		zap.String("from", b.Route.From),
+		zap.String("client", key),
+		zap.String("uri", r.RequestURI))
+
+	w.Header().Set("Retry-After",
+		strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w,
+		http.StatusText(http.StatusTooManyRequests),
+		http.StatusTooManyRequests)
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/user"
+)
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(&config.RateLimitInfo{Rate: 2, Burst: 3})
+
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.Allow("a", now); !ok {
+			t.Fatalf("request %d should have been allowed by the burst", i)
+		}
+	}
+
+	ok, after := l.Allow("a", now)
+	if ok || after != 500*time.Millisecond {
+		t.Fatalf("expected to wait 500ms, got %v %s", ok, after)
+	}
+
+	// other clients have their own buckets.
+	if ok, _ := l.Allow("b", now); !ok {
+		t.Fatal("b should not be limited by a")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := l.Allow("a", now); !ok {
+		t.Fatal("a token should have been added after 500ms")
+	}
+
+	// buckets that have refilled are forgotten.
+	l.sweep(now.Add(time.Minute))
+	if len(l.buckets) != 0 {
+		t.Fatalf("expected all buckets to be swept, got %d", len(l.buckets))
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer s.Close()
+
+	b := backendFor(t, fmt.Sprintf(`{
+		"from": "a.com",
+		"to": "%s",
+		"paths": [{"path": "/public/*", "public": true}],
+		"rate-limit": {"rate": 0.1}
+	}`, s.URL))
+	b.AuthProvider = &stubProvider{}
+	b.limiter = newLimiter(b.Route.RateLimit)
+
+	v, err := b.Ctx.Sessions.Encode(&user.Info{
+		Email:             "a@a.com",
+		LastAuthenticated: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Path   string
+		User   bool
+		Addr   string
+		Status int
+	}{
+		{"/x", true, "10.0.0.1:1", http.StatusOK},
+		// the user is limited no matter where they come from.
+		{"/x", true, "10.0.0.2:1", http.StatusTooManyRequests},
+		// anonymous clients are limited by address.
+		{"/public/x", false, "10.0.0.1:1", http.StatusOK},
+		{"/public/x", false, "10.0.0.1:2", http.StatusTooManyRequests},
+		{"/public/x", false, "10.0.0.2:1", http.StatusOK},
+	}
+
+	for i, test := range tests {
+		r := httptest.NewRequest("GET", "http://a.com"+test.Path, nil)
+		r.RemoteAddr = test.Addr
+		if test.User {
+			r.AddCookie(&http.Cookie{Name: user.CookieKey, Value: v})
+		}
+
+		w := httptest.NewRecorder()
+		b.serveHTTPProxy(w, r)
+
+		if w.Code != test.Status {
+			t.Fatalf("test %d: expected status %d, got %d", i, test.Status, w.Code)
+		}
+
+		if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "10" {
+			t.Fatalf("test %d: expected Retry-After of 10, got %q",
+				i, w.Header().Get("Retry-After"))
+		}
+	}
+}
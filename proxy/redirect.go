@@ -0,0 +1,25 @@
+package proxy
+
+import (
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// serveRedirect redirects the request to the route's To URL, for routes that redirect
+// instead of proxying.
+func (b *Backend) serveRedirect(w http.ResponseWriter, r *http.Request) {
+	u, err := b.backendURL(r, b.Route.ToURL())
+	if err != nil {
+		zap.L().Info("unable to build redirect",
+			zap.String("from", b.Route.From),
+			zap.String("uri", r.RequestURI),
+			zap.Error(err))
+		http.Error(w,
+			http.StatusText(http.StatusBadRequest),
+			http.StatusBadRequest)
+		return
+	}
+
+	http.Redirect(w, r, u.String(), b.Route.Redirect)
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRedirect(t *testing.T) {
+	b := backendFor(t, `{
+		"from": "go.com/wiki",
+		"to": "https://wiki.internal/pages/",
+		"strip-prefix": true,
+		"redirect": 301,
+		"public-paths": ["/wiki/public/*"]
+	}`)
+	b.AuthProvider = &stubProvider{}
+
+	for uri, expected := range map[string]string{
+		"/wiki/public/faq?q=1": "https://wiki.internal/pages/public/faq?q=1",
+		"/wiki/public/":        "https://wiki.internal/pages/public/",
+	} {
+		w := httptest.NewRecorder()
+		b.serveHTTPProxy(w, httptest.NewRequest("GET", "http://go.com"+uri, nil))
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != expected {
+			t.Fatalf("expected a redirect to %s, got %d %q",
+				expected, w.Code, w.Header().Get("Location"))
+		}
+	}
+
+	// everything else is still behind sign in.
+	w := httptest.NewRecorder()
+	b.serveHTTPProxy(w, httptest.NewRequest("GET", "http://go.com/wiki", nil))
+	if !strings.HasPrefix(w.Header().Get("Location"), "http://hub.com/auth") {
+		t.Fatalf("expected a redirect to sign in, got %d %q",
+			w.Code, w.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kellegous/underpants/auth"
+	"github.com/kellegous/underpants/user"
+
+	"go.uber.org/zap"
+)
+
+// refresh silently re-validates the user of an expired session with the provider,
+// using the refresh token kept in the session. If that succeeds, a new session is
+// issued and the user is returned. Otherwise nil is returned and the user has to sign
+// in again.
+func (b *Backend) refresh(w http.ResponseWriter, r *http.Request) *user.Info {
+	rp, ok := b.AuthProvider.(auth.Refresher)
+	if !ok || !b.Ctx.Oauth.RefreshTokens {
+		return nil
+	}
+
+	old, err := b.Ctx.Sessions.Refreshable(r)
+	if err != nil {
+		return nil
+	}
+
+	tok, err := b.Ctx.Sessions.OpenToken(old.RefreshToken)
+	if err != nil {
+		zap.L().Info("unable to open refresh token",
+			zap.String("user", old.Email),
+			zap.Error(err))
+		return nil
+	}
+
+	u, err := rp.Refresh(b.Ctx.ForHost(b.Route.Host()), tok)
+	if err != nil {
+		zap.L().Info("unable to refresh session",
+			zap.String("user", old.Email),
+			zap.Error(err))
+		return nil
+	}
+
+	if !strings.EqualFold(u.Email, old.Email) {
+		zap.L().Info("refreshed session has a different user",
+			zap.String("user", old.Email),
+			zap.String("refreshed", u.Email))
+		return nil
+	}
+
+	if b.Ctx.Oauth.RequireVerifiedEmail && !u.EmailVerified {
+		return nil
+	}
+
+	if u.RefreshToken == "" {
+		u.RefreshToken = old.RefreshToken
+	} else if u.RefreshToken, err = b.Ctx.Sessions.SealToken(u.RefreshToken); err != nil {
+		zap.L().Error("unable to seal refresh token",
+			zap.String("user", u.Email),
+			zap.Error(err))
+		return nil
+	}
+
+	u.Provider = old.Provider
+	u.LastAuthenticated = time.Now()
+	u.LastSignIn = old.SignedIn()
+
+	// the expired session is replaced.
+	if err := b.Ctx.Sessions.Destroy(r); err != nil {
+		zap.L().Error("unable to destroy session",
+			zap.Error(err))
+	}
+
+	v, err := b.Ctx.Sessions.Encode(u)
+	if err != nil {
+		zap.L().Error("unable to encode refreshed session",
+			zap.String("user", u.Email),
+			zap.Error(err))
+		return nil
+	}
+
+	http.SetCookie(w, b.sessions().NewCookie(v))
+
+	zap.L().Info("refreshed session",
+		zap.String("user", u.Email))
+
+	return u
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/user"
+)
+
+// refreshingProvider is a stubProvider that can refresh users.
+type refreshingProvider struct {
+	stubProvider
+	tokens map[string]string
+}
+
+func (p *refreshingProvider) Refresh(ctx *config.Context, token string) (*user.Info, error) {
+	email, ok := p.tokens[token]
+	if !ok {
+		return nil, errors.New("invalid refresh token")
+	}
+	return &user.Info{Email: email, EmailVerified: true}, nil
+}
+
+func TestRefresh(t *testing.T) {
+	var email string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		email = r.Header.Get("Underpants-Email")
+	}))
+	defer s.Close()
+
+	b := backendFor(t, fmt.Sprintf(`{"from": "a.com", "to": "%s"}`, s.URL))
+	b.Ctx.Oauth.RefreshTokens = true
+	b.Ctx.Sessions.MaxLifetime = time.Hour
+	b.AuthProvider = &refreshingProvider{
+		tokens: map[string]string{"good": "a@a.com"},
+	}
+
+	cookie := func(token string) *http.Cookie {
+		sealed, err := b.Ctx.Sessions.SealToken(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		v, err := b.Ctx.Sessions.Encode(&user.Info{
+			Email:             "a@a.com",
+			LastAuthenticated: time.Now().Add(-2 * time.Hour),
+			LastActive:        time.Now().Add(-10 * time.Minute),
+			RefreshToken:      sealed,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b.Ctx.Sessions.NewCookie(v)
+	}
+
+	tests := []struct {
+		Token  string
+		Status int
+	}{
+		{"good", http.StatusOK},
+		{"bad", http.StatusFound},
+	}
+
+	for _, test := range tests {
+		email = ""
+
+		r := httptest.NewRequest("GET", "http://a.com/", nil)
+		r.AddCookie(cookie(test.Token))
+
+		w := httptest.NewRecorder()
+		b.serveHTTPProxy(w, r)
+
+		if w.Code != test.Status {
+			t.Fatalf("%s: expected status %d, got %d", test.Token, test.Status, w.Code)
+		}
+
+		if test.Status != http.StatusOK {
+			continue
+		}
+
+		if email != "a%40a.com" {
+			t.Fatalf("%s: expected backend to see a@a.com, got %q", test.Token, email)
+		}
+
+		var c *http.Cookie
+		for _, rc := range w.Result().Cookies() {
+			if rc.Name == b.Ctx.Sessions.CookieName() {
+				c = rc
+			}
+		}
+
+		if c == nil {
+			t.Fatalf("%s: expected a new session cookie", test.Token)
+		}
+
+		u, err := b.Ctx.Sessions.FromRequest(httptest.NewRecorder(), func() *http.Request {
+			r := httptest.NewRequest("GET", "http://a.com/", nil)
+			r.AddCookie(c)
+			return r
+		}())
+		if err != nil {
+			t.Fatalf("%s: new session is invalid: %s", test.Token, err)
+		}
+
+		if tok, err := b.Ctx.Sessions.OpenToken(u.RefreshToken); err != nil || tok != "good" {
+			t.Fatalf("%s: expected refresh token to be kept, got %q (%v)", test.Token, tok, err)
+		}
+	}
+}
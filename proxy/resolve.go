@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/discovery"
+
+	"go.uber.org/zap"
+)
+
+// lookupHost and lookupSRV are how the hosts of resolved backends are looked up.
+var (
+	lookupHost = net.DefaultResolver.LookupHost
+	lookupSRV  = net.DefaultResolver.LookupSRV
+)
+
+// resolveTimeout limits how long looking up the hosts of a route's backends takes.
+const resolveTimeout = 10 * time.Second
+
+// consulRetryDelay is how long the resolver of consul backends waits to query the
+// catalog again after a failure.
+var consulRetryDelay = 5 * time.Second
+
+// resolver finds the backends of a route, periodically or as they change, and puts
+// them in rotation in place of those that were found before.
+type resolver struct {
+	// interval is how long to wait between lookups that do not wait for changes
+	// themselves, and after failed lookups.
+	interval time.Duration
+
+	// lookup finds the backends, ordered by URL, and an index to pass to the next call.
+	// Given a non-zero index, lookup waits until the backends may have changed.
+	lookup func(ctx context.Context, index uint64) ([]*upstream, uint64, error)
+
+	stop chan struct{}
+}
+
+// newResolver creates the resolver for a route, which is nil if the route's backends
+// are not resolved. The instances of consul backends are found in the catalog.
+func newResolver(route *config.RouteInfo, catalog *discovery.Catalog) *resolver {
+	if route.UsesConsul() {
+		return &resolver{
+			interval: consulRetryDelay,
+			lookup: func(ctx context.Context, index uint64) ([]*upstream, uint64, error) {
+				return lookupInstances(ctx, catalog, route.ToURLs(), index)
+			},
+			stop: make(chan struct{}),
+		}
+	}
+
+	rs := route.Resolve
+	if rs == nil {
+		return nil
+	}
+
+	return &resolver{
+		interval: time.Duration(rs.Interval) * time.Second,
+		lookup: func(ctx context.Context, index uint64) ([]*upstream, uint64, error) {
+			ctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+			defer cancel()
+			ups, err := lookupUpstreams(ctx, route.ToURLs(), rs.SRV)
+			return ups, 0, err
+		},
+		stop: make(chan struct{}),
+	}
+}
+
+// lookupInstances finds the healthy instances of the Consul services named by the
+// hosts of the URLs. Routes with a single service are watched for changes.
+func lookupInstances(
+	ctx context.Context,
+	catalog *discovery.Catalog,
+	urls []*url.URL,
+	index uint64) ([]*upstream, uint64, error) {
+	// a blocking query can only wait on one service.
+	if len(urls) > 1 {
+		index = 0
+	}
+
+	var ups []*upstream
+	var next uint64
+	for _, base := range urls {
+		instances, n, err := catalog.Instances(ctx, base.Hostname(), index)
+		if err != nil {
+			return nil, 0, err
+		}
+		next = n
+
+		for _, in := range instances {
+			u := *base
+			u.Host = net.JoinHostPort(in.Address, strconv.Itoa(in.Port))
+			ups = append(ups, &upstream{url: &u, weight: 1})
+		}
+	}
+
+	if len(urls) > 1 {
+		next = 0
+	}
+
+	sortUpstreams(ups)
+	return ups, next, nil
+}
+
+// lookupUpstreams finds the backends of each of the URLs, either by the addresses of
+// their hosts or, with srv, by the targets of their hosts' SRV records.
+func lookupUpstreams(ctx context.Context, urls []*url.URL, srv bool) ([]*upstream, error) {
+	var ups []*upstream
+	for _, base := range urls {
+		if srv {
+			_, addrs, err := lookupSRV(ctx, "", "", base.Hostname())
+			if err != nil {
+				return nil, err
+			}
+
+			for _, addr := range addrs {
+				u := *base
+				u.Host = net.JoinHostPort(
+					strings.TrimSuffix(addr.Target, "."),
+					strconv.Itoa(int(addr.Port)))
+				ups = append(ups, &upstream{url: &u, weight: 1})
+			}
+			continue
+		}
+
+		ips, err := lookupHost(ctx, base.Hostname())
+		if err != nil {
+			return nil, err
+		}
+
+		port := base.Port()
+		if port == "" {
+			port = "80"
+			if base.Scheme == "https" {
+				port = "443"
+			}
+		}
+
+		for _, ip := range ips {
+			u := *base
+			u.Host = net.JoinHostPort(ip, port)
+			ups = append(ups, &upstream{url: &u, host: base.Host, weight: 1})
+		}
+	}
+
+	sortUpstreams(ups)
+	return ups, nil
+}
+
+// sortUpstreams orders upstreams by URL.
+func sortUpstreams(ups []*upstream) {
+	sort.Slice(ups, func(i, j int) bool {
+		return ups[i].url.String() < ups[j].url.String()
+	})
+}
+
+// resolve looks up the route's backends once and puts them in rotation, returning the
+// index of the lookup. Failed lookups, and those that find no backends, leave the
+// current backends in rotation.
+func (b *Backend) resolve(ctx context.Context, index uint64) (uint64, error) {
+	ups, next, err := b.resolver.lookup(ctx, index)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(ups) == 0 {
+		zap.L().Warn("no backends found, keeping the current backends",
+			zap.String("from", b.Route.From))
+		return next, nil
+	}
+
+	var urls []string
+	for _, up := range ups {
+		urls = append(urls, up.url.String())
+	}
+
+	var current []string
+	for _, u := range b.balancer.urls() {
+		current = append(current, u.String())
+	}
+
+	if reflect.DeepEqual(urls, current) {
+		return next, nil
+	}
+
+	b.balancer.update(ups)
+	b.health.update(b.upstreamURLs())
+
+	zap.L().Info("backends changed",
+		zap.String("from", b.Route.From),
+		zap.Strings("urls", urls))
+
+	return next, nil
+}
+
+// runResolver finds the route's backends until the backend is closed, waiting for
+// them to change if the lookup can and every interval if it cannot.
+func (b *Backend) runResolver() {
+	rs := b.resolver
+	if rs == nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-rs.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var index uint64
+	for {
+		next, err := b.resolve(ctx, index)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err == nil && next != 0 {
+			index = next
+			continue
+		}
+
+		if err != nil {
+			zap.L().Warn("unable to resolve backends",
+				zap.String("from", b.Route.From),
+				zap.Error(err))
+		}
+
+		select {
+		case <-time.After(rs.interval):
+		case <-rs.stop:
+			return
+		}
+	}
+}
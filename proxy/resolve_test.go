@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/discovery"
+)
+
+func TestResolve(t *testing.T) {
+	var host string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+	}))
+	defer s.Close()
+
+	su, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ips []string
+	var lookupErr error
+	lookupHost = func(ctx context.Context, name string) ([]string, error) {
+		if name != "svc.internal" {
+			t.Fatalf("unexpected lookup of %s", name)
+		}
+		return ips, lookupErr
+	}
+	defer func() {
+		lookupHost = net.DefaultResolver.LookupHost
+	}()
+
+	b := backendFor(t, fmt.Sprintf(`{
+		"from": "a.com",
+		"to": "http://svc.internal:%s",
+		"resolve": {"interval": 5},
+		"paths": [{"path": "/*", "public": true}]
+	}`, su.Port()))
+	b.AuthProvider = &stubProvider{}
+	b.balancer = newBalancer(b.Route)
+	b.resolver = newResolver(b.Route, nil)
+
+	ips = []string{"127.0.0.2", "127.0.0.1"}
+	if _, err := b.resolve(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	want := fmt.Sprintf("[http://127.0.0.1:%s http://127.0.0.2:%s]", su.Port(), su.Port())
+	if urls := fmt.Sprint(b.upstreamURLs()); urls != want {
+		t.Fatalf("expected %s, got %s", want, urls)
+	}
+
+	// failed lookups and those that find nothing keep the current backends.
+	for _, test := range []struct {
+		IPs []string
+		Err error
+	}{
+		{nil, errors.New("no such host")},
+		{[]string{}, nil},
+	} {
+		ips, lookupErr = test.IPs, test.Err
+		if _, err := b.resolve(context.Background(), 0); (err != nil) != (test.Err != nil) {
+			t.Fatalf("expected error %v, got %v", test.Err, err)
+		}
+
+		if urls := fmt.Sprint(b.upstreamURLs()); urls != want {
+			t.Fatalf("expected %s to be kept, got %s", want, urls)
+		}
+	}
+
+	ips, lookupErr = []string{"127.0.0.1"}, nil
+	if _, err := b.resolve(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	b.serveHTTPProxy(w, httptest.NewRequest("GET", "http://a.com/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	if host != "svc.internal:"+su.Port() {
+		t.Fatalf("expected Host of svc.internal:%s, got %s", su.Port(), host)
+	}
+}
+
+func TestResolveSRV(t *testing.T) {
+	lookupSRV = func(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+		if name != "_http._tcp.svc.internal" {
+			t.Fatalf("unexpected lookup of %s", name)
+		}
+		return "", []*net.SRV{
+			{Target: "b.svc.internal.", Port: 8081},
+			{Target: "a.svc.internal.", Port: 8080},
+		}, nil
+	}
+	defer func() {
+		lookupSRV = net.DefaultResolver.LookupSRV
+	}()
+
+	b := backendFor(t, `{
+		"from": "a.com",
+		"to": "http://_http._tcp.svc.internal",
+		"resolve": {"srv": true}
+	}`)
+	b.balancer = newBalancer(b.Route)
+	b.resolver = newResolver(b.Route, nil)
+	if _, err := b.resolve(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var hosts []string
+	for _, up := range b.balancer.current() {
+		if up.host != "" {
+			t.Fatalf("expected SRV backends to keep their Host, got %s", up.host)
+		}
+		hosts = append(hosts, up.url.Host)
+	}
+
+	if fmt.Sprint(hosts) != "[a.svc.internal:8080 b.svc.internal:8081]" {
+		t.Fatalf("unexpected backends %v", hosts)
+	}
+}
+
+func TestResolveConsul(t *testing.T) {
+	var query string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		if r.URL.Path != "/v1/health/service/api" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+
+		w.Header().Set("X-Consul-Index", "12")
+		fmt.Fprint(w, `[
+			{"Node": {"Address": "10.0.0.2"}, "Service": {"Address": "", "Port": 8080}},
+			{"Node": {"Address": "10.0.0.9"}, "Service": {"Address": "10.0.0.1", "Port": 9090}}
+		]`)
+	}))
+	defer s.Close()
+
+	b := backendFor(t, `{"from": "a.com", "to": "consul://api/v1/"}`)
+	b.balancer = newBalancer(b.Route)
+	b.resolver = newResolver(b.Route, discovery.NewCatalog(&config.ConsulInfo{Address: s.URL}))
+
+	index, err := b.resolve(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if query != "passing=true" || index != 12 {
+		t.Fatalf("unexpected query %s and index %d", query, index)
+	}
+
+	want := "[http://10.0.0.1:9090/v1/ http://10.0.0.2:8080/v1/]"
+	if urls := fmt.Sprint(b.upstreamURLs()); urls != want {
+		t.Fatalf("expected %s, got %s", want, urls)
+	}
+
+	if _, err := b.resolve(context.Background(), index); err != nil {
+		t.Fatal(err)
+	}
+
+	if query != "index=12&passing=true&wait=300s" {
+		t.Fatalf("expected a blocking query, got %s", query)
+	}
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/kellegous/underpants/config"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// retry retries idempotent requests that fail to reach the backend or that receive
+// one of a set of error statuses, waiting exponentially longer before each retry.
+type retry struct {
+	count    int
+	backoff  time.Duration
+	statuses map[int]bool
+}
+
+// newRetry creates the retry for a route, which is nil if the route does not retry
+// requests.
+func newRetry(cfg *config.RetryInfo) *retry {
+	if cfg == nil {
+		return nil
+	}
+
+	statuses := map[int]bool{}
+	for _, code := range cfg.StatusCodes {
+		statuses[code] = true
+	}
+
+	return &retry{
+		count:    cfg.Count,
+		backoff:  time.Duration(cfg.BackoffMs) * time.Millisecond,
+		statuses: statuses,
+	}
+}
+
+// applies determines if the request can be retried. Only GET and HEAD requests without
+// a body are, since they can be safely sent again.
+func (rt *retry) applies(r *http.Request) bool {
+	return (r.Method == "GET" || r.Method == "HEAD") && r.ContentLength == 0
+}
+
+// roundTrip sends the request with send, retrying it as needed.
+func (rt *retry) roundTrip(
+	b *Backend,
+	r *http.Request,
+	send func() (*http.Response, error)) (*http.Response, error) {
+	for i := 0; ; i++ {
+		bp, err := send()
+
+		// a request cancelled by the client is not a backend failure.
+		if i == rt.count || r.Context().Err() != nil {
+			return bp, err
+		}
+
+		if err == nil && !rt.statuses[bp.StatusCode] {
+			return bp, nil
+		}
+
+		fields := []zapcore.Field{
+			zap.String("from", b.Route.From),
+			zap.String("uri", r.RequestURI),
+			zap.Int("attempt", i+1),
+		}
+
+		if err != nil {
+			fields = append(fields, zap.Error(err))
+		} else {
+			fields = append(fields, zap.Int("status", bp.StatusCode))
+			bp.Body.Close()
+		}
+
+		zap.L().Warn("retrying backend request", fields...)
+
+		t := time.NewTimer(rt.backoff << uint(i))
+		select {
+		case <-t.C:
+		case <-r.Context().Done():
+			t.Stop()
+			return nil, r.Context().Err()
+		}
+	}
+}
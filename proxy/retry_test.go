@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRetry(t *testing.T) {
+	var calls int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// every request fails twice before succeeding.
+		if atomic.AddInt32(&calls, 1)%3 != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer s.Close()
+
+	b := backendFor(t, fmt.Sprintf(`{
+		"from": "a.com",
+		"to": "%s",
+		"paths": [{"path": "/*", "public": true}],
+		"retry": {"backoff-ms": 1}
+	}`, s.URL))
+	b.AuthProvider = &stubProvider{}
+	b.retry = newRetry(b.Route.Retry)
+
+	tests := []struct {
+		Method string
+		Status int
+		Calls  int32
+	}{
+		{"GET", http.StatusOK, 3},
+		{"HEAD", http.StatusOK, 3},
+		{"POST", http.StatusServiceUnavailable, 1},
+	}
+
+	for _, test := range tests {
+		atomic.StoreInt32(&calls, 0)
+
+		w := httptest.NewRecorder()
+		b.serveHTTPProxy(w, httptest.NewRequest(test.Method, "http://a.com/", nil))
+
+		if w.Code != test.Status {
+			t.Fatalf("%s: expected status %d, got %d", test.Method, test.Status, w.Code)
+		}
+
+		if n := atomic.LoadInt32(&calls); n != test.Calls {
+			t.Fatalf("%s: expected %d calls, got %d", test.Method, test.Calls, n)
+		}
+	}
+
+	// retries are limited to count.
+	b.retry.count = 1
+	atomic.StoreInt32(&calls, 0)
+
+	w := httptest.NewRecorder()
+	b.serveHTTPProxy(w, httptest.NewRequest("GET", "http://a.com/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503 after exhausting retries, got %d", w.Code)
+	}
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+
+	"github.com/kellegous/underpants/user"
+
+	"go.uber.org/zap"
+)
+
+// stateKey is the context key of the proxyState of a request.
+type stateKey struct{}
+
+// proxyState is what the reverse proxy needs to know about the request it is
+// proxying, which is carried in the request's context.
+type proxyState struct {
+	// in is the request as it was received from the client.
+	in *http.Request
+
+	// user is the user the request is made on behalf of, it is nil for anonymous
+	// requests to public paths.
+	user *user.Info
+
+	// reqBody and resBody hold the captured bodies, they are nil unless the request
+	// is being captured.
+	reqBody, resBody *limitedBuffer
+
+	// affinity is the id of the upstream the client should be pinned to with a cookie,
+	// it is empty if the client is already pinned or the route has no cookie affinity.
+	affinity string
+}
+
+// withState attaches the proxyState to the request.
+func withState(r *http.Request, s *proxyState) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), stateKey{}, s))
+}
+
+// stateFrom returns the proxyState attached to the request, or an empty state if there
+// is none.
+func stateFrom(r *http.Request) *proxyState {
+	if s, ok := r.Context().Value(stateKey{}).(*proxyState); ok {
+		return s
+	}
+	return &proxyState{}
+}
+
+// reverseProxy creates the httputil.ReverseProxy that forwards requests to the
+// route's backends. It strips hop-by-hop headers in both directions, sends requests
+// over the route's shared transport and streams responses back as they arrive.
+func (b *Backend) reverseProxy() *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetXForwarded()
+		},
+		Transport:      backendTransport{b},
+		FlushInterval:  time.Duration(b.Route.FlushInterval) * time.Millisecond,
+		ModifyResponse: b.modifyResponse,
+		ErrorHandler:   b.proxyError,
+	}
+}
+
+// modifyResponse applies the route's cookie collision policy to the backend's
+// response, leaves CORS to the route's policy, pins the client to the backend if
+// needed and captures the response body, if the request is being captured.
+func (b *Backend) modifyResponse(bp *http.Response) error {
+	if err := b.filterSetCookies(bp.Header); err != nil {
+		return err
+	}
+
+	b.prefixLocation(bp.Header)
+	b.stripCORSHeaders(bp.Header)
+
+	s := stateFrom(bp.Request)
+	if s.affinity != "" {
+		bp.Header.Add("Set-Cookie", (&http.Cookie{
+			Name:     affinityCookieKey,
+			Value:    s.affinity,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   b.Ctx.IsSecure(),
+		}).String())
+	}
+
+	if s.resBody == nil {
+		return nil
+	}
+
+	bp.Body = &teeBody{
+		Reader: io.TeeReader(bp.Body, s.resBody),
+		Closer: &captureCloser{
+			Closer: bp.Body,
+			done: func() {
+				b.logCapture(s.in, bp.StatusCode, s.reqBody, s.resBody)
+			},
+		},
+	}
+	return nil
+}
+
+// prefixLocation undoes the rewriting of the request path in the backend's redirects to
+// absolute paths, removing the added prefix and adding back the stripped one.
+func (b *Backend) prefixLocation(h http.Header) {
+	loc := h.Get("Location")
+	if !strings.HasPrefix(loc, "/") || strings.HasPrefix(loc, "//") {
+		return
+	}
+
+	if b.Route.StrippedPrefix() == "" && b.Route.AddPrefix == "" {
+		return
+	}
+
+	if s, ok := trimPathPrefix(loc, b.Route.AddPrefix); ok {
+		loc = s
+	}
+	h.Set("Location", b.Route.StrippedPrefix()+loc)
+}
+
+// trimPathPrefix removes prefix from the path (which may include a query) p, if p is
+// the prefix or is under it.
+func trimPathPrefix(p, prefix string) (string, bool) {
+	if prefix == "" || !strings.HasPrefix(p, prefix) {
+		return p, false
+	}
+
+	rest := p[len(prefix):]
+	switch {
+	case rest == "", rest[0] == '?':
+		return "/" + rest, true
+	case rest[0] == '/':
+		return rest, true
+	}
+	return p, false
+}
+
+// serveTooLarge answers requests whose bodies are larger than the route allows.
+func (b *Backend) serveTooLarge(w http.ResponseWriter, r *http.Request) {
+	zap.L().Info("request body too large",
+		zap.String("from", b.Route.From),
+		zap.String("uri", r.RequestURI),
+		zap.Int64("max-body-bytes", b.Route.MaxBodyBytes))
+	http.Error(w,
+		http.StatusText(http.StatusRequestEntityTooLarge),
+		http.StatusRequestEntityTooLarge)
+}
+
+// captureCloser logs the captured bodies once the response body is closed.
+type captureCloser struct {
+	io.Closer
+	done func()
+}
+
+func (c *captureCloser) Close() error {
+	err := c.Closer.Close()
+	c.done()
+	return err
+}
+
+// proxyError answers requests that could not be proxied.
+func (b *Backend) proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		b.serveTooLarge(w, r)
+		return
+	}
+
+	b.serveGatewayError(w, r, stateFrom(r).user, err)
+}
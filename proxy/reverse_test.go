@@ -0,0 +1,253 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kellegous/underpants/user"
+)
+
+func TestReverseProxy(t *testing.T) {
+	var hdr http.Header
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hdr = r.Header
+		w.Header().Set("Connection", "X-Backend-Hop")
+		w.Header().Set("X-Backend-Hop", "1")
+		w.Header().Set("X-Backend", "1")
+		fmt.Fprint(w, "ok")
+	}))
+
+	var conns int32
+	s.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	s.Start()
+	defer s.Close()
+
+	b := backendFor(t, fmt.Sprintf(`{
+		"from": "a.com",
+		"to": "%s",
+		"paths": [{"path": "/*", "public": true}]
+	}`, s.URL))
+	b.AuthProvider = &stubProvider{}
+	b.transport = newTransport(newSharedTransport(&b.Ctx.Transport), b.Route)
+
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest("GET", "http://a.com/", nil)
+		r.Header.Set("Connection", "X-Client-Hop")
+		r.Header.Set("X-Client-Hop", "1")
+		r.Header.Set("Keep-Alive", "timeout=5")
+		r.Header.Set("X-Client", "1")
+
+		w := httptest.NewRecorder()
+		b.serveHTTPProxy(w, r)
+
+		if w.Code != http.StatusOK || w.Body.String() != "ok" {
+			t.Fatalf("expected 200 ok, got %d %q", w.Code, w.Body.String())
+		}
+
+		if hdr.Get("X-Client-Hop") != "" || hdr.Get("Keep-Alive") != "" {
+			t.Fatalf("hop-by-hop headers were sent to the backend: %v", hdr)
+		}
+
+		if hdr.Get("X-Client") != "1" || hdr.Get("X-Forwarded-For") == "" {
+			t.Fatalf("expected end-to-end headers to reach the backend: %v", hdr)
+		}
+
+		if w.Header().Get("X-Backend-Hop") != "" || w.Header().Get("X-Backend") != "1" {
+			t.Fatalf("unexpected response headers %v", w.Header())
+		}
+	}
+
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Fatalf("expected requests to share 1 connection, got %d", n)
+	}
+}
+
+func TestReverseProxyError(t *testing.T) {
+	b := backendFor(t, `{
+		"from": "a.com",
+		"to": "http://localhost:1",
+		"paths": [{"path": "/*", "public": true}]
+	}`)
+	b.AuthProvider = &stubProvider{}
+
+	w := httptest.NewRecorder()
+	b.serveHTTPProxy(w, httptest.NewRequest("GET", "http://a.com/", nil))
+
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("expected status 502, got %d", w.Code)
+	}
+}
+
+func TestStreaming(t *testing.T) {
+	done := make(chan struct{})
+	be := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, "data: 1\n\n")
+		w.(http.Flusher).Flush()
+
+		// the first event must reach the client while the response is still open.
+		<-done
+	}))
+	defer be.Close()
+	defer close(done)
+
+	for _, route := range []string{
+		`{"from": "a.com", "to": "%s", "paths": [{"path": "/*", "public": true}]}`,
+		`{"from": "a.com", "to": "%s", "paths": [{"path": "/*", "public": true}], "flush-interval": -1}`,
+	} {
+		b := backendFor(t, fmt.Sprintf(route, be.URL))
+		b.AuthProvider = &stubProvider{}
+
+		s := httptest.NewServer(http.HandlerFunc(b.serveHTTPProxy))
+		defer s.Close()
+
+		res, err := http.Get(s.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		line, err := bufio.NewReader(res.Body).ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if line != "data: 1\n" {
+			t.Fatalf("expected the first event, got %q", line)
+		}
+	}
+}
+
+func TestStripPrefix(t *testing.T) {
+	var uri, prefix string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uri, prefix = r.URL.RequestURI(), r.Header.Get("X-Forwarded-Prefix")
+		http.Redirect(w, r, "/login", http.StatusFound)
+	}))
+	defer s.Close()
+
+	b := backendFor(t, fmt.Sprintf(`{
+		"from": "a.com/grafana/",
+		"to": "%s/app/",
+		"strip-prefix": true,
+		"paths": [{"path": "/grafana/*", "public": true}]
+	}`, s.URL))
+	b.AuthProvider = &stubProvider{}
+	b.transport = newTransport(newSharedTransport(&b.Ctx.Transport), b.Route)
+
+	w := httptest.NewRecorder()
+	b.serveHTTPProxy(w, httptest.NewRequest("GET", "http://a.com/grafana/d?x=1", nil))
+
+	if uri != "/app/d?x=1" || prefix != "/grafana" {
+		t.Fatalf("expected /app/d?x=1 with prefix /grafana, got %s with %q", uri, prefix)
+	}
+
+	if loc := w.Header().Get("Location"); loc != "/grafana/login" {
+		t.Fatalf("expected redirect to /grafana/login, got %q", loc)
+	}
+}
+
+func TestRewritePrefix(t *testing.T) {
+	var uri string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uri = r.URL.RequestURI()
+		http.Redirect(w, r, "/v1/login", http.StatusFound)
+	}))
+	defer s.Close()
+
+	b := backendFor(t, fmt.Sprintf(`{
+		"from": "a.com",
+		"to": "%s",
+		"strip-prefix": "/app/",
+		"add-prefix": "/v1",
+		"paths": [{"path": "/*", "public": true}]
+	}`, s.URL))
+	b.AuthProvider = &stubProvider{}
+	b.transport = newTransport(newSharedTransport(&b.Ctx.Transport), b.Route)
+
+	tests := []struct {
+		Path string
+		URI  string
+	}{
+		{"/app/foo", "/v1/foo"},
+		{"/app?x=1", "/v1/?x=1"},
+		{"/application", "/v1/application"},
+		{"/", "/v1/"},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		b.serveHTTPProxy(w, httptest.NewRequest("GET", "http://a.com"+test.Path, nil))
+
+		if uri != test.URI {
+			t.Fatalf("expected %s to be sent as %s, got %s", test.Path, test.URI, uri)
+		}
+
+		if loc := w.Header().Get("Location"); loc != "/app/login" {
+			t.Fatalf("expected redirect to /app/login, got %q", loc)
+		}
+	}
+}
+
+func TestHandoffRejectsOtherHosts(t *testing.T) {
+	b := backendFor(t, `{"from": "a.com", "to": "http://localhost:1"}`)
+
+	for _, p := range []string{"//evil.com/", "/\\evil.com/", "http://evil.com/"} {
+		r := httptest.NewRequest("GET", "http://a.com/__auth__/?"+url.Values{
+			"c": {"cookie"},
+			"p": {p},
+		}.Encode(), nil)
+
+		w := httptest.NewRecorder()
+		b.serveHTTPAuth(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400 for %s, got %d", p, w.Code)
+		}
+	}
+}
+
+func TestHandoffIsOneTime(t *testing.T) {
+	b := backendFor(t, `{"from": "a.com", "to": "http://localhost:1"}`)
+
+	v, err := b.Ctx.Sessions.Encode(&user.Info{
+		Email:             "a@a.com",
+		LastAuthenticated: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := b.Ctx.Sessions.NewHandoff(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(code, v) {
+		t.Fatal("handoff code should not contain the session")
+	}
+
+	for i, expected := range []int{http.StatusFound, http.StatusForbidden} {
+		r := httptest.NewRequest("GET", "http://a.com/__auth__/?"+url.Values{
+			"c": {code},
+			"p": {"/a"},
+		}.Encode(), nil)
+
+		w := httptest.NewRecorder()
+		b.serveHTTPAuth(w, r)
+		if w.Code != expected {
+			t.Fatalf("expected status %d for attempt %d, got %d", expected, i, w.Code)
+		}
+	}
+}
@@ -1,21 +1,78 @@
 package proxy
 
 import (
+	"net/http"
+
 	"github.com/kellegous/underpants/auth"
 	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/discovery"
 	"github.com/kellegous/underpants/internal"
 	"github.com/kellegous/underpants/mux"
 )
 
-// Setup adds the proxy handlers to the mux.Builder.
-func Setup(ctx *config.Context, prv auth.Provider, mb *mux.Builder) {
+// Setup adds the proxy handlers to the mux.Builder and returns the backends that
+// were created, one for each route.
+func Setup(ctx *config.Context, prv auth.Provider, mb *mux.Builder) []*Backend {
+	shared := newSharedTransport(&ctx.Transport)
+	catalog := discovery.NewCatalog(&ctx.Consul)
+
+	var backends []*Backend
 	for _, route := range ctx.Routes {
-		mb.ForHost(route.From).Handle("/",
-			internal.AddSecurityHeaders(ctx.Info,
-				&Backend{
-					Ctx:          ctx,
-					Route:        route,
-					AuthProvider: prv,
-				}))
+		b := &Backend{
+			Ctx:          ctx,
+			Route:        route,
+			AuthProvider: prv,
+			capture:      newCapture(route.BodyCapture),
+			failover:     newFailover(route),
+			balancer:     newBalancer(route),
+			retry:        newRetry(route.Retry),
+			breaker:      newBreaker(route.CircuitBreaker),
+			limiter:      newLimiter(route.RateLimit),
+			concurrency:  newConcurrency(route.Concurrency),
+			maintenance:  newMaintenance(route.Maintenance),
+			mirror:       newMirror(route.Mirror),
+			health:       newHealth(route),
+			resolver:     newResolver(route, catalog),
+			allowFile:    newAllowFileWatcher(route),
+			transport:    newTransport(shared, route),
+		}
+
+		go b.runHealthChecks()
+		go b.runResolver()
+		go b.watchAllowFile()
+
+		h := instrument(ctx.Metrics, route.From,
+			withResponseHeaderRules(route.ResponseHeaders,
+				internal.AddRouteSecurityHeaders(ctx.Info, route, b)))
+
+		prefix := route.PathPrefix()
+		mb.ForHost(route.Host()).Handle(prefix+"/", h)
+
+		// the prefix itself is redirected so that relative URLs resolve under it, unless
+		// the route only redirects, in which case it is the route's shortlink.
+		if prefix != "" && route.Redirect != 0 {
+			mb.ForHost(route.Host()).Handle(prefix, h)
+		} else if prefix != "" {
+			mb.ForHost(route.Host()).Handle(prefix, http.HandlerFunc(addSlash))
+		}
+
+		if route.Default {
+			mb.UnknownHost(
+				instrument(ctx.Metrics, route.From,
+					withResponseHeaderRules(route.ResponseHeaders,
+						internal.AddRouteSecurityHeaders(ctx.Info, route,
+							http.HandlerFunc(b.serveUnknownHost)))),
+				ctx.Info.Host)
+		}
+
+		backends = append(backends, b)
 	}
+	return backends
+}
+
+// addSlash redirects a request to the same path with a trailing slash.
+func addSlash(w http.ResponseWriter, r *http.Request) {
+	u := *r.URL
+	u.Path += "/"
+	http.Redirect(w, r, u.RequestURI(), http.StatusMovedPermanently)
 }
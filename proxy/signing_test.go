@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/kellegous/underpants/signature"
+)
+
+func TestRequestSigning(t *testing.T) {
+	var verr error
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, verr = signature.Verify(r, []byte("secret"), time.Minute)
+	}))
+	defer s.Close()
+
+	b := backendFor(t, fmt.Sprintf(`{
+		"from": "a.com",
+		"to": "%s/app/",
+		"paths": [{"path": "/*", "public": true}],
+		"request-signing": {"secret": "secret"}
+	}`, s.URL))
+	b.AuthProvider = &stubProvider{}
+
+	r := httptest.NewRequest("GET", "http://a.com/x?y=z", nil)
+	r.Header.Set(signature.Header, "t=0,n=forged,s=00")
+
+	w := httptest.NewRecorder()
+	b.serveHTTPProxy(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	if verr != nil {
+		t.Fatalf("backend rejected signature: %s", verr)
+	}
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// staticFS is the directory of a file backend. Directories are only served through
+// their index.html, so that their contents are not listed, and hidden files, such as
+// those in .git, are not served at all.
+type staticFS struct {
+	dir http.Dir
+}
+
+// newStaticTransport creates the transport that serves the files in dir to the
+// reverse proxy as if they came from a backend.
+func newStaticTransport(dir string) http.RoundTripper {
+	return http.NewFileTransport(staticFS{http.Dir(dir)})
+}
+
+// Open implements http.FileSystem.
+func (fs staticFS) Open(name string) (http.File, error) {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return nil, os.ErrNotExist
+		}
+	}
+
+	f, err := fs.dir.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if fi.IsDir() {
+		idx, err := fs.dir.Open(path.Join(name, "index.html"))
+		if err != nil {
+			f.Close()
+			return nil, os.ErrNotExist
+		}
+		idx.Close()
+	}
+
+	return f, nil
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStatic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "static")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, data := range map[string]string{
+		"index.html":       "<h1>Docs</h1>",
+		"api/intro.html":   "<h1>Intro</h1>",
+		".git/config":      "[core]",
+		"assets/style.css": "body {}",
+	} {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := backendFor(t, fmt.Sprintf(`{
+		"from": "docs.com",
+		"to": "file://%s",
+		"paths": [{"path": "/*", "public": true}]
+	}`, dir))
+	b.AuthProvider = &stubProvider{}
+	b.transport = newTransport(nil, b.Route)
+
+	for _, test := range []struct {
+		Path   string
+		Status int
+		Body   string
+	}{
+		{"/", http.StatusOK, "<h1>Docs</h1>"},
+		{"/api/intro.html", http.StatusOK, "<h1>Intro</h1>"},
+		{"/assets/", http.StatusNotFound, ""},
+		{"/.git/config", http.StatusNotFound, ""},
+		{"/missing.html", http.StatusNotFound, ""},
+	} {
+		w := httptest.NewRecorder()
+		b.serveHTTPProxy(w, httptest.NewRequest("GET", "http://docs.com"+test.Path, nil))
+		if w.Code != test.Status {
+			t.Fatalf("expected status %d for %s, got %d", test.Status, test.Path, w.Code)
+		}
+
+		if test.Body != "" && w.Body.String() != test.Body {
+			t.Fatalf("expected %q for %s, got %q", test.Body, test.Path, w.Body.String())
+		}
+	}
+
+	if res := b.Check(httptest.NewRequest("GET", "/", nil).Context()); !res.Healthy {
+		t.Fatalf("expected the directory to be healthy, got %+v", res)
+	}
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/kellegous/underpants/config"
+)
+
+// newSharedTransport creates the transport, and so the pool of connections, shared
+// by all of the backends.
+func newSharedTransport(cfg *config.TransportInfo) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = cfg.MaxIdleConns
+	t.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	t.MaxConnsPerHost = cfg.MaxConnsPerHost
+	t.IdleConnTimeout = time.Duration(cfg.IdleConnTimeout) * time.Second
+	t.DisableKeepAlives = cfg.DisableKeepAlives
+	t.DialContext = (&net.Dialer{
+		Timeout:   time.Duration(cfg.DialTimeout) * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	t.ResponseHeaderTimeout = time.Duration(cfg.ResponseHeaderTimeout) * time.Second
+	return t
+}
+
+// newTransport creates the transport used to reach the route's backends. Routes that
+// need their own TLS settings or protocols, or that have unix socket backends, get their
+// own copy of the shared transport. Routes that serve a directory read it directly.
+func newTransport(shared *http.Transport, route *config.RouteInfo) http.RoundTripper {
+	if dir := route.StaticDir(); dir != "" {
+		return newStaticTransport(dir)
+	}
+
+	c := route.BackendTLSConfig()
+	p := backendProtocols(route.BackendProtocol)
+	if c == nil && p == nil && !route.HasSockets() {
+		return shared
+	}
+
+	t := shared.Clone()
+	if c != nil {
+		t.TLSClientConfig = c
+	}
+	t.Protocols = p
+	if route.HasSockets() {
+		t.DialContext = dialSockets(route, t.DialContext)
+	}
+	return t
+}
+
+// dialSockets wraps dial so that connections to the hosts that stand in for the
+// route's unix socket backends are made to the sockets instead.
+func dialSockets(
+	route *config.RouteInfo,
+	dial func(context.Context, string, string) (net.Conn, error),
+) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			if path := route.SocketFor(host); path != "" {
+				return dial(ctx, "unix", path)
+			}
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// setSocketHost gives requests to unix socket backends a Host of localhost, since the
+// host that stands in for the socket means nothing to the backend.
+func setSocketHost(r *http.Request, route *config.RouteInfo) {
+	if route.SocketFor(r.URL.Hostname()) != "" {
+		r.Host = "localhost"
+	}
+}
+
+// backendProtocols are the protocols the transport uses for the backend-protocol,
+// nil if the transport's defaults should be used.
+func backendProtocols(name string) *http.Protocols {
+	var p http.Protocols
+	switch name {
+	case config.BackendProtocolHTTP1:
+		p.SetHTTP1(true)
+	case config.BackendProtocolH2:
+		p.SetHTTP2(true)
+	case config.BackendProtocolH2C:
+		p.SetUnencryptedHTTP2(true)
+	default:
+		return nil
+	}
+	return &p
+}
+
+// roundTripper is the transport used to reach the route's backends.
+func (b *Backend) roundTripper() http.RoundTripper {
+	if b.transport == nil {
+		return http.DefaultTransport
+	}
+	return b.transport
+}
+
+// backendTransport sends the requests prepared by the reverse proxy on to the route's
+// backends, failing over between them if the route is configured to do so.
+type backendTransport struct {
+	b *Backend
+}
+
+func (t backendTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	body := r.Body
+	if body == nil {
+		body = http.NoBody
+	}
+	bp, err := t.b.roundTrip(r, stateFrom(r).user, body)
+
+	// requests cancelled by the client say nothing about the health of the backend.
+	if c := t.b.breaker; c != nil && r.Context().Err() == nil {
+		c.record(time.Now(), err != nil || bp.StatusCode >= 500)
+	}
+
+	return bp, err
+}
@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeClientCert creates a self-signed client certificate and key in dir, returning
+// the parsed certificate and the paths of the files.
+func writeClientCert(t *testing.T, dir string) (*x509.Certificate, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "underpants"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "underpants"},
+	}, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crtFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	if err := ioutil.WriteFile(crtFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: der,
+	}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "EC PRIVATE KEY",
+		Bytes: keyDer,
+	}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return crt, crtFile, keyFile
+}
+
+func TestBackendTLS(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: s.Certificate().Raw,
+	}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		BackendTLS string
+		Healthy    bool
+	}{
+		{``, false},
+		{fmt.Sprintf(`, "backend-tls": {"ca": %q}`, ca), true},
+		{fmt.Sprintf(`, "backend-tls": {"ca": %q, "server-name": "b.com"}`, ca), false},
+		{`, "backend-tls": {"insecure-skip-verify": true}`, true},
+	}
+
+	for _, test := range tests {
+		b := backendFor(t, fmt.Sprintf(`{"from": "a.com", "to": "%s"%s}`,
+			s.URL, test.BackendTLS))
+		b.transport = newTransport(newSharedTransport(&b.Ctx.Transport), b.Route)
+
+		if res := b.Check(context.Background()); res.Healthy != test.Healthy {
+			t.Fatalf("expected healthy=%t for %q, got %+v", test.Healthy, test.BackendTLS, res)
+		}
+	}
+}
+
+func TestBackendMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	crt, crtFile, keyFile := writeClientCert(t, dir)
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	s.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  x509.NewCertPool(),
+	}
+	s.TLS.ClientCAs.AddCert(crt)
+	s.StartTLS()
+	defer s.Close()
+
+	tests := []struct {
+		BackendTLS string
+		Healthy    bool
+	}{
+		{`{"insecure-skip-verify": true}`, false},
+		{fmt.Sprintf(`{"insecure-skip-verify": true, "client-cert": {"crt": %q, "key": %q}}`,
+			crtFile, keyFile), true},
+	}
+
+	for _, test := range tests {
+		b := backendFor(t, fmt.Sprintf(`{"from": "a.com", "to": "%s", "backend-tls": %s}`,
+			s.URL, test.BackendTLS))
+		b.transport = newTransport(newSharedTransport(&b.Ctx.Transport), b.Route)
+
+		if res := b.Check(context.Background()); res.Healthy != test.Healthy {
+			t.Fatalf("expected healthy=%t for %s, got %+v", test.Healthy, test.BackendTLS, res)
+		}
+	}
+}
+
+func TestSocketBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sock := filepath.Join(dir, "app.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var host, path string
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, path = r.Host, r.URL.Path
+	}))
+	s.Listener = l
+	s.Start()
+	defer s.Close()
+
+	b := backendFor(t, fmt.Sprintf(`{
+		"from": "a.com",
+		"to": "unix://%s",
+		"health-check": {"path": "/healthz"}
+	}`, sock))
+	b.transport = newTransport(newSharedTransport(&b.Ctx.Transport), b.Route)
+
+	if res := b.Check(context.Background()); !res.Healthy {
+		t.Fatalf("expected healthy socket backend, got %+v", res)
+	}
+
+	if host != "localhost" || path != "/healthz" {
+		t.Fatalf("expected localhost /healthz, got %s %s", host, path)
+	}
+}
@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// headerContainsToken determines if a comma separated header contains the given token,
+// ignoring case.
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, val := range h[http.CanonicalHeaderKey(name)] {
+		for _, v := range strings.Split(val, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isWebSocketUpgrade determines if the request is asking to be upgraded to a
+// websocket. Upgrades are proxied like any other request, but the connection then
+// lives on long after the request is done.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return headerContainsToken(r.Header, "Connection", "upgrade") &&
+		headerContainsToken(r.Header, "Upgrade", "websocket")
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/kellegous/underpants/user"
+)
+
+// echoUpgrader is a backend that upgrades any request and then echoes everything it
+// reads.
+func echoUpgrader(t *testing.T) *httptest.Server {
+	return upgrader(t, "")
+}
+
+// upgrader is a backend that upgrades any request, with the given extra header lines
+// in its response, and then echoes everything it reads.
+func upgrader(t *testing.T, headers string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Underpants-Email") == "" {
+			t.Error("identity headers were not sent to the backend")
+		}
+
+		c, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+
+		fmt.Fprint(c, "HTTP/1.1 101 Switching Protocols\r\n"+
+			"Upgrade: websocket\r\n"+
+			"Connection: Upgrade\r\n"+
+			headers+"\r\n")
+		io.Copy(c, brw)
+	}))
+}
+
+// serveAs proxies the request through the route's reverse proxy on behalf of u.
+func serveAs(b *Backend, w http.ResponseWriter, r *http.Request, u *user.Info) {
+	b.reverseProxy().ServeHTTP(w, withState(r, &proxyState{in: r, user: u}))
+}
+
+func TestIsWebSocketUpgrade(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://a.com/", nil)
+	r.Header.Set("Connection", "keep-alive, Upgrade")
+	r.Header.Set("Upgrade", "WebSocket")
+	if !isWebSocketUpgrade(r) {
+		t.Fatal("expected websocket upgrade")
+	}
+
+	r.Header.Set("Upgrade", "h2c")
+	if isWebSocketUpgrade(r) {
+		t.Fatal("h2c is not a websocket upgrade")
+	}
+}
+
+func TestServeWebSocket(t *testing.T) {
+	be := echoUpgrader(t)
+	defer be.Close()
+
+	for _, route := range []string{
+		fmt.Sprintf(`{"from": "a.com", "to": "%s"}`, be.URL),
+		fmt.Sprintf(`{"from": "a.com", "to": ["%s", "%s"], "balance": "least-connections"}`,
+			be.URL, be.URL),
+	} {
+		b := backendFor(t, route)
+		b.balancer = newBalancer(b.Route)
+
+		fe := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			serveAs(b, w, r, &user.Info{Email: "a@a.com"})
+		}))
+
+		c, br, res := upgradeWebSocket(t, fe.Listener.Addr().String())
+		if res.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("%s: expected 101, got %d", route, res.StatusCode)
+		}
+
+		fmt.Fprint(c, "ping")
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if string(buf) != "ping" {
+			t.Fatalf("%s: expected ping, got %s", route, buf)
+		}
+
+		c.Close()
+		fe.Close()
+	}
+}
+
+// upgradeWebSocket sends a websocket upgrade for a.com/ws to the server at addr and
+// reads the response.
+func upgradeWebSocket(t *testing.T, addr string) (net.Conn, *bufio.Reader, *http.Response) {
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fmt.Fprint(c, "GET /ws HTTP/1.1\r\n"+
+		"Host: a.com\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Upgrade: websocket\r\n\r\n")
+
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		c.Close()
+		t.Fatal(err)
+	}
+	return c, br, res
+}
+
+func TestWebSocketCookieCollision(t *testing.T) {
+	be := upgrader(t, "Set-Cookie: u=backend\r\n"+
+		"Access-Control-Allow-Origin: *\r\n")
+	defer be.Close()
+
+	for _, test := range []struct {
+		Policy string
+		Status int
+		Cookie string
+	}{
+		{"rename", http.StatusSwitchingProtocols, "upstream-u=backend"},
+		{"drop", http.StatusSwitchingProtocols, ""},
+		{"refuse", http.StatusBadGateway, ""},
+	} {
+		b := backendFor(t, fmt.Sprintf(`{
+			"from": "a.com",
+			"to": "%s",
+			"cookie-collision": "%s",
+			"cors": {"allowed-origins": ["https://b.a.com"]}
+		}`, be.URL, test.Policy))
+		if name := b.Ctx.Sessions.CookieName(); name != "u" {
+			t.Fatalf("expected the session cookie to be u, got %s", name)
+		}
+
+		fe := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			serveAs(b, w, r, &user.Info{Email: "a@a.com"})
+		}))
+
+		c, _, res := upgradeWebSocket(t, fe.Listener.Addr().String())
+		c.Close()
+		fe.Close()
+
+		if res.StatusCode != test.Status {
+			t.Fatalf("%s: expected %d, got %d", test.Policy, test.Status, res.StatusCode)
+		}
+
+		if cookie := res.Header.Get("Set-Cookie"); cookie != test.Cookie {
+			t.Fatalf("%s: expected Set-Cookie %q, got %q", test.Policy, test.Cookie, cookie)
+		}
+
+		if o := res.Header.Get("Access-Control-Allow-Origin"); o != "" {
+			t.Fatalf("%s: expected the backend's CORS headers to be stripped, got %s",
+				test.Policy, o)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package session
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/kellegous/underpants/user"
+)
+
+// CookieOptions are the attributes of the session cookie. Zero values for the name
+// and max age fall back to user.CookieKey and user.CookieMaxAge.
+type CookieOptions struct {
+	Name     string
+	Domain   string
+	MaxAge   int
+	Secure   bool
+	HTTPOnly bool
+	SameSite http.SameSite
+}
+
+// CookieName is the name of the session cookie.
+func (m *Manager) CookieName() string {
+	if m.Cookie.Name == "" {
+		return user.CookieKey
+	}
+	return m.Cookie.Name
+}
+
+// MaxAge is how long a session lasts after the user authenticates.
+func (m *Manager) MaxAge() time.Duration {
+	if m.Cookie.MaxAge <= 0 {
+		return user.CookieMaxAge * time.Second
+	}
+	return time.Duration(m.Cookie.MaxAge) * time.Second
+}
+
+// WithMaxAge returns a copy of the manager whose sessions last for maxAge.
+func (m *Manager) WithMaxAge(maxAge time.Duration) *Manager {
+	c := *m
+	c.Cookie.MaxAge = int(maxAge / time.Second)
+	return &c
+}
+
+// NewCookie creates the session cookie carrying the value v.
+func (m *Manager) NewCookie(v string) *http.Cookie {
+	return &http.Cookie{
+		Name:     m.CookieName(),
+		Value:    url.QueryEscape(v),
+		Path:     "/",
+		Domain:   m.Cookie.Domain,
+		MaxAge:   int(m.MaxAge() / time.Second),
+		Secure:   m.Cookie.Secure,
+		HttpOnly: m.Cookie.HTTPOnly,
+		SameSite: m.Cookie.SameSite,
+	}
+}
+
+// ClearCookie creates a cookie that removes the session cookie from the browser.
+func (m *Manager) ClearCookie() *http.Cookie {
+	c := m.NewCookie("")
+	c.MaxAge = -1
+	return c
+}
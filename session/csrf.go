@@ -0,0 +1,49 @@
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/kellegous/underpants/user"
+)
+
+const (
+	// CSRFField is the form field that carries the CSRF token.
+	CSRFField = "csrf"
+
+	// CSRFHeader is the header that carries the CSRF token for requests that are not
+	// forms.
+	CSRFHeader = "X-Csrf-Token"
+)
+
+// CSRFToken returns the token that state-changing requests made with the user's
+// session must carry. It is bound to the user's sign in, so it stays the same as
+// sliding sessions are refreshed and changes when the user signs in again.
+func (m *Manager) CSRFToken(u *user.Info) string {
+	h := hmac.New(sha256.New, m.Key)
+	fmt.Fprintf(h, "csrf|%s|%d", u.Email, u.LastAuthenticated.UnixNano())
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// CheckCSRF verifies that the request carries the user's CSRF token, either in the
+// CSRFHeader or in the CSRFField of its form.
+func (m *Manager) CheckCSRF(r *http.Request, u *user.Info) error {
+	tok := r.Header.Get(CSRFHeader)
+	if tok == "" {
+		tok = r.PostFormValue(CSRFField)
+	}
+
+	if tok == "" {
+		return errors.New("missing csrf token")
+	}
+
+	if !hmac.Equal([]byte(tok), []byte(m.CSRFToken(u))) {
+		return errors.New("invalid csrf token")
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/kellegous/underpants/user"
+)
+
+// encryptedPrefix marks a cookie value as a self-contained user that is encrypted,
+// rather than only signed. Like idPrefix, it cannot appear in a legacy cookie.
+const encryptedPrefix = "e."
+
+// cookieKeyLabel distinguishes the key that encrypts cookies from the signing key it
+// is derived from.
+const cookieKeyLabel = "underpants session cookie"
+
+// newCipher creates an AES-GCM AEAD whose key is derived from key for the purpose
+// named by label.
+func newCipher(key []byte, label string) (cipher.AEAD, error) {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(label))
+
+	b, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(b)
+}
+
+// isEncrypted determines if a cookie value is an encrypted self-contained user.
+func isEncrypted(v string) bool {
+	return strings.HasPrefix(v, encryptedPrefix)
+}
+
+// encodeUser creates a self-contained cookie value for the user, which is encrypted
+// if the manager encrypts cookies and only signed if it does not.
+func (m *Manager) encodeUser(u *user.Info) (string, error) {
+	if !m.Encrypt {
+		return u.Encode(m.Key)
+	}
+
+	c, err := newCipher(m.Key, cookieKeyLabel)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(u)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, c.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return encryptedPrefix + base64.RawURLEncoding.EncodeToString(
+		c.Seal(nonce, nonce, b, nil)), nil
+}
+
+// decryptUser decrypts and authenticates a user encrypted by encodeUser.
+func (m *Manager) decryptUser(v string) (*user.Info, error) {
+	c, err := newCipher(m.Key, cookieKeyLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(v[len(encryptedPrefix):])
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) < c.NonceSize() {
+		return nil, errors.New("encrypted cookie is too short")
+	}
+
+	p, err := c.Open(nil, b[:c.NonceSize()], b[c.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("invalid encrypted cookie")
+	}
+
+	var u user.Info
+	if err := json.Unmarshal(p, &u); err != nil {
+		return nil, err
+	}
+
+	return &u, nil
+}
@@ -0,0 +1,115 @@
+package session
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/kellegous/underpants/user"
+)
+
+// handoffPrefix marks a value as a handoff code.
+const handoffPrefix = "h."
+
+// handoffTTL is how long a handoff code can be redeemed for. Browsers redeem it as soon
+// as they follow the redirect from the hub.
+const handoffTTL = time.Minute
+
+// Handoffs holds the one-time codes that carry a session from the hub to the route the
+// user signed in for, so that the session itself never appears in a URL.
+type Handoffs interface {
+	PutHandoff(code, v string, ttl time.Duration) error
+
+	// TakeHandoff returns the value for a code and removes it, so that each code can
+	// only be redeemed once. It returns ErrNotFound for unknown or expired codes.
+	TakeHandoff(code string) (string, error)
+}
+
+// MemoryHandoffs keeps handoff codes in process memory.
+type MemoryHandoffs struct {
+	lck   sync.Mutex
+	codes map[string]*handoff
+}
+
+type handoff struct {
+	v       string
+	expires time.Time
+}
+
+// NewMemoryHandoffs creates an empty MemoryHandoffs.
+func NewMemoryHandoffs() *MemoryHandoffs {
+	return &MemoryHandoffs{
+		codes: map[string]*handoff{},
+	}
+}
+
+// PutHandoff stores the value for a code until ttl has passed.
+func (m *MemoryHandoffs) PutHandoff(code, v string, ttl time.Duration) error {
+	m.lck.Lock()
+	defer m.lck.Unlock()
+
+	now := time.Now()
+	for k, h := range m.codes {
+		if now.After(h.expires) {
+			delete(m.codes, k)
+		}
+	}
+
+	m.codes[code] = &handoff{v: v, expires: now.Add(ttl)}
+	return nil
+}
+
+// TakeHandoff returns the value for a code and removes it.
+func (m *MemoryHandoffs) TakeHandoff(code string) (string, error) {
+	m.lck.Lock()
+	defer m.lck.Unlock()
+
+	h := m.codes[code]
+	if h == nil {
+		return "", ErrNotFound
+	}
+	delete(m.codes, code)
+
+	if time.Now().After(h.expires) {
+		return "", ErrNotFound
+	}
+	return h.v, nil
+}
+
+// NewHandoff issues a one-time code for the cookie value v.
+func (m *Manager) NewHandoff(v string) (string, error) {
+	if m.Handoffs == nil {
+		return "", errors.New("session handoffs are not configured")
+	}
+
+	code, err := newToken(handoffPrefix)
+	if err != nil {
+		return "", err
+	}
+
+	if err := m.Handoffs.PutHandoff(code, v, handoffTTL); err != nil {
+		return "", err
+	}
+
+	return code, nil
+}
+
+// RedeemHandoff exchanges a code issued by NewHandoff for the cookie value it carries,
+// which is verified as though it came from a cookie.
+func (m *Manager) RedeemHandoff(code string) (string, *user.Info, error) {
+	if m.Handoffs == nil {
+		return "", nil, errors.New("session handoffs are not configured")
+	}
+
+	v, err := m.Handoffs.TakeHandoff(code)
+	if err != nil {
+		return "", nil, err
+	}
+
+	u, err := m.Decode(v)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return v, u, nil
+}
@@ -0,0 +1,282 @@
+package session
+
+import (
+	"container/list"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/kellegous/underpants/user"
+)
+
+const (
+	// EvictSync evicts expired and excess sessions inline on each Put.
+	EvictSync = "sync"
+
+	// EvictAsync evicts on a background goroutine, letting go of the lock between
+	// chunks so that callers are not held up by a long eviction. Put only evicts, a
+	// chunk at a time, when the store has outgrown its capacity by more than a chunk.
+	EvictAsync = "async"
+
+	// EvictBatch lets the store grow past its capacity by BatchSize sessions and then
+	// evicts all of the excess at once, amortizing the cost of eviction.
+	EvictBatch = "batch"
+)
+
+// defaultBatchSize is the batch size used by EvictBatch when none is given.
+const defaultBatchSize = 64
+
+// evictChunkSize is the most sessions that EvictAsync removes before letting go of the
+// lock.
+const evictChunkSize = 64
+
+// evictYieldAfter is how long EvictAsync evicts before it yields to the requests
+// waiting on the lock.
+const evictYieldAfter = 100 * time.Microsecond
+
+// MemoryOptions configures a MemoryStore.
+type MemoryOptions struct {
+	// TTL is how long a session lives after it is stored.
+	TTL time.Duration
+
+	// Capacity is the maximum number of sessions that are held, the least recently used
+	// sessions are evicted first. A Capacity of 0 is unbounded.
+	Capacity int
+
+	// Eviction is the eviction strategy, one of EvictSync, EvictAsync or EvictBatch.
+	// It defaults to EvictSync.
+	Eviction string
+
+	// BatchSize is the number of sessions by which an EvictBatch store may exceed its
+	// capacity before evicting.
+	BatchSize int
+}
+
+type memoryEntry struct {
+	id      string
+	user    *user.Info
+	expires time.Time
+}
+
+// MemoryStore is a Store that keeps sessions in process memory. Sessions do not
+// survive a restart and are not shared between instances.
+type MemoryStore struct {
+	lck     sync.Mutex
+	opts    MemoryOptions
+	entries map[string]*list.Element
+
+	// order holds entries from least to most recently used. Sessions that go unused
+	// drift to the front, which is where expired sessions are evicted from, and those
+	// that expire while still near the back are removed when they are next looked up.
+	order *list.List
+
+	hits   uint64
+	misses uint64
+
+	evict  chan struct{}
+	done   chan struct{}
+	closed sync.Once
+}
+
+// NewMemoryStore creates a MemoryStore with the given options.
+func NewMemoryStore(opts MemoryOptions) (*MemoryStore, error) {
+	switch opts.Eviction {
+	case "":
+		opts.Eviction = EvictSync
+	case EvictSync, EvictAsync, EvictBatch:
+	default:
+		return nil, fmt.Errorf("invalid eviction strategy: %s", opts.Eviction)
+	}
+
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+
+	s := &MemoryStore{
+		opts:    opts,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+
+	if opts.Eviction == EvictAsync {
+		s.evict = make(chan struct{}, 1)
+		s.done = make(chan struct{})
+		go s.evictLoop()
+	}
+
+	return s, nil
+}
+
+// Get returns the user for a session.
+func (s *MemoryStore) Get(id string) (*user.Info, error) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	el := s.entries[id]
+	if el == nil {
+		s.misses++
+		return nil, ErrNotFound
+	}
+
+	e := el.Value.(*memoryEntry)
+	if time.Now().After(e.expires) {
+		s.misses++
+		s.remove(el)
+		return nil, ErrNotFound
+	}
+
+	s.hits++
+	s.order.MoveToBack(el)
+	return e.user, nil
+}
+
+// Put stores the user for a session.
+func (s *MemoryStore) Put(id string, u *user.Info) error {
+	s.lck.Lock()
+
+	if el := s.entries[id]; el != nil {
+		s.remove(el)
+	}
+
+	s.entries[id] = s.order.PushBack(&memoryEntry{
+		id:      id,
+		user:    u,
+		expires: time.Now().Add(s.opts.TTL),
+	})
+
+	switch s.opts.Eviction {
+	case EvictSync:
+		s.evictTo(s.opts.Capacity, 0)
+	case EvictAsync:
+		// puts that outpace the background eviction help it along, a chunk at a time.
+		if c := s.opts.Capacity; c > 0 && len(s.entries) > c+evictChunkSize {
+			s.evictTo(c, evictChunkSize)
+		}
+	case EvictBatch:
+		if c := s.opts.Capacity; c > 0 && len(s.entries) > c+s.opts.BatchSize {
+			s.evictTo(c, 0)
+		}
+	}
+
+	s.lck.Unlock()
+
+	if s.evict != nil {
+		// a pending signal already covers this put.
+		select {
+		case s.evict <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// Delete removes a session.
+func (s *MemoryStore) Delete(id string) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	if el := s.entries[id]; el != nil {
+		s.remove(el)
+	}
+	return nil
+}
+
+// Len is the number of sessions currently held, including expired sessions that have
+// not yet been evicted.
+func (s *MemoryStore) Len() int {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	return len(s.entries)
+}
+
+// List returns the sessions that have not expired, from least to most recently used.
+func (s *MemoryStore) List() []*Listing {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	now := time.Now()
+	var ls []*Listing
+	for el := s.order.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*memoryEntry)
+		if now.After(e.expires) {
+			continue
+		}
+		ls = append(ls, &Listing{User: e.user, Expires: e.expires})
+	}
+	return ls
+}
+
+// CacheStats reports the number of lookups that found a session and the number that
+// did not, including those that found an expired session.
+func (s *MemoryStore) CacheStats() (hits, misses uint64) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	return s.hits, s.misses
+}
+
+// Close stops any background eviction.
+func (s *MemoryStore) Close() error {
+	if s.done != nil {
+		s.closed.Do(func() { close(s.done) })
+	}
+	return nil
+}
+
+func (s *MemoryStore) evictLoop() {
+	for {
+		select {
+		case <-s.evict:
+			yielded := time.Now()
+			for s.evictChunk() {
+				// the lock would otherwise go straight back to this goroutine, rather
+				// than to the requests waiting on it.
+				if time.Since(yielded) >= evictYieldAfter {
+					runtime.Gosched()
+					yielded = time.Now()
+				}
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// evictChunk removes up to evictChunkSize sessions and reports whether there may be
+// more to remove.
+func (s *MemoryStore) evictChunk() bool {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	return s.evictTo(s.opts.Capacity, evictChunkSize)
+}
+
+// evictTo removes the expired entries at the front of the order and then the least
+// recently used entries until no more than capacity remain. A capacity of 0 only
+// removes expired entries. If limit is positive, it stops after removing that many
+// entries and reports whether it did. The caller must hold the lock.
+func (s *MemoryStore) evictTo(capacity, limit int) bool {
+	now := time.Now()
+	for n := 0; ; n++ {
+		el := s.order.Front()
+		if el == nil {
+			return false
+		}
+
+		e := el.Value.(*memoryEntry)
+		if !now.After(e.expires) && (capacity <= 0 || len(s.entries) <= capacity) {
+			return false
+		}
+
+		if limit > 0 && n == limit {
+			return true
+		}
+		s.remove(el)
+	}
+}
+
+// remove removes an entry. The caller must hold the lock.
+func (s *MemoryStore) remove(el *list.Element) {
+	delete(s.entries, el.Value.(*memoryEntry).id)
+	s.order.Remove(el)
+}
@@ -0,0 +1,409 @@
+package session
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kellegous/underpants/user"
+)
+
+func waitForLen(t *testing.T, s *MemoryStore, n int) {
+	deadline := time.Now().Add(time.Second)
+	for s.Len() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d sessions, got %d", n, s.Len())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMemoryStoreExpiration(t *testing.T) {
+	s := newMemoryStore(t, MemoryOptions{TTL: time.Millisecond})
+
+	if err := s.Put("a", &user.Info{Email: "a@a.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	if _, err := s.Get("a"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	if s.Len() != 0 {
+		t.Fatalf("expired session should have been removed, got %d", s.Len())
+	}
+}
+
+func TestMemoryStoreSyncEviction(t *testing.T) {
+	s := newMemoryStore(t, MemoryOptions{Capacity: 2})
+
+	for _, id := range []string{"a", "b", "c"} {
+		if err := s.Put(id, &user.Info{Email: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if s.Len() != 2 {
+		t.Fatalf("expected 2 sessions, got %d", s.Len())
+	}
+
+	if _, err := s.Get("a"); err != ErrNotFound {
+		t.Fatal("oldest session should have been evicted")
+	}
+
+	for _, id := range []string{"b", "c"} {
+		if _, err := s.Get(id); err != nil {
+			t.Fatalf("session %s should not have been evicted", id)
+		}
+	}
+}
+
+func TestMemoryStoreLRU(t *testing.T) {
+	s := newMemoryStore(t, MemoryOptions{Capacity: 2})
+
+	for _, id := range []string{"a", "b"} {
+		if err := s.Put(id, &user.Info{Email: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// using a makes b the least recently used session.
+	if _, err := s.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Put("c", &user.Info{Email: "c"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Get("b"); err != ErrNotFound {
+		t.Fatal("least recently used session should have been evicted")
+	}
+
+	for _, id := range []string{"a", "c"} {
+		if _, err := s.Get(id); err != nil {
+			t.Fatalf("session %s should not have been evicted", id)
+		}
+	}
+
+	if hits, misses := s.CacheStats(); hits != 3 || misses != 1 {
+		t.Fatalf("expected 3 hits and 1 miss, got %d and %d", hits, misses)
+	}
+}
+
+func TestMemoryStoreBatchEviction(t *testing.T) {
+	s := newMemoryStore(t, MemoryOptions{
+		Capacity:  2,
+		Eviction:  EvictBatch,
+		BatchSize: 2,
+	})
+
+	for i := 0; i < 4; i++ {
+		if err := s.Put(fmt.Sprintf("%d", i), &user.Info{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if s.Len() != 4 {
+		t.Fatalf("store should overshoot by the batch size, got %d", s.Len())
+	}
+
+	if err := s.Put("4", &user.Info{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Len() != 2 {
+		t.Fatalf("expected eviction down to capacity, got %d", s.Len())
+	}
+}
+
+func TestMemoryStoreAsyncEviction(t *testing.T) {
+	s := newMemoryStore(t, MemoryOptions{
+		Capacity: 2,
+		Eviction: EvictAsync,
+	})
+	defer s.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := s.Put(fmt.Sprintf("%d", i), &user.Info{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitForLen(t, s, 2)
+
+	if _, err := s.Get("9"); err != nil {
+		t.Fatal("newest session should not have been evicted")
+	}
+}
+
+func TestMemoryStoreAsyncEvictionInChunks(t *testing.T) {
+	s := newMemoryStore(t, MemoryOptions{
+		Capacity: 2,
+		Eviction: EvictAsync,
+	})
+	defer s.Close()
+
+	// the excess is more than a chunk, so eviction lets go of the lock along the way.
+	s.lck.Lock()
+	for i := 0; i < 10*evictChunkSize; i++ {
+		id := fmt.Sprintf("%d", i)
+		s.entries[id] = s.order.PushBack(&memoryEntry{
+			id:      id,
+			user:    &user.Info{},
+			expires: time.Now().Add(time.Hour),
+		})
+	}
+	s.lck.Unlock()
+
+	if err := s.Put("last", &user.Info{}); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForLen(t, s, 2)
+
+	if _, err := s.Get("last"); err != nil {
+		t.Fatal("newest session should not have been evicted")
+	}
+
+	// closing again is harmless.
+	s.Close()
+}
+
+func TestMemoryStoreInvalidEviction(t *testing.T) {
+	if _, err := NewMemoryStore(MemoryOptions{Eviction: "lru"}); err == nil {
+		t.Fatal("expected error for invalid eviction strategy")
+	}
+}
+
+// benchmarkPut measures Put under churn, where every put is a new session and the
+// store is always at capacity.
+func benchmarkPut(b *testing.B, opts MemoryOptions) {
+	opts.TTL = time.Hour
+	opts.Capacity = 10000
+
+	s, err := NewMemoryStore(opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+
+	u := &user.Info{Email: "a@a.com"}
+	for i := 0; i < opts.Capacity; i++ {
+		s.Put(fmt.Sprintf("warm-%d", i), u)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			s.Put(fmt.Sprintf("%p-%d", pb, i), u)
+			i++
+		}
+	})
+}
+
+func BenchmarkPutSync(b *testing.B) {
+	benchmarkPut(b, MemoryOptions{Eviction: EvictSync})
+}
+
+func BenchmarkPutAsync(b *testing.B) {
+	benchmarkPut(b, MemoryOptions{Eviction: EvictAsync})
+}
+
+func BenchmarkPutBatch(b *testing.B) {
+	benchmarkPut(b, MemoryOptions{Eviction: EvictBatch, BatchSize: 256})
+}
+
+// fullSweepStore is the memory store as it was before sessions were kept in expiry
+// order, the baseline for BenchmarkPutLatency: once per TTL, a Put sweeps the whole map
+// for expired sessions while holding the lock.
+type fullSweepStore struct {
+	lck       sync.Mutex
+	ttl       time.Duration
+	entries   map[string]*memoryEntry
+	lastSweep time.Time
+}
+
+func (s *fullSweepStore) Get(id string) (*user.Info, error) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	e := s.entries[id]
+	if e == nil || time.Now().After(e.expires) {
+		return nil, ErrNotFound
+	}
+	return e.user, nil
+}
+
+func (s *fullSweepStore) Put(id string, u *user.Info) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) >= s.ttl {
+		for id, e := range s.entries {
+			if now.After(e.expires) {
+				delete(s.entries, id)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	s.entries[id] = &memoryEntry{id: id, user: u, expires: now.Add(s.ttl)}
+	return nil
+}
+
+func (s *fullSweepStore) Delete(id string) error {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	delete(s.entries, id)
+	return nil
+}
+
+// putLatencyBacklog is the number of sessions that have just expired when
+// BenchmarkPutLatency starts timing puts.
+const putLatencyBacklog = 200000
+
+// benchmarkPutLatency times each Put into a store that holds putLatencyBacklog sessions
+// that have just expired, so that the store evicts all of them while puts are being
+// made. It reports percentiles and the longest put as well as the mean. The garbage
+// collector is held off while puts are timed, since its pauses would swamp those of
+// eviction.
+func benchmarkPutLatency(b *testing.B, s Store) {
+	u := &user.Info{Email: "a@a.com"}
+	lat := make([]time.Duration, b.N)
+
+	runtime.GC()
+	defer debug.SetGCPercent(debug.SetGCPercent(-1))
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		id := strconv.Itoa(i)
+		t := time.Now()
+		s.Put(id, u)
+		lat[i] = time.Since(t)
+	}
+	b.StopTimer()
+
+	sort.Slice(lat, func(i, j int) bool {
+		return lat[i] < lat[j]
+	})
+	b.ReportMetric(float64(lat[len(lat)*99/100]), "p99-ns")
+	b.ReportMetric(float64(lat[len(lat)*9999/10000]), "p99.99-ns")
+	b.ReportMetric(float64(lat[len(lat)-1]), "max-ns")
+}
+
+// fillExpired adds n sessions that have already expired to the store.
+func fillExpired(s *MemoryStore, n int) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	u := &user.Info{Email: "a@a.com"}
+	expired := time.Now().Add(-time.Minute)
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("expired-%d", i)
+		s.entries[id] = s.order.PushBack(&memoryEntry{id: id, user: u, expires: expired})
+	}
+}
+
+// BenchmarkPutLatency compares the longest puts of the eviction strategies with those
+// of the full-sweep baseline, which holds the lock while it sweeps the whole map.
+func BenchmarkPutLatency(b *testing.B) {
+	b.Run("full-sweep", func(b *testing.B) {
+		s := &fullSweepStore{
+			ttl:       time.Hour,
+			entries:   map[string]*memoryEntry{},
+			lastSweep: time.Now().Add(-time.Hour),
+		}
+
+		u := &user.Info{Email: "a@a.com"}
+		expired := time.Now().Add(-time.Minute)
+		for i := 0; i < putLatencyBacklog; i++ {
+			id := fmt.Sprintf("expired-%d", i)
+			s.entries[id] = &memoryEntry{id: id, user: u, expires: expired}
+		}
+
+		benchmarkPutLatency(b, s)
+	})
+
+	for _, eviction := range []string{EvictSync, EvictAsync} {
+		b.Run(eviction, func(b *testing.B) {
+			s, err := NewMemoryStore(MemoryOptions{TTL: time.Hour, Eviction: eviction})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer s.Close()
+
+			fillExpired(s, putLatencyBacklog)
+			benchmarkPutLatency(b, s)
+		})
+	}
+}
+
+func TestMemoryStoreList(t *testing.T) {
+	s := newMemoryStore(t, MemoryOptions{TTL: time.Hour})
+
+	for _, email := range []string{"a@a.com", "b@a.com"} {
+		if err := s.Put(email, &user.Info{Email: email}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ls := s.List()
+	if len(ls) != 2 || ls[0].User.Email != "a@a.com" || ls[1].User.Email != "b@a.com" {
+		t.Fatalf("unexpected sessions %+v", ls)
+	}
+
+	if d := time.Until(ls[0].Expires); d <= 0 || d > time.Hour {
+		t.Fatalf("unexpected expiry %s", ls[0].Expires)
+	}
+}
+
+// BenchmarkWaitDuringAsyncEviction measures how long callers wait on the store's lock
+// during the background eviction of a large number of expired sessions. Each op is one
+// such eviction, and max-wait-ns is the longest any caller waited during it.
+func BenchmarkWaitDuringAsyncEviction(b *testing.B) {
+	s, err := NewMemoryStore(MemoryOptions{
+		TTL:      time.Hour,
+		Eviction: EvictAsync,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer s.Close()
+
+	var wait time.Duration
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		fillExpired(s, 500000)
+		b.StartTimer()
+
+		s.evict <- struct{}{}
+
+		// callers arrive every so often, as requests would, rather than in a busy loop.
+		var max time.Duration
+		for {
+			t := time.Now()
+			n := s.Len()
+			if d := time.Since(t); d > max {
+				max = d
+			}
+
+			if n == 0 {
+				break
+			}
+			time.Sleep(50 * time.Microsecond)
+		}
+		wait += max
+	}
+
+	b.ReportMetric(float64(wait.Nanoseconds())/float64(b.N), "max-wait-ns")
+}
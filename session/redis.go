@@ -0,0 +1,301 @@
+package session
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kellegous/underpants/user"
+)
+
+// defaultRedisPrefix is prepended to session ids to form Redis keys when no prefix is
+// given.
+const defaultRedisPrefix = "underpants:session:"
+
+// defaultRedisTimeout bounds each Redis command when no timeout is given.
+const defaultRedisTimeout = 2 * time.Second
+
+// maxIdleRedisConns is the number of idle connections kept for reuse.
+const maxIdleRedisConns = 8
+
+// RedisOptions configures a RedisStore.
+type RedisOptions struct {
+	// Addr is the host:port of the Redis server.
+	Addr string
+
+	// Password is sent with AUTH when connecting, if it is not empty.
+	Password string
+
+	// DB is the database selected when connecting.
+	DB int
+
+	// Prefix is prepended to session ids to form keys.
+	Prefix string
+
+	// TTL is how long a session lives after it is stored, which is also how long
+	// revocations are kept.
+	TTL time.Duration
+
+	// Timeout bounds connecting and each command.
+	Timeout time.Duration
+}
+
+// RedisStore is a Store that keeps sessions in Redis, so that they survive restarts
+// and are shared by every instance using the same server.
+type RedisStore struct {
+	opts RedisOptions
+	idle chan *redisConn
+}
+
+type redisConn struct {
+	c net.Conn
+	r *bufio.Reader
+}
+
+// NewRedisStore creates a RedisStore with the given options. Connections are made as
+// they are needed.
+func NewRedisStore(opts RedisOptions) (*RedisStore, error) {
+	if opts.Addr == "" {
+		return nil, errors.New("redis store requires an address")
+	}
+
+	if opts.Prefix == "" {
+		opts.Prefix = defaultRedisPrefix
+	}
+
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultRedisTimeout
+	}
+
+	return &RedisStore{
+		opts: opts,
+		idle: make(chan *redisConn, maxIdleRedisConns),
+	}, nil
+}
+
+// Get returns the user for a session.
+func (s *RedisStore) Get(id string) (*user.Info, error) {
+	v, err := s.do("GET", s.opts.Prefix+id)
+	if err != nil {
+		return nil, err
+	}
+
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	var u user.Info
+	if err := json.Unmarshal(b, &u); err != nil {
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+// Put stores the user for a session.
+func (s *RedisStore) Put(id string, u *user.Info) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.do("SET", s.opts.Prefix+id, string(b),
+		"PX", strconv.FormatInt(int64(s.opts.TTL/time.Millisecond), 10))
+	return err
+}
+
+// Delete removes a session.
+func (s *RedisStore) Delete(id string) error {
+	_, err := s.do("DEL", s.opts.Prefix+id)
+	return err
+}
+
+// Revoke records that the user's sessions were revoked at the given time. The record
+// expires along with the sessions it covers.
+func (s *RedisStore) Revoke(email string, at time.Time) error {
+	_, err := s.do("SET", s.revokedKey(email), at.Format(time.RFC3339Nano),
+		"PX", strconv.FormatInt(int64(s.opts.TTL/time.Millisecond), 10))
+	return err
+}
+
+// RevokedAt returns when the user's sessions were last revoked, the zero time if they
+// have not been.
+func (s *RedisStore) RevokedAt(email string) (time.Time, error) {
+	v, err := s.do("GET", s.revokedKey(email))
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	b, ok := v.([]byte)
+	if !ok {
+		return time.Time{}, nil
+	}
+
+	return time.Parse(time.RFC3339Nano, string(b))
+}
+
+// PutHandoff stores the value for a handoff code until ttl has passed.
+func (s *RedisStore) PutHandoff(code, v string, ttl time.Duration) error {
+	_, err := s.do("SET", s.opts.Prefix+"handoff:"+code, v,
+		"PX", strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	return err
+}
+
+// TakeHandoff returns the value for a handoff code and removes it, so that any instance
+// sharing the store can redeem it but only once.
+func (s *RedisStore) TakeHandoff(code string) (string, error) {
+	v, err := s.do("GETDEL", s.opts.Prefix+"handoff:"+code)
+	if err != nil {
+		return "", err
+	}
+
+	b, ok := v.([]byte)
+	if !ok {
+		return "", ErrNotFound
+	}
+
+	return string(b), nil
+}
+
+// revokedKey is the key under which the user's revocation is stored.
+func (s *RedisStore) revokedKey(email string) string {
+	return s.opts.Prefix + "revoked:" + strings.ToLower(email)
+}
+
+// Close closes the idle connections.
+func (s *RedisStore) Close() error {
+	for {
+		select {
+		case rc := <-s.idle:
+			rc.c.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// conn returns an idle connection or, if there are none, a new one.
+func (s *RedisStore) conn() (*redisConn, error) {
+	select {
+	case rc := <-s.idle:
+		return rc, nil
+	default:
+	}
+
+	c, err := net.DialTimeout("tcp", s.opts.Addr, s.opts.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &redisConn{c: c, r: bufio.NewReader(c)}
+
+	if s.opts.Password != "" {
+		if _, err := s.exec(rc, "AUTH", s.opts.Password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	if s.opts.DB != 0 {
+		if _, err := s.exec(rc, "SELECT", strconv.Itoa(s.opts.DB)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return rc, nil
+}
+
+// do runs a command on a pooled connection. Connections that fail are discarded.
+func (s *RedisStore) do(args ...string) (interface{}, error) {
+	rc, err := s.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := s.exec(rc, args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		rc.c.Close()
+		return nil, err
+	}
+
+	select {
+	case s.idle <- rc:
+	default:
+		rc.c.Close()
+	}
+
+	return v, err
+}
+
+// exec sends a command and reads its reply.
+func (s *RedisStore) exec(rc *redisConn, args ...string) (interface{}, error) {
+	if err := rc.c.SetDeadline(time.Now().Add(s.opts.Timeout)); err != nil {
+		return nil, err
+	}
+
+	cmd := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	if _, err := io.WriteString(rc.c, cmd); err != nil {
+		return nil, err
+	}
+
+	return readReply(rc.r)
+}
+
+// redisError is an error reply from the server, the connection remains usable.
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// readReply reads a single RESP reply. Bulk strings are returned as []byte, a nil bulk
+// string as nil, integers as int64 and simple strings as string.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		if n < 0 {
+			return nil, nil
+		}
+
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+
+	return nil, fmt.Errorf("redis: unsupported reply %q", line)
+}
@@ -0,0 +1,106 @@
+package session
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kellegous/underpants/session/redistest"
+	"github.com/kellegous/underpants/user"
+)
+
+func TestRedisStore(t *testing.T) {
+	f := redistest.NewServer(t)
+
+	s, err := NewRedisStore(RedisOptions{
+		Addr:     f.Addr(),
+		Password: "secret",
+		DB:       2,
+		TTL:      time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	m := &Manager{Key: []byte("key"), Store: s}
+
+	id, err := m.Encode(&user.Info{
+		Email:             "a@a.com",
+		LastAuthenticated: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsID(id) {
+		t.Fatalf("expected a session id, got %s", id)
+	}
+
+	if ttl := f.TTL(defaultRedisPrefix + id); ttl != "PX 3600000" {
+		t.Fatalf("expected session to expire in an hour, got %q", ttl)
+	}
+
+	u, err := m.Decode(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Email != "a@a.com" {
+		t.Fatalf("expected a@a.com, got %s", u.Email)
+	}
+
+	if err := s.Revoke("A@a.com", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := (&Manager{Key: m.Key, Store: s, Revocations: s}).Decode(id); err == nil {
+		t.Fatal("revoked session should have been rejected")
+	}
+
+	code, err := (&Manager{Key: m.Key, Store: s, Handoffs: s}).NewHandoff(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ttl := f.TTL(defaultRedisPrefix + "handoff:" + code); ttl != "PX 60000" {
+		t.Fatalf("expected handoff to expire in a minute, got %q", ttl)
+	}
+
+	if v, err := s.TakeHandoff(code); err != nil || v != id {
+		t.Fatalf("expected handoff of %s, got %q, %v", id, v, err)
+	}
+
+	if _, err := s.TakeHandoff(code); err != ErrNotFound {
+		t.Fatalf("expected redeemed handoff to be missing, got %v", err)
+	}
+
+	if err := m.Destroy(requestWithCookie(id)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Get(id); err != ErrNotFound {
+		t.Fatalf("expected destroyed session to be missing, got %v", err)
+	}
+
+	// all of the commands should have shared a single connection.
+	if auth := f.Auth(); len(auth) != 2 || auth[0] != "AUTH secret" || auth[1] != "SELECT 2" {
+		t.Fatalf("expected one AUTH and SELECT, got %v", auth)
+	}
+}
+
+func TestRedisStoreUnavailable(t *testing.T) {
+	f := redistest.NewServer(t)
+	f.Close()
+
+	s, err := NewRedisStore(RedisOptions{
+		Addr: f.Addr(),
+		TTL:  time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Get("s.nope"); err == nil || err == ErrNotFound {
+		t.Fatalf("expected a connection error, got %v", err)
+	}
+}
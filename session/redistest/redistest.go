@@ -0,0 +1,133 @@
+// Package redistest provides a Redis server for tests that understands just enough of
+// the protocol for session.RedisStore.
+package redistest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Server is an in-memory Redis server listening on a local port.
+type Server struct {
+	l net.Listener
+
+	lck  sync.Mutex
+	data map[string]string
+	ttls map[string]string
+	auth []string
+}
+
+// NewServer starts a Server, which is closed when the test ends.
+func NewServer(t testing.TB) *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		l:    l,
+		data: map[string]string{},
+		ttls: map[string]string{},
+	}
+	t.Cleanup(s.Close)
+	go s.serve()
+	return s
+}
+
+// Addr is the host:port the server listens on.
+func (s *Server) Addr() string {
+	return s.l.Addr().String()
+}
+
+// Close stops accepting connections.
+func (s *Server) Close() {
+	s.l.Close()
+}
+
+// TTL is the expiration given when the key was last set, as in "PX 60000".
+func (s *Server) TTL(key string) string {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	return s.ttls[key]
+}
+
+// Auth is the AUTH and SELECT commands the server has received.
+func (s *Server) Auth() []string {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	return append([]string(nil), s.auth...)
+}
+
+func (s *Server) serve() {
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(c)
+	}
+}
+
+func (s *Server) serveConn(c net.Conn) {
+	defer c.Close()
+
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, n)
+		for i := range args {
+			if _, err := r.ReadString('\n'); err != nil {
+				return
+			}
+			arg, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			args[i] = strings.TrimSuffix(arg, "\r\n")
+		}
+
+		fmt.Fprint(c, s.exec(args))
+	}
+}
+
+func (s *Server) exec(args []string) string {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+
+	switch strings.ToUpper(args[0]) {
+	case "AUTH", "SELECT":
+		s.auth = append(s.auth, strings.Join(args, " "))
+		return "+OK\r\n"
+	case "SET":
+		s.data[args[1]] = args[2]
+		s.ttls[args[1]] = strings.Join(args[3:], " ")
+		return "+OK\r\n"
+	case "GET":
+		v, ok := s.data[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "GETDEL":
+		v, ok := s.data[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		delete(s.data, args[1])
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "DEL":
+		delete(s.data, args[1])
+		return ":1\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
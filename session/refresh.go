@@ -0,0 +1,98 @@
+package session
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/kellegous/underpants/user"
+)
+
+// tokenKeyLabel distinguishes the key that encrypts refresh tokens from the signing
+// key it is derived from.
+const tokenKeyLabel = "underpants refresh token"
+
+// tokenCipher is the AEAD used to encrypt refresh tokens, its key is derived from the
+// session signing key.
+func (m *Manager) tokenCipher() (cipher.AEAD, error) {
+	return newCipher(m.Key, tokenKeyLabel)
+}
+
+// SealToken encrypts a refresh token so that it can be kept in a session.
+func (m *Manager) SealToken(tok string) (string, error) {
+	c, err := m.tokenCipher()
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, c.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(
+		c.Seal(nonce, nonce, []byte(tok), nil)), nil
+}
+
+// OpenToken decrypts a refresh token sealed with SealToken.
+func (m *Manager) OpenToken(sealed string) (string, error) {
+	c, err := m.tokenCipher()
+	if err != nil {
+		return "", err
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+
+	if len(b) < c.NonceSize() {
+		return "", errors.New("sealed token is too short")
+	}
+
+	tok, err := c.Open(nil, b[:c.NonceSize()], b[c.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(tok), nil
+}
+
+// Refreshable returns the user of an expired session in the request's cookie that can
+// still be refreshed. The session must carry a refresh token, must not have been
+// revoked and must have been used within MaxLifetime.
+func (m *Manager) Refreshable(r *http.Request) (*user.Info, error) {
+	c, err := r.Cookie(m.CookieName())
+	if err != nil || c.Value == "" {
+		return nil, errors.New("empty cookie")
+	}
+
+	v, err := url.QueryUnescape(c.Value)
+	if err != nil {
+		return nil, errors.New("unable to escape cookie")
+	}
+
+	u, err := m.decode(v)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.RefreshToken == "" {
+		return nil, fmt.Errorf("Session cannot be refreshed for: %s", u.Email)
+	}
+
+	if time.Now().Sub(lastActive(u)) >= m.MaxLifetime {
+		return nil, fmt.Errorf("Session too old to refresh for: %s", u.Email)
+	}
+
+	if err := m.checkRevoked(u); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
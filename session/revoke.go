@@ -0,0 +1,54 @@
+package session
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Revocations records when all of a user's sessions were last revoked. Sessions that
+// were authenticated at or before that time are no longer valid.
+type Revocations interface {
+	Revoke(email string, at time.Time) error
+	RevokedAt(email string) (time.Time, error)
+}
+
+// MemoryRevocations keeps revocations in process memory. Revocations are forgotten
+// once every session they cover would have expired anyway.
+type MemoryRevocations struct {
+	ttl time.Duration
+
+	lck     sync.Mutex
+	revoked map[string]time.Time
+}
+
+// NewMemoryRevocations creates MemoryRevocations for sessions that last for ttl.
+func NewMemoryRevocations(ttl time.Duration) *MemoryRevocations {
+	return &MemoryRevocations{
+		ttl:     ttl,
+		revoked: map[string]time.Time{},
+	}
+}
+
+// Revoke records that the user's sessions were revoked at the given time.
+func (m *MemoryRevocations) Revoke(email string, at time.Time) error {
+	m.lck.Lock()
+	defer m.lck.Unlock()
+
+	for k, v := range m.revoked {
+		if time.Since(v) > m.ttl {
+			delete(m.revoked, k)
+		}
+	}
+
+	m.revoked[strings.ToLower(email)] = at
+	return nil
+}
+
+// RevokedAt returns when the user's sessions were last revoked, the zero time if they
+// have not been.
+func (m *MemoryRevocations) RevokedAt(email string) (time.Time, error) {
+	m.lck.Lock()
+	defer m.lck.Unlock()
+	return m.revoked[strings.ToLower(email)], nil
+}
@@ -0,0 +1,321 @@
+package session
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kellegous/underpants/user"
+
+	"go.uber.org/zap"
+)
+
+// idPrefix marks a cookie value as a session id rather than a self-contained, signed
+// user. Legacy cookies are base64 and can never contain a '.'.
+const idPrefix = "s."
+
+// slideInterval is the minimum time between refreshes of a sliding session, so that
+// a busy user does not have their session re-minted on every request.
+const slideInterval = time.Minute
+
+// ErrNotFound is returned by a Store when there is no session for an id.
+var ErrNotFound = errors.New("session not found")
+
+// Store holds server-side session state keyed by an opaque session id.
+type Store interface {
+	Get(id string) (*user.Info, error)
+	Put(id string, u *user.Info) error
+	Delete(id string) error
+}
+
+// Listing is a session held by a store, without its id.
+type Listing struct {
+	User    *user.Info
+	Expires time.Time
+}
+
+// Lister is implemented by stores that can list the sessions they hold.
+type Lister interface {
+	List() []*Listing
+}
+
+// Manager encodes and decodes the values carried in the user cookie. Without a Store,
+// values are self-contained signed users. With a Store, values are opaque session ids
+// and legacy self-contained cookies are upgraded to sessions as they are seen, until
+// LegacyUntil.
+type Manager struct {
+	// Key is the hmac signing key for self-contained cookies.
+	Key []byte
+
+	// Store holds server-side sessions, it is nil for purely cookie based sessions.
+	Store Store
+
+	// Cookie controls the attributes of the session cookie.
+	Cookie CookieOptions
+
+	// Revocations records revoked sessions, revocation is unsupported if it is nil.
+	Revocations Revocations
+
+	// Handoffs holds the codes that hand sessions from the hub to routes.
+	Handoffs Handoffs
+
+	// Sliding enables sliding expiration, where sessions expire after being idle for
+	// the cookie's max age rather than that long after the user signed in.
+	Sliding bool
+
+	// MaxLifetime is how long a sliding session can last, no matter how active it is.
+	MaxLifetime time.Duration
+
+	// Encrypt enables encryption of self-contained cookies, so that the user cannot be
+	// read from them. Cookies that are only signed are still accepted.
+	Encrypt bool
+
+	// LegacyUntil is when a Store stops accepting legacy self-contained cookies. Each
+	// use of one mints a new session, so signing out cannot end it; the migration has
+	// to end instead. With the zero time, they are never accepted.
+	LegacyUntil time.Time
+}
+
+// IsID determines if a cookie value is a session id.
+func IsID(v string) bool {
+	return strings.HasPrefix(v, idPrefix)
+}
+
+// newID generates a new random session id.
+func newID() (string, error) {
+	return newToken(idPrefix)
+}
+
+// newToken generates a new random token with the given prefix.
+func newToken(prefix string) (string, error) {
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return prefix + base64.RawURLEncoding.EncodeToString(b[:]), nil
+}
+
+// Encode creates the cookie value for the user.
+func (m *Manager) Encode(u *user.Info) (string, error) {
+	if m.Store == nil {
+		return m.encodeUser(u)
+	}
+
+	id, err := newID()
+	if err != nil {
+		return "", err
+	}
+
+	if err := m.Store.Put(id, u); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// decode decodes a cookie value in the session id, the encrypted or the legacy
+// self-contained format, without checking whether the session is still valid.
+func (m *Manager) decode(v string) (*user.Info, error) {
+	if m.Store != nil && !IsID(v) && !time.Now().Before(m.LegacyUntil) {
+		return nil, errors.New("legacy cookies are no longer accepted")
+	}
+
+	if isEncrypted(v) {
+		return m.decryptUser(v)
+	}
+
+	if !IsID(v) {
+		return user.Decode(v, m.Key)
+	}
+
+	if m.Store == nil {
+		return nil, errors.New("session ids are not supported without a session store")
+	}
+
+	return m.Store.Get(v)
+}
+
+// checkRevoked returns an error if the user's session has been revoked.
+func (m *Manager) checkRevoked(u *user.Info) error {
+	if m.Revocations == nil {
+		return nil
+	}
+
+	t, err := m.Revocations.RevokedAt(u.Email)
+	if err != nil {
+		return err
+	}
+
+	if !u.LastAuthenticated.After(t) {
+		return fmt.Errorf("Session revoked for: %s", u.Email)
+	}
+
+	// revoking an admin's sessions also ends their impersonations.
+	if u.Impersonator != "" {
+		t, err := m.Revocations.RevokedAt(u.Impersonator)
+		if err != nil {
+			return err
+		}
+
+		if !u.LastAuthenticated.After(t) {
+			return fmt.Errorf("Session revoked for: %s", u.Impersonator)
+		}
+	}
+
+	return nil
+}
+
+// Decode decodes and verifies a cookie value in the session id, the encrypted or the
+// legacy self-contained format.
+func (m *Manager) Decode(v string) (*user.Info, error) {
+	u, err := m.decode(v)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.expired(u, time.Now()) {
+		return nil, fmt.Errorf("Session too old for: %s", u.Email)
+	}
+
+	if err := m.checkRevoked(u); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// lastActive is when the session was last used, as far as the manager knows.
+func lastActive(u *user.Info) time.Time {
+	if u.LastActive.After(u.LastAuthenticated) {
+		return u.LastActive
+	}
+	return u.LastAuthenticated
+}
+
+// expired determines if the user's session has expired.
+func (m *Manager) expired(u *user.Info, now time.Time) bool {
+	if !m.Sliding {
+		return now.Sub(u.LastAuthenticated) >= m.MaxAge()
+	}
+
+	return now.Sub(u.LastAuthenticated) >= m.MaxLifetime ||
+		now.Sub(lastActive(u)) >= m.MaxAge()
+}
+
+// slide refreshes a sliding session that has not been refreshed recently and
+// re-mints its cookie.
+func (m *Manager) slide(w http.ResponseWriter, v string, u *user.Info) {
+	now := time.Now()
+	if now.Sub(lastActive(u)) < slideInterval {
+		return
+	}
+
+	s := *u
+	s.LastActive = now
+
+	var err error
+	if IsID(v) {
+		err = m.Store.Put(v, &s)
+	} else {
+		v, err = m.encodeUser(&s)
+	}
+
+	if err != nil {
+		zap.L().Error("unable to refresh session",
+			zap.String("user", u.Email),
+			zap.Error(err))
+		return
+	}
+
+	http.SetCookie(w, m.NewCookie(v))
+}
+
+// RevokeUser invalidates all of the sessions the user has signed in with so far, on
+// every route.
+func (m *Manager) RevokeUser(email string) error {
+	if m.Revocations == nil {
+		return errors.New("session revocation is not configured")
+	}
+
+	return m.Revocations.Revoke(email, time.Now())
+}
+
+// FromRequest decodes the user from the cookie found in the http.Request. If the
+// cookie is a legacy self-contained cookie and a Store is configured, the user is
+// moved into a new session and the cookie is replaced, as are signed cookies if
+// cookies are encrypted. Sliding sessions are refreshed as they are used.
+func (m *Manager) FromRequest(w http.ResponseWriter, r *http.Request) (*user.Info, error) {
+	c, err := r.Cookie(m.CookieName())
+	if err != nil || c.Value == "" {
+		return nil, errors.New("empty cookie")
+	}
+
+	v, err := url.QueryUnescape(c.Value)
+	if err != nil {
+		return nil, errors.New("unable to escape cookie")
+	}
+
+	u, err := m.Decode(v)
+	if err != nil {
+		zap.L().Debug("invalid session cookie",
+			zap.String("host", r.Host),
+			zap.Error(err))
+		return nil, errors.New("could not decode and verify user")
+	}
+
+	if m.Store != nil && !IsID(v) {
+		id, err := m.Encode(u)
+		if err != nil {
+			zap.L().Error("unable to upgrade legacy cookie",
+				zap.String("user", u.Email),
+				zap.Error(err))
+			return u, nil
+		}
+
+		http.SetCookie(w, m.NewCookie(id))
+		return u, nil
+	}
+
+	if m.Store == nil && m.Encrypt && !isEncrypted(v) {
+		e, err := m.encodeUser(u)
+		if err != nil {
+			zap.L().Error("unable to encrypt signed cookie",
+				zap.String("user", u.Email),
+				zap.Error(err))
+			return u, nil
+		}
+
+		http.SetCookie(w, m.NewCookie(e))
+		return u, nil
+	}
+
+	if m.Sliding {
+		m.slide(w, v, u)
+	}
+
+	return u, nil
+}
+
+// Destroy removes the session referenced by the request's cookie, if any.
+func (m *Manager) Destroy(r *http.Request) error {
+	if m.Store == nil {
+		return nil
+	}
+
+	c, err := r.Cookie(m.CookieName())
+	if err != nil {
+		return nil
+	}
+
+	v, err := url.QueryUnescape(c.Value)
+	if err != nil || !IsID(v) {
+		return nil
+	}
+
+	return m.Store.Delete(v)
+}
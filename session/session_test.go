@@ -0,0 +1,705 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kellegous/underpants/user"
+)
+
+func requestWithCookie(v string) *http.Request {
+	r := httptest.NewRequest("GET", "http://a.com/", nil)
+	r.AddCookie(&http.Cookie{
+		Name:  user.CookieKey,
+		Value: url.QueryEscape(v),
+	})
+	return r
+}
+
+func cookieFrom(w *httptest.ResponseRecorder) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == user.CookieKey {
+			return c
+		}
+	}
+	return nil
+}
+
+func newMemoryStore(t testing.TB, opts MemoryOptions) *MemoryStore {
+	if opts.TTL == 0 {
+		opts.TTL = time.Hour
+	}
+
+	s, err := NewMemoryStore(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestCookieSessions(t *testing.T) {
+	m := &Manager{Key: []byte("key")}
+
+	v, err := m.Encode(&user.Info{
+		Email:             "a@a.com",
+		LastAuthenticated: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if IsID(v) {
+		t.Fatalf("expected a self-contained cookie, got %s", v)
+	}
+
+	w := httptest.NewRecorder()
+	u, err := m.FromRequest(w, requestWithCookie(v))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Email != "a@a.com" {
+		t.Fatalf("expected a@a.com, got %s", u.Email)
+	}
+
+	if c := cookieFrom(w); c != nil {
+		t.Fatalf("cookie sessions should not be upgraded, got %s", c.Value)
+	}
+}
+
+func TestEncryptedCookies(t *testing.T) {
+	m := &Manager{Key: []byte("key"), Encrypt: true}
+
+	u := &user.Info{
+		Email:             "a@a.com",
+		Name:              "A",
+		LastAuthenticated: time.Now(),
+	}
+
+	v, err := m.Encode(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := u.Encode(m.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !isEncrypted(v) || strings.Contains(v, strings.Split(signed, ",")[1][:16]) {
+		t.Fatalf("expected an encrypted cookie, got %s", v)
+	}
+
+	w := httptest.NewRecorder()
+	d, err := m.FromRequest(w, requestWithCookie(v))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d.Email != "a@a.com" || d.Name != "A" {
+		t.Fatalf("expected a@a.com, got %+v", d)
+	}
+
+	if c := cookieFrom(w); c != nil {
+		t.Fatalf("encrypted cookies should not be replaced, got %s", c.Value)
+	}
+
+	// tampered cookies and those encrypted with another key are rejected.
+	tampered := v[:len(v)-2] + "AA"
+	if tampered == v {
+		tampered = v[:len(v)-2] + "BB"
+	}
+
+	for _, bad := range []string{tampered, encryptedPrefix + "AA"} {
+		if _, err := m.Decode(bad); err == nil {
+			t.Fatalf("expected %s to be rejected", bad)
+		}
+	}
+
+	if _, err := (&Manager{Key: []byte("other"), Encrypt: true}).Decode(v); err == nil {
+		t.Fatal("expected a cookie encrypted with another key to be rejected")
+	}
+
+	// signed cookies are still accepted and are encrypted as they are seen.
+	w = httptest.NewRecorder()
+	if _, err := m.FromRequest(w, requestWithCookie(signed)); err != nil {
+		t.Fatal(err)
+	}
+
+	c := cookieFrom(w)
+	if c == nil {
+		t.Fatal("expected the signed cookie to be replaced")
+	}
+
+	e, err := url.QueryUnescape(c.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !isEncrypted(e) {
+		t.Fatalf("expected an encrypted cookie, got %s", e)
+	}
+}
+
+func TestLegacyCookieUpgrade(t *testing.T) {
+	key := []byte("key")
+
+	legacy, err := (&user.Info{
+		Email:             "a@a.com",
+		LastAuthenticated: time.Now(),
+	}).Encode(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newMemoryStore(t, MemoryOptions{})
+	m := &Manager{Key: key, Store: s, LegacyUntil: time.Now().Add(time.Hour)}
+
+	w := httptest.NewRecorder()
+	u, err := m.FromRequest(w, requestWithCookie(legacy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Email != "a@a.com" {
+		t.Fatalf("expected a@a.com, got %s", u.Email)
+	}
+
+	c := cookieFrom(w)
+	if c == nil {
+		t.Fatal("legacy cookie should have been upgraded")
+	}
+
+	id, err := url.QueryUnescape(c.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsID(id) {
+		t.Fatalf("expected a session id, got %s", id)
+	}
+
+	if s.Len() != 1 {
+		t.Fatalf("expected 1 session, got %d", s.Len())
+	}
+
+	// the upgraded cookie is now accepted and not upgraded again.
+	w = httptest.NewRecorder()
+	u, err = m.FromRequest(w, requestWithCookie(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Email != "a@a.com" {
+		t.Fatalf("expected a@a.com, got %s", u.Email)
+	}
+
+	if c := cookieFrom(w); c != nil {
+		t.Fatalf("session cookie should not be replaced, got %s", c.Value)
+	}
+
+	// a legacy cookie presented after the upgrade still works during the migration,
+	// even once the session it was upgraded to has been signed out of.
+	if err := m.Destroy(requestWithCookie(id)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.FromRequest(httptest.NewRecorder(), requestWithCookie(id)); err == nil {
+		t.Fatal("signed out session should have been rejected")
+	}
+
+	w = httptest.NewRecorder()
+	if _, err := m.FromRequest(w, requestWithCookie(legacy)); err != nil {
+		t.Fatal(err)
+	}
+
+	if cookieFrom(w) == nil {
+		t.Fatal("legacy cookie should have been upgraded")
+	}
+
+	// once the migration is over, it is refused.
+	m.LegacyUntil = time.Now()
+
+	w = httptest.NewRecorder()
+	if _, err := m.FromRequest(w, requestWithCookie(legacy)); err == nil {
+		t.Fatal("legacy cookie should have been rejected after the migration")
+	}
+
+	if c := cookieFrom(w); c != nil {
+		t.Fatal("legacy cookie should not have been upgraded after the migration")
+	}
+
+	m.LegacyUntil = time.Time{}
+	if _, err := m.FromRequest(httptest.NewRecorder(), requestWithCookie(legacy)); err == nil {
+		t.Fatal("legacy cookie should have been rejected without a migration")
+	}
+}
+
+func TestExpiredLegacyCookie(t *testing.T) {
+	key := []byte("key")
+
+	legacy, err := (&user.Info{
+		Email:             "a@a.com",
+		LastAuthenticated: time.Now().Add(-2 * user.CookieMaxAge * time.Second),
+	}).Encode(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &Manager{
+		Key:         key,
+		Store:       newMemoryStore(t, MemoryOptions{}),
+		LegacyUntil: time.Now().Add(time.Hour),
+	}
+
+	w := httptest.NewRecorder()
+	if _, err := m.FromRequest(w, requestWithCookie(legacy)); err == nil {
+		t.Fatal("expired legacy cookie should have been rejected")
+	}
+
+	if c := cookieFrom(w); c != nil {
+		t.Fatal("expired legacy cookie should not have been upgraded")
+	}
+}
+
+func TestUnknownSession(t *testing.T) {
+	m := &Manager{Key: []byte("key"), Store: newMemoryStore(t, MemoryOptions{})}
+
+	if _, err := m.Decode(idPrefix + "nope"); err == nil {
+		t.Fatal("unknown session should have been rejected")
+	}
+
+	m = &Manager{Key: []byte("key")}
+	if _, err := m.Decode(idPrefix + "nope"); err == nil {
+		t.Fatal("session ids should be rejected without a store")
+	}
+}
+
+func TestDestroy(t *testing.T) {
+	s := newMemoryStore(t, MemoryOptions{})
+	m := &Manager{Key: []byte("key"), Store: s}
+
+	id, err := m.Encode(&user.Info{
+		Email:             "a@a.com",
+		LastAuthenticated: time.Now(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Destroy(requestWithCookie(id)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Decode(id); err == nil {
+		t.Fatal("destroyed session should have been rejected")
+	}
+}
+
+func TestCookieOptions(t *testing.T) {
+	m := &Manager{
+		Key: []byte("key"),
+		Cookie: CookieOptions{
+			Name:     "sid",
+			Domain:   "a.com",
+			MaxAge:   60,
+			Secure:   true,
+			HTTPOnly: true,
+			SameSite: http.SameSiteStrictMode,
+		},
+	}
+
+	c := m.NewCookie("v")
+	if c.Name != "sid" || c.Domain != "a.com" || c.MaxAge != 60 || !c.Secure ||
+		!c.HttpOnly || c.SameSite != http.SameSiteStrictMode {
+		t.Fatalf("unexpected cookie %+v", c)
+	}
+
+	if c := m.ClearCookie(); c.Name != "sid" || c.MaxAge >= 0 {
+		t.Fatalf("expected cookie to be cleared, got %+v", c)
+	}
+
+	v, err := m.Encode(&user.Info{
+		Email:             "a@a.com",
+		LastAuthenticated: time.Now().Add(-2 * time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Decode(v); err == nil {
+		t.Fatal("session older than max-age should have been rejected")
+	}
+
+	r := httptest.NewRequest("GET", "http://a.com/", nil)
+	r.AddCookie(&http.Cookie{Name: "sid", Value: url.QueryEscape(v)})
+	m.Cookie.MaxAge = 3600
+	if _, err := m.FromRequest(httptest.NewRecorder(), r); err != nil {
+		t.Fatalf("expected session to be read from the sid cookie: %s", err)
+	}
+}
+
+func TestRevokeUser(t *testing.T) {
+	m := &Manager{Key: []byte("key")}
+	if err := m.RevokeUser("a@a.com"); err == nil {
+		t.Fatal("expected revocation to fail without revocations")
+	}
+
+	m.Revocations = NewMemoryRevocations(time.Hour)
+
+	before, err := m.Encode(&user.Info{
+		Email:             "a@a.com",
+		LastAuthenticated: time.Now().Add(-time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := m.Encode(&user.Info{
+		Email:             "b@a.com",
+		LastAuthenticated: time.Now().Add(-time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.RevokeUser("A@a.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Decode(before); err == nil {
+		t.Fatal("revoked session should have been rejected")
+	}
+
+	if _, err := m.Decode(other); err != nil {
+		t.Fatalf("other users' sessions should be unaffected: %s", err)
+	}
+
+	after, err := m.Encode(&user.Info{
+		Email:             "a@a.com",
+		LastAuthenticated: time.Now().Add(time.Millisecond),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Decode(after); err != nil {
+		t.Fatalf("sessions signed in after revocation should be valid: %s", err)
+	}
+
+	impersonated, err := m.Encode(&user.Info{
+		Email:             "b@a.com",
+		LastAuthenticated: time.Now().Add(time.Millisecond),
+		Impersonator:      "root@a.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	if err := m.RevokeUser("root@a.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.Decode(impersonated); err == nil {
+		t.Fatal("revoking an admin should end their impersonations")
+	}
+}
+
+func TestSlidingSessions(t *testing.T) {
+	m := &Manager{
+		Key:         []byte("key"),
+		Cookie:      CookieOptions{MaxAge: 600},
+		Sliding:     true,
+		MaxLifetime: time.Hour,
+	}
+
+	encode := func(signedIn, active time.Duration) string {
+		v, err := m.Encode(&user.Info{
+			Email:             "a@a.com",
+			LastAuthenticated: time.Now().Add(-signedIn),
+			LastActive:        time.Now().Add(-active),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	// signed in long ago but recently active, the session is refreshed.
+	w := httptest.NewRecorder()
+	if _, err := m.FromRequest(w, requestWithCookie(encode(30*time.Minute, 5*time.Minute))); err != nil {
+		t.Fatalf("active session should be valid: %s", err)
+	}
+
+	c := cookieFrom(w)
+	if c == nil {
+		t.Fatal("active session should have been refreshed")
+	}
+
+	v, err := url.QueryUnescape(c.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := m.Decode(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if time.Since(u.LastActive) > time.Minute {
+		t.Fatalf("expected refreshed session to be active now, got %s", u.LastActive)
+	}
+
+	// just refreshed sessions are not re-minted.
+	w = httptest.NewRecorder()
+	if _, err := m.FromRequest(w, requestWithCookie(v)); err != nil {
+		t.Fatal(err)
+	}
+
+	if cookieFrom(w) != nil {
+		t.Fatal("recently refreshed session should not have been re-minted")
+	}
+
+	if _, err := m.Decode(encode(30*time.Minute, 15*time.Minute)); err == nil {
+		t.Fatal("idle session should have expired")
+	}
+
+	if _, err := m.Decode(encode(2*time.Hour, time.Minute)); err == nil {
+		t.Fatal("session past its max lifetime should have expired")
+	}
+}
+
+func TestSlidingStoreSessions(t *testing.T) {
+	s := newMemoryStore(t, MemoryOptions{})
+	m := &Manager{
+		Key:         []byte("key"),
+		Store:       s,
+		Sliding:     true,
+		MaxLifetime: 2 * time.Hour,
+	}
+
+	id, err := m.Encode(&user.Info{
+		Email:             "a@a.com",
+		LastAuthenticated: time.Now().Add(-90 * time.Minute),
+		LastActive:        time.Now().Add(-10 * time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	if _, err := m.FromRequest(w, requestWithCookie(id)); err != nil {
+		t.Fatalf("active session should be valid: %s", err)
+	}
+
+	if c := cookieFrom(w); c == nil || c.Value != id {
+		t.Fatalf("expected cookie for %s to be re-minted, got %v", id, c)
+	}
+
+	u, err := s.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if time.Since(u.LastActive) > time.Minute {
+		t.Fatalf("expected stored session to be active now, got %s", u.LastActive)
+	}
+}
+
+func TestSealToken(t *testing.T) {
+	m := &Manager{Key: []byte("key")}
+
+	sealed, err := m.SealToken("refresh")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(sealed, "refresh") {
+		t.Fatalf("sealed token should not contain the token: %s", sealed)
+	}
+
+	tok, err := m.OpenToken(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tok != "refresh" {
+		t.Fatalf("expected refresh, got %s", tok)
+	}
+
+	if _, err := (&Manager{Key: []byte("other")}).OpenToken(sealed); err == nil {
+		t.Fatal("token sealed with a different key should not open")
+	}
+}
+
+func TestRefreshable(t *testing.T) {
+	m := &Manager{Key: []byte("key"), MaxLifetime: 3 * time.Hour}
+
+	encode := func(active time.Duration, token string) *http.Request {
+		v, err := m.Encode(&user.Info{
+			Email:             "a@a.com",
+			LastAuthenticated: time.Now().Add(-active),
+			RefreshToken:      token,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return requestWithCookie(v)
+	}
+
+	if _, err := m.Refreshable(encode(2*time.Hour, "t")); err != nil {
+		t.Fatalf("expired session with a refresh token should be refreshable: %s", err)
+	}
+
+	if _, err := m.Refreshable(encode(time.Minute, "")); err == nil {
+		t.Fatal("session without a refresh token should not be refreshable")
+	}
+
+	if _, err := m.Refreshable(encode(4*time.Hour, "t")); err == nil {
+		t.Fatal("session past its max lifetime should not be refreshable")
+	}
+}
+
+func TestHandoffs(t *testing.T) {
+	m := &Manager{Key: []byte("key")}
+	if _, err := m.NewHandoff("v"); err == nil {
+		t.Fatal("expected handoff to fail without handoffs")
+	}
+
+	h := NewMemoryHandoffs()
+	m.Handoffs = h
+
+	v, err := m.Encode(&user.Info{Email: "a@a.com", LastAuthenticated: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := m.NewHandoff(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, u, err := m.RedeemHandoff(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r != v || u.Email != "a@a.com" {
+		t.Fatalf("expected session for a@a.com, got %q for %v", r, u)
+	}
+
+	if _, _, err := m.RedeemHandoff(code); err != ErrNotFound {
+		t.Fatalf("expected redeemed code to be missing, got %v", err)
+	}
+
+	if err := h.PutHandoff("expired", v, -time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := m.RedeemHandoff("expired"); err != ErrNotFound {
+		t.Fatalf("expected expired code to be missing, got %v", err)
+	}
+
+	if err := h.PutHandoff("forged", "not-a-session", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := m.RedeemHandoff("forged"); err == nil {
+		t.Fatal("expected invalid session to be rejected")
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	m := &Manager{Key: []byte("key")}
+	u := &user.Info{Email: "a@a.com", LastAuthenticated: time.Now()}
+
+	post := func(tok string) *http.Request {
+		r := httptest.NewRequest("POST", "http://a.com/",
+			strings.NewReader(url.Values{CSRFField: {tok}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+
+	if err := m.CheckCSRF(post(""), u); err == nil {
+		t.Fatal("expected missing token to be rejected")
+	}
+
+	if err := m.CheckCSRF(post(m.CSRFToken(u)), u); err != nil {
+		t.Fatalf("expected token to be accepted: %s", err)
+	}
+
+	r := httptest.NewRequest("POST", "http://a.com/", nil)
+	r.Header.Set(CSRFHeader, m.CSRFToken(u))
+	if err := m.CheckCSRF(r, u); err != nil {
+		t.Fatalf("expected token in header to be accepted: %s", err)
+	}
+
+	// tokens from an earlier sign in are no good.
+	old := &user.Info{Email: u.Email, LastAuthenticated: u.LastAuthenticated.Add(-time.Hour)}
+	if err := m.CheckCSRF(post(m.CSRFToken(old)), u); err == nil {
+		t.Fatal("expected token of another sign in to be rejected")
+	}
+}
+
+func TestAPIToken(t *testing.T) {
+	m := &Manager{Key: []byte("key"), Revocations: NewMemoryRevocations(time.Hour)}
+
+	if _, err := m.NewAPIToken("ci@a.com", nil, time.Hour); err == nil {
+		t.Fatal("expected token without routes to be refused")
+	}
+
+	tok, err := m.NewAPIToken("ci@a.com", []string{"a.com"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "http://a.com/", nil)
+	r.Header.Set("Authorization", "Bearer "+tok)
+	if BearerToken(r) != tok {
+		t.Fatalf("expected bearer token %s, got %s", tok, BearerToken(r))
+	}
+
+	r.Header.Set("Authorization", "Bearer other")
+	if BearerToken(r) != "" {
+		t.Fatal("expected other bearer tokens to be ignored")
+	}
+
+	u, err := m.DecodeAPIToken(tok, "a.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.Email != "ci@a.com" || u.Provider != ProviderToken {
+		t.Fatalf("unexpected user %+v", u)
+	}
+
+	if _, err := m.DecodeAPIToken(tok, "b.com"); err == nil {
+		t.Fatal("expected token to be refused for other routes")
+	}
+
+	if _, err := (&Manager{Key: []byte("other")}).DecodeAPIToken(tok, "a.com"); err == nil {
+		t.Fatal("expected token signed with another key to be refused")
+	}
+
+	expired, err := m.NewAPIToken("ci@a.com", []string{"a.com"}, -time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.DecodeAPIToken(expired, "a.com"); err == nil {
+		t.Fatal("expected expired token to be refused")
+	}
+
+	if err := m.RevokeUser("ci@a.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := m.DecodeAPIToken(tok, "a.com"); err == nil {
+		t.Fatal("expected revoked token to be refused")
+	}
+}
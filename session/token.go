@@ -0,0 +1,123 @@
+package session
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kellegous/underpants/user"
+)
+
+// tokenPrefix marks a bearer token as an API token issued by underpants, so that other
+// bearer tokens are passed on to backends untouched.
+const tokenPrefix = "upt_"
+
+// ProviderToken is the provider of users identified by an API token.
+const ProviderToken = "token"
+
+// apiToken is the payload of an API token.
+type apiToken struct {
+	Email    string   `json:"email"`
+	Routes   []string `json:"routes"`
+	IssuedAt int64    `json:"iat"`
+	Expires  int64    `json:"exp"`
+}
+
+// signToken signs the encoded payload of an API token.
+func (m *Manager) signToken(payload string) string {
+	h := hmac.New(sha256.New, m.Key)
+	fmt.Fprintf(h, "token|%s", payload)
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// NewAPIToken issues a bearer token that identifies the user by email to the routes
+// (by their from) given, until ttl has passed. Tokens are revoked along with the
+// user's sessions.
+func (m *Manager) NewAPIToken(email string, routes []string, ttl time.Duration) (string, error) {
+	if email == "" || len(routes) == 0 {
+		return "", errors.New("api tokens need an email and at least one route")
+	}
+
+	now := time.Now()
+	b, err := json.Marshal(&apiToken{
+		Email:    email,
+		Routes:   routes,
+		IssuedAt: now.UnixNano(),
+		Expires:  now.Add(ttl).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return tokenPrefix + payload + "." + m.signToken(payload), nil
+}
+
+// BearerToken returns the API token presented with the request, or "" if there is
+// none.
+func BearerToken(r *http.Request) string {
+	v := r.Header.Get("Authorization")
+	if !strings.HasPrefix(v, "Bearer "+tokenPrefix) {
+		return ""
+	}
+	return v[len("Bearer "):]
+}
+
+// DecodeAPIToken verifies an API token and returns the user it identifies, as long as
+// it may be used with the route.
+func (m *Manager) DecodeAPIToken(tok, route string) (*user.Info, error) {
+	s := strings.SplitN(strings.TrimPrefix(tok, tokenPrefix), ".", 2)
+	if len(s) != 2 {
+		return nil, errors.New("malformed api token")
+	}
+
+	if !hmac.Equal([]byte(s[1]), []byte(m.signToken(s[0]))) {
+		return nil, errors.New("invalid api token signature")
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(s[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var t apiToken
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, err
+	}
+
+	if time.Now().Unix() >= t.Expires {
+		return nil, fmt.Errorf("api token expired for: %s", t.Email)
+	}
+
+	scoped := false
+	for _, r := range t.Routes {
+		if r == route {
+			scoped = true
+			break
+		}
+	}
+
+	if !scoped {
+		return nil, fmt.Errorf("api token for %s is not valid for %s", t.Email, route)
+	}
+
+	u := &user.Info{
+		Email:             t.Email,
+		EmailVerified:     true,
+		Name:              t.Email,
+		LastAuthenticated: time.Unix(0, t.IssuedAt),
+		Provider:          ProviderToken,
+	}
+
+	if err := m.checkRevoked(u); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
@@ -0,0 +1,88 @@
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Header is the header that carries the signature of a proxied request.
+const Header = "X-Underpants-Signature"
+
+// ErrInvalid is returned by Verify when a request's signature is missing or wrong.
+var ErrInvalid = errors.New("invalid request signature")
+
+// ErrExpired is returned by Verify when a request was signed too long ago.
+var ErrExpired = errors.New("request signature expired")
+
+// payload is the string that is signed for a request.
+func payload(method, uri string, t int64, nonce string) string {
+	return fmt.Sprintf("%s\n%s\n%d\n%s", method, uri, t, nonce)
+}
+
+func mac(key []byte, p string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(p))
+	return h.Sum(nil)
+}
+
+// Sign adds a signature of the request's method, URI, the current time and a random
+// nonce to the request, in the form t=<unix time>,n=<nonce>,s=<hex hmac-sha256>.
+func Sign(r *http.Request, key []byte) error {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return err
+	}
+
+	t := time.Now().Unix()
+	n := hex.EncodeToString(b[:])
+	s := mac(key, payload(r.Method, r.URL.RequestURI(), t, n))
+
+	r.Header.Set(Header, fmt.Sprintf("t=%d,n=%s,s=%s", t, n, hex.EncodeToString(s)))
+	return nil
+}
+
+// Verify checks the signature of a request received from underpants and returns its
+// nonce. Requests signed more than skew from now are rejected. Backends that need
+// to reject replayed requests must also remember the nonces they have seen for skew.
+func Verify(r *http.Request, key []byte, skew time.Duration) (string, error) {
+	var t int64
+	var n, s string
+	for _, part := range strings.Split(r.Header.Get(Header), ",") {
+		ix := strings.IndexByte(part, '=')
+		if ix == -1 {
+			return "", ErrInvalid
+		}
+
+		switch v := part[ix+1:]; part[:ix] {
+		case "t":
+			var err error
+			if t, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return "", ErrInvalid
+			}
+		case "n":
+			n = v
+		case "s":
+			s = v
+		}
+	}
+
+	sig, err := hex.DecodeString(s)
+	if err != nil || n == "" ||
+		!hmac.Equal(sig, mac(key, payload(r.Method, r.URL.RequestURI(), t, n))) {
+		return "", ErrInvalid
+	}
+
+	if d := time.Since(time.Unix(t, 0)); d > skew || d < -skew {
+		return "", ErrExpired
+	}
+
+	return n, nil
+}
@@ -0,0 +1,49 @@
+package signature
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	key := []byte("secret")
+
+	r := httptest.NewRequest("POST", "http://a.com/x?y=z", nil)
+	if err := Sign(r, key); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := Verify(r, key, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(n) != 32 {
+		t.Fatalf("expected a 16 byte hex nonce, got %q", n)
+	}
+
+	if _, err := Verify(r, []byte("other"), time.Minute); err != ErrInvalid {
+		t.Fatalf("expected a different key to be rejected, got %v", err)
+	}
+
+	tampered := httptest.NewRequest("POST", "http://a.com/x?y=w", nil)
+	tampered.Header.Set(Header, r.Header.Get(Header))
+	if _, err := Verify(tampered, key, time.Minute); err != ErrInvalid {
+		t.Fatalf("expected a different uri to be rejected, got %v", err)
+	}
+
+	old := time.Now().Add(-time.Hour).Unix()
+	stale := httptest.NewRequest("GET", "http://a.com/", nil)
+	stale.Header.Set(Header, fmt.Sprintf("t=%d,n=abc,s=%x",
+		old, mac(key, payload("GET", "/", old, "abc"))))
+	if _, err := Verify(stale, key, time.Minute); err != ErrExpired {
+		t.Fatalf("expected an old signature to be rejected, got %v", err)
+	}
+
+	if _, err := Verify(httptest.NewRequest("GET", "http://a.com/", nil), key,
+		time.Minute); err != ErrInvalid {
+		t.Fatalf("expected a missing signature to be rejected, got %v", err)
+	}
+}
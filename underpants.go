@@ -2,10 +2,12 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -13,22 +15,53 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/kellegous/underpants/accesslog"
+	"github.com/kellegous/underpants/admin"
 	"github.com/kellegous/underpants/auth"
+	"github.com/kellegous/underpants/auth/dev"
+	"github.com/kellegous/underpants/auth/github"
 	"github.com/kellegous/underpants/auth/google"
+	"github.com/kellegous/underpants/auth/local"
+	"github.com/kellegous/underpants/auth/multi"
+	"github.com/kellegous/underpants/auth/oidc"
 	"github.com/kellegous/underpants/auth/okta"
+	"github.com/kellegous/underpants/auth/saml"
 	"github.com/kellegous/underpants/config"
+	"github.com/kellegous/underpants/discovery"
 	"github.com/kellegous/underpants/hub"
+	"github.com/kellegous/underpants/internal"
 	"github.com/kellegous/underpants/mux"
 	"github.com/kellegous/underpants/proxy"
 
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
 // getAuthProvider returns the auth.Provider that was configured in the config info.
 func getAuthProvider(cfg *config.Info) (auth.Provider, error) {
+	if cfg.DevUser != "" {
+		return dev.Provider, dev.Provider.Validate(cfg)
+	}
+
+	if len(cfg.Providers) > 0 {
+		return multi.New(cfg, getOAuthProvider)
+	}
+
+	return getOAuthProvider(cfg)
+}
+
+// getOAuthProvider returns the auth.Provider for the config's oauth settings.
+func getOAuthProvider(cfg *config.Info) (auth.Provider, error) {
 	var prv auth.Provider
 
 	switch cfg.Oauth.Provider {
@@ -36,6 +69,14 @@ func getAuthProvider(cfg *config.Info) (auth.Provider, error) {
 		prv = google.Provider
 	case okta.Name:
 		prv = okta.Provider
+	case oidc.Name:
+		prv = oidc.Provider
+	case github.Name:
+		prv = github.Provider
+	case saml.Name:
+		prv = saml.Provider
+	case local.Name:
+		prv = local.Provider
 	default:
 		return nil, fmt.Errorf("invalid oauth provider: %s", cfg.Oauth.Provider)
 	}
@@ -48,11 +89,31 @@ func getAuthProvider(cfg *config.Info) (auth.Provider, error) {
 }
 
 func getAuthProviderName(cfg *config.Info) string {
+	if cfg.DevUser != "" {
+		return dev.Name
+	}
+
+	if len(cfg.Providers) > 0 {
+		var names []string
+		for _, p := range cfg.Providers {
+			names = append(names, p.Name)
+		}
+		return strings.Join(names, ",")
+	}
+
 	switch cfg.Oauth.Provider {
 	case google.Name, "":
 		return google.Name
 	case okta.Name:
 		return okta.Name
+	case oidc.Name:
+		return oidc.Name
+	case github.Name:
+		return github.Name
+	case saml.Name:
+		return saml.Name
+	case local.Name:
+		return local.Name
 	}
 	return "unknown"
 }
@@ -70,17 +131,205 @@ func newKey() ([]byte, error) {
 	return b.Bytes(), nil
 }
 
-// buildMux creates a mux for serving all http routes.
-func buildMux(ctx *config.Context, p auth.Provider) (*mux.Serve, error) {
+// buildMux creates a mux for serving all http routes and returns it along with the
+// mux for the administrative API, which is nil unless the API has a listener of its
+// own, and the backends of the routes.
+func buildMux(
+	ctx *config.Context,
+	p auth.Provider) (*mux.Serve, *mux.Serve, []*proxy.Backend, error) {
 	mb := mux.Create()
 
 	// setup routes for proxy backends
-	proxy.Setup(ctx, p, mb)
+	backends := proxy.Setup(ctx, p, mb)
+
+	// setup the administrative endpoints on the hub, unless they have a listener of
+	// their own
+	var am *mux.Serve
+	if !ctx.HasAdminListener() {
+		admin.Setup(ctx, backends, mb)
+	} else {
+		ab := mux.Create()
+		admin.Setup(ctx, backends, ab)
+		am = ab.Build()
+	}
 
 	// setup all routes for the hub
-	hub.Setup(ctx, p, mb)
+	hub.Setup(ctx, p, backends, mb)
+
+	// setup the liveness and readiness endpoints
+	hub.SetupHealth(ctx, p, backends, mb)
+
+	// serve metrics from the hub, unless they have a listener of their own
+	if m := ctx.Info.Metrics; m != nil && m.Addr == "" {
+		mb.ForEveryHost().Handle(m.Path, ctx.Metrics)
+	}
+
+	mb.NotFound(internal.AddSecurityHeadersFunc(ctx.Info,
+		func(w http.ResponseWriter, r *http.Request) {
+			internal.ServeErrorPage(ctx, w, r, &internal.ErrorPage{
+				Status:  http.StatusNotFound,
+				Message: "There is nothing here.",
+			}, nil)
+		}))
+
+	return mb.Build(), am, backends, nil
+}
+
+// reloader serves all http routes with the mux built from the config file, which it
+// rebuilds when the config file is reloaded.
+type reloader struct {
+	filename string
+
+	// lck serializes reloads.
+	lck      sync.Mutex
+	ctx      *config.Context
+	backends []*proxy.Backend
+
+	// entries hold the routes last read from the route-source, which are added to
+	// the routes of the config file.
+	entries []*discovery.Entry
+
+	// mux holds the *mux.Serve that requests are currently served by.
+	mux atomic.Value
+
+	// info holds the *config.Info that requests are currently served with.
+	info atomic.Value
+
+	// admin holds the *mux.Serve of the administrative API's own listener.
+	admin atomic.Value
+}
+
+// newReloader creates a reloader that serves the routes of the running context.
+func newReloader(filename string, ctx *config.Context, p auth.Provider) (*reloader, error) {
+	m, am, backends, err := buildMux(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &reloader{
+		filename: filename,
+		ctx:      ctx,
+		backends: backends,
+	}
+	r.mux.Store(m)
+	r.admin.Store(am)
+	r.info.Store(ctx.Info)
+	return r, nil
+}
+
+// currentInfo is the config that requests are currently served with.
+func (r *reloader) currentInfo() *config.Info {
+	return r.info.Load().(*config.Info)
+}
+
+// ServeHTTP serves the request with the current mux.
+func (r *reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mux.Load().(*mux.Serve).ServeHTTP(w, req)
+}
+
+// serveAdmin serves a request to the administrative API's own listener with the
+// current admin mux.
+func (r *reloader) serveAdmin(w http.ResponseWriter, req *http.Request) {
+	am := r.admin.Load().(*mux.Serve)
+	if am == nil {
+		// the reloaded config serves the API from the hub instead.
+		http.NotFound(w, req)
+		return
+	}
+	am.ServeHTTP(w, req)
+}
+
+// reload re-reads the config file and swaps in the routes, access rules and provider
+// settings it describes. The session key and store are kept, so users remain signed
+// in. Requests already being served finish with the old config. If the config is
+// invalid, the old one stays in place.
+func (r *reloader) reload() error {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	return r.reloadLocked()
+}
 
-	return mb.Build(), nil
+// setRoutes replaces the routes read from the route-source and reloads.
+func (r *reloader) setRoutes(entries []*discovery.Entry) error {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	r.entries = entries
+	return r.reloadLocked()
+}
+
+func (r *reloader) reloadLocked() error {
+	cfg := config.Info{DevUser: r.ctx.DevUser}
+	if err := cfg.ReadFile(r.filename); err != nil {
+		return err
+	}
+
+	// a route that cannot be added does not stop the others from being served.
+	for _, e := range r.entries {
+		route, err := e.Route()
+		if err == nil {
+			err = cfg.AddRoute(route)
+		}
+
+		if err != nil {
+			zap.L().Warn("ignoring route from route-source",
+				zap.String("key", e.Key),
+				zap.Error(err))
+		}
+	}
+
+	p, err := getAuthProvider(&cfg)
+	if err != nil {
+		return err
+	}
+
+	key := r.ctx.Key
+	if k := cfg.Session.Key; k != nil {
+		key, err = internal.LoadKey(k)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, err := config.ReloadContext(r.ctx, &cfg, key)
+	if err != nil {
+		return err
+	}
+
+	m, am, backends, err := buildMux(ctx, p)
+	if err != nil {
+		return err
+	}
+
+	r.mux.Store(m)
+	r.admin.Store(am)
+	r.info.Store(ctx.Info)
+
+	for _, b := range r.backends {
+		b.Close()
+	}
+	config.ReleaseContext(r.ctx, ctx)
+
+	r.ctx, r.backends = ctx, backends
+
+	zap.L().Info("config reloaded",
+		zap.String("filename", r.filename),
+		zap.Int("routes", len(cfg.Routes)),
+		zap.String("provider", getAuthProviderName(&cfg)))
+	return nil
+}
+
+// reloadOnHangup reloads the config each time underpants receives SIGHUP.
+func (r *reloader) reloadOnHangup() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+
+	for range sigs {
+		if err := r.reload(); err != nil {
+			zap.L().Error("unable to reload config, keeping the running config",
+				zap.String("filename", r.filename),
+				zap.Error(err))
+		}
+	}
 }
 
 // LoadCertificate loads the TLS certificate from the speciified files. The key file can be an encryped
@@ -126,57 +375,306 @@ func LoadCertificate(crtFile, keyFile string) (tls.Certificate, error) {
 	}))
 }
 
-// ListenAndServe binds the listening port and start serving traffic.
-func ListenAndServe(ctx *config.Context, m http.Handler) error {
-	if ctx.HasCerts() {
-		var certs []tls.Certificate
-		for _, item := range ctx.Certs {
-			crt, err := LoadCertificate(item.Crt, item.Key)
-			if err != nil {
-				return err
-			}
+// newAutocertManager creates the manager that obtains certificates for the hub and all
+// routes if autocert is configured. Wildcard routes get a certificate for each of
+// their subdomains as it is first requested.
+func newAutocertManager(ctx *config.Context) *autocert.Manager {
+	a := ctx.Autocert
+	if a == nil {
+		return nil
+	}
 
-			certs = append(certs, crt)
+	hosts := []string{ctx.Info.Host}
+	wildcards := map[string]bool{}
+	for _, route := range ctx.Routes {
+		if route.IsWildcard() {
+			wildcards[route.Host()] = true
+			continue
 		}
+		hosts = append(hosts, route.Host())
+	}
 
-		addr := ctx.ListenAddr()
+	whitelist := autocert.HostWhitelist(hosts...)
+	policy := func(c context.Context, host string) error {
+		if wildcards[config.WildcardOf(strings.ToLower(host))] {
+			return nil
+		}
+		return whitelist(c, host)
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(a.CacheDir),
+		HostPolicy: policy,
+		Email:      a.Email,
+		Client: &acme.Client{
+			DirectoryURL: a.DirectoryURL,
+		},
+	}
+}
 
-		s := &http.Server{
-			Addr:    addr,
-			Handler: m,
-			TLSConfig: &tls.Config{
-				NextProtos:   []string{"http/1.1"},
-				Certificates: certs,
-				MinVersion:   tls.VersionTLS10,
-				CipherSuites: []uint16{
-					tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-					tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-					tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
-				},
-				PreferServerCipherSuites: true,
-			},
+// newTLSConfig loads the certificates in the config and builds the TLS config for the
+// https listener. Certificates given for a route are selected by SNI and all others
+// are selected by the names they cover.
+func newTLSConfig(ctx *config.Context) (*tls.Config, error) {
+	var certs []tls.Certificate
+	for _, item := range ctx.Certs {
+		crt, err := LoadCertificate(item.Crt, item.Key)
+		if err != nil {
+			return nil, err
 		}
 
-		s.TLSConfig.BuildNameToCertificate()
+		certs = append(certs, crt)
+	}
+
+	byHost := map[string]*tls.Certificate{}
+	for _, route := range ctx.Routes {
+		if route.Cert == nil {
+			continue
+		}
 
-		conn, err := net.Listen("tcp", addr)
+		crt, err := LoadCertificate(route.Cert.Crt, route.Cert.Key)
 		if err != nil {
+			return nil, err
+		}
+
+		byHost[route.Host()] = &crt
+	}
+
+	am := newAutocertManager(ctx)
+
+	cfg := &tls.Config{
+		NextProtos:               nextProtos(ctx),
+		Certificates:             certs,
+		MinVersion:               ctx.TLSVersion(),
+		CipherSuites:             ctx.CipherSuites(),
+		PreferServerCipherSuites: true,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			host := strings.ToLower(hello.ServerName)
+			if crt := byHost[host]; crt != nil {
+				return crt, nil
+			}
+
+			if crt := byHost[config.WildcardOf(host)]; crt != nil {
+				return crt, nil
+			}
+
+			if am != nil {
+				return am.GetCertificate(hello)
+			}
+
+			// returning nil falls back to the global certificates.
+			return nil, nil
+		},
+	}
+
+	if p := ctx.ClientCertPool(); p != nil {
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		cfg.ClientCAs = p
+	}
+
+	cfg.BuildNameToCertificate()
+
+	return cfg, nil
+}
+
+// nextProtos are the protocols offered with ALPN.
+func nextProtos(ctx *config.Context) []string {
+	if ctx.HTTP2 {
+		return []string{"h2", "http/1.1"}
+	}
+	return []string{"http/1.1"}
+}
+
+// ListenAndServe binds the listening ports and starts serving traffic. The
+// administrative API is served by adm if it has a listener of its own.
+func ListenAndServe(ctx *config.Context, m, adm http.Handler) error {
+	if mc := ctx.Info.Metrics; mc != nil && mc.Addr != "" {
+		go func() {
+			sm := http.NewServeMux()
+			sm.Handle(mc.Path, ctx.Metrics)
+			err := http.ListenAndServe(mc.Addr, sm)
+			zap.L().Fatal("unable to serve metrics",
+				zap.String("addr", mc.Addr),
+				zap.Error(err))
+		}()
+	}
+
+	var servers []*server
+	for _, l := range listenersOf(ctx) {
+		s, err := newServer(ctx, l, m, adm)
+		if err != nil {
+			for _, s := range servers {
+				s.conn.Close()
+			}
 			return err
 		}
+		servers = append(servers, s)
+
+		zap.L().Info("listening",
+			zap.String("addr", l.Addr),
+			zap.String("serve", l.Serve))
+	}
 
-		return s.Serve(tls.NewListener(conn, s.TLSConfig))
+	return serveUntilStopped(ctx, servers)
+}
+
+// listenersOf is the listeners section of the config or, if there is none, the
+// listeners described by the -port flag, http-redirect-port and admin.addr.
+func listenersOf(ctx *config.Context) []*config.ListenerInfo {
+	if len(ctx.Listeners) > 0 {
+		return ctx.Listeners
+	}
+
+	ls := []*config.ListenerInfo{
+		{Addr: ctx.ListenAddr(), Serve: config.ListenerProxy},
+	}
+
+	if port := ctx.HTTPRedirectPort; port > 0 && ctx.HasCerts() {
+		ls = append(ls, &config.ListenerInfo{
+			Addr:  fmt.Sprintf(":%d", port),
+			Serve: config.ListenerRedirect,
+		})
+	}
+
+	if addr := ctx.Admin.Addr; addr != "" {
+		ls = append(ls, &config.ListenerInfo{
+			Addr:  addr,
+			Serve: config.ListenerAdmin,
+		})
+	}
+
+	return ls
+}
+
+// server is an http.Server along with the connection it serves.
+type server struct {
+	srv  *http.Server
+	conn net.Listener
+}
+
+// newServer binds the listener's address and creates the server for what it serves.
+func newServer(ctx *config.Context, l *config.ListenerInfo, m, adm http.Handler) (*server, error) {
+	s := &http.Server{Addr: l.Addr}
+
+	switch l.Serve {
+	case config.ListenerRedirect:
+		s.Handler = internal.RedirectToHTTPS(ctx)
+	case config.ListenerAdmin:
+		s.Handler = adm
+	default:
+		s.Handler = m
+		s.Protocols = serverProtocols(ctx)
 	}
 
-	return http.ListenAndServe(ctx.ListenAddr(), m)
+	conn, err := net.Listen("tcp", l.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if l.Serve == config.ListenerProxy && ctx.HasCerts() {
+		cfg, err := newTLSConfig(ctx)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		s.TLSConfig = cfg
+		conn = tls.NewListener(conn, cfg)
+	}
+
+	return &server{srv: s, conn: conn}, nil
+}
+
+// serveUntilStopped serves each of the servers until one fails or underpants receives
+// SIGTERM or SIGINT. On a signal, the servers stop accepting connections and give
+// in-flight requests the drain timeout to finish before the remaining connections are
+// closed.
+func serveUntilStopped(ctx *config.Context, servers []*server) error {
+	errc := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s *server) {
+			errc <- s.srv.Serve(s.conn)
+		}(s)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(sigs)
+
+	select {
+	case err := <-errc:
+		return err
+	case sig := <-sigs:
+		zap.L().Info("shutting down",
+			zap.String("signal", sig.String()),
+			zap.Int("drain-timeout", ctx.DrainTimeout))
+	}
+
+	c, cancel := context.WithTimeout(context.Background(),
+		time.Duration(ctx.DrainTimeout)*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *server) {
+			defer wg.Done()
+			if err := s.srv.Shutdown(c); err != nil {
+				zap.L().Warn("in-flight requests did not finish draining",
+					zap.String("addr", s.srv.Addr),
+					zap.Error(err))
+				s.srv.Close()
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	for range servers {
+		if err := <-errc; err != http.ErrServerClosed {
+			return err
+		}
+	}
+
+	zap.L().Info("stopped")
+	return nil
+}
+
+// serverProtocols are the protocols served by the listener. HTTP/2 is only served if it
+// is enabled, over TLS when there are certs and as h2c otherwise.
+func serverProtocols(ctx *config.Context) *http.Protocols {
+	var p http.Protocols
+	p.SetHTTP1(true)
+	if ctx.HTTP2 {
+		if ctx.HasCerts() {
+			p.SetHTTP2(true)
+		} else {
+			p.SetUnencryptedHTTP2(true)
+		}
+	}
+	return &p
 }
 
 func contextFrom(cfg *config.Info, port int) (*config.Context, error) {
 	// Construct the HMAC signing key
-	key, err := newKey()
+	var key []byte
+	var err error
+	if k := cfg.Session.Key; k != nil {
+		key, err = internal.LoadKey(k)
+	} else {
+		key, err = newKey()
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	if lp := cfg.ListenerPort(); lp != 0 {
+		if port != 0 {
+			return nil, errors.New("-port cannot be used with listeners")
+		}
+		port = lp
+	}
+
 	if port == 0 {
 		if cfg.HasCerts() {
 			port = 443
@@ -185,11 +683,31 @@ func contextFrom(cfg *config.Info, port int) (*config.Context, error) {
 		}
 	}
 
-	return config.BuildContext(cfg, port, key), nil
+	return config.BuildContext(cfg, port, key)
 }
 
-func setupLogger() error {
-	lg, err := zap.NewProduction()
+// setupLogger replaces the global logger with one configured by the log section. Its
+// empty fields take their defaults, so the zero value gives the default logger.
+func setupLogger(cfg *config.LogInfo) error {
+	c := zap.NewProductionConfig()
+
+	if cfg.Level != "" {
+		if err := c.Level.UnmarshalText([]byte(cfg.Level)); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Format == config.LogFormatConsole {
+		c.Encoding = "console"
+		c.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+		c.EncoderConfig.EncodeLevel = zapcore.CapitalLevelEncoder
+	}
+
+	if cfg.Path != "" {
+		c.OutputPaths = []string{cfg.Path}
+	}
+
+	lg, err := c.Build()
 	if err != nil {
 		return err
 	}
@@ -198,23 +716,87 @@ func setupLogger() error {
 	return nil
 }
 
+// validate checks the config file named by the -conf flag in args and prints a report
+// of what it configures, or of why it is invalid. It returns the exit status.
+func validate(w io.Writer, args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	fs.SetOutput(w)
+	flagConf := fs.String("conf", "underpants.json", "")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	var cfg config.Info
+	if err := cfg.ReadFile(*flagConf); err != nil {
+		fmt.Fprintf(w, "%s is invalid: %s\n", *flagConf, err)
+		return 1
+	}
+
+	if _, err := getAuthProvider(&cfg); err != nil {
+		fmt.Fprintf(w, "%s is invalid: %s\n", *flagConf, err)
+		return 1
+	}
+
+	if k := cfg.Session.Key; k != nil {
+		if _, err := internal.LoadKey(k); err != nil {
+			fmt.Fprintf(w, "%s is invalid: unable to load session key: %s\n", *flagConf, err)
+			return 1
+		}
+	}
+
+	fmt.Fprintf(w, "%s is valid\n", *flagConf)
+	fmt.Fprintf(w, "  hub:      %s://%s\n", cfg.Scheme(), cfg.Host)
+	fmt.Fprintf(w, "  provider: %s\n", getAuthProviderName(&cfg))
+	fmt.Fprintf(w, "  routes:   %d\n", len(cfg.Routes))
+	for _, route := range cfg.Routes {
+		fmt.Fprintf(w, "    %s -> %s", route.From, strings.Join(route.To, ", "))
+		if route.Provider != "" {
+			fmt.Fprintf(w, " (provider %s)", route.Provider)
+		}
+		fmt.Fprintln(w)
+	}
+	return 0
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		os.Exit(validate(os.Stdout, os.Args[2:]))
+	}
+
 	flagPort := flag.Int("port", 0, "")
 	flagConf := flag.String("conf", "underpants.json", "")
+	flagDevUser := flag.String("dev-user", "",
+		"sign everyone in as this email without an identity provider (localhost only)")
 
 	flag.Parse()
 
-	if err := setupLogger(); err != nil {
+	if err := setupLogger(&config.LogInfo{}); err != nil {
 		panic(err)
 	}
 
-	var cfg config.Info
+	cfg := config.Info{DevUser: *flagDevUser}
 	if err := cfg.ReadFile(*flagConf); err != nil {
 		zap.L().Fatal("unable to load config",
 			zap.String("filename", *flagConf),
 			zap.Error(err))
 	}
 
+	if err := setupLogger(&cfg.Log); err != nil {
+		zap.L().Fatal("unable to set up log",
+			zap.String("path", cfg.Log.Path),
+			zap.Error(err))
+	}
+
+	zap.L().Debug("config loaded",
+		zap.String("filename", *flagConf),
+		zap.String("host", cfg.Host),
+		zap.Int("routes", len(cfg.Routes)))
+	for _, route := range cfg.Routes {
+		zap.L().Debug("route",
+			zap.String("from", route.From),
+			zap.Strings("to", route.To))
+	}
+
 	p, err := getAuthProvider(&cfg)
 	if err != nil {
 		zap.L().Fatal("invalid provider config",
@@ -233,13 +815,51 @@ func main() {
 		zap.String("conf", *flagConf),
 		zap.String("provider", getAuthProviderName(ctx.Info)))
 
-	m, err := buildMux(ctx, p)
+	if ctx.DevUser != "" {
+		zap.L().Warn("everyone is signed in as the dev user, this is only for local development",
+			zap.String("user", ctx.DevUser),
+			zap.String("addr", ctx.ListenAddr()))
+	}
+
+	m, err := newReloader(*flagConf, ctx, p)
 	if err != nil {
 		zap.L().Fatal("unable to build mux",
 			zap.Error(err))
 	}
 
-	if err := ListenAndServe(ctx, m); err != nil {
+	go m.reloadOnHangup()
+
+	if rs := ctx.RouteSource; rs != nil {
+		src, err := discovery.New(rs)
+		if err != nil {
+			zap.L().Fatal("unable to create route-source",
+				zap.Error(err))
+		}
+
+		go discovery.Watch(context.Background(), src, func(entries []*discovery.Entry) {
+			if err := m.setRoutes(entries); err != nil {
+				zap.L().Error("unable to apply routes from route-source",
+					zap.Int("routes", len(entries)),
+					zap.Error(err))
+			}
+		})
+	}
+
+	h := internal.Recover(m)
+	if cfg := ctx.AccessLog; cfg != nil {
+		l, err := accesslog.Open(cfg)
+		if err != nil {
+			zap.L().Fatal("unable to open access log",
+				zap.String("path", cfg.Path),
+				zap.Error(err))
+		}
+		h = accesslog.Handler(l, h)
+	}
+	// the trusted proxies are those of the current config, so a reload that changes
+	// them applies to the next request.
+	h = internal.TrustCurrentProxies(m.currentInfo, h)
+
+	if err := ListenAndServe(ctx, h, internal.Recover(http.HandlerFunc(m.serveAdmin))); err != nil {
 		zap.L().Fatal("unable to listen and serve",
 			zap.Error(err))
 	}
@@ -25,12 +25,52 @@ const (
 	CookieMaxAge = 3600
 )
 
+// ProviderClientCert is the provider of users identified by a client certificate.
+const ProviderClientCert = "client-cert"
+
+// ProviderAPIKey is the provider of users identified by a route's API key.
+const ProviderAPIKey = "api-key"
+
+// ProviderJWT is the provider of users identified by a JWT from the identity
+// provider.
+const ProviderJWT = "jwt"
+
 // Info ...
 type Info struct {
 	Email             string
+	EmailVerified     bool
 	Name              string
 	Picture           string
 	LastAuthenticated time.Time
+
+	// Provider is the name of the identity provider the user signed in with when
+	// more than one is configured.
+	Provider string `json:",omitempty"`
+
+	// LastActive is when the session was last refreshed by activity, it is only set
+	// for sessions with sliding expiration.
+	LastActive time.Time `json:",omitempty"`
+
+	// RefreshToken is the provider's refresh token for the user. It is encrypted
+	// before the user is stored in a session.
+	RefreshToken string `json:",omitempty"`
+
+	// Impersonator is the email of the admin acting as this user, it is only set for
+	// sessions created by impersonation.
+	Impersonator string `json:",omitempty"`
+
+	// LastSignIn is when the user last signed in with the identity provider. Sessions
+	// that are refreshed keep the time of the sign in they were refreshed from.
+	LastSignIn time.Time `json:",omitempty"`
+}
+
+// SignedIn is when the user last signed in with the identity provider, which is when
+// they authenticated for sessions that do not record it.
+func (i *Info) SignedIn() time.Time {
+	if i.LastSignIn.IsZero() {
+		return i.LastAuthenticated
+	}
+	return i.LastSignIn
 }
 
 func isValidMessage(key []byte, sig, msg string) bool {